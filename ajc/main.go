@@ -41,6 +41,7 @@ func main() {
 	configureTaskCommand(ajc)
 	configureQueueCommand(ajc)
 	configurePackagesCommand(ajc)
+	configureWatchCommand(ajc)
 
 	_, err := ajc.Parse(os.Args[1:])
 	if err != nil {
@@ -22,10 +22,14 @@ type queueCommand struct {
 	maxEntries    int
 	maxTries      int
 	maxTime       time.Duration
+	ackWait       time.Duration
+	redeliveries  int
 	maxConcurrent int
 	memory        bool
 	replicas      int
 	discardOld    bool
+	priority      bool
+	dupeWindow    time.Duration
 }
 
 func configureQueueCommand(app *fisk.Application) {
@@ -39,10 +43,14 @@ func configureQueueCommand(app *fisk.Application) {
 	add.Flag("entries", "Sets the maximum amount of entries to keep, 0 for unlimited").Default("0").IntVar(&c.maxEntries)
 	add.Flag("tries", "Maximum delivery attempts to allow per message, -1 for unlimited").Default("-1").IntVar(&c.maxTries)
 	add.Flag("run-time", "Maximum run-time to allow per task").Default(asyncjobs.DefaultJobRunTime.String()).DurationVar(&c.maxTime)
+	add.Flag("ack-wait", "Time before unacknowledged entries are redelivered, defaults to the run-time").Default("0s").DurationVar(&c.ackWait)
+	add.Flag("redeliveries", "Maximum redeliveries to allow per message, -1 for unlimited, defaults to allowing the tries").Default("0").IntVar(&c.redeliveries)
 	add.Flag("concurrent", "Maximum concurrent jobs that can be ran").Default(fmt.Sprintf("%d", asyncjobs.DefaultQueueMaxConcurrent)).IntVar(&c.maxConcurrent)
 	add.Flag("memory", "Store the Queue in memory").BoolVar(&c.memory)
 	add.Flag("replicas", "Number of storage replicas to configure").Default("1").IntVar(&c.replicas)
 	add.Flag("discard-old", "When full, discard old entries").BoolVar(&c.discardOld)
+	add.Flag("priority", "Enables task priority support").BoolVar(&c.priority)
+	add.Flag("duplicate-window", "How long enqueued task IDs are remembered to suppress duplicate entries").Default("0s").DurationVar(&c.dupeWindow)
 
 	queues.Command("list", "List Queues").Alias("ls").Action(c.lsAction)
 
@@ -54,6 +62,12 @@ func configureQueueCommand(app *fisk.Application) {
 	purge.Arg("queue", "Queue to Purge").Required().StringVar(&c.name)
 	purge.Flag("force", "Force purge without prompting").Short('f').BoolVar(&c.force)
 
+	pause := queues.Command("pause", "Stops all clients from processing a queue").Action(c.pauseAction)
+	pause.Arg("queue", "Queue to pause").Required().StringVar(&c.name)
+
+	resume := queues.Command("resume", "Resumes processing of a paused queue").Action(c.resumeAction)
+	resume.Arg("queue", "Queue to resume").Required().StringVar(&c.name)
+
 	info := queues.Command("info", "Shows information about a queue").Alias("view").Alias("i").Action(c.viewAction)
 	info.Arg("queue", "Queue to view").Required().StringVar(&c.name)
 
@@ -79,13 +93,17 @@ func (c *queueCommand) addAction(_ *fisk.ParseContext) error {
 	}
 
 	queue := &asyncjobs.Queue{
-		Name:          c.name,
-		MaxAge:        c.maxAge,
-		MaxEntries:    c.maxEntries,
-		DiscardOld:    c.discardOld,
-		MaxTries:      c.maxTries,
-		MaxRunTime:    c.maxTime,
-		MaxConcurrent: c.maxConcurrent,
+		Name:            c.name,
+		MaxAge:          c.maxAge,
+		MaxEntries:      c.maxEntries,
+		DiscardOld:      c.discardOld,
+		MaxTries:        c.maxTries,
+		MaxRunTime:      c.maxTime,
+		AckWait:         c.ackWait,
+		MaxRedeliveries: c.redeliveries,
+		MaxConcurrent:   c.maxConcurrent,
+		PrioritySupport: c.priority,
+		DuplicateWindow: c.dupeWindow,
 	}
 
 	err = admin.PrepareQueue(queue, c.replicas, c.memory)
@@ -165,6 +183,14 @@ func (c *queueCommand) configureAction(_ *fisk.ParseContext) error {
 		return err
 	}
 
+	// the consumers of the other priority levels and the queue slots share the settings of the default level
+	if ccfg.FilterSubject != "" {
+		err = c.updatePriorityLevels()
+		if err != nil {
+			return err
+		}
+	}
+
 	nfo, err = admin.QueueInfo(c.name)
 	if err != nil {
 		return err
@@ -174,6 +200,22 @@ func (c *queueCommand) configureAction(_ *fisk.ParseContext) error {
 	return nil
 }
 
+// updatePriorityLevels updates every priority level of the queue to the settings of its default level
+func (c *queueCommand) updatePriorityLevels() error {
+	queues, err := admin.ListWorkQueues()
+	if err != nil {
+		return err
+	}
+
+	for _, q := range queues {
+		if q.Name == c.name {
+			return admin.UpdateWorkQueue(q)
+		}
+	}
+
+	return asyncjobs.ErrQueueNotFound
+}
+
 func (c *queueCommand) viewAction(_ *fisk.ParseContext) error {
 	err := prepare()
 	if err != nil {
@@ -217,6 +259,38 @@ func (c *queueCommand) purgeAction(_ *fisk.ParseContext) error {
 	return nil
 }
 
+func (c *queueCommand) pauseAction(_ *fisk.ParseContext) error {
+	err := prepare()
+	if err != nil {
+		return err
+	}
+
+	err = admin.PauseQueue(c.name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queue %s was paused\n", c.name)
+
+	return nil
+}
+
+func (c *queueCommand) resumeAction(_ *fisk.ParseContext) error {
+	err := prepare()
+	if err != nil {
+		return err
+	}
+
+	err = admin.ResumeQueue(c.name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Queue %s was resumed\n", c.name)
+
+	return nil
+}
+
 func (c *queueCommand) rmAction(_ *fisk.ParseContext) error {
 	err := prepare()
 	if err != nil {
@@ -273,7 +347,7 @@ func (c *queueCommand) lsAction(_ *fisk.ParseContext) error {
 			maxMsgs = humanize.Comma(q.Stream.Config.MaxMsgs)
 		}
 
-		table.AddRow(q.Name, humanize.Comma(int64(q.Stream.State.Msgs)), humanize.IBytes(q.Stream.State.Bytes), q.Stream.Config.Replicas, humanize.Comma(int64(q.Consumer.Config.MaxDeliver)), maxMsgs, humanize.Comma(int64(q.Consumer.Config.MaxAckPending)))
+		table.AddRow(q.Name, humanize.Comma(int64(q.Stream.State.Msgs)), humanize.IBytes(q.Stream.State.Bytes), q.Stream.Config.Replicas, humanize.Comma(int64(q.MaxTries)), maxMsgs, humanize.Comma(int64(q.MaxConcurrent)))
 	}
 
 	fmt.Println(table.Render())
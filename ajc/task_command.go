@@ -9,7 +9,11 @@ import (
 	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	aj "github.com/choria-io/asyncjobs"
@@ -25,7 +29,10 @@ type taskCommand struct {
 	payload         string
 	queue           string
 	deadline        time.Duration
+	delay           time.Duration
 	maxtries        int
+	noRetry         bool
+	priority        int
 	retention       time.Duration
 	concurrency     int
 	command         string
@@ -41,6 +48,11 @@ type taskCommand struct {
 	ed25519Seed     string
 	ed25519PubKey   string
 	optionalSigs    bool
+	states          []string
+	since           time.Duration
+	dryRun          bool
+	tags            map[string]string
+	file            string
 
 	limit int
 	json  bool
@@ -59,14 +71,37 @@ func configureTaskCommand(app *fisk.Application) {
 	add.Arg("payload", "The task Payload").Required().StringVar(&c.payload)
 	add.Flag("queue", "The name of the queue to add the task to").Short('q').Default("DEFAULT").StringVar(&c.queue)
 	add.Flag("deadline", "A duration to determine when the latest time that a task handler will be called").DurationVar(&c.deadline)
+	add.Flag("delay", "A duration to wait before the task will be handled").DurationVar(&c.delay)
 	add.Flag("tries", "Sets the maximum amount of times this task may be tried").IntVar(&c.maxtries)
+	add.Flag("no-retry", "Terminates the task after a single failed try").UnNegatableBoolVar(&c.noRetry)
+	add.Flag("priority", "Sets the task priority, used in queues with priority support").Default(fmt.Sprintf("%d", aj.DefaultPriority)).IntVar(&c.priority)
 	add.Flag("depends", "Sets IDs to depend on, comma sep or pass multiple times").StringsVar(&c.dependencies)
 	add.Flag("load", "Loads results from dependencies before executing task").BoolVar(&c.loadDepResults)
+	add.Flag("tag", "Adds a tag to the task in the form name=value, pass multiple times for more tags").StringMapVar(&c.tags)
 
 	retry := tasks.Command("retry", "Retries delivery of a task currently in the Task Store").Action(c.retryAction)
 	retry.Arg("id", "The Task ID to view").Required().StringVar(&c.id)
 	retry.Flag("queue", "The name of the queue to add the task to").Short('q').Default("DEFAULT").StringVar(&c.queue)
 
+	replay := tasks.Command("replay", "Enqueues failed Tasks in a queue again with their tries reset").Action(c.replayAction)
+	replay.Flag("queue", "The name of the queue to replay tasks in").Short('q').Default("DEFAULT").StringVar(&c.queue)
+	replay.Flag("state", "Replay tasks in this state, pass multiple times for more states").Default(string(aj.TaskStateExpired)).EnumsVar(&c.states, string(aj.TaskStateExpired), string(aj.TaskStateTerminated), string(aj.TaskStateQueueError), string(aj.TaskStateQuarantined))
+	replay.Flag("type", "Only replay tasks of this type").StringVar(&c.ttype)
+	replay.Flag("tag", "Only replay tasks with this tag in the form name=value, pass multiple times for more tags").StringMapVar(&c.tags)
+	replay.Flag("since", "Only replay tasks last tried, or created if never tried, within this duration").DurationVar(&c.since)
+	replay.Flag("dry-run", "Lists the tasks that would be replayed without replaying them").BoolVar(&c.dryRun)
+	replay.Flag("concurrency", "How many tasks to replay concurrently").Default("10").IntVar(&c.concurrency)
+
+	export := tasks.Command("export", "Exports Tasks as newline delimited JSON").Action(c.exportAction)
+	export.Flag("output", "File to write the tasks to, defaults to standard output").Short('o').StringVar(&c.file)
+	export.Flag("queue", "Only export tasks in this queue").Short('q').StringVar(&c.queue)
+	export.Flag("state", "Only export tasks in this state, pass multiple times for more states").EnumsVar(&c.states, watchStates...)
+	export.Flag("type", "Only export tasks of this type").StringVar(&c.ttype)
+	export.Flag("tag", "Only export tasks with this tag in the form name=value, pass multiple times for more tags").StringMapVar(&c.tags)
+
+	imp := tasks.Command("import", "Imports Tasks exported using export into the Task Store").Action(c.importAction)
+	imp.Arg("file", "File holding the exported tasks").Required().ExistingFileVar(&c.file)
+
 	view := tasks.Command("view", "Views the status of a Task").Alias("show").Alias("v").Alias("info").Alias("i").Action(c.viewAction)
 	view.Arg("id", "The Task ID to view").Required().StringVar(&c.id)
 	view.Flag("json", "Show JSON data").Short('j').BoolVar(&c.json)
@@ -166,6 +201,158 @@ func (c *taskCommand) retryAction(_ *fisk.ParseContext) error {
 	return c.viewAction(nil)
 }
 
+func (c *taskCommand) replayAction(_ *fisk.ParseContext) error {
+	if c.concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	err := c.prepare(aj.BindWorkQueue(c.queue))
+	if err != nil {
+		return err
+	}
+
+	filter := aj.TaskFilter{Queues: []string{c.queue}, Tags: c.tags}
+	for _, s := range c.states {
+		filter.States = append(filter.States, aj.TaskState(s))
+	}
+	if c.ttype != "" {
+		filter.Types = []string{c.ttype}
+	}
+
+	ctx := context.Background()
+	tasks, err := client.ListTasks(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer tasks.Close()
+
+	var (
+		replayed atomic.Int64
+		skipped  atomic.Int64
+		wg       sync.WaitGroup
+	)
+
+	ids := make(chan string)
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for id := range ids {
+				err := client.ReplayTaskByID(ctx, id)
+				if err != nil {
+					fmt.Printf("Could not replay task %s: %v\n", id, err)
+					skipped.Add(1)
+					continue
+				}
+				replayed.Add(1)
+			}
+		}()
+	}
+
+	for tasks.Next() {
+		task := tasks.Task()
+
+		last := task.CreatedAt
+		if task.LastTriedAt != nil {
+			last = *task.LastTriedAt
+		}
+		if c.since > 0 && time.Since(last) > c.since {
+			continue
+		}
+
+		if c.dryRun {
+			fmt.Printf("Would replay task %s type: %s state: %s tries: %d\n", task.ID, task.Type, task.State, task.Tries)
+			replayed.Add(1)
+			continue
+		}
+
+		ids <- task.ID
+	}
+	close(ids)
+	wg.Wait()
+
+	if tasks.Err() != nil {
+		return tasks.Err()
+	}
+
+	if c.dryRun {
+		fmt.Printf("Would replay %s tasks\n", humanize.Comma(replayed.Load()))
+		return nil
+	}
+
+	fmt.Printf("Replayed %s tasks, skipped %s\n", humanize.Comma(replayed.Load()), humanize.Comma(skipped.Load()))
+
+	return nil
+}
+
+func (c *taskCommand) exportAction(_ *fisk.ParseContext) error {
+	err := c.prepare()
+	if err != nil {
+		return err
+	}
+
+	filter := aj.TaskFilter{Tags: c.tags}
+	for _, s := range c.states {
+		filter.States = append(filter.States, aj.TaskState(s))
+	}
+	if c.queue != "" {
+		filter.Queues = []string{c.queue}
+	}
+	if c.ttype != "" {
+		filter.Types = []string{c.ttype}
+	}
+
+	out := os.Stdout
+	if c.file != "" {
+		out, err = os.Create(c.file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	exported, err := client.ExportTasks(context.Background(), filter, out)
+	if err != nil {
+		return err
+	}
+
+	if c.file == "" {
+		return nil
+	}
+
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d tasks to %s\n", exported, c.file)
+
+	return nil
+}
+
+func (c *taskCommand) importAction(_ *fisk.ParseContext) error {
+	err := c.prepare()
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(c.file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	imported, err := client.ImportTasks(context.Background(), in)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d tasks from %s\n", imported, c.file)
+
+	return nil
+}
+
 func (c *taskCommand) initAction(_ *fisk.ParseContext) error {
 	err := c.prepare(aj.NoStorageInit())
 	if err != nil {
@@ -417,6 +604,9 @@ func (c *taskCommand) viewAction(_ *fisk.ParseContext) error {
 	}
 	if task.Result != nil {
 		fmt.Printf("            Completed: %s (%s)\n", task.Result.CompletedAt.Format(timeFormat), humanizeDuration(task.Result.CompletedAt.Sub(task.CreatedAt)))
+		if task.Result.SkipReason != "" {
+			fmt.Printf("          Skip Reason: %s\n", task.Result.SkipReason)
+		}
 	} else {
 		if task.LastTriedAt != nil {
 			fmt.Printf("       Last Processed: %s\n", task.LastTriedAt.Format(timeFormat))
@@ -424,17 +614,54 @@ func (c *taskCommand) viewAction(_ *fisk.ParseContext) error {
 		if task.LastErr != "" {
 			fmt.Printf("           Last Error: %s\n", task.LastErr)
 		}
+		if task.Requeues > 0 {
+			fmt.Printf("             Requeues: %d\n", task.Requeues)
+		}
+		if task.FailureRepeats > 1 {
+			fmt.Printf("      Repeated Errors: %d\n", task.FailureRepeats)
+		}
 	}
 	if task.Queue != "" {
 		fmt.Printf("                Queue: %s\n", task.Queue)
 	}
+	if task.FanoutID != "" {
+		fmt.Printf("            Fanout ID: %s\n", task.FanoutID)
+	}
 	fmt.Printf("                Tries: %d\n", task.Tries)
+	if len(task.Attempts) > 0 {
+		fmt.Printf("             Attempts:\n")
+		for _, a := range task.Attempts {
+			res := "ok"
+			if a.Error != "" {
+				res = a.Error
+			}
+			fmt.Printf("                       %s on %s after %s: %s\n", a.Time.Format(timeFormat), a.Worker, humanizeDuration(a.Duration), res)
+		}
+	}
+	fmt.Printf("             Priority: %d\n", task.Priority)
 	if task.Deadline != nil {
 		fmt.Printf("  Scheduling Deadline: %s\n", task.Deadline.Format(timeFormat))
 	}
+	if task.ScheduledFor != nil {
+		fmt.Printf("        Scheduled For: %s\n", task.ScheduledFor.Format(timeFormat))
+	}
 	if task.MaxTries > 0 {
 		fmt.Printf("        Maximum Tries: %s\n", humanize.Comma(int64(task.MaxTries)))
 	}
+	if task.NoRetry {
+		fmt.Printf("             No Retry: true\n")
+	}
+	if len(task.Tags) > 0 {
+		var tags []string
+		for k, v := range task.Tags {
+			tags = append(tags, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(tags)
+		fmt.Printf("                 Tags: %s\n", strings.Join(tags, ", "))
+	}
+	if len(task.Capabilities) > 0 {
+		fmt.Printf("         Capabilities: %s\n", strings.Join(task.Capabilities, ", "))
+	}
 
 	return nil
 }
@@ -449,6 +676,9 @@ func (c *taskCommand) addAction(_ *fisk.ParseContext) error {
 	if c.deadline > 0 {
 		opts = append(opts, aj.TaskDeadline(time.Now().UTC().Add(c.deadline)))
 	}
+	if c.delay > 0 {
+		opts = append(opts, aj.TaskScheduledIn(c.delay))
+	}
 
 	if len(c.dependencies) > 0 {
 		for _, deps := range c.dependencies {
@@ -466,6 +696,16 @@ func (c *taskCommand) addAction(_ *fisk.ParseContext) error {
 		opts = append(opts, aj.TaskMaxTries(c.maxtries))
 	}
 
+	if c.noRetry {
+		opts = append(opts, aj.NoRetry())
+	}
+
+	opts = append(opts, aj.TaskPriority(c.priority))
+
+	if len(c.tags) > 0 {
+		opts = append(opts, aj.TaskTags(c.tags))
+	}
+
 	task, err := aj.NewTask(c.ttype, c.payload, opts...)
 	if err != nil {
 		return err
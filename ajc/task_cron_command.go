@@ -25,7 +25,9 @@ type taskCronCommand struct {
 	queue    string
 	deadline time.Duration
 	maxtries int
+	jitter   time.Duration
 	promPort int
+	catchUp  string
 
 	names bool
 	force bool
@@ -45,6 +47,7 @@ func configureTaskCronCommand(app *fisk.CmdClause) {
 	add.Flag("queue", "The name of the queue to add the task to").Short('q').Default("DEFAULT").StringVar(&c.queue)
 	add.Flag("deadline", "A duration to determine when the latest time that a task handler will be called").DurationVar(&c.deadline)
 	add.Flag("tries", "Sets the maximum amount of times this task may be tried").IntVar(&c.maxtries)
+	add.Flag("jitter", "Delays enqueueing tasks by a random duration of up to this long after every tick").DurationVar(&c.jitter)
 
 	view := cron.Command("view", "Views a Scheduled Task").Alias("show").Alias("v").Action(c.viewAction)
 	view.Arg("name", "The name of the Schedule to view").Required().StringVar(&c.name)
@@ -60,6 +63,7 @@ func configureTaskCronCommand(app *fisk.CmdClause) {
 	scheduler := cron.Command("scheduler", "Runs the Scheduled Task Scheduler").Action(c.schedulerAction)
 	scheduler.Arg("name", "A unique name for this scheduler, used for leader election").Required().Envar("AJC_SCHEDULER_NAME").StringVar(&c.name)
 	scheduler.Flag("monitor", "Runs monitoring on the given port").PlaceHolder("AJC_MONITOR").IntVar(&c.promPort)
+	scheduler.Flag("catch-up", "How to handle ticks missed while no scheduler was running").Envar("AJC_SCHEDULER_CATCH_UP").Default(string(aj.CatchUpSkip)).EnumVar(&c.catchUp, string(aj.CatchUpSkip), string(aj.CatchUpOnce), string(aj.CatchUpAll))
 }
 
 func (c *taskCronCommand) schedulerAction(_ *fisk.ParseContext) error {
@@ -72,7 +76,7 @@ func (c *taskCronCommand) schedulerAction(_ *fisk.ParseContext) error {
 	defer cancel()
 	wg := sync.WaitGroup{}
 
-	sched, err := aj.NewTaskScheduler(c.name, client)
+	sched, err := aj.NewTaskScheduler(c.name, client, aj.ScheduleCatchUp(aj.CatchUpPolicy(c.catchUp)))
 	if err != nil {
 		return err
 	}
@@ -184,6 +188,9 @@ func (c *taskCronCommand) showSchedule(s *aj.ScheduledTask) {
 	if s.MaxTries > 0 {
 		fmt.Printf("        Maximum Tries: %s\n", humanize.Comma(int64(s.MaxTries)))
 	}
+	if s.Jitter > 0 {
+		fmt.Printf("               Jitter: %s\n", humanizeDuration(s.Jitter))
+	}
 }
 
 func (c *taskCronCommand) addAction(_ *fisk.ParseContext) error {
@@ -217,7 +224,7 @@ func (c *taskCronCommand) addAction(_ *fisk.ParseContext) error {
 		}
 	}
 
-	err = client.NewScheduledTask(c.name, c.schedule, c.queue, task)
+	err = client.NewScheduledTask(c.name, c.schedule, c.queue, task, aj.ScheduleJitter(c.jitter))
 	if err != nil {
 		return err
 	}
@@ -209,9 +209,11 @@ func showQueue(q *asyncjobs.QueueInfo) {
 	fmt.Printf("    Memory Based: %t\n", q.Stream.Config.Storage == api.MemoryStorage)
 	fmt.Printf("        Replicas: %d\n", q.Stream.Config.Replicas)
 	fmt.Printf("  Archive Period: %s\n", humanizeDuration(q.Stream.Config.MaxAge))
-	fmt.Printf("  Max Task Tries: %d\n", q.Consumer.Config.MaxDeliver)
+	fmt.Printf("Duplicate Window: %s\n", humanizeDuration(q.Stream.Config.Duplicates))
+	fmt.Printf("  Max Task Tries: %d\n", q.MaxTries)
 	fmt.Printf("    Max Run Time: %s\n", humanizeDuration(q.Consumer.Config.AckWait))
-	fmt.Printf("  Max Concurrent: %d\n", q.Consumer.Config.MaxAckPending)
+	fmt.Printf("  Max Concurrent: %d\n", q.MaxConcurrent)
+	fmt.Printf("          Paused: %t\n", q.Paused)
 	if q.Stream.Config.MaxMsgs == -1 {
 		fmt.Printf("     Max Entries: unlimited\n")
 	} else {
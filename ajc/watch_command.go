@@ -0,0 +1,172 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	aj "github.com/choria-io/asyncjobs"
+	"github.com/choria-io/fisk"
+)
+
+type watchCommand struct {
+	queue  string
+	types  []string
+	states []string
+	json   bool
+}
+
+// watchTransition is a single task state change as rendered by ajc watch
+type watchTransition struct {
+	Time     time.Time    `json:"time"`
+	TaskID   string       `json:"task_id"`
+	TaskType string       `json:"task_type"`
+	Queue    string       `json:"queue,omitempty"`
+	Previous aj.TaskState `json:"previous_state,omitempty"`
+	State    aj.TaskState `json:"state"`
+	Tries    int          `json:"tries"`
+	Elapsed  string       `json:"elapsed,omitempty"`
+	LastErr  string       `json:"last_error,omitempty"`
+}
+
+var watchStates = []string{
+	string(aj.TaskStateNew), string(aj.TaskStateActive), string(aj.TaskStateRetry), string(aj.TaskStateExpired),
+	string(aj.TaskStateTerminated), string(aj.TaskStateCompleted), string(aj.TaskStateQueueError),
+	string(aj.TaskStateBlocked), string(aj.TaskStateUnreachable), string(aj.TaskStateQuarantined),
+	string(aj.TaskStateSkipped),
+}
+
+func configureWatchCommand(app *fisk.Application) {
+	c := &watchCommand{}
+
+	watch := app.Command("watch", "Tails task state changes in real time").Action(c.watchAction)
+	watch.Flag("queue", "Only show tasks in this queue").StringVar(&c.queue)
+	watch.Flag("type", "Only show tasks of this type, pass multiple times for more types").StringsVar(&c.types)
+	watch.Flag("state", "Only show changes to this state, pass multiple times for more states").EnumsVar(&c.states, watchStates...)
+	watch.Flag("json", "Show JSON data, one change per line").Short('j').BoolVar(&c.json)
+}
+
+func (c *watchCommand) watchAction(_ *fisk.ParseContext) error {
+	err := prepare()
+	if err != nil {
+		return err
+	}
+
+	mgr, _, err := admin.TasksStore()
+	if err != nil {
+		return err
+	}
+
+	sub, err := mgr.NatsConn().SubscribeSync(aj.TaskStateChangeEventSubjectWildcard)
+	if err != nil {
+		return err
+	}
+
+	// the last state seen for tasks that are not yet in a final state
+	seen := map[string]aj.TaskState{}
+
+	for {
+		msg, err := sub.NextMsg(time.Hour)
+		if err != nil {
+			return err
+		}
+
+		event, _, err := aj.ParseEventJSON(msg.Data)
+		if err != nil {
+			fmt.Printf("Could not parse event: %v\n", err)
+			continue
+		}
+
+		e, ok := event.(aj.TaskStateChangeEvent)
+		if !ok {
+			continue
+		}
+
+		previous := seen[e.TaskID]
+		switch e.State {
+		case aj.TaskStateCompleted, aj.TaskStateExpired, aj.TaskStateTerminated, aj.TaskStateUnreachable, aj.TaskStateQuarantined, aj.TaskStateSkipped:
+			delete(seen, e.TaskID)
+		default:
+			seen[e.TaskID] = e.State
+		}
+
+		if !c.matches(e) {
+			continue
+		}
+
+		change := watchTransition{
+			Time:     e.TimeStamp,
+			TaskID:   e.TaskID,
+			TaskType: e.TaskType,
+			Queue:    e.Queue,
+			Previous: previous,
+			State:    e.State,
+			Tries:    e.Tries,
+			LastErr:  e.LastErr,
+		}
+		if e.Age > 0 {
+			change.Elapsed = humanizeDuration(e.Age)
+		}
+
+		if c.json {
+			j, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(j))
+			continue
+		}
+
+		c.showTransition(change)
+	}
+}
+
+func (c *watchCommand) matches(e aj.TaskStateChangeEvent) bool {
+	if c.queue != "" && e.Queue != c.queue {
+		return false
+	}
+
+	if len(c.types) > 0 && !stringsContain(c.types, e.TaskType) {
+		return false
+	}
+
+	if len(c.states) > 0 && !stringsContain(c.states, string(e.State)) {
+		return false
+	}
+
+	return true
+}
+
+func (c *watchCommand) showTransition(t watchTransition) {
+	previous := string(t.Previous)
+	if previous == "" {
+		previous = "?"
+	}
+
+	line := fmt.Sprintf("[%s] %s: type: %s %s -> %s tries: %d", t.Time.Format("15:04:05"), t.TaskID, t.TaskType, previous, t.State, t.Tries)
+	if c.queue == "" && t.Queue != "" {
+		line += fmt.Sprintf(" queue: %s", t.Queue)
+	}
+	if t.Elapsed != "" {
+		line += fmt.Sprintf(" elapsed: %s", t.Elapsed)
+	}
+	if t.LastErr != "" {
+		line += fmt.Sprintf(" error: %s", t.LastErr)
+	}
+
+	fmt.Println(line)
+}
+
+func stringsContain(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
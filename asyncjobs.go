@@ -22,6 +22,17 @@ const (
 	DefaultMaxTries = 10
 	// DefaultQueueMaxConcurrent when not configured for a queue this is the default concurrency setting
 	DefaultQueueMaxConcurrent = 100
+	// DefaultPriority is the priority tasks will have when not configured using TaskPriority()
+	DefaultPriority = 5
+	// MaxPriority is the highest priority a task can have
+	MaxPriority = 9
+	// TaskEventsBufferSize is the capacity of the channel returned by Client.Events()
+	TaskEventsBufferSize = 1000
+	// DefaultMaxPayloadSize is the largest task payload that can be enqueued when not configured using MaxPayloadSize()
+	// and the client is not connected to NATS, half of the default NATS server max_payload
+	DefaultMaxPayloadSize = 512 * 1024
+	// DefaultTaskAttemptHistory is how many attempts are kept in a task when not configured using TaskAttemptHistory()
+	DefaultTaskAttemptHistory = 10
 )
 
 // StorageAdmin is helpers to support the CLI mainly, this leaks a bunch of details about JetStream
@@ -32,7 +43,13 @@ type StorageAdmin interface {
 	QueueInfo(name string) (*QueueInfo, error)
 	PurgeQueue(name string) error
 	DeleteQueue(name string) error
+	PauseQueue(name string) error
+	ResumeQueue(name string) error
 	PrepareQueue(q *Queue, replicas int, memory bool) error
+	CreateWorkQueue(q *Queue, replicas int, memory bool) error
+	UpdateWorkQueue(q *Queue) error
+	DeleteWorkQueue(name string) error
+	ListWorkQueues() ([]*Queue, error)
 	ConfigurationInfo() (*nats.KeyValueBucketStatus, error)
 	PrepareConfigurationStore(memory bool, replicas int) error
 	PrepareTasks(memory bool, replicas int, retention time.Duration) error
@@ -49,32 +66,126 @@ type ScheduledTaskStorage interface {
 	DeleteScheduledTaskByName(name string) error
 	ScheduledTasks(ctx context.Context) ([]*ScheduledTask, error)
 	ScheduledTasksWatch(ctx context.Context) (chan *ScheduleWatchEntry, error)
+	ScheduledTaskLastRun(name string) (time.Time, error)
+	SaveScheduledTaskLastRun(name string, t time.Time) error
 	EnqueueTask(ctx context.Context, queue *Queue, task *Task) error
 	ElectionStorage() (nats.KeyValue, error)
 	PublishLeaderElectedEvent(ctx context.Context, name string, component string) error
 }
 
-// Storage implements the backend access
+// Storage implements the backend access, the JetStream storage is used by default and NewInMemoryStorage() is
+// included for tests, other implementations can be passed to the client using StorageBackend().
+//
+// Implementations should return ErrTaskNotFound, ErrTaskAlreadyExists, ErrConflict and ErrQueueNotFound where
+// appropriate as the client relies on these to make decisions. Tasks loaded or saved have to be marked using
+// Task.SetRevision() so stale saves can be detected. Tasks enqueued with Task.ReplaceExisting() replace stored tasks
+// with the same ID, enqueues of tasks with Task.MatchPending() fail with a DuplicateTaskError naming the task holding
+// the deduplication key. Optional features are enabled by also implementing TaskStateChangeNotifier,
+// QueueStatsProvider, QueueDescriber, BatchPoller, ConfigurationStorage, QueuePauser, DeadLetterStorage,
+// DeduplicationStorage, TaskTypeLocker, TaskCancelRequester, ResultStore, ScheduledTaskStore and
+// ScheduledTaskStorage, the client fails with ErrStorageNotReady when a feature is used that the storage does not
+// support
 type Storage interface {
+	// SaveTaskState persists task, rejecting updates of tasks whose stored Revision() changed with ErrConflict, publishing a state change event when notify is true
 	SaveTaskState(ctx context.Context, task *Task, notify bool) error
+	// EnqueueTask saves a new task and adds a TaskItem for it to queue
 	EnqueueTask(ctx context.Context, queue *Queue, task *Task) error
+	// RetryTaskByID resets a task to the retry state and adds a new TaskItem for it to queue
 	RetryTaskByID(ctx context.Context, queue *Queue, id string) error
+	// LoadTaskByID loads a task, ErrTaskNotFound when it does not exist
 	LoadTaskByID(id string) (*Task, error)
+	// DeleteTaskByID removes a task
 	DeleteTaskByID(id string) error
+	// ListTasks finds tasks matching filter, see NewTaskIterator()
+	ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error)
+	// WatchTask sends every saved version of a task, closing the channel once it reaches a final state or ctx is done
+	WatchTask(ctx context.Context, id string) (chan *Task, error)
+	// PurgeTasks deletes tasks matching filter, pausing between deletes, returning the number removed
+	PurgeTasks(ctx context.Context, filter TaskFilter, pause time.Duration) (int, error)
+	// PublishTaskStateChangeEvent announces the current state of task to event listeners
 	PublishTaskStateChangeEvent(ctx context.Context, task *Task) error
+	// AckItem removes an item fetched using PollQueue() from its queue
 	AckItem(ctx context.Context, item *ProcessItem) error
+	// InProgressItem extends the time the processor has to handle an item before it is redelivered
+	InProgressItem(ctx context.Context, item *ProcessItem) error
+	// NakBlockedItem returns an item whose dependencies are not yet met to the queue for later delivery
 	NakBlockedItem(ctx context.Context, item *ProcessItem) error
+	// NakItem returns an item to the queue for redelivery according to the client retry policy
 	NakItem(ctx context.Context, item *ProcessItem) error
+	// NakDelayedItem returns an item to the queue, delivering it again after delay
+	NakDelayedItem(ctx context.Context, item *ProcessItem, delay time.Duration) error
+	// TerminateItem removes an item from the queue without delivering it again
 	TerminateItem(ctx context.Context, item *ProcessItem) error
+	// PollQueue waits for the next item in q until ctx is done, see ProcessItem.SetStorageMeta()
 	PollQueue(ctx context.Context, q *Queue) (*ProcessItem, error)
+	// PrepareQueue creates or updates the storage for q
 	PrepareQueue(q *Queue, replicas int, memory bool) error
+	// PrepareTasks creates the storage for tasks, removing them after retention when not zero
 	PrepareTasks(memory bool, replicas int, retention time.Duration) error
+}
+
+// ConfigurationStorage is implemented by storage that keeps configuration such as paused queues in a store of its own
+type ConfigurationStorage interface {
+	// PrepareConfigurationStore creates the storage for configuration such as paused queues
 	PrepareConfigurationStore(memory bool, replicas int) error
+}
+
+// QueuePauser is implemented by storage that can pause queues, queues of storage that does not implement it are
+// never paused
+type QueuePauser interface {
+	// PauseQueue stops PollQueue() from delivering items from the named queue
+	PauseQueue(name string) error
+	// ResumeQueue resumes delivery of items from a paused queue
+	ResumeQueue(name string) error
+	// QueuePaused indicates if the named queue is paused
+	QueuePaused(name string) (bool, error)
+	// QueuePausedWatch sends the paused state of the named queue whenever it changes until ctx is done
+	QueuePausedWatch(ctx context.Context, name string) (chan bool, error)
+}
+
+// DeadLetterStorage is implemented by storage that can keep failed tasks in a dead letter queue, see DeadLetterQueue()
+type DeadLetterStorage interface {
+	// DeadLetterTask adds a DeadLetterItem holding a copy of the task to dlq
+	DeadLetterTask(ctx context.Context, dlq *Queue, task *Task) error
+	// ReplayDeadLetter removes the dead letter entry for a task from dlq and enqueues the task again
+	ReplayDeadLetter(ctx context.Context, dlq *Queue, id string) error
+}
+
+// DeduplicationStorage is implemented by storage that can detect duplicate tasks, see DedupWindow()
+type DeduplicationStorage interface {
+	// PrepareDeduplicationStore creates the storage used to detect duplicate tasks within window
+	PrepareDeduplicationStore(memory bool, replicas int, window time.Duration) error
+}
+
+// TaskTypeLocker is implemented by storage that can lock task types, see Mux.UniqueActive()
+type TaskTypeLocker interface {
+	// PrepareTaskTypeLockStore creates the storage for task type locks that expire after ttl unless refreshed
+	PrepareTaskTypeLockStore(memory bool, replicas int, ttl time.Duration) error
+	// AcquireTaskTypeLock takes the lock for taskType, ErrTaskTypeLocked when another holder has it
+	AcquireTaskTypeLock(taskType string, holder string) (uint64, error)
+	// RefreshTaskTypeLock extends a held lock, ErrTaskTypeLockLost when it expired or was taken by another holder
+	RefreshTaskTypeLock(taskType string, holder string, revision uint64) (uint64, error)
+	// ReleaseTaskTypeLock releases a held lock
+	ReleaseTaskTypeLock(taskType string, revision uint64) error
+}
+
+// ScheduledTaskStore is implemented by storage that can store scheduled tasks, see Client.NewScheduledTask(), running
+// the Task Scheduler also requires ScheduledTaskStorage
+type ScheduledTaskStore interface {
+	// SaveScheduledTask stores a scheduled task, ErrScheduledTaskAlreadyExist when it exists and update is false
 	SaveScheduledTask(st *ScheduledTask, update bool) error
+	// LoadScheduledTaskByName loads a scheduled task, ErrScheduledTaskNotFound when it does not exist
 	LoadScheduledTaskByName(name string) (*ScheduledTask, error)
+	// DeleteScheduledTaskByName removes a scheduled task
 	DeleteScheduledTaskByName(name string) error
-	ScheduledTasks(ctx context.Context) ([]*ScheduledTask, error)
-	ScheduledTasksWatch(ctx context.Context) (chan *ScheduleWatchEntry, error)
+}
+
+// TaskStateChangeNotifier is implemented by storage that reports changes of task states, the client registers a handler
+// that has to be called after every save that changed the state of a task, passing the state previously stored as
+// reported by Task.StoredState() before the save. Metrics, Events() and OnTaskDead() rely on it
+type TaskStateChangeNotifier interface {
+	// SetTaskStateChangeHandler sets the handler to call after a save changed the state of a task
+	SetTaskStateChangeHandler(handler func(task *Task, previous TaskState))
 }
 
 var (
@@ -0,0 +1,29 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"math/rand"
+	"time"
+)
+
+// capabilityRetryDelay is the minimum time a task requiring capabilities the client lacks is returned to the queue for
+var capabilityRetryDelay = time.Second
+
+func capabilityDelay() time.Duration {
+	return capabilityRetryDelay + time.Duration(rand.Int63n(int64(capabilityRetryDelay)))
+}
+
+// missingCapabilities are the capabilities required by task that the client did not declare
+func (p *processor) missingCapabilities(task *Task) []string {
+	var missing []string
+	for _, c := range task.Capabilities {
+		if !containsString(p.c.opts.capabilities, c) {
+			missing = append(missing, c)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Capabilities", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+
+		delay := capabilityRetryDelay
+		capabilityRetryDelay = 10 * time.Millisecond
+		DeferCleanup(func() { capabilityRetryDelay = delay })
+	})
+
+	AfterEach(func() { cancel() })
+
+	It("Should validate capabilities", func() {
+		_, err := NewTask("ml:train", nil, RequireCapability("gpu", ""))
+		Expect(err).To(MatchError(ErrTaskCapabilityInvalid))
+
+		task, err := NewTask("ml:train", nil, RequireCapability("gpu", "cuda"), RequireCapability("gpu"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.Capabilities).To(Equal([]string{"gpu", "cuda"}))
+
+		_, err = NewClient(StorageBackend(NewInMemoryStorage()), WorkerCapabilities(""))
+		Expect(err).To(MatchError("worker capabilities may not be empty"))
+	})
+
+	It("Should only handle tasks on workers with the required capabilities", func() {
+		storage := NewInMemoryStorage()
+		handler := func(name string) HandlerFunc {
+			return func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return name, nil
+			}
+		}
+
+		cpu, err := NewClient(StorageBackend(storage), WorkerCapabilities("cuda"))
+		Expect(err).ToNot(HaveOccurred())
+		router := NewTaskRouter()
+		router.HandleFunc("ml:train", handler("cpu"))
+		go cpu.Run(ctx, router)
+
+		task, err := NewTask("ml:train", nil, RequireCapability("gpu", "cuda"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cpu.EnqueueTask(ctx, task)).To(Succeed())
+
+		other, err := NewTask("ml:train", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := cpu.EnqueueAndWait(ctx, other)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`"cpu"`))
+
+		Consistently(func() TaskState {
+			task, err = cpu.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}, 200*time.Millisecond).Should(Equal(TaskStateNew))
+
+		gpu, err := NewClient(StorageBackend(storage), WorkerCapabilities("gpu", "cuda"))
+		Expect(err).ToNot(HaveOccurred())
+		router = NewTaskRouter()
+		router.HandleFunc("ml:train", handler("gpu"))
+		go gpu.Run(ctx, router)
+
+		Eventually(func() TaskState {
+			task, err = gpu.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateCompleted))
+		Expect(task.Result.Payload).To(Equal("gpu"))
+	})
+})
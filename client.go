@@ -9,52 +9,117 @@ import (
 	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// the maximum amount of enqueue operations EnqueueTasks will have in flight
+const enqueueBatchConcurrency = 100
+
+// prefixes the deduplication keys of tasks enqueued using EnqueueIfNotPending()
+const pendingDeduplicationKeyPrefix = "pending:"
+
 // Client connects Task producers and Task handlers to the backend
 type Client struct {
 	opts    *ClientOpts
 	storage Storage
+	proc    *processor
+	events  chan TaskEvent
+	tracer  trace.Tracer
+	conn    *connectionMonitor
+
+	processed   atomic.Uint64
+	failed      atomic.Uint64
+	statesCache *clientTaskStatesCache
+
+	// queues are the queues tasks were enqueued into using EnqueueTaskToQueue
+	queues map[string]*Queue
+	qmu    sync.Mutex
+
+	// dead tasks waiting to be passed to the OnTaskDead() callback, deadDone is closed once the goroutine calling the
+	// callback finished all and exited
+	dead     []*Task
+	deadDone chan struct{}
+	deadMu   sync.Mutex
 
 	log Logger
+	mu  sync.Mutex
 }
 
 // NewClient creates a new client, one of NatsConn() or NatsContext() must be passed, other options are optional.
 //
 // When no Queue() is supplied a default queue called DEFAULT will be used
 func NewClient(opts ...ClientOpt) (*Client, error) {
-	copts := &ClientOpts{
-		replicas:    1,
-		concurrency: 10,
-		retryPolicy: RetryDefault,
-		logger:      &noopLogger{},
+	copts := newClientOpts()
+
+	err := copts.apply(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	for _, opt := range opts {
-		err = opt(copts)
+	err = copts.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	if copts.registerer != nil {
+		err = registerMetrics(copts.registerer)
 		if err != nil {
 			return nil, err
 		}
 	}
-
-	err = copts.validate()
-	if err != nil {
-		return nil, err
+	if copts.maxPayloadSize == 0 {
+		copts.maxPayloadSize = DefaultMaxPayloadSize
+		if copts.nc != nil && copts.nc.MaxPayload() > 0 {
+			copts.maxPayloadSize = int(copts.nc.MaxPayload() / 2)
+		}
+	}
+	if copts.promTaskTypeLimit != nil {
+		taskTypeLabels.setLimit(*copts.promTaskTypeLimit)
 	}
 
-	c := &Client{opts: copts, log: copts.logger}
-	c.storage, err = newJetStreamStorage(copts.nc, copts.retryPolicy, c.log)
-	if err != nil {
-		return nil, err
+	c := &Client{opts: copts, log: copts.logger, tracer: newTracer(copts.tracerProvider)}
+
+	switch storage := copts.storage.(type) {
+	case nil:
+		js, err := newJetStreamStorage(copts.nc, copts.retryPolicy, c.log)
+		if err != nil {
+			return nil, err
+		}
+		js.stateChanged = c.taskStateChanged
+		js.compression = copts.compression
+		js.crypter = copts.crypter
+		js.requestRetries = copts.storageRetries
+		js.requestRetryPolicy = copts.storageRetryPolicy
+		js.clock = copts.clock
+		c.storage = js
+		c.conn = newConnectionMonitor(copts.nc, c.log)
+
+	case *InMemoryStorage:
+		storage.mu.Lock()
+		storage.stateChanged = c.taskStateChanged
+		storage.retry = copts.retryPolicy
+		storage.clock = copts.clock
+		storage.log = c.log
+		storage.mu.Unlock()
+		c.storage = storage
+
+	default:
+		if n, ok := storage.(TaskStateChangeNotifier); ok {
+			n.SetTaskStateChangeHandler(c.taskStateChanged)
+		}
+		c.storage = storage
 	}
 
 	if c.opts.queue == nil {
@@ -83,16 +148,291 @@ func (c *Client) Run(ctx context.Context, router *Mux) error {
 		return fmt.Errorf("no queue defined")
 	}
 
+	c.mu.Lock()
 	proc, err := newProcessor(c)
 	if err != nil {
+		c.mu.Unlock()
 		return err
 	}
+	c.proc = proc
+	c.mu.Unlock()
 
 	c.startPrometheus()
 
+	if c.opts.retentionMaxAge > 0 {
+		go c.reapTasks(ctx)
+	}
+
 	return proc.processMessages(ctx, router)
 }
 
+// RunUntilEmpty processes tasks using the router like Run until no handler started or finished for idle while none
+// are running, it then drains the client and returns. This suits batch workers that should exit once the queue has
+// no work ready for them, like those started by cron. Tasks waiting for their retry backoff, scheduled for later or
+// blocked on dependencies are not waited for, they remain in the queue for a later run. Returns ctx.Err() when ctx
+// is done before the queue became idle
+func (c *Client) RunUntilEmpty(ctx context.Context, router *Mux, idle time.Duration) error {
+	if idle <= 0 {
+		return fmt.Errorf("idle timeout must be positive")
+	}
+
+	// handlers use this context while draining so it is only canceled once Run returned
+	rctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	c.mu.Lock()
+	previous := c.proc
+	c.mu.Unlock()
+
+	errs := make(chan error, 1)
+	go func() { errs <- c.Run(rctx, router) }()
+
+	interval := idle / 10
+	switch {
+	case interval < 10*time.Millisecond:
+		interval = 10 * time.Millisecond
+	case interval > time.Second:
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errs:
+			if err == nil && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+
+		case <-ticker.C:
+			c.mu.Lock()
+			proc := c.proc
+			c.mu.Unlock()
+
+			if proc == nil || proc == previous || !proc.idleFor(idle) {
+				continue
+			}
+
+			c.log.Infof("No tasks were handled for %v, stopping", idle)
+
+			err := c.Drain(ctx)
+			rerr := <-errs
+			if err != nil {
+				return err
+			}
+			return rerr
+		}
+	}
+}
+
+// Drain stops Run from fetching new tasks and waits for in-flight handlers to finish or ctx to be done, Run will
+// return once draining starts. Handlers are told about the shutdown using ShutdownSignal(), when ctx is done before
+// they finish their context is canceled and the tasks of those that fail are returned to the queue. Storage is used
+// to update those tasks so ctx passed to Run should stay active until Drain returns. Drain also waits for tasks
+// passed to the OnTaskDead() callback to be handled, it does nothing else when Run was not called.
+func (c *Client) Drain(ctx context.Context) error {
+	c.mu.Lock()
+	proc := c.proc
+	c.mu.Unlock()
+
+	if proc != nil {
+		err := proc.drain(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.waitDeadTasks(ctx)
+}
+
+// InFlightTasks is the number of tasks currently being handled by Run
+func (c *Client) InFlightTasks() int {
+	c.mu.Lock()
+	proc := c.proc
+	c.mu.Unlock()
+
+	if proc == nil {
+		return 0
+	}
+
+	return proc.inFlightCount()
+}
+
+// SetConcurrency changes the number of tasks Run handles concurrently without restarting it, before Run is called it
+// sets the concurrency Run starts with like ClientConcurrency(). When lowering the concurrency in-flight handlers are
+// not interrupted, their slots are removed once they finish. The queue MaxConcurrent setting still limits the
+// concurrency across all clients
+func (c *Client) SetConcurrency(n int) error {
+	if n < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+	if len(c.opts.boundQueues) > 1 && n < len(c.opts.boundQueues) {
+		return fmt.Errorf("client concurrency must be at least the number of bound queues")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.proc != nil {
+		err := c.proc.setConcurrency(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.opts.concurrency = n
+
+	return nil
+}
+
+// Concurrency is the number of tasks Run handles concurrently, see SetConcurrency()
+func (c *Client) Concurrency() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.proc != nil {
+		return c.proc.currentConcurrency()
+	}
+
+	return c.opts.concurrency
+}
+
+// Events is a channel of state changes for tasks enqueued or handled by this client, it is buffered with capacity
+// TaskEventsBufferSize. Events are only recorded once Events was called, when the channel is full new events are
+// dropped and counted in the choria_asyncjobs_task_events_dropped_total metric rather than block processing.
+func (c *Client) Events() <-chan TaskEvent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan TaskEvent, TaskEventsBufferSize)
+	}
+
+	return c.events
+}
+
+func (c *Client) taskStateChanged(task *Task, previous TaskState) {
+	recordTaskStateMetrics(task, previous)
+	c.recordProcessingStats(task)
+	c.notifyTaskEvent(task, previous)
+	c.notifyTaskDead(task)
+}
+
+// deadTaskStates are the final states that are not a success, tasks reaching them are passed to OnTaskDead()
+var deadTaskStates = []TaskState{TaskStateExpired, TaskStateTerminated, TaskStateQuarantined, TaskStateUnreachable}
+
+func (c *Client) notifyTaskDead(task *Task) {
+	if c.opts.onTaskDead == nil || !containsState(deadTaskStates, task.State) {
+		return
+	}
+
+	// the callback runs concurrently with further use of task by processing so it receives a copy
+	j, err := json.Marshal(task)
+	if err != nil {
+		c.log.Errorf("Could not copy dead task %s: %v", task.ID, err)
+		return
+	}
+	cp := &Task{}
+	err = json.Unmarshal(j, cp)
+	if err != nil {
+		c.log.Errorf("Could not copy dead task %s: %v", task.ID, err)
+		return
+	}
+	cp.payloadValue = task.payloadValue
+
+	c.deadMu.Lock()
+	defer c.deadMu.Unlock()
+
+	if len(c.dead) >= TaskEventsBufferSize {
+		c.log.Warnf("Dropping dead task %s notification, OnTaskDead callback is not keeping up", task.ID)
+		taskDeadDroppedCounter.WithLabelValues(task.Queue, taskTypeLabels.label(task.Type)).Inc()
+		return
+	}
+
+	c.dead = append(c.dead, cp)
+
+	if c.deadDone == nil {
+		c.deadDone = make(chan struct{})
+		go c.deadTaskNotifier(c.deadDone)
+	}
+}
+
+// deadTaskNotifier passes dead tasks to the OnTaskDead() callback one at a time, it exits and closes done once no
+// more tasks are waiting and is started again by notifyTaskDead() when needed
+func (c *Client) deadTaskNotifier(done chan struct{}) {
+	for {
+		c.deadMu.Lock()
+		if len(c.dead) == 0 {
+			c.deadDone = nil
+			c.deadMu.Unlock()
+			close(done)
+			return
+		}
+		task := c.dead[0]
+		c.dead[0] = nil
+		c.dead = c.dead[1:]
+		c.deadMu.Unlock()
+
+		c.callDeadTaskCallback(task)
+	}
+}
+
+func (c *Client) callDeadTaskCallback(task *Task) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Errorf("Dead task callback for task %s panicked: %v", task.ID, r)
+		}
+	}()
+
+	c.opts.onTaskDead(task)
+}
+
+// waitDeadTasks waits for dead tasks waiting to be passed to the OnTaskDead() callback to be handled or ctx to be done
+func (c *Client) waitDeadTasks(ctx context.Context) error {
+	c.deadMu.Lock()
+	done := c.deadDone
+	c.deadMu.Unlock()
+
+	if done == nil {
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) notifyTaskEvent(task *Task, previous TaskState) {
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+
+	if events == nil {
+		return
+	}
+
+	e := TaskEvent{
+		TaskID:        task.ID,
+		TaskType:      task.Type,
+		Queue:         task.Queue,
+		PreviousState: previous,
+		State:         task.State,
+		Tries:         task.Tries,
+		TimeStamp:     c.opts.clock.Now().UTC(),
+	}
+
+	select {
+	case events <- e:
+	default:
+		taskEventsDroppedCounter.WithLabelValues().Inc()
+	}
+}
+
 // LoadTaskByID loads a task from the backend using its ID
 func (c *Client) LoadTaskByID(id string) (*Task, error) {
 	task, err := c.storage.LoadTaskByID(id)
@@ -113,16 +453,458 @@ func (c *Client) RetryTaskByID(ctx context.Context, id string) error {
 	return c.opts.queue.retryTaskByID(ctx, id)
 }
 
-// EnqueueTask adds a task to the named queue which must already exist
+// ReplayDeadLetter enqueues a task stored in the dead letter queue back into its original queue with its tries reset
+// to zero, the entry is then removed from the dead letter queue. Requires the client to be configured using DeadLetterQueue()
+func (c *Client) ReplayDeadLetter(ctx context.Context, id string) error {
+	if c.opts.deadLetterQueue == nil {
+		return fmt.Errorf("no dead letter queue configured")
+	}
+
+	dls, ok := c.storage.(DeadLetterStorage)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support dead letter queues", ErrStorageNotReady)
+	}
+
+	return dls.ReplayDeadLetter(ctx, c.opts.deadLetterQueue, id)
+}
+
+// ReplayTaskByID enqueues a task that failed, one in state TaskStateExpired, TaskStateTerminated, TaskStateQueueError or
+// TaskStateQuarantined, into the client queue again with its tries, last error and result reset. The task must belong to the client queue,
+// tasks with a deadline that passed will expire again when received
+func (c *Client) ReplayTaskByID(ctx context.Context, id string) error {
+	task, err := c.LoadTaskByID(id)
+	if err != nil {
+		return err
+	}
+
+	switch task.State {
+	case TaskStateExpired, TaskStateTerminated, TaskStateQueueError, TaskStateQuarantined:
+	default:
+		return fmt.Errorf("%w %q", ErrTaskTypeCannotEnqueue, task.State)
+	}
+
+	if task.Queue != c.opts.queue.Name {
+		return fmt.Errorf("task %s belongs to queue %s", task.ID, task.Queue)
+	}
+
+	task.State = TaskStateRetry
+	task.NextTryAt = nil
+	task.Tries = 0
+	task.LastErr = ""
+	task.FailureSignature = ""
+	task.FailureRepeats = 0
+	task.Result = nil
+
+	return c.storage.EnqueueTask(ctx, c.opts.queue, task)
+}
+
+// CancelTasks terminates all tasks matching filter that are waiting to be processed, those in state TaskStateNew,
+// TaskStateRetry or TaskStateBlocked, and returns the number of tasks canceled. Tasks that become active before they
+// are canceled are left to finish, a task that was canceled first will not be started by any worker. Filter.States
+// may be used to cancel only some of the waiting states.
+func (c *Client) CancelTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	states := filter.States
+	filter.States = nil
+	for _, state := range cancelableTaskStates {
+		if len(states) == 0 || containsState(states, state) {
+			filter.States = append(filter.States, state)
+		}
+	}
+	if len(filter.States) == 0 {
+		return 0, nil
+	}
+
+	tasks, err := c.ListTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []string
+	for tasks.Next() {
+		ids = append(ids, tasks.Task().ID)
+	}
+	tasks.Close()
+	if tasks.Err() != nil {
+		return 0, tasks.Err()
+	}
+
+	canceled := 0
+	for _, id := range ids {
+		ok, err := c.cancelTask(ctx, id)
+		if err != nil {
+			return canceled, err
+		}
+		if ok {
+			canceled++
+		}
+	}
+
+	return canceled, nil
+}
+
+var cancelableTaskStates = []TaskState{TaskStateNew, TaskStateRetry, TaskStateBlocked}
+
+// maxTaskModifyTries is how often modifyTask loads a task again after a conflicting update
+const maxTaskModifyTries = 5
+
+// modifyTask loads the task with id and saves it after change modified it, change returns false to leave the task
+// unchanged. Saves are conditional on the task being unchanged since loaded, when another client or a worker updated
+// the task first it is loaded again and passed to change again. Fails with ErrConflict once the task kept changing
+func (c *Client) modifyTask(ctx context.Context, id string, notify bool, change func(task *Task) (bool, error)) (bool, error) {
+	for try := 0; try < maxTaskModifyTries; try++ {
+		task, err := c.LoadTaskByID(id)
+		if err != nil {
+			return false, err
+		}
+
+		ok, err := change(task)
+		if err != nil || !ok {
+			return false, err
+		}
+
+		err = c.storage.SaveTaskState(ctx, task, notify)
+		if err == nil {
+			return true, nil
+		}
+
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		if !errors.Is(err, ErrConflict) {
+			return false, err
+		}
+		c.log.Debugf("Task %s changed while being updated, retrying: %v", id, err)
+	}
+
+	return false, fmt.Errorf("%w: task %s kept changing after %d tries", ErrConflict, id, maxTaskModifyTries)
+}
+
+// cancelTask terminates a waiting task, when a worker starts the task concurrently the task is loaded again and left
+// alone
+func (c *Client) cancelTask(ctx context.Context, id string) (bool, error) {
+	canceled, err := c.modifyTask(ctx, id, true, func(task *Task) (bool, error) {
+		if !containsState(cancelableTaskStates, task.State) {
+			return false, nil
+		}
+
+		task.State = TaskStateTerminated
+		task.LastErr = ErrTaskCanceled.Error()
+		task.LastTriedAt = c.nowPointer()
+
+		return true, nil
+	})
+	if errors.Is(err, ErrTaskNotFound) {
+		return false, nil
+	}
+
+	return canceled, err
+}
+
+// UpdateTask replaces the payload of a task that is waiting to be processed, one in state TaskStateNew, TaskStateRetry
+// or TaskStateBlocked. Tasks being handled fail with ErrTaskInFlight, tasks in any other state with ErrTaskNotWaiting.
+// The save is conditional on the task being unchanged since loaded so a worker starting the task concurrently either
+// starts it with the new payload or the update fails with ErrTaskInFlight
+func (c *Client) UpdateTask(ctx context.Context, id string, payload any) error {
+	p, pt, err := c.marshalPayload(payload)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkPayloadSize(p)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.modifyTask(ctx, id, false, func(task *Task) (bool, error) {
+		switch {
+		case task.State == TaskStateActive:
+			return false, fmt.Errorf("%w: %s", ErrTaskInFlight, id)
+		case !containsState(cancelableTaskStates, task.State):
+			return false, fmt.Errorf("%w: %s is %s", ErrTaskNotWaiting, id, task.State)
+		}
+
+		task.Payload = p
+		task.PayloadType = pt
+		if schema, ok := c.opts.payloadSchemas[task.Type]; ok {
+			err := validateTaskPayload(schema, task)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if task.Signature != "" {
+			task.Signature = ""
+			err := c.signTask(task)
+			if err != nil {
+				return false, err
+			}
+			if task.Signature == "" {
+				return false, fmt.Errorf("%w: signed tasks can only be updated by clients with a signing key", ErrTaskSignatureInvalid)
+			}
+		}
+
+		return true, nil
+	})
+
+	return err
+}
+
+// checkPayloadSize enforces the client MaxPayloadSize() on an encoded task payload
+func (c *Client) checkPayloadSize(payload []byte) error {
+	if len(payload) <= c.opts.maxPayloadSize {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrTaskPayloadTooLarge, len(payload), c.opts.maxPayloadSize)
+}
+
+// EnqueueTask adds a task to the named queue which must already exist. A task that failed to enqueue with
+// TaskStateQueueError can be passed again, within the queue DuplicateWindow this does not create a second queue entry
+// when the first attempt was stored despite the error
 func (c *Client) EnqueueTask(ctx context.Context, task *Task) error {
-	task.Queue = c.opts.queue.Name
+	return c.enqueueTask(ctx, c.opts.queue, task)
+}
 
-	err := c.signTask(task)
+// EnqueueTaskToQueue adds a task to the named queue rather than the client queue, the task is enqueued like
+// EnqueueTask would. The queue must exist unless the client was created using AutoCreateQueue(), in which case the
+// first enqueue creates it using the QueueTemplate()
+func (c *Client) EnqueueTaskToQueue(ctx context.Context, queue string, task *Task) error {
+	if queue == "" {
+		return ErrQueueNameRequired
+	}
+
+	q, err := c.enqueueQueue(queue)
 	if err != nil {
 		return err
 	}
 
-	return c.opts.queue.enqueueTask(ctx, task)
+	return c.enqueueTask(ctx, q, task)
+}
+
+func (c *Client) enqueueTask(ctx context.Context, q *Queue, task *Task) (err error) {
+	task.Queue = q.Name
+
+	err = c.waitEnqueueRate(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := c.startEnqueueSpan(ctx, task)
+	defer func() { endSpan(span, err) }()
+
+	err = c.encodeTaskPayload(task)
+	if err != nil {
+		return err
+	}
+
+	err = c.checkPayloadSize(task.Payload)
+	if err != nil {
+		return err
+	}
+
+	if schema, ok := c.opts.payloadSchemas[task.Type]; ok {
+		err = validateTaskPayload(schema, task)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.opts.cloudEventsSource != "" && task.CloudEvent == nil {
+		ce := task.newCloudEvent(c.opts.cloudEventsSource)
+		task.CloudEvent = &ce
+	}
+
+	err = c.signTask(task)
+	if err != nil {
+		return err
+	}
+
+	err = q.enqueueTask(ctx, task)
+	if errors.Is(err, ErrQueueNotFound) && c.opts.autoCreateQueue {
+		c.log.Warnf("Creating queue %s that was removed", q.Name)
+
+		// the task is now in TaskStateQueueError which can be enqueued again
+		err = c.recreateQueue(q)
+		if err != nil {
+			return err
+		}
+
+		err = q.enqueueTask(ctx, task)
+	}
+
+	return err
+}
+
+// waitEnqueueRate waits until the EnqueueRateLimit() allows enqueueing another task
+func (c *Client) waitEnqueueRate(ctx context.Context, q *Queue) error {
+	if c.opts.enqueueLimiter == nil {
+		return nil
+	}
+
+	err := c.opts.enqueueLimiter.Wait(ctx)
+	if err == nil {
+		return nil
+	}
+
+	enqueueRateLimitedCounter.WithLabelValues(q.Name).Inc()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return ErrEnqueueRateLimited
+}
+
+// EnqueueTaskIfAbsent adds a task to the queue only when no task with the same ID is stored, returning true when
+// the task was created. The task store checks for existing tasks atomically so of many concurrent callers only one
+// creates the task, combined with TaskID() this allows enqueues to be safely retried. Unlike TaskDeduplicationKey()
+// tasks are matched strictly on their ID.
+func (c *Client) EnqueueTaskIfAbsent(ctx context.Context, task *Task) (bool, error) {
+	if task.replace {
+		return false, fmt.Errorf("tasks replacing existing tasks cannot be enqueued if absent")
+	}
+
+	err := c.EnqueueTask(ctx, task)
+	switch {
+	case errors.Is(err, ErrTaskAlreadyExists):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// EnqueueIfNotPending adds a task to the queue unless a task of the same type enqueued using the same key is not yet
+// in a final state, returning the ID of that task rather than enqueueing. The ID of task and true are returned when it
+// was enqueued. Keys are claimed atomically in the deduplication store so of many concurrent callers only one enqueues
+// a task, this requires the client to be configured using DedupWindow(). Claims do not expire with the window, they are
+// released once the task holding it reaches a final state.
+func (c *Client) EnqueueIfNotPending(ctx context.Context, task *Task, key string) (string, bool, error) {
+	pendingKey := fmt.Sprintf("%s%s:%s", pendingDeduplicationKeyPrefix, task.Type, key)
+
+	switch {
+	case key == "":
+		return "", false, fmt.Errorf("a key to match pending tasks is required")
+	case task.replace:
+		return "", false, fmt.Errorf("tasks replacing existing tasks cannot be enqueued if not pending")
+	case task.DeduplicationKey != "" && task.DeduplicationKey != pendingKey:
+		return "", false, fmt.Errorf("tasks with a deduplication key cannot be enqueued if not pending")
+	}
+
+	task.DeduplicationKey = pendingKey
+	task.matchPending = true
+
+	err := c.EnqueueTask(ctx, task)
+	var dupe *DuplicateTaskError
+	switch {
+	case errors.As(err, &dupe):
+		return dupe.TaskID, false, nil
+	case err != nil:
+		return "", false, err
+	}
+
+	return task.ID, true, nil
+}
+
+// EnqueueAndWait enqueues task and blocks until it reaches a final state, returning the JSON encoded result payload
+// of the completed task. Skipped tasks return ErrTaskSkipped with the reason, see SkipTask(), other tasks that do not
+// complete return ErrTaskFailed with their final state and last error, handler
+// failures that will be retried do not unblock the caller. Waiting ends when ctx is done, the task is not affected by
+// that and continues to be processed. Clients discarding tasks using DiscardTaskStates() cannot wait for tasks.
+func (c *Client) EnqueueAndWait(ctx context.Context, task *Task) ([]byte, error) {
+	if len(c.opts.discard) > 0 {
+		return nil, fmt.Errorf("cannot wait for tasks while task states are discarded")
+	}
+
+	err := c.EnqueueTask(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	updates, err := c.WatchTask(wctx, task.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for t := range updates {
+		if !t.IsFinal() {
+			continue
+		}
+
+		if t.State == TaskStateSkipped {
+			if t.Result != nil && t.Result.SkipReason != "" {
+				return nil, fmt.Errorf("%w: %s", ErrTaskSkipped, t.Result.SkipReason)
+			}
+			return nil, ErrTaskSkipped
+		}
+
+		if t.State != TaskStateCompleted {
+			if t.LastErr != "" {
+				return nil, fmt.Errorf("%w: %s: %s", ErrTaskFailed, t.State, t.LastErr)
+			}
+			return nil, fmt.Errorf("%w: %s", ErrTaskFailed, t.State)
+		}
+
+		if t.Result == nil {
+			return nil, nil
+		}
+
+		return json.Marshal(t.Result.Payload)
+	}
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return nil, fmt.Errorf("watching task %s ended before it reached a final state", task.ID)
+}
+
+// EnqueueTasks adds many tasks to the queue, keeping up to 100 enqueue operations in flight at a time.
+//
+// Every task is enqueued like EnqueueTask would, failures do not impact other tasks in the batch. The returned
+// errors correspond by index to tasks with nil indicating the task was stored. Tasks not yet started when ctx
+// is canceled will not be enqueued and have the context error set.
+func (c *Client) EnqueueTasks(ctx context.Context, tasks []*Task) (int, []error) {
+	var stored int32
+	var wg sync.WaitGroup
+
+	errs := make([]error, len(tasks))
+	limiter := make(chan struct{}, enqueueBatchConcurrency)
+
+	for i, task := range tasks {
+		if ctx.Err() != nil {
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		select {
+		case limiter <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, task *Task) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+
+			errs[i] = c.EnqueueTask(ctx, task)
+			if errs[i] == nil {
+				atomic.AddInt32(&stored, 1)
+			}
+		}(i, task)
+	}
+
+	wg.Wait()
+
+	return int(stored), errs
 }
 
 func (c *Client) verifyTaskSignature(task *Task) error {
@@ -244,34 +1026,100 @@ func (c *Client) signTask(task *Task) error {
 	return nil
 }
 
-// StorageAdmin access admin features of the storage backend
+// ListTasks streams tasks matching filter from the task store, the returned iterator should be closed when done
+func (c *Client) ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error) {
+	return c.storage.ListTasks(ctx, filter)
+}
+
+// WatchTask watches a task for state changes, the current state of the task is delivered first followed by every
+// update until the task reaches a final state or ctx is canceled, the channel is closed in either case.
+// ErrTaskNotFound is returned for unknown tasks
+func (c *Client) WatchTask(ctx context.Context, id string) (<-chan *Task, error) {
+	return c.storage.WatchTask(ctx, id)
+}
+
+// PurgeTasks deletes all tasks matching filter from the task store, returning the number of tasks deleted.
+// Tasks updated while the purge is running are not deleted
+func (c *Client) PurgeTasks(ctx context.Context, filter TaskFilter) (int, error) {
+	return c.storage.PurgeTasks(ctx, filter, 0)
+}
+
+// PauseQueue stops all clients from fetching new tasks from the named queue until ResumeQueue is called, tasks
+// already being handled are not interrupted. The pause is stored in the configuration bucket and so persists
+// across restarts of clients
+func (c *Client) PauseQueue(ctx context.Context, name string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	pauser, ok := c.storage.(QueuePauser)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support pausing queues", ErrStorageNotReady)
+	}
+
+	return pauser.PauseQueue(name)
+}
+
+// ResumeQueue resumes processing of a queue paused using PauseQueue
+func (c *Client) ResumeQueue(ctx context.Context, name string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	pauser, ok := c.storage.(QueuePauser)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support pausing queues", ErrStorageNotReady)
+	}
+
+	return pauser.ResumeQueue(name)
+}
+
+// StorageAdmin access admin features of the storage backend, nil when the storage does not support administration
 func (c *Client) StorageAdmin() StorageAdmin {
-	return c.storage.(*jetStreamStorage)
+	admin, _ := c.storage.(StorageAdmin)
+	return admin
 }
 
-// ScheduledTasksStorage gives access to administrative functions for task maintenance
+// ScheduledTasksStorage gives access to administrative functions for task maintenance, nil when the storage does
+// not support scheduled tasks and leader elections
 func (c *Client) ScheduledTasksStorage() ScheduledTaskStorage {
-	return c.storage.(*jetStreamStorage)
+	st, _ := c.storage.(ScheduledTaskStorage)
+	return st
 }
 
 // NewScheduledTask creates a new scheduled task, an existing schedule will result in failure
-func (c *Client) NewScheduledTask(name string, schedule string, queue string, task *Task) error {
-	st, _, err := newScheduledTaskFromTask(name, schedule, queue, task)
+func (c *Client) NewScheduledTask(name string, schedule string, queue string, task *Task, opts ...ScheduledTaskOpt) error {
+	st, _, err := newScheduledTaskFromTask(name, schedule, queue, task, opts...)
 	if err != nil {
 		return err
 	}
 
-	return c.storage.SaveScheduledTask(st, false)
+	sts, ok := c.storage.(ScheduledTaskStore)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support scheduled tasks", ErrStorageNotReady)
+	}
+
+	return sts.SaveScheduledTask(st, false)
 }
 
 // RemoveScheduledTask removes a scheduled task
 func (c *Client) RemoveScheduledTask(name string) error {
-	return c.storage.DeleteScheduledTaskByName(name)
+	sts, ok := c.storage.(ScheduledTaskStore)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support scheduled tasks", ErrStorageNotReady)
+	}
+
+	return sts.DeleteScheduledTaskByName(name)
 }
 
 // LoadScheduledTaskByName loads a scheduled task by name
 func (c *Client) LoadScheduledTaskByName(name string) (*ScheduledTask, error) {
-	return c.storage.LoadScheduledTaskByName(name)
+	sts, ok := c.storage.(ScheduledTaskStore)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage does not support scheduled tasks", ErrStorageNotReady)
+	}
+
+	return sts.LoadScheduledTaskByName(name)
 }
 
 func (c *Client) startPrometheus() {
@@ -280,7 +1128,12 @@ func (c *Client) startPrometheus() {
 	}
 
 	c.log.Warnf("Exposing Prometheus metrics on port %d", c.opts.statsPort)
-	http.Handle("/metrics", promhttp.Handler())
+	handler := promhttp.Handler()
+	if g, ok := c.opts.registerer.(prometheus.Gatherer); ok {
+		handler = promhttp.HandlerFor(g, promhttp.HandlerOpts{})
+	}
+
+	http.Handle("/metrics", handler)
 	go func() {
 		err := http.ListenAndServe(fmt.Sprintf(":%d", c.opts.statsPort), nil)
 		if err != nil {
@@ -295,17 +1148,46 @@ func (c *Client) setupStreams() error {
 		return err
 	}
 
-	return c.storage.PrepareConfigurationStore(c.opts.memoryStore, c.opts.replicas)
+	if cs, ok := c.storage.(ConfigurationStorage); ok {
+		err = cs.PrepareConfigurationStore(c.opts.memoryStore, c.opts.replicas)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.opts.streamedResults {
+		store, ok := c.storage.(ResultStore)
+		if !ok {
+			return fmt.Errorf("%w: storage does not support streamed results", ErrStorageNotReady)
+		}
+
+		err = store.PrepareResultStore(c.opts.memoryStore, c.opts.replicas, c.opts.taskRetention)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.opts.dedupWindow > 0 {
+		ds, ok := c.storage.(DeduplicationStorage)
+		if !ok {
+			return fmt.Errorf("%w: storage does not support task deduplication", ErrStorageNotReady)
+		}
+
+		return ds.PrepareDeduplicationStore(c.opts.memoryStore, c.opts.replicas, c.opts.dedupWindow)
+	}
+
+	return nil
 }
 
-func nowPointer() *time.Time {
-	t := time.Now().UTC()
+// nowPointer is the current time of the client clock in UTC
+func (c *Client) nowPointer() *time.Time {
+	t := c.opts.clock.Now().UTC()
 	return &t
 }
 
 func (c *Client) setTaskActive(ctx context.Context, t *Task) error {
 	t.State = TaskStateActive
-	t.LastTriedAt = nowPointer()
+	t.LastTriedAt = c.nowPointer()
 	t.LastErr = ""
 
 	return c.storage.SaveTaskState(ctx, t, true)
@@ -321,25 +1203,49 @@ func (c *Client) shouldDiscardTask(t *Task) bool {
 	return false
 }
 
+func (c *Client) deadLetterTaskIfDesired(ctx context.Context, t *Task) {
+	if c.opts.deadLetterQueue == nil {
+		return
+	}
+
+	if t.State != TaskStateTerminated && t.State != TaskStateExpired {
+		return
+	}
+
+	dls, ok := c.storage.(DeadLetterStorage)
+	if !ok {
+		return
+	}
+
+	err := dls.DeadLetterTask(ctx, c.opts.deadLetterQueue, t)
+	if err != nil {
+		c.log.Errorf("Could not store task %s in dead letter queue %s: %v", t.ID, c.opts.deadLetterQueue.Name, err)
+	}
+}
+
 func (c *Client) saveOrDiscardTaskIfDesired(ctx context.Context, t *Task) error {
+	c.deadLetterTaskIfDesired(ctx, t)
+
 	if !c.shouldDiscardTask(t) {
 		return c.storage.SaveTaskState(ctx, t, true)
 	}
 
 	c.storage.PublishTaskStateChangeEvent(ctx, t)
+	c.taskStateChanged(t, t.StoredState())
 
 	c.log.Debugf("Discarding task with state %s based on desired discards %q", t.State, c.opts.discard)
 	return c.storage.DeleteTaskByID(t.ID)
 }
 
 func (c *Client) setTaskSuccess(ctx context.Context, t *Task, payload any) error {
-	t.LastTriedAt = nowPointer()
+	t.LastTriedAt = c.nowPointer()
 	t.State = TaskStateCompleted
 	t.LastErr = ""
 
 	t.Result = &TaskResult{
 		Payload:     payload,
-		CompletedAt: time.Now().UTC(),
+		CompletedAt: c.opts.clock.Now().UTC(),
+		Object:      t.resultObject(),
 	}
 
 	return c.saveOrDiscardTaskIfDesired(ctx, t)
@@ -347,36 +1253,229 @@ func (c *Client) setTaskSuccess(ctx context.Context, t *Task, payload any) error
 
 func (c *Client) handleTaskTerminated(ctx context.Context, t *Task, terr error) error {
 	t.LastErr = terr.Error()
-	t.LastTriedAt = nowPointer()
+	t.LastTriedAt = c.nowPointer()
 	t.State = TaskStateTerminated
 
 	return c.saveOrDiscardTaskIfDesired(ctx, t)
 }
 
+// handleTaskSkipped records that the handler skipped t for reason
+func (c *Client) handleTaskSkipped(ctx context.Context, t *Task, reason string) error {
+	t.LastErr = ""
+	t.LastTriedAt = c.nowPointer()
+	t.State = TaskStateSkipped
+	t.Result = &TaskResult{CompletedAt: c.opts.clock.Now().UTC(), SkipReason: reason}
+
+	return c.saveOrDiscardTaskIfDesired(ctx, t)
+}
+
 func (c *Client) handleTaskExpired(ctx context.Context, t *Task) error {
 	t.State = TaskStateExpired
 
 	return c.saveOrDiscardTaskIfDesired(ctx, t)
 }
 
+// handleTaskPastTTL expires a task that was not handled within its TTL
+func (c *Client) handleTaskPastTTL(ctx context.Context, t *Task) error {
+	t.LastErr = ErrTaskPastTTL.Error()
+
+	return c.handleTaskExpired(ctx, t)
+}
+
+// handleTaskRetryAfter records a try deferred by the handler, it is not counted as a try
+func (c *Client) handleTaskRetryAfter(ctx context.Context, t *Task, terr error) error {
+	t.Tries--
+	t.Deferrals++
+	t.LastErr = terr.Error()
+	t.LastTriedAt = c.nowPointer()
+	t.State = TaskStateRetry
+
+	return c.storage.SaveTaskState(ctx, t, true)
+}
+
 func (c *Client) handleTaskError(ctx context.Context, t *Task, terr error) error {
 	t.LastErr = terr.Error()
-	t.LastTriedAt = nowPointer()
+	t.LastTriedAt = c.nowPointer()
 	t.State = TaskStateRetry
 
+	// a passed deadline expires tasks whatever their tries, also those not allowing retries
 	if errors.Is(terr, ErrTaskDependenciesFailed) {
 		t.State = TaskStateUnreachable
-	} else if t.Queue != "" && t.Queue == c.opts.queue.Name {
-		if c.opts.queue.MaxTries == t.Tries {
-			c.log.Infof("Expiring task %s after %d / %d tries", t.ID, t.Tries, c.opts.queue.MaxTries)
-			t.State = TaskStateExpired
-		}
+	} else if t.isPastDeadline(c.opts.clock.Now()) {
+		c.log.Infof("Expiring task %s after try %d as it is past its deadline", t.ID, t.Tries)
+		t.State = TaskStateExpired
+	} else if t.NoRetry {
+		c.log.Infof("Terminating task %s after its only try as it does not allow retries", t.ID)
+		t.State = TaskStateTerminated
+	} else if max := c.taskMaxTries(t); max > 0 && t.Tries >= max {
+		c.log.Infof("Expiring task %s after %d / %d tries", t.ID, t.Tries, max)
+		t.State = TaskStateExpired
+	}
+
+	if t.State != TaskStateUnreachable {
+		t.recordFailure(terr)
+	}
+
+	if t.State == TaskStateRetry && c.opts.quarantineFailures > 0 && t.FailureRepeats >= c.opts.quarantineFailures {
+		c.log.Warnf("Quarantining task %s after %d consecutive failures with the same error: %v", t.ID, t.FailureRepeats, terr)
+		t.State = TaskStateQuarantined
+	}
+
+	if t.State != TaskStateRetry {
+		t.NextTryAt = nil
 	}
 
 	return c.saveOrDiscardTaskIfDesired(ctx, t)
 }
 
 func (c *Client) setupQueues() error {
-	c.opts.queue.storage = c.storage
-	return c.storage.PrepareQueue(c.opts.queue, c.opts.replicas, c.opts.memoryStore)
+	if c.opts.deadLetterQueue != nil {
+		if _, ok := c.storage.(DeadLetterStorage); !ok {
+			return fmt.Errorf("%w: storage does not support dead letter queues", ErrStorageNotReady)
+		}
+
+		c.opts.deadLetterQueue.storage = c.storage
+		err := c.storage.PrepareQueue(c.opts.deadLetterQueue, c.opts.replicas, c.opts.memoryStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, q := range c.workQueues() {
+		err := c.prepareQueue(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// prepareQueue prepares q in the storage, queues that should already exist are created when AutoCreateQueue() is set
+func (c *Client) prepareQueue(q *Queue) error {
+	q.storage = c.storage
+
+	err := c.storage.PrepareQueue(q, c.opts.replicas, c.opts.memoryStore)
+	if !errors.Is(err, ErrQueueNotFound) || !c.opts.autoCreateQueue || !q.NoCreate {
+		return err
+	}
+
+	c.log.Infof("Creating queue %s", q.Name)
+
+	template := c.opts.queueTemplate
+	if template == nil {
+		template = newDefaultQueue()
+	}
+	q.applyTemplate(template)
+	q.NoCreate = false
+
+	return c.createQueue(q)
+}
+
+// recreateQueue creates q after it was removed, queues that were created from the defaults are created again using
+// the settings they were created with
+func (c *Client) recreateQueue(q *Queue) error {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+
+	if q.NoCreate {
+		return c.prepareQueue(q)
+	}
+
+	return c.createQueue(q)
+}
+
+// createQueue creates q, when another client created the queue at the same time with different settings the
+// existing queue is joined instead
+func (c *Client) createQueue(q *Queue) error {
+	err := c.storage.PrepareQueue(q, c.opts.replicas, c.opts.memoryStore)
+	if err == nil {
+		return nil
+	}
+
+	q.NoCreate = true
+	jerr := c.storage.PrepareQueue(q, c.opts.replicas, c.opts.memoryStore)
+	if jerr != nil {
+		q.NoCreate = false
+		return err
+	}
+
+	return nil
+}
+
+// enqueueQueue finds the queue called name for enqueueing tasks, queues not seen before are joined or, with
+// AutoCreateQueue(), created
+func (c *Client) enqueueQueue(name string) (*Queue, error) {
+	if c.opts.queue != nil && c.opts.queue.Name == name {
+		return c.opts.queue, nil
+	}
+	if q := c.workQueue(name); q != nil {
+		return q, nil
+	}
+
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+
+	if q, ok := c.queues[name]; ok {
+		return q, nil
+	}
+
+	q := &Queue{Name: name, NoCreate: true}
+	err := c.prepareQueue(q)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.queues == nil {
+		c.queues = map[string]*Queue{}
+	}
+	c.queues[name] = q
+
+	return q, nil
+}
+
+// workQueues are the queues Run processes
+func (c *Client) workQueues() []*Queue {
+	if len(c.opts.boundQueues) > 0 {
+		return c.opts.boundQueues
+	}
+	if c.opts.queue == nil {
+		return nil
+	}
+
+	return []*Queue{c.opts.queue}
+}
+
+// taskMaxTries is the amount of tries t is allowed, a limit set on the task using TaskMaxTries() is used instead of the
+// limit of its queue, otherwise the lower of the task and queue limits applies. 0 when the tries are not limited
+func (c *Client) taskMaxTries(t *Task) int {
+	if t.MaxTriesOverride && t.MaxTries > 0 {
+		return t.MaxTries
+	}
+
+	max := t.MaxTries
+	if q := c.workQueue(t.Queue); q != nil && q.MaxTries > 0 && (max <= 0 || q.MaxTries < max) {
+		max = q.MaxTries
+	}
+
+	if max < 0 {
+		return 0
+	}
+
+	return max
+}
+
+// workQueue finds a queue processed by Run by name
+func (c *Client) workQueue(name string) *Queue {
+	if name == "" {
+		return nil
+	}
+
+	for _, q := range c.workQueues() {
+		if q.Name == name {
+			return q
+		}
+	}
+
+	return nil
 }
@@ -7,18 +7,33 @@ package asyncjobs
 import (
 	"crypto/ed25519"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/nats-io/jsm.go/natscontext"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
 // ClientOpts configures the client
 type ClientOpts struct {
 	concurrency            int
+	fetchBatchSize         int
+	fairShare              float64
+	taskTypeShares         map[string]float64
 	replicas               int
 	queue                  *Queue
+	boundQueues            []*Queue
+	queueWeights           map[string]int
+	autoCreateQueue        bool
+	enqueueLimiter         *rate.Limiter
+	queueTemplate          *Queue
 	taskRetention          time.Duration
 	retryPolicy            RetryPolicyProvider
 	memoryStore            bool
@@ -31,25 +46,174 @@ type ClientOpts struct {
 	publicKey              ed25519.PublicKey
 	publicKeyFile          string
 	optionalTaskSignatures bool
+	dedupWindow            time.Duration
+	panicHandler           func(t *Task, r any)
+	onTaskDead             func(t *Task)
+	streamedResults        bool
+	preProcess             PreProcessFunc
+	postProcess            PostProcessFunc
+	dependencyFailure      DependencyFailurePolicy
+	quarantineFailures     int
+	unroutedTasks          UnroutedTaskPolicy
+	maxResultSize          int
+	maxPayloadSize         int
+	payloadSchemas         map[string]*jsonschema.Schema
+	cloudEventsSource      string
+	codec                  Codec
+	oversizedResults       OversizedResultPolicy
+	heartbeats             bool
+	heartbeatInterval      time.Duration
+	handlerTimeLimit       time.Duration
+	handlerMemoryLimit     uint64
+	handlerStopGrace       time.Duration
+	handlerLeakCheck       bool
+	attemptHistory         int
+	workerName             string
+	capabilities           []string
+	retentionMaxAge        time.Duration
+	retentionStates        []TaskState
+	deadLetterQueue        *Queue
+	compression            CompressionAlgorithm
+	crypter                Crypter
+	registerer             prometheus.Registerer
+	promTaskTypeLimit      *int
+	tracerProvider         trace.TracerProvider
+	storage                Storage
+	storageRetries         int
+	storageRetryPolicy     RetryPolicyProvider
+	clock                  clock
 
-	nc *nats.Conn
+	nc          *nats.Conn
+	natsContext string
+	natsOpts    []nats.Option
 }
 
 // ClientOpt configures the client
 type ClientOpt func(opts *ClientOpts) error
 
-func (c *ClientOpts) validate() error {
+func newClientOpts() *ClientOpts {
+	return &ClientOpts{
+		replicas:       1,
+		concurrency:    10,
+		fetchBatchSize: 1,
+		retryPolicy:    RetryDefault,
+		attemptHistory: DefaultTaskAttemptHistory,
+		workerName:     defaultWorkerName(),
+		clock:          realClock{},
+		logger:         &noopLogger{},
+
+		handlerStopGrace: DefaultHandlerStopGrace,
+	}
+}
+
+func defaultWorkerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// ClientOptionsError lists every problem found in the options passed to NewClient() or ValidateClientOptions()
+type ClientOptionsError struct {
+	Errors []error
+}
+
+func (e *ClientOptionsError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0].Error()
+	}
+
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", ErrInvalidClientOptions, strings.Join(msgs, "; "))
+}
+
+// Is matches ErrInvalidClientOptions and any of the problems found
+func (e *ClientOptionsError) Is(target error) bool {
+	if target == ErrInvalidClientOptions {
+		return true
+	}
+
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateClientOptions checks opts for problems that would prevent NewClient() from creating a client, returning
+// a ClientOptionsError describing all of them. No connection to NATS is made, so NatsContext() is not checked
+// beyond its name, and storage is not prepared
+func ValidateClientOptions(opts ...ClientOpt) error {
+	return newClientOpts().apply(opts)
+}
+
+// apply configures c using opts and validates the result, every option is applied even after one failed
+func (c *ClientOpts) apply(opts []ClientOpt) error {
+	var errs []error
+	for _, opt := range opts {
+		err := opt(c)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		return &ClientOptionsError{Errors: errs}
+	}
+
+	return nil
+}
+
+func (c *ClientOpts) validate() []error {
+	var errs []error
+
 	if c.privateKey != nil && c.seedFile != "" {
-		return fmt.Errorf("cannot set both private key and seed file")
+		errs = append(errs, fmt.Errorf("cannot set both private key and seed file"))
 	}
 	if c.publicKey != nil && c.publicKeyFile != "" {
-		return fmt.Errorf("cannot set both public key and public key file")
+		errs = append(errs, fmt.Errorf("cannot set both public key and public key file"))
 	}
 	if c.seedFile != "" && (c.publicKeyFile != "" || c.publicKey != nil) {
-		return fmt.Errorf("cannot set a seedfile and public key information")
+		errs = append(errs, fmt.Errorf("cannot set a seedfile and public key information"))
+	}
+	if c.nc != nil && c.natsContext != "" {
+		errs = append(errs, fmt.Errorf("cannot set both a NATS connection and a NATS context"))
+	}
+	if len(c.boundQueues) > 1 && c.concurrency < len(c.boundQueues) {
+		errs = append(errs, fmt.Errorf("client concurrency must be at least the number of bound queues"))
+	}
+	for name := range c.queueWeights {
+		found := false
+		for _, q := range c.boundQueues {
+			if q.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("weight set for queue %s that is not bound using BindWorkQueues", name))
+		}
+	}
+	for _, q := range []*Queue{c.queue, c.deadLetterQueue} {
+		if q == nil {
+			continue
+		}
+		err := q.validate()
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	return nil
+	return errs
 }
 
 // DiscardTaskStates configures the client to discard Tasks that reach a final state in the list of supplied TaskState
@@ -86,6 +250,40 @@ func DiscardTaskStatesByName(states ...string) ClientOpt {
 	}
 }
 
+// StorageBackend uses storage instead of JetStream to store tasks and work queues, no NATS connection is needed when
+// set. NewInMemoryStorage() creates a storage suitable for unit testing handlers and routing. Options that configure
+// JetStream, like StoreReplicas() and MemoryStorage(), have no effect.
+func StorageBackend(storage Storage) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if storage == nil {
+			return fmt.Errorf("storage is required")
+		}
+
+		opts.storage = storage
+
+		return nil
+	}
+}
+
+// StorageRetries retries storing tasks and their state in JetStream up to retries times when it failed for transient
+// reasons like timeouts, no responders or JetStream being temporarily unavailable. Retries are delayed following
+// policy, DefaultStorageRetryPolicy when nil, and end when the context of the operation is done. Other errors are
+// not retried
+func StorageRetries(retries int, policy RetryPolicyProvider) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if retries < 0 {
+			return fmt.Errorf("storage retries may not be negative")
+		}
+		if policy == nil {
+			policy = DefaultStorageRetryPolicy
+		}
+
+		opts.storageRetries = retries
+		opts.storageRetryPolicy = policy
+		return nil
+	}
+}
+
 // NoStorageInit skips setting up any queues or task stores when creating a client
 func NoStorageInit() ClientOpt {
 	return func(opts *ClientOpts) error {
@@ -94,7 +292,8 @@ func NoStorageInit() ClientOpt {
 	}
 }
 
-// CustomLogger sets a custom logger to use for all logging
+// CustomLogger sets a custom logger to use for all logging, by default nothing is logged. StdLogger() adapts the
+// standard library logger, loggers implementing FieldLogger receive task details when handling tasks
 func CustomLogger(log Logger) ClientOpt {
 	return func(opts *ClientOpts) error {
 		opts.logger = log
@@ -122,46 +321,103 @@ func PrometheusListenPort(port int) ClientOpt {
 	}
 }
 
-// NatsContext attempts to connect to the NATS client context c
-func NatsContext(c string, opts ...nats.Option) ClientOpt {
+// PrometheusRegisterer registers the metrics with reg instead of the default Prometheus registry, when reg is also a
+// prometheus.Gatherer it will be used by PrometheusListenPort(). Metrics are shared by all clients in the process
+// and will be removed from the default registry
+func PrometheusRegisterer(reg prometheus.Registerer) ClientOpt {
 	return func(copts *ClientOpts) error {
-		nopts := []nats.Option{
-			nats.MaxReconnects(-1),
-			nats.CustomReconnectDelay(RetryLinearOneMinute.Duration),
-			nats.UseOldRequestStyle(),
-			nats.Name("Choria Asynchronous Jobs Client"),
-			nats.ReconnectHandler(func(nc *nats.Conn) {
-				copts.logger.Infof("Reconnected to NATS server %s", nc.ConnectedUrl())
-			}),
-			nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-				copts.logger.Errorf("Disconnected from server: %v", err)
-			}),
-			nats.ErrorHandler(func(nc *nats.Conn, _ *nats.Subscription, err error) {
-				url := nc.ConnectedUrl()
-				if url == "" {
-					copts.logger.Errorf("Unexpected NATS error: %s", err)
-				} else {
-					copts.logger.Errorf("Unexpected NATS error from server %s: %s", url, err)
-				}
-			}),
-			nats.CustomReconnectDelay(func(n int) time.Duration {
-				d := RetryLinearOneMinute.Duration(n)
-				copts.logger.Warnf("Sleeping %v till the next reconnection attempt after %d attempts", d, n)
+		if reg == nil {
+			return fmt.Errorf("registerer is required")
+		}
 
-				return d
-			}),
+		copts.registerer = reg
+		return nil
+	}
+}
+
+// PrometheusTaskTypeLimit sets how many distinct task types will be used as values for the type label on metrics,
+// additional types are reported as PrometheusOtherTaskType. Setting 0 reports all types as PrometheusOtherTaskType.
+// Defaults to DefaultPrometheusTaskTypeLimit and applies to all clients in the process
+func PrometheusTaskTypeLimit(limit int) ClientOpt {
+	return func(copts *ClientOpts) error {
+		if limit < 0 {
+			return fmt.Errorf("task type limit can not be negative")
 		}
 
-		nc, err := natscontext.Connect(c, append(nopts, opts...)...)
-		if err != nil {
-			return err
+		copts.promTaskTypeLimit = &limit
+		return nil
+	}
+}
+
+// TracerProvider enables OpenTelemetry tracing, spans are created when enqueueing and handling tasks with the W3C
+// Trace Context stored in the task so handler spans are children of the enqueue span. Tracing is disabled by default
+func TracerProvider(tp trace.TracerProvider) ClientOpt {
+	return func(copts *ClientOpts) error {
+		if tp == nil {
+			return fmt.Errorf("tracer provider is required")
 		}
-		copts.nc = nc
 
+		copts.tracerProvider = tp
 		return nil
 	}
 }
 
+// NatsContext connects to NATS using the NATS client context c once all options were validated
+func NatsContext(c string, opts ...nats.Option) ClientOpt {
+	return func(copts *ClientOpts) error {
+		if c == "" {
+			return fmt.Errorf("a NATS context name is required")
+		}
+
+		copts.natsContext = c
+		copts.natsOpts = opts
+
+		return nil
+	}
+}
+
+// connect connects to the NATS context set using NatsContext()
+func (c *ClientOpts) connect() error {
+	if c.natsContext == "" {
+		return nil
+	}
+
+	nopts := []nats.Option{
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(RetryLinearOneMinute.Duration),
+		nats.UseOldRequestStyle(),
+		nats.Name("Choria Asynchronous Jobs Client"),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			c.logger.Infof("Reconnected to NATS server %s", nc.ConnectedUrl())
+		}),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			c.logger.Errorf("Disconnected from server: %v", err)
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, _ *nats.Subscription, err error) {
+			url := nc.ConnectedUrl()
+			if url == "" {
+				c.logger.Errorf("Unexpected NATS error: %s", err)
+			} else {
+				c.logger.Errorf("Unexpected NATS error from server %s: %s", url, err)
+			}
+		}),
+		nats.CustomReconnectDelay(func(n int) time.Duration {
+			d := RetryLinearOneMinute.Duration(n)
+			c.logger.Warnf("Sleeping %v till the next reconnection attempt after %d attempts", d, n)
+
+			return d
+		}),
+	}
+
+	nc, err := natscontext.Connect(c.natsContext, append(nopts, c.natsOpts...)...)
+	if err != nil {
+		return err
+	}
+	c.nc = nc
+
+	return nil
+}
+
 // MemoryStorage enables storing tasks and work queue in memory in JetStream
 func MemoryStorage() ClientOpt {
 	return func(opts *ClientOpts) error {
@@ -202,6 +458,69 @@ func ClientConcurrency(c int) ClientOpt {
 	}
 }
 
+// EnqueueRateLimit limits enqueueing tasks using this client to limit tasks every interval, allowing bursts of up
+// to burst tasks. Enqueues exceeding the rate wait for the limit to allow them, should waiting exceed the context
+// deadline they fail immediately with ErrEnqueueRateLimited without waiting
+func EnqueueRateLimit(limit int, interval time.Duration, burst int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if limit <= 0 || interval <= 0 {
+			return fmt.Errorf("%w: limit and interval must be positive", ErrInvalidRateLimit)
+		}
+		if burst <= 0 {
+			return fmt.Errorf("%w: burst must be positive", ErrInvalidRateLimit)
+		}
+
+		opts.enqueueLimiter = rate.NewLimiter(rate.Limit(float64(limit)/interval.Seconds()), burst)
+
+		return nil
+	}
+}
+
+// FetchBatchSize sets the maximum amount of tasks fetched from the work queue at a time, defaults to 1. Only as many
+// tasks as there are free concurrency slots are fetched and each is handled and acknowledged on its own. When
+// several queues are bound using BindWorkQueues() tasks are fetched one at a time so slots are shared by weight
+func FetchBatchSize(n int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if n < 1 {
+			return fmt.Errorf("fetch batch size must be at least 1")
+		}
+
+		opts.fetchBatchSize = n
+		return nil
+	}
+}
+
+// TaskTypeFairShare limits every task type to share, between 0 and 1, of the client concurrency while tasks of other
+// types are waiting. Tasks of a type already using its share are deferred for a short while so a flood of one type
+// can not starve others, when no other types are waiting a type may use all the concurrency
+func TaskTypeFairShare(share float64) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if share <= 0 || share > 1 {
+			return fmt.Errorf("fair share must be more than 0 and at most 1")
+		}
+
+		opts.fairShare = share
+		return nil
+	}
+}
+
+// TaskTypeShare sets the share of the client concurrency tasks with exactly the type taskType may use while tasks of
+// other types are waiting, overriding TaskTypeFairShare(). A share of 1 does not limit the type
+func TaskTypeShare(taskType string, share float64) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if share <= 0 || share > 1 {
+			return fmt.Errorf("share for task type %s must be more than 0 and at most 1", taskType)
+		}
+
+		if opts.taskTypeShares == nil {
+			opts.taskTypeShares = map[string]float64{}
+		}
+		opts.taskTypeShares[taskType] = share
+
+		return nil
+	}
+}
+
 // StoreReplicas sets the replica level to keep for the tasks store and work queue
 //
 // Used only when initially creating the underlying streams.
@@ -247,6 +566,81 @@ func BindWorkQueue(queue string) ClientOpt {
 	}
 }
 
+// BindWorkQueues binds the client to several work queues that should already exist, Run fetches and handles tasks
+// from all of them. ClientConcurrency is shared between the queues, when the client is busy free slots are given to
+// the queues in proportion to their weights set using WorkQueueWeights. Tasks are enqueued into the first queue.
+func BindWorkQueues(queues ...string) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if len(queues) == 0 {
+			return fmt.Errorf("a queue name is required")
+		}
+		if opts.queue != nil {
+			return fmt.Errorf("a queue has already been defined")
+		}
+
+		var bound []*Queue
+		for _, name := range queues {
+			if name == "" {
+				return fmt.Errorf("a queue name is required")
+			}
+			for _, q := range bound {
+				if q.Name == name {
+					return fmt.Errorf("queue %s is bound more than once", name)
+				}
+			}
+
+			bound = append(bound, &Queue{Name: name, NoCreate: true})
+		}
+
+		opts.boundQueues = bound
+		opts.queue = bound[0]
+
+		return nil
+	}
+}
+
+// AutoCreateQueue creates queues that do not exist yet rather than failing, using the settings of the
+// QueueTemplate(). This applies to queues bound using BindWorkQueue() and BindWorkQueues(), queues tasks are enqueued
+// into using EnqueueTaskToQueue() and queues that were removed while the client was running. Creating a queue that
+// another client created at the same time joins the existing queue
+func AutoCreateQueue(enable bool) ClientOpt {
+	return func(opts *ClientOpts) error {
+		opts.autoCreateQueue = enable
+		return nil
+	}
+}
+
+// QueueTemplate sets the settings used for queues created by AutoCreateQueue(), the name of the template is ignored.
+// Defaults to the settings of the DEFAULT queue
+func QueueTemplate(template *Queue) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if template == nil {
+			return fmt.Errorf("queue template is required")
+		}
+
+		opts.queueTemplate = template
+
+		return nil
+	}
+}
+
+// WorkQueueWeights sets the relative share of ClientConcurrency given to queues bound using BindWorkQueues while
+// the client is busy, queues without a weight have a weight of 1. With weights high=5, default=3 and low=1 the low
+// queue is given at least 1 of every 9 free slots
+func WorkQueueWeights(weights map[string]int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		for name, weight := range weights {
+			if weight < 1 {
+				return fmt.Errorf("weight for queue %s must be at least 1", name)
+			}
+		}
+
+		opts.queueWeights = weights
+
+		return nil
+	}
+}
+
 // TaskRetention is the time tasks will be kept for in the task storage
 //
 // Used only when initially creating the underlying streams.
@@ -257,6 +651,422 @@ func TaskRetention(r time.Duration) ClientOpt {
 	}
 }
 
+// RetentionPolicy periodically deletes tasks in any of states that were created more than maxAge ago, when no
+// states are given tasks in final states are deleted. Tasks are deleted by a single elected client running Run()
+func RetentionPolicy(maxAge time.Duration, states ...TaskState) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("retention max age must be positive")
+		}
+
+		if len(states) == 0 {
+			states = []TaskState{TaskStateCompleted, TaskStateExpired, TaskStateTerminated, TaskStateQueueError, TaskStateUnreachable, TaskStateSkipped}
+		}
+
+		opts.retentionMaxAge = maxAge
+		opts.retentionStates = states
+
+		return nil
+	}
+}
+
+// DedupWindow enables deduplication of tasks with a deduplication key set using TaskDeduplicationKey(), while
+// a task with the same key is not completed or expired and within this window new tasks with that key will fail
+// to enqueue with ErrDuplicateTask
+//
+// Used only when initially creating the underlying bucket.
+func DedupWindow(d time.Duration) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if d <= 0 {
+			return fmt.Errorf("deduplication window must be positive")
+		}
+
+		opts.dedupWindow = d
+		return nil
+	}
+}
+
+// PayloadCompression compresses task payloads using algo when storing tasks, handlers and loaded tasks always
+// receive the original payload. The algorithm is recorded with every stored task so tasks stored with different
+// or no compression can be read by any client
+func PayloadCompression(algo CompressionAlgorithm) ClientOpt {
+	return func(opts *ClientOpts) error {
+		switch algo {
+		case NoCompression, GzipCompression, S2Compression, ZstdCompression:
+			opts.compression = algo
+		default:
+			return fmt.Errorf("%w: %q", ErrCompressionUnsupported, algo)
+		}
+
+		return nil
+	}
+}
+
+// PayloadEncryption encrypts task payloads using crypter before they are stored, handlers and callers of
+// LoadTaskByID receive decrypted payloads. Clients without a Crypter can load encrypted tasks only as part of
+// task listings where the payload will be empty, see NewAESGCMCrypter()
+func PayloadEncryption(crypter Crypter) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if crypter == nil {
+			return fmt.Errorf("crypter is required")
+		}
+
+		opts.crypter = crypter
+		return nil
+	}
+}
+
+// HandlerHeartbeats extends the lease of running handlers every interval so tasks are not redelivered while a
+// handler runs for longer than the queue MaxRunTime, with interval 0 a third of MaxRunTime is used. The handler
+// context will then not expire while the client is running, use HandleFuncTimeout() to limit how long handlers run.
+// Handlers can also extend their lease using Heartbeat()
+func HandlerHeartbeats(interval time.Duration) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if interval < 0 {
+			return fmt.Errorf("heartbeat interval may not be negative")
+		}
+
+		opts.heartbeats = true
+		opts.heartbeatInterval = interval
+
+		return nil
+	}
+}
+
+// HandlerTimeLimit sets a watchdog that cancels the context of handlers running for longer than limit and fails their
+// tasks with ErrHandlerTimeLimit, handlers that do not return within the HandlerStopGrace() are abandoned. Unlike
+// HandleFuncTimeout() this applies to all handlers and protects the client from handlers that ignore their context
+func HandlerTimeLimit(limit time.Duration) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if limit <= 0 {
+			return fmt.Errorf("handler time limit must be positive")
+		}
+
+		opts.handlerTimeLimit = limit
+		return nil
+	}
+}
+
+// HandlerMemoryLimit sets a watchdog that cancels the context of running handlers and fails their tasks with
+// ErrHandlerMemoryLimit while the heap of the process exceeds limit bytes, handlers that do not return within the
+// HandlerStopGrace() are abandoned. Go can not attribute memory to handlers so every running handler is stopped
+func HandlerMemoryLimit(limit uint64) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if limit == 0 {
+			return fmt.Errorf("handler memory limit must be positive")
+		}
+
+		opts.handlerMemoryLimit = limit
+		return nil
+	}
+}
+
+// HandlerStopGrace sets how long handlers stopped by HandlerTimeLimit() or HandlerMemoryLimit() have to return once
+// their context is canceled, after that their tasks are failed and the handlers left running in the background.
+// Defaults to DefaultHandlerStopGrace
+func HandlerStopGrace(grace time.Duration) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if grace < 0 {
+			return fmt.Errorf("handler stop grace may not be negative")
+		}
+
+		opts.handlerStopGrace = grace
+		return nil
+	}
+}
+
+// HandlerGoroutineLeakCheck logs and counts handlers that return while goroutines they started are still running,
+// these are found using profiler labels so this adds some overhead to every handler
+func HandlerGoroutineLeakCheck() ClientOpt {
+	return func(opts *ClientOpts) error {
+		opts.handlerLeakCheck = true
+		return nil
+	}
+}
+
+// TaskAttemptHistory sets how many of the most recent attempts are recorded in Task.Attempts, older attempts are
+// removed. Defaults to DefaultTaskAttemptHistory, 0 disables recording attempts
+func TaskAttemptHistory(attempts int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if attempts < 0 {
+			return fmt.Errorf("task attempt history may not be negative")
+		}
+
+		opts.attemptHistory = attempts
+		return nil
+	}
+}
+
+// WorkerName sets the name recorded in Task.Attempts for tasks handled by this client, defaults to the hostname and
+// process id
+func WorkerName(name string) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if name == "" {
+			return fmt.Errorf("worker name is required")
+		}
+
+		opts.workerName = name
+		return nil
+	}
+}
+
+// WorkerCapabilities declares the capabilities of this client, like having a GPU, tasks created using
+// RequireCapability() are only handled by clients declaring all the capabilities they require. Tasks without
+// requirements are handled by all clients
+func WorkerCapabilities(caps ...string) ClientOpt {
+	return func(opts *ClientOpts) error {
+		for _, c := range caps {
+			if c == "" {
+				return fmt.Errorf("worker capabilities may not be empty")
+			}
+			if !containsString(opts.capabilities, c) {
+				opts.capabilities = append(opts.capabilities, c)
+			}
+		}
+
+		return nil
+	}
+}
+
+// PanicHandler sets a function that will be called whenever a task handler panics, the panic is recovered and the task
+// retried as with any other handler error. r is the value passed to panic()
+func PanicHandler(h func(t *Task, r any)) ClientOpt {
+	return func(opts *ClientOpts) error {
+		opts.panicHandler = h
+		return nil
+	}
+}
+
+// OnTaskDead sets a function that will be called with the final task, including its LastErr, whenever a task handled
+// or enqueued by this client reaches a final state that is not a success: TaskStateExpired, TaskStateTerminated,
+// TaskStateQuarantined or TaskStateUnreachable. The function is called from a single goroutine, started while dead
+// tasks are waiting, so a slow function does not block processing and Drain() waits for it. When more than
+// TaskEventsBufferSize dead tasks are waiting further tasks are dropped and counted in the
+// choria_asyncjobs_task_dead_dropped_total metric
+func OnTaskDead(cb func(t *Task)) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if cb == nil {
+			return fmt.Errorf("dead task callback is required")
+		}
+
+		opts.onTaskDead = cb
+		return nil
+	}
+}
+
+// StreamedResults allows handlers to stream large results into a result store using ResultStream(), results are kept
+// for the TaskRetention() and removed with their tasks. With JetStream results are stored in the CHORIA_AJ_RESULTS
+// Object Store
+func StreamedResults() ClientOpt {
+	return func(opts *ClientOpts) error {
+		opts.streamedResults = true
+		return nil
+	}
+}
+
+// PreProcess sets a hook called for every task received by the client before it is routed to its handler, this can
+// be used to prepare state shared by all handlers like a database transaction
+func PreProcess(h PreProcessFunc) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if h == nil {
+			return fmt.Errorf("pre process hook is required")
+		}
+
+		opts.preProcess = h
+		return nil
+	}
+}
+
+// PostProcess sets a hook called for every task after its handler returned, this can be used to clean up state
+// prepared using PreProcess() or to record metrics
+func PostProcess(h PostProcessFunc) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if h == nil {
+			return fmt.Errorf("post process hook is required")
+		}
+
+		opts.postProcess = h
+		return nil
+	}
+}
+
+// QuarantinePoisonTasks sets tasks that failed failures times in a row with the same error to TaskStateQuarantined
+// rather than retrying them. Errors are the same when they are of the same type with a message that only differs in
+// numbers, see Task.FailureSignature. Quarantined tasks are not retried until replayed using ReplayTaskByID()
+func QuarantinePoisonTasks(failures int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if failures < 1 {
+			return fmt.Errorf("quarantine failures must be at least 1")
+		}
+
+		opts.quarantineFailures = failures
+
+		return nil
+	}
+}
+
+// DependencyFailurePolicy determines what happens to a task when one of its dependencies failed
+type DependencyFailurePolicy string
+
+const (
+	// DependencyFailureUnreachable sets tasks with failed dependencies to TaskStateUnreachable, this is the default
+	DependencyFailureUnreachable DependencyFailurePolicy = "unreachable"
+	// DependencyFailureTerminate sets tasks with failed dependencies to TaskStateTerminated
+	DependencyFailureTerminate DependencyFailurePolicy = "terminate"
+	// DependencyFailureBlock keeps tasks with failed dependencies in TaskStateBlocked, should the failed dependency
+	// be retried successfully the task will be processed.  The task remains subject to the queue limits
+	DependencyFailureBlock DependencyFailurePolicy = "block"
+)
+
+// DependencyFailureHandling configures what happens to tasks whose dependencies failed, defaults to DependencyFailureUnreachable
+func DependencyFailureHandling(p DependencyFailurePolicy) ClientOpt {
+	return func(opts *ClientOpts) error {
+		switch p {
+		case DependencyFailureUnreachable, DependencyFailureTerminate, DependencyFailureBlock:
+			opts.dependencyFailure = p
+		default:
+			return fmt.Errorf("invalid dependency failure policy %q", p)
+		}
+
+		return nil
+	}
+}
+
+// UnroutedTaskPolicy determines what happens to a task when the router has no handler for its type
+type UnroutedTaskPolicy string
+
+const (
+	// UnroutedTaskTerminate sets tasks without a handler to TaskStateTerminated without retrying them, this is the default
+	UnroutedTaskTerminate UnroutedTaskPolicy = "terminate"
+	// UnroutedTaskRetry retries tasks without a handler according to the retry policy, useful when deploying
+	// handlers for new task types while older workers are still running
+	UnroutedTaskRetry UnroutedTaskPolicy = "retry"
+)
+
+// UnroutedTaskHandling configures what happens to tasks the router has no handler for, defaults to UnroutedTaskTerminate.
+// This does not apply when a default handler is registered using HandleDefault()
+func UnroutedTaskHandling(p UnroutedTaskPolicy) ClientOpt {
+	return func(opts *ClientOpts) error {
+		switch p {
+		case UnroutedTaskTerminate, UnroutedTaskRetry:
+			opts.unroutedTasks = p
+		default:
+			return fmt.Errorf("invalid unrouted task policy %q", p)
+		}
+
+		return nil
+	}
+}
+
+// TaskPayloadSchema validates the payload of tasks with exactly the type taskType against the JSON Schema document
+// schema when enqueued, tasks with invalid payloads are not enqueued and fail with ErrTaskPayloadInvalid. Use
+// PayloadSchema() on the router to validate tasks before handling them
+func TaskPayloadSchema(taskType string, schema []byte) ClientOpt {
+	return func(opts *ClientOpts) error {
+		s, err := compilePayloadSchema(taskType, schema)
+		if err != nil {
+			return err
+		}
+
+		if opts.payloadSchemas == nil {
+			opts.payloadSchemas = map[string]*jsonschema.Schema{}
+		}
+		opts.payloadSchemas[taskType] = s
+
+		return nil
+	}
+}
+
+// PayloadCodec encodes the payloads of tasks enqueued by the client using codec rather than JSON, []byte payloads are
+// stored as is and protobuf messages are always encoded in the protobuf wire format. Handlers decode payloads using
+// UnmarshalPayload() which uses the codec of the client handling the task, so all clients using a queue should use
+// the same codec. Features that inspect payloads, like TaskPayloadSchema(), require JSON payloads
+func PayloadCodec(codec Codec) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if codec == nil {
+			return fmt.Errorf("payload codec is required")
+		}
+
+		opts.codec = codec
+
+		return nil
+	}
+}
+
+// CloudEventsEnvelope stores CloudEvents attributes with every task enqueued that does not already have them, using
+// source as event source and the task ID, type and creation time. Handlers receive the payload as before and can
+// access the attributes in the task CloudEvent, use Task.AsCloudEvent() to create the full event
+func CloudEventsEnvelope(source string) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if source == "" {
+			return fmt.Errorf("cloud events source is required")
+		}
+
+		opts.cloudEventsSource = source
+
+		return nil
+	}
+}
+
+// OversizedResultPolicy determines what is stored for a task whose handler returned a result larger than MaxResultSize()
+type OversizedResultPolicy string
+
+const (
+	// OversizedResultReject discards the result of the handler, this is the default
+	OversizedResultReject OversizedResultPolicy = "reject"
+	// OversizedResultTruncate stores the JSON encoded result truncated to the maximum size as a string
+	OversizedResultTruncate OversizedResultPolicy = "truncate"
+)
+
+// MaxResultSize limits the size in bytes of the JSON encoded results handlers return, tasks with larger results are
+// terminated with ErrTaskResultTooLarge as their last error and the result is handled according to policy
+func MaxResultSize(size int, policy OversizedResultPolicy) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if size < 1 {
+			return fmt.Errorf("maximum result size must be at least 1 byte")
+		}
+
+		switch policy {
+		case OversizedResultReject, OversizedResultTruncate:
+			opts.oversizedResults = policy
+		default:
+			return fmt.Errorf("invalid oversized result policy %q", policy)
+		}
+
+		opts.maxResultSize = size
+
+		return nil
+	}
+}
+
+// MaxPayloadSize limits the size in bytes of task payloads, as encoded by the client Codec, that can be enqueued or set
+// using UpdateTask(). Larger payloads fail with ErrTaskPayloadTooLarge before anything is published. Defaults to half
+// the max_payload of the connected NATS server, leaving room for the rest of the task, or DefaultMaxPayloadSize
+func MaxPayloadSize(size int) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if size < 1 {
+			return fmt.Errorf("maximum payload size must be at least 1 byte")
+		}
+
+		opts.maxPayloadSize = size
+
+		return nil
+	}
+}
+
+// DeadLetterQueue stores a copy of tasks that reach TaskStateTerminated or TaskStateExpired in the named queue, the
+// queue will be created if it does not exist. Tasks can be replayed into their original queue using ReplayDeadLetter()
+func DeadLetterQueue(name string) ClientOpt {
+	return func(opts *ClientOpts) error {
+		if !IsValidName(name) {
+			return fmt.Errorf("invalid dead letter queue name %q", name)
+		}
+
+		opts.deadLetterQueue = &Queue{Name: name}
+		return nil
+	}
+}
+
 // TaskSigningKey sets a key used to sign tasks, will be kept in memory for the duration
 func TaskSigningKey(pk ed25519.PrivateKey) ClientOpt {
 	return func(opts *ClientOpts) error {
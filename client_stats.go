@@ -0,0 +1,329 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ClientStatsTaskStatesInterval is how long task counts per state gathered by Client.Stats are reused before the
+// task store is scanned again
+var ClientStatsTaskStatesInterval = 30 * time.Second
+
+// ClientStats is aggregate information about queues, tasks and the processing done by a client
+type ClientStats struct {
+	// Time is when the information was gathered
+	Time time.Time `json:"time"`
+	// Queues is information about every known queue
+	Queues []QueueStats `json:"queues"`
+	// TaskStates is the number of tasks in the task store per state
+	TaskStates map[TaskState]uint64 `json:"task_states"`
+	// TaskStatesTime is when TaskStates were gathered, they are cached for ClientStatsTaskStatesInterval
+	TaskStatesTime time.Time `json:"task_states_time"`
+	// Concurrency is the maximum number of tasks this client handles concurrently
+	Concurrency int `json:"concurrency"`
+	// InFlight is the number of tasks currently being handled by this client
+	InFlight int `json:"in_flight"`
+	// Processed is the number of tasks that completed successfully since the client started
+	Processed uint64 `json:"processed"`
+	// Failed is the number of tasks that were terminated, expired or became unreachable since the client started
+	Failed uint64 `json:"failed"`
+}
+
+// QueueStats is information about the work items in a queue
+type QueueStats struct {
+	// Name is the name of the queue
+	Name string `json:"name"`
+	// Depth is the number of items in the queue, including those being handled
+	Depth uint64 `json:"depth"`
+	// Pending is the number of items not yet delivered to any handler
+	Pending uint64 `json:"pending"`
+	// InFlight is the number of items delivered to handlers that are not yet acknowledged
+	InFlight int `json:"in_flight"`
+	// OldestItemAge is the age of the oldest item in the queue, zero when the queue is empty
+	OldestItemAge time.Duration `json:"oldest_item_age"`
+	// OldestPendingAge is the age of the oldest item not yet delivered to any handler, zero when none are pending.
+	// This approximates how far processing lags behind
+	OldestPendingAge time.Duration `json:"oldest_pending_age"`
+	// LastDelivered is the stream sequence of the item most recently delivered to a handler, JetStream storage only
+	LastDelivered uint64 `json:"last_delivered,omitempty"`
+	// AckFloor is the stream sequence up to which all delivered items were acknowledged, JetStream storage only
+	AckFloor uint64 `json:"ack_floor,omitempty"`
+	// Paused indicates the queue was paused using PauseQueue
+	Paused bool `json:"paused"`
+}
+
+// QueueDescription describes a queue, its settings and how many items it holds
+type QueueDescription struct {
+	// Name is the name of the queue
+	Name string `json:"name"`
+	// MaxRunTime is the maximum time a task can be processed
+	MaxRunTime time.Duration `json:"max_runtime"`
+	// MaxTries is the maximum amount of times an item is delivered, -1 for unlimited
+	MaxTries int `json:"max_tries"`
+	// MaxConcurrent is the total number of in-flight tasks across all clients
+	MaxConcurrent int `json:"max_concurrent"`
+	// MaxAge is the longest time an item can stay in the queue, zero for no limit
+	MaxAge time.Duration `json:"max_age"`
+	// MaxEntries is the maximum amount of items in the queue, zero for no limit
+	MaxEntries int `json:"max_entries"`
+	// DiscardOld indicates old items are discarded when the queue is full rather than new ones rejected
+	DiscardOld bool `json:"discard_old"`
+	// PrioritySupport indicates the queue delivers tasks with higher priorities first
+	PrioritySupport bool `json:"priority_support"`
+	// Depth is the number of items in the queue, including those being handled
+	Depth uint64 `json:"depth"`
+	// Paused indicates the queue was paused using PauseQueue
+	Paused bool `json:"paused"`
+}
+
+// QueueStatsProvider is implemented by storage that can report QueueStats, Client.Stats() reports no queues and
+// Client.QueueStats() fails with ErrStorageNotReady for storage that does not implement it
+type QueueStatsProvider interface {
+	// QueueStats is information about every queue in the storage
+	QueueStats(ctx context.Context) ([]QueueStats, error)
+	// QueueStatsByName is information about the queue name, ErrQueueNotFound when it does not exist
+	QueueStatsByName(ctx context.Context, name string) (QueueStats, error)
+}
+
+// QueueDescriber is implemented by storage that can describe its queues, Client.Queues() fails with
+// ErrStorageNotReady for storage that does not implement it
+type QueueDescriber interface {
+	// DescribeQueues describes every queue in the storage sorted by name
+	DescribeQueues(ctx context.Context) ([]QueueDescription, error)
+}
+
+func newQueueDescription(q *Queue, stats QueueStats) QueueDescription {
+	return QueueDescription{
+		Name:            q.Name,
+		MaxRunTime:      q.MaxRunTime,
+		MaxTries:        q.MaxTries,
+		MaxConcurrent:   q.MaxConcurrent,
+		MaxAge:          q.MaxAge,
+		MaxEntries:      q.MaxEntries,
+		DiscardOld:      q.DiscardOld,
+		PrioritySupport: q.PrioritySupport,
+		Depth:           stats.Depth,
+		Paused:          stats.Paused,
+	}
+}
+
+// Queues describes every queue in the storage with its settings, depth and if it is paused, sorted by name
+func (c *Client) Queues(ctx context.Context) ([]QueueDescription, error) {
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	qd, ok := c.storage.(QueueDescriber)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage does not support describing queues", ErrStorageNotReady)
+	}
+
+	return qd.DescribeQueues(ctx)
+}
+
+type clientTaskStatesCache struct {
+	states map[TaskState]uint64
+	time   time.Time
+}
+
+// Stats gathers aggregate information about all queues, task counts per state and the tasks processed by this client
+// since it started. Counting tasks per state requires scanning the task store so these counts are cached for
+// ClientStatsTaskStatesInterval, other information is gathered on every call.
+func (c *Client) Stats(ctx context.Context) (ClientStats, error) {
+	if ctx.Err() != nil {
+		return ClientStats{}, ctx.Err()
+	}
+
+	stats := ClientStats{
+		Time:        c.opts.clock.Now().UTC(),
+		Concurrency: c.opts.concurrency,
+		InFlight:    c.InFlightTasks(),
+		Processed:   c.processed.Load(),
+		Failed:      c.failed.Load(),
+		Queues:      []QueueStats{},
+	}
+
+	if qs, ok := c.storage.(QueueStatsProvider); ok {
+		queues, err := qs.QueueStats(ctx)
+		if err != nil {
+			return ClientStats{}, err
+		}
+		stats.Queues = append(stats.Queues, queues...)
+	}
+
+	states, statesTime, err := c.taskStates(ctx)
+	if err != nil {
+		return ClientStats{}, err
+	}
+	stats.TaskStates = states
+	stats.TaskStatesTime = statesTime
+
+	return stats, nil
+}
+
+// QueueStats gathers information about the work items in the queue name, unlike Stats() the task store is not
+// scanned so it is cheap enough to be called frequently, for example to scale processing based on queue depth
+func (c *Client) QueueStats(ctx context.Context, name string) (QueueStats, error) {
+	if ctx.Err() != nil {
+		return QueueStats{}, ctx.Err()
+	}
+
+	qs, ok := c.storage.(QueueStatsProvider)
+	if !ok {
+		return QueueStats{}, fmt.Errorf("%w: storage does not support queue statistics", ErrStorageNotReady)
+	}
+
+	return qs.QueueStatsByName(ctx, name)
+}
+
+// QueueStats is information about every queue in the storage
+func (s *jetStreamStorage) QueueStats(ctx context.Context) ([]QueueStats, error) {
+	queues, err := s.Queues()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]QueueStats, 0, len(queues))
+	for _, nfo := range queues {
+		stats = append(stats, s.newQueueStats(ctx, nfo))
+	}
+
+	return stats, nil
+}
+
+// DescribeQueues describes every queue in the storage
+func (s *jetStreamStorage) DescribeQueues(ctx context.Context) ([]QueueDescription, error) {
+	queues, err := s.ListWorkQueues()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]QueueDescription, 0, len(queues))
+	for _, q := range queues {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		nfo, err := s.QueueInfo(q.Name)
+		if errors.Is(err, ErrQueueNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, newQueueDescription(q, newQueueStats(nfo)))
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res, nil
+}
+
+// QueueStatsByName is information about the queue name
+func (s *jetStreamStorage) QueueStatsByName(ctx context.Context, name string) (QueueStats, error) {
+	nfo, err := s.QueueInfo(name)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	return s.newQueueStats(ctx, nfo), nil
+}
+
+func (s *jetStreamStorage) newQueueStats(ctx context.Context, nfo *QueueInfo) QueueStats {
+	qs := newQueueStats(nfo)
+
+	if qs.Pending > 0 && nfo.Stream != nil {
+		filter := nfo.Consumer.Config.FilterSubject
+		if filter == "" && len(nfo.Stream.Config.Subjects) > 0 {
+			filter = nfo.Stream.Config.Subjects[0]
+		}
+
+		enqueued, ok := s.oldestItemAfter(ctx, nfo.Stream.Config.Name, filter, nfo.Consumer.Delivered.Stream)
+		if ok {
+			qs.OldestPendingAge = nfo.Time.Sub(enqueued)
+		}
+	}
+
+	return qs
+}
+
+func newQueueStats(nfo *QueueInfo) QueueStats {
+	qs := QueueStats{
+		Name:   nfo.Name,
+		Paused: nfo.Paused,
+	}
+
+	if nfo.Stream != nil {
+		qs.Depth = nfo.Stream.State.Msgs
+		if qs.Depth > 0 && !nfo.Stream.State.FirstTime.IsZero() {
+			qs.OldestItemAge = nfo.Time.Sub(nfo.Stream.State.FirstTime)
+		}
+	}
+
+	if nfo.Consumer != nil {
+		qs.Pending = nfo.Consumer.NumPending
+		qs.InFlight = nfo.Consumer.NumAckPending
+		qs.LastDelivered = nfo.Consumer.Delivered.Stream
+		qs.AckFloor = nfo.Consumer.AckFloor.Stream
+	}
+
+	return qs
+}
+
+func (c *Client) taskStates(ctx context.Context) (map[TaskState]uint64, time.Time, error) {
+	c.mu.Lock()
+	cache := c.statesCache
+	c.mu.Unlock()
+
+	if cache != nil && c.opts.clock.Now().Sub(cache.time) < ClientStatsTaskStatesInterval {
+		return copyTaskStates(cache.states), cache.time, nil
+	}
+
+	started := c.opts.clock.Now().UTC()
+	tasks, err := c.storage.ListTasks(ctx, TaskFilter{})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer tasks.Close()
+
+	states := make(map[TaskState]uint64)
+	for tasks.Next() {
+		states[tasks.Task().State]++
+	}
+	if tasks.Err() != nil {
+		return nil, time.Time{}, tasks.Err()
+	}
+
+	c.mu.Lock()
+	c.statesCache = &clientTaskStatesCache{states: states, time: started}
+	c.mu.Unlock()
+
+	return copyTaskStates(states), started, nil
+}
+
+// recordProcessingStats updates the processed and failed counts reported by Stats
+func (c *Client) recordProcessingStats(task *Task) {
+	switch task.State {
+	case TaskStateCompleted:
+		c.processed.Add(1)
+	case TaskStateTerminated, TaskStateExpired, TaskStateUnreachable, TaskStateQuarantined:
+		c.failed.Add(1)
+	}
+}
+
+func copyTaskStates(states map[TaskState]uint64) map[TaskState]uint64 {
+	res := make(map[TaskState]uint64, len(states))
+	for k, v := range states {
+		res[k] = v
+	}
+
+	return res
+}
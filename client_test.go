@@ -8,8 +8,10 @@ import (
 	"context"
 	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -141,6 +143,36 @@ var _ = Describe("Client", func() {
 		})
 	})
 
+	Describe("ValidateClientOptions", func() {
+		It("Should report every problem found at once", func() {
+			opts := []ClientOpt{
+				DiscardTaskStates(TaskStateNew),
+				WorkQueue(&Queue{Name: "ginkgo", AckWait: -1}),
+				FetchBatchSize(0),
+				WorkQueueWeights(map[string]int{"other": 1}),
+			}
+
+			err := ValidateClientOptions(opts...)
+			Expect(err).To(MatchError(ErrInvalidClientOptions))
+			Expect(err).To(MatchError(ErrQueueInvalidSettings))
+			Expect(err).To(MatchError("invalid client options: only states completed, expired or terminated can be discarded; fetch batch size must be at least 1; weight set for queue other that is not bound using BindWorkQueues; invalid queue settings: queue ginkgo ack wait can not be negative"))
+
+			var oerr *ClientOptionsError
+			Expect(errors.As(err, &oerr)).To(BeTrue())
+			Expect(oerr.Errors).To(HaveLen(4))
+
+			_, err = NewClient(append(opts, StorageBackend(NewInMemoryStorage()))...)
+			Expect(err).To(Equal(oerr))
+
+			// single problems are reported as is
+			_, err = NewClient(FetchBatchSize(0))
+			Expect(err).To(MatchError("fetch batch size must be at least 1"))
+
+			// contexts are not connected to
+			Expect(ValidateClientOptions(NatsContext("unknown"), ClientConcurrency(2))).To(Succeed())
+		})
+	})
+
 	Describe("DiscardTaskStatesByName", func() {
 		It("Should correctly parse state names", func() {
 			opts := &ClientOpts{}
@@ -148,48 +180,1705 @@ var _ = Describe("Client", func() {
 			Expect(opts.discard).To(HaveLen(1))
 			Expect(opts.discard[0]).To(Equal(TaskStateCompleted))
 
-			opts = &ClientOpts{}
-			Expect(DiscardTaskStatesByName("completed")(opts)).ToNot(HaveOccurred())
-			Expect(opts.discard).To(HaveLen(1))
-			Expect(opts.discard[0]).To(Equal(TaskStateCompleted))
+			opts = &ClientOpts{}
+			Expect(DiscardTaskStatesByName("completed")(opts)).ToNot(HaveOccurred())
+			Expect(opts.discard).To(HaveLen(1))
+			Expect(opts.discard[0]).To(Equal(TaskStateCompleted))
+		})
+	})
+
+	Describe("shouldDiscardTask", func() {
+		It("Should correctly detect task states", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				_, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateActive))
+				Expect(err).To(MatchError("only states completed, expired or terminated can be discarded"))
+
+				client, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateCompleted))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.shouldDiscardTask(&Task{State: TaskStateActive})).To(BeFalse())
+				Expect(client.shouldDiscardTask(&Task{State: TaskStateExpired})).To(BeTrue())
+				Expect(client.shouldDiscardTask(&Task{State: TaskStateCompleted})).To(BeTrue())
+			})
+		})
+	})
+
+	Describe("saveOrDiscardTaskIfDesired", func() {
+		It("Should delete the correct tasks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateCompleted))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("x", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).ToNot(HaveOccurred())
+
+				Expect(client.saveOrDiscardTaskIfDesired(context.Background(), task)).ToNot(HaveOccurred())
+				_, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+
+				task.State = TaskStateExpired
+				Expect(client.saveOrDiscardTaskIfDesired(context.Background(), task)).ToNot(HaveOccurred())
+				_, err = client.LoadTaskByID(task.ID)
+				Expect(err).To(Equal(ErrTaskNotFound))
+			})
+		})
+	})
+
+	Describe("handleTaskError", func() {
+		It("Should not retry tasks past their deadline", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("x", nil, TaskDeadline(time.Now().Add(time.Hour)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).ToNot(HaveOccurred())
+
+				task.Tries = 1
+				Expect(client.handleTaskError(context.Background(), task, fmt.Errorf("simulated"))).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateRetry))
+
+				deadline := time.Now().Add(-time.Second)
+				task.Deadline = &deadline
+				task.Tries = 2
+				Expect(client.handleTaskError(context.Background(), task, fmt.Errorf("simulated"))).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+			})
+		})
+	})
+
+	Describe("TaskPayloadSchema", func() {
+		It("Should only enqueue tasks with valid payloads", func() {
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), TaskPayloadSchema("email", []byte(`{"type":"x"}`)))
+			Expect(err).To(MatchError(ErrInvalidPayloadSchema))
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), TaskPayloadSchema("email", []byte(`{"type":"string"}`)))
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err := NewTask("email", 1)
+			Expect(err).ToNot(HaveOccurred())
+			err = client.EnqueueTask(context.Background(), task)
+			Expect(err).To(MatchError(ErrTaskPayloadInvalid))
+			Expect(err.Error()).To(ContainSubstring("expected string, but got number"))
+			_, err = client.LoadTaskByID(task.ID)
+			Expect(err).To(MatchError(ErrTaskNotFound))
+
+			task, err = NewTask("email", "ginkgo@example.net")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+
+			task, err = NewTask("other", 1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+		})
+	})
+
+	Describe("ReplayTaskByID", func() {
+		It("Should enqueue failed tasks with their tries reset", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				var fail atomic.Bool
+				fail.Store(true)
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					if fail.Load() {
+						return nil, ErrTerminateTask
+					}
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueAndWait(ctx, task)
+				Expect(err).To(MatchError(ErrTaskFailed))
+
+				other, err := NewTask("ginkgo", nil, TaskScheduledIn(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, other)).To(Succeed())
+				Expect(client.ReplayTaskByID(ctx, other.ID)).To(MatchError(ErrTaskTypeCannotEnqueue))
+
+				fail.Store(false)
+				Expect(client.ReplayTaskByID(ctx, task.ID)).To(Succeed())
+
+				Eventually(func() TaskState {
+					task, err = client.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					return task.State
+				}).Should(Equal(TaskStateCompleted))
+				Expect(task.Tries).To(Equal(1))
+				Expect(task.LastErr).To(BeEmpty())
+			})
+		})
+	})
+
+	Describe("CancelTasks", func() {
+		It("Should terminate waiting tasks and leave active ones", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.setupStreams()).To(Succeed())
+				Expect(client.setupQueues()).To(Succeed())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				var tasks []*Task
+				for i := 0; i < 4; i++ {
+					tenant := "acme"
+					if i == 3 {
+						tenant = "other"
+					}
+					task, err := NewTask("ginkgo", nil, TaskTags(map[string]string{"tenant": tenant}))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					tasks = append(tasks, task)
+				}
+				Expect(client.setTaskActive(ctx, tasks[0])).To(Succeed())
+
+				canceled, err := client.CancelTasks(ctx, TaskFilter{States: []TaskState{TaskStateRetry}, Tags: map[string]string{"tenant": "acme"}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(canceled).To(Equal(0))
+
+				canceled, err = client.CancelTasks(ctx, TaskFilter{Tags: map[string]string{"tenant": "acme"}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(canceled).To(Equal(2))
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				Eventually(func() TaskState {
+					task, err := client.LoadTaskByID(tasks[3].ID)
+					Expect(err).ToNot(HaveOccurred())
+					return task.State
+				}).Should(Equal(TaskStateCompleted))
+
+				for i, state := range []TaskState{TaskStateActive, TaskStateTerminated, TaskStateTerminated} {
+					task, err := client.LoadTaskByID(tasks[i].ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(task.State).To(Equal(state))
+					if state == TaskStateTerminated {
+						Expect(task.LastErr).To(Equal("task canceled"))
+						Expect(task.Tries).To(Equal(0))
+					}
+				}
+			})
+		})
+
+		It("Should reject stale updates with ErrConflict and retry them", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.setupStreams()).To(Succeed())
+				Expect(client.setupQueues()).To(Succeed())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.Revision()).To(BeZero())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				Expect(task.Revision()).ToNot(BeZero())
+
+				stale, err := client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stale.Revision()).To(Equal(task.Revision()))
+
+				// a worker starting the task while it is being canceled
+				Expect(client.setTaskActive(ctx, task)).To(Succeed())
+				Expect(task.Revision()).To(BeNumerically(">", stale.Revision()))
+				stale.State = TaskStateTerminated
+				Expect(client.storage.SaveTaskState(ctx, stale, false)).To(MatchError(ErrConflict))
+				Expect(client.storage.SaveTaskState(ctx, stale, false)).To(MatchError(ErrTaskUpdateFailed))
+
+				tries := 0
+				updated, err := client.modifyTask(ctx, task.ID, false, func(t *Task) (bool, error) {
+					tries++
+					if tries == 1 {
+						loaded, err := client.LoadTaskByID(t.ID)
+						Expect(err).ToNot(HaveOccurred())
+						loaded.Tries = 10
+						Expect(client.storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+					}
+					t.LastErr = "ginkgo"
+					return true, nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(updated).To(BeTrue())
+				Expect(tries).To(Equal(2))
+
+				loaded, err := client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Tries).To(Equal(10))
+				Expect(loaded.LastErr).To(Equal("ginkgo"))
+
+				_, err = client.modifyTask(ctx, task.ID, false, func(t *Task) (bool, error) {
+					loaded, err := client.LoadTaskByID(t.ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+					return true, nil
+				})
+				Expect(err).To(MatchError(ErrConflict))
+
+				canceled, err := client.CancelTasks(ctx, TaskFilter{})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(canceled).To(BeZero())
+			})
+		})
+	})
+
+	Describe("UpdateTask", func() {
+		It("Should only update the payload of waiting tasks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), TaskPayloadSchema("ginkgo", []byte(`{"type":"object","required":["to"]}`)))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.setupStreams()).To(Succeed())
+				Expect(client.setupQueues()).To(Succeed())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				task, err := NewTask("ginkgo", map[string]string{"to": "1"})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+				Expect(client.UpdateTask(ctx, task.ID, map[string]string{"to": "2"})).To(Succeed())
+				Expect(client.UpdateTask(ctx, task.ID, map[string]string{})).To(MatchError(ErrTaskPayloadInvalid))
+				Expect(client.UpdateTask(ctx, "unknown", nil)).To(MatchError(ErrTaskNotFound))
+
+				updated, err := client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(updated.Payload).To(MatchJSON(`{"to":"2"}`))
+				Expect(updated.State).To(Equal(TaskStateNew))
+
+				// a worker that loaded the task before the update can not start it
+				Expect(client.setTaskActive(ctx, task)).ToNot(Succeed())
+
+				Expect(client.setTaskActive(ctx, updated)).To(Succeed())
+				Expect(client.UpdateTask(ctx, task.ID, map[string]string{"to": "3"})).To(MatchError(ErrTaskInFlight))
+
+				Expect(client.setTaskSuccess(ctx, updated, nil)).To(Succeed())
+				Expect(client.UpdateTask(ctx, task.ID, map[string]string{"to": "3"})).To(MatchError(ErrTaskNotWaiting))
+			})
+		})
+	})
+
+	Describe("DiscardOld", func() {
+		It("Should expire tasks discarded from full queues", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: "FULL", MaxEntries: 2, DiscardOld: true}))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.setupStreams()).To(Succeed())
+				Expect(client.setupQueues()).To(Succeed())
+
+				events := client.Events()
+
+				var tasks []*Task
+				for i := 0; i < 3; i++ {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+					tasks = append(tasks, task)
+				}
+
+				oldest, err := client.LoadTaskByID(tasks[0].ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(oldest.State).To(Equal(TaskStateExpired))
+				Expect(oldest.LastErr).To(Equal("discarded from full queue FULL"))
+
+				for _, task := range tasks[1:] {
+					task, err = client.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(task.State).To(Equal(TaskStateNew))
+				}
+
+				var expired []string
+				for len(events) > 0 {
+					e := <-events
+					if e.State == TaskStateExpired {
+						expired = append(expired, e.TaskID)
+					}
+				}
+				Expect(expired).To(Equal([]string{tasks[0].ID}))
+
+				nfo, err := client.StorageAdmin().QueueInfo("FULL")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(2)))
+			})
+		})
+	})
+
+	Describe("EnqueueTasks", func() {
+		It("Should enqueue all tasks and report individual failures", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				var tasks []*Task
+				for i := 0; i < 250; i++ {
+					task, err := NewTask("x", i)
+					Expect(err).ToNot(HaveOccurred())
+					tasks = append(tasks, task)
+				}
+				tasks[10].State = TaskStateCompleted
+
+				stored, errs := client.EnqueueTasks(context.Background(), tasks)
+				Expect(stored).To(Equal(249))
+				Expect(errs).To(HaveLen(250))
+
+				for i, err := range errs {
+					if i == 10 {
+						Expect(err).To(MatchError(ErrTaskTypeCannotEnqueue))
+						continue
+					}
+
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				nfo, err := client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(249)))
+			})
+		})
+
+		It("Should not enqueue tasks after the context is canceled", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("x", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+
+				stored, errs := client.EnqueueTasks(ctx, []*Task{task})
+				Expect(stored).To(Equal(0))
+				Expect(errs[0]).To(MatchError(context.Canceled))
+
+				_, err = client.LoadTaskByID(task.ID)
+				Expect(err).To(MatchError(ErrTaskNotFound))
+			})
+		})
+	})
+
+	Describe("EnqueueRateLimit", func() {
+		It("Should limit the enqueue rate", func() {
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), EnqueueRateLimit(0, time.Second, 1))
+			Expect(err).To(MatchError(ErrInvalidRateLimit))
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), EnqueueRateLimit(10, 100*time.Millisecond, 5))
+			Expect(err).ToNot(HaveOccurred())
+
+			var tasks []*Task
+			for i := 0; i < 15; i++ {
+				task, err := NewTask("x", i)
+				Expect(err).ToNot(HaveOccurred())
+				tasks = append(tasks, task)
+			}
+
+			// the burst is allowed after which 10 tasks take 100ms
+			start := time.Now()
+			stored, errs := client.EnqueueTasks(context.Background(), tasks)
+			Expect(stored).To(Equal(15))
+			Expect(errs).To(HaveEach(BeNil()))
+			Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+
+			// waits that would exceed the deadline fail right away
+			rctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+			defer cancel()
+			task, err := NewTask("x", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(rctx, task)).To(MatchError(ErrEnqueueRateLimited))
+			_, err = client.LoadTaskByID(task.ID)
+			Expect(err).To(MatchError(ErrTaskNotFound))
+
+			cctx, ccancel := context.WithCancel(context.Background())
+			ccancel()
+			Expect(client.EnqueueTask(cctx, task)).To(MatchError(context.Canceled))
+
+			Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+		})
+	})
+
+	Describe("Events", func() {
+		It("Should report task state changes", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				events := client.Events()
+				Expect(cap(events)).To(Equal(TaskEventsBufferSize))
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					return "done", nil
+				})
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go client.Run(ctx, router)
+
+				var transitions []string
+				for len(transitions) < 3 {
+					select {
+					case e := <-events:
+						Expect(e.TaskID).To(Equal(task.ID))
+						Expect(e.TaskType).To(Equal("ginkgo"))
+						Expect(e.TimeStamp).To(BeTemporally("~", time.Now(), time.Second))
+						transitions = append(transitions, fmt.Sprintf("%s>%s:%d", e.PreviousState, e.State, e.Tries))
+					case <-time.After(2 * time.Second):
+						Fail("timeout waiting for events")
+					}
+				}
+
+				Expect(transitions).To(Equal([]string{">new:0", "new>active:0", "active>complete:1"}))
+			})
+		})
+
+		It("Should drop events when the channel is full", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				// not recorded before Events() is called
+				client.notifyTaskEvent(task, TaskStateUnknown)
+				events := client.Events()
+				Expect(events).To(BeEmpty())
+
+				for i := 0; i < TaskEventsBufferSize+10; i++ {
+					client.notifyTaskEvent(task, TaskStateUnknown)
+				}
+
+				Expect(events).To(HaveLen(TaskEventsBufferSize))
+			})
+		})
+	})
+
+	Describe("TaskID", func() {
+		It("Should reject duplicate IDs unless replacing", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				task, err := NewTask("ginkgo", "first", TaskID("order:1"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+				task, err = NewTask("ginkgo", "second", TaskID("order:1"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(MatchError(ErrTaskAlreadyExists))
+
+				task, err = NewTask("ginkgo", "third", TaskID("order:1"), TaskReplaceExisting())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+				task, err = client.LoadTaskByID("order:1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.Payload).To(MatchJSON(`"third"`))
+				Expect(task.State).To(Equal(TaskStateNew))
+
+				// the work item of the replaced task is replaced as well
+				nfo, err := client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(1)))
+			})
+		})
+	})
+
+	Describe("EnqueueTaskIfAbsent", func() {
+		It("Should create the task only once", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), DedupWindow(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				var created int32
+				wg := sync.WaitGroup{}
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						task, err := NewTask("ginkgo", i, TaskID("order:1"))
+						Expect(err).ToNot(HaveOccurred())
+
+						ok, err := client.EnqueueTaskIfAbsent(ctx, task)
+						Expect(err).ToNot(HaveOccurred())
+						if ok {
+							atomic.AddInt32(&created, 1)
+						}
+					}(i)
+				}
+				wg.Wait()
+
+				Expect(created).To(Equal(int32(1)))
+
+				nfo, err := client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(1)))
+
+				// retrying a task holding a deduplication key finds the existing task
+				task, err := NewTask("ginkgo", nil, TaskID("order:2"), TaskDeduplicationKey("order:2"))
+				Expect(err).ToNot(HaveOccurred())
+				ok, err := client.EnqueueTaskIfAbsent(ctx, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+
+				task, err = NewTask("ginkgo", nil, TaskID("order:2"), TaskDeduplicationKey("order:2"))
+				Expect(err).ToNot(HaveOccurred())
+				ok, err = client.EnqueueTaskIfAbsent(ctx, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeFalse())
+
+				task, err = NewTask("ginkgo", nil, TaskID("order:1"), TaskReplaceExisting())
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueTaskIfAbsent(ctx, task)
+				Expect(err).To(MatchError("tasks replacing existing tasks cannot be enqueued if absent"))
+			})
+		})
+	})
+
+	Describe("EnqueueIfNotPending", func() {
+		It("Should enqueue only one pending task per key", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), DedupWindow(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				var enqueued []string
+				ids := make([]string, 10)
+				mu := sync.Mutex{}
+				wg := sync.WaitGroup{}
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						task, err := NewTask("reconcile", nil)
+						Expect(err).ToNot(HaveOccurred())
+
+						id, ok, err := client.EnqueueIfNotPending(ctx, task, "cluster:1")
+						Expect(err).ToNot(HaveOccurred())
+
+						mu.Lock()
+						ids[i] = id
+						if ok {
+							enqueued = append(enqueued, task.ID)
+						}
+						mu.Unlock()
+					}(i)
+				}
+				wg.Wait()
+
+				Expect(enqueued).To(HaveLen(1))
+				for _, id := range ids {
+					Expect(id).To(Equal(enqueued[0]))
+				}
+
+				nfo, err := client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(1)))
+				tasks, err := client.StorageAdmin().TasksInfo()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tasks.Stream.State.Msgs).To(Equal(uint64(1)))
+
+				// other types do not match
+				task, err := NewTask("report", nil)
+				Expect(err).ToNot(HaveOccurred())
+				id, ok, err := client.EnqueueIfNotPending(ctx, task, "cluster:1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+				Expect(id).To(Equal(task.ID))
+
+				_, _, err = client.EnqueueIfNotPending(ctx, task, "")
+				Expect(err).To(MatchError("a key to match pending tasks is required"))
+			})
+		})
+
+		It("Should enqueue again once the pending task is final", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), DedupWindow(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			first, err := NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			id, ok, err := client.EnqueueIfNotPending(ctx, first, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal(first.ID))
+
+			// enqueueing the pending task again finds itself
+			id, ok, err = client.EnqueueIfNotPending(ctx, first, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(id).To(Equal(first.ID))
+			_, err = client.LoadTaskByID(first.ID)
+			Expect(err).ToNot(HaveOccurred())
+
+			second, err := NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			id, ok, err = client.EnqueueIfNotPending(ctx, second, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(id).To(Equal(first.ID))
+			_, err = client.LoadTaskByID(second.ID)
+			Expect(err).To(MatchError(ErrTaskNotFound))
+
+			first, err = client.LoadTaskByID(first.ID)
+			Expect(err).ToNot(HaveOccurred())
+			first.State = TaskStateTerminated
+			Expect(client.storage.SaveTaskState(ctx, first, false)).To(Succeed())
+
+			second, err = NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			id, ok, err = client.EnqueueIfNotPending(ctx, second, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal(second.ID))
+		})
+
+		It("Should keep claims of tasks pending longer than the deduplication window", func() {
+			clock := newFakeClock()
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), DedupWindow(time.Minute), withClock(clock))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			first, err := NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, ok, err := client.EnqueueIfNotPending(ctx, first, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+
+			clock.Advance(time.Hour)
+
+			second, err := NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			id, ok, err := client.EnqueueIfNotPending(ctx, second, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeFalse())
+			Expect(id).To(Equal(first.ID))
+
+			first, err = client.LoadTaskByID(first.ID)
+			Expect(err).ToNot(HaveOccurred())
+			first.State = TaskStateCompleted
+			Expect(client.storage.SaveTaskState(ctx, first, false)).To(Succeed())
+			Expect(client.storage.(*InMemoryStorage).pending).To(BeEmpty())
+
+			second, err = NewTask("reconcile", nil)
+			Expect(err).ToNot(HaveOccurred())
+			id, ok, err = client.EnqueueIfNotPending(ctx, second, "cluster:1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(id).To(Equal(second.ID))
+		})
+
+		It("Should keep claims in JetStream until the pending task is final", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), DedupWindow(time.Second))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				first, err := NewTask("reconcile", nil)
+				Expect(err).ToNot(HaveOccurred())
+				_, ok, err := client.EnqueueIfNotPending(ctx, first, "cluster:1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+
+				time.Sleep(1500 * time.Millisecond)
+
+				second, err := NewTask("reconcile", nil)
+				Expect(err).ToNot(HaveOccurred())
+				id, ok, err := client.EnqueueIfNotPending(ctx, second, "cluster:1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeFalse())
+				Expect(id).To(Equal(first.ID))
+
+				first, err = client.LoadTaskByID(first.ID)
+				Expect(err).ToNot(HaveOccurred())
+				first.State = TaskStateExpired
+				Expect(client.storage.SaveTaskState(ctx, first, false)).To(Succeed())
+
+				pending := client.storage.(*jetStreamStorage).pending
+				_, err = pending.Get(deduplicationBucketKey(first.DeduplicationKey))
+				Expect(err).To(MatchError(nats.ErrKeyNotFound))
+
+				second, err = NewTask("reconcile", nil)
+				Expect(err).ToNot(HaveOccurred())
+				id, ok, err = client.EnqueueIfNotPending(ctx, second, "cluster:1")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ok).To(BeTrue())
+				Expect(id).To(Equal(second.ID))
+			})
+		})
+	})
+
+	Describe("AutoCreateQueue", func() {
+		It("Should create missing queues using the template", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				_, err := NewClient(NatsConn(nc), BindWorkQueue("BOUND"))
+				Expect(err).To(MatchError(ErrQueueNotFound))
+
+				client, err := NewClient(NatsConn(nc), BindWorkQueue("BOUND"), AutoCreateQueue(true), QueueTemplate(&Queue{MaxTries: 5, MaxRunTime: time.Hour}))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.opts.queue.MaxTries).To(Equal(5))
+
+				nfo, err := client.StorageAdmin().QueueInfo("BOUND")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Consumer.Config.AckWait).To(Equal(time.Hour))
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				// many producers enqueueing into a new queue at the same time
+				var producers []*Client
+				for i := 0; i < 10; i++ {
+					producer, err := NewClient(NatsConn(nc), AutoCreateQueue(true), QueueTemplate(&Queue{MaxTries: 5, MaxRunTime: time.Hour}))
+					Expect(err).ToNot(HaveOccurred())
+					producers = append(producers, producer)
+				}
+
+				wg := sync.WaitGroup{}
+				for i, producer := range producers {
+					wg.Add(1)
+					go func(i int, producer *Client) {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						task, err := NewTask("ginkgo", i)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(producer.EnqueueTaskToQueue(ctx, "TENANT", task)).To(Succeed())
+						Expect(task.Queue).To(Equal("TENANT"))
+					}(i, producer)
+				}
+				wg.Wait()
+
+				nfo, err = client.StorageAdmin().QueueInfo("TENANT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(10)))
+
+				// queues removed while the client runs are created again
+				Expect(mgr.DeleteStream(fmt.Sprintf(WorkStreamNamePattern, "BOUND"))).To(Succeed())
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateNew))
+				nfo, err = client.StorageAdmin().QueueInfo("BOUND")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(1)))
+
+				fixed, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+				task, err = NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fixed.EnqueueTaskToQueue(ctx, "UNKNOWN", task)).To(MatchError(ErrQueueNotFound))
+				Expect(fixed.EnqueueTaskToQueue(ctx, "TENANT", task)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("EnqueueAndWait", func() {
+		It("Should wait for tasks to reach a final state", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					switch {
+					case t.Tries == 1:
+						return nil, fmt.Errorf("simulated failure")
+					case string(t.Payload) == `"terminate"`:
+						return nil, fmt.Errorf("simulated termination: %w", ErrTerminateTask)
+					default:
+						return map[string]int{"tries": t.Tries}, nil
+					}
+				})
+				go client.Run(ctx, router)
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				res, err := client.EnqueueAndWait(ctx, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(MatchJSON(`{"tries":2}`))
+
+				task, err = NewTask("ginkgo", "terminate")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueAndWait(ctx, task)
+				Expect(err).To(MatchError(ErrTaskFailed))
+				Expect(err.Error()).To(ContainSubstring("terminated: simulated termination"))
+
+				wctx, wcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer wcancel()
+				task, err = NewTask("ginkgo", nil, TaskScheduledIn(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueAndWait(wctx, task)
+				Expect(err).To(MatchError(context.DeadlineExceeded))
+
+				client, err = NewClient(NatsConn(nc), DiscardTaskStates(TaskStateCompleted))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueAndWait(ctx, task)
+				Expect(err).To(MatchError("cannot wait for tasks while task states are discarded"))
+			})
+		})
+	})
+
+	Describe("WatchTask", func() {
+		It("Should fail for unknown tasks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = client.WatchTask(context.Background(), "unknown")
+				Expect(err).To(MatchError(ErrTaskNotFound))
+			})
+		})
+
+		It("Should deliver state changes until the task is final", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				watch, err := client.WatchTask(ctx, task.ID)
+				Expect(err).ToNot(HaveOccurred())
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				var states []TaskState
+				var last *Task
+				for t := range watch {
+					Expect(t.ID).To(Equal(task.ID))
+					states = append(states, t.State)
+					last = t
+				}
+				Expect(ctx.Err()).ToNot(HaveOccurred())
+				Expect(states).To(Equal([]TaskState{TaskStateNew, TaskStateActive, TaskStateCompleted}))
+				Expect(last.Result.Payload).To(Equal("done"))
+
+				// already final tasks deliver their state and close immediately
+				watch, err = client.WatchTask(ctx, task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect((<-watch).State).To(Equal(TaskStateCompleted))
+				Eventually(watch).Should(BeClosed())
+			})
+		})
+	})
+
+	Describe("Stats", func() {
+		It("Should report queue, task and processing statistics", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				for i := 0; i < 2; i++ {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				}
+
+				stats, err := client.Stats(ctx)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Concurrency).To(Equal(10))
+				Expect(stats.TaskStates).To(Equal(map[TaskState]uint64{TaskStateNew: 2}))
+				Expect(stats.Queues).To(HaveLen(1))
+				Expect(stats.Queues[0].Name).To(Equal("DEFAULT"))
+				Expect(stats.Queues[0].Depth).To(Equal(uint64(2)))
+				Expect(stats.Queues[0].Pending).To(Equal(uint64(2)))
+				Expect(stats.Queues[0].OldestItemAge).To(BeNumerically(">", 0))
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					if t.Payload == nil {
+						return "done", nil
+					}
+					return nil, ErrTerminateTask
+				})
+				go client.Run(ctx, router)
+
+				task, err := NewTask("ginkgo", "fail")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+				Eventually(func() uint64 {
+					stats, err = client.Stats(ctx)
+					Expect(err).ToNot(HaveOccurred())
+					return stats.Processed + stats.Failed
+				}, 5*time.Second).Should(Equal(uint64(3)))
+
+				Expect(stats.Processed).To(Equal(uint64(2)))
+				Expect(stats.Failed).To(Equal(uint64(1)))
+				Expect(stats.Queues[0].Depth).To(Equal(uint64(0)))
+				Expect(stats.Queues[0].OldestItemAge).To(BeZero())
+
+				// task counts are cached
+				Expect(stats.TaskStates).To(Equal(map[TaskState]uint64{TaskStateNew: 2}))
+			})
+		})
+	})
+
+	Describe("QueueStats", func() {
+		It("Should report pending, in-flight and lag information for a queue", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				_, err = client.QueueStats(ctx, "UNKNOWN")
+				Expect(err).To(MatchError(ErrQueueNotFound))
+
+				for i := 0; i < 3; i++ {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				}
+
+				item, err := client.storage.PollQueue(ctx, client.opts.queue)
+				Expect(err).ToNot(HaveOccurred())
+				time.Sleep(20 * time.Millisecond)
+
+				stats, err := client.QueueStats(ctx, "DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.Name).To(Equal("DEFAULT"))
+				Expect(stats.Depth).To(Equal(uint64(3)))
+				Expect(stats.Pending).To(Equal(uint64(2)))
+				Expect(stats.InFlight).To(Equal(1))
+				Expect(stats.OldestPendingAge).To(BeNumerically(">=", 20*time.Millisecond))
+				Expect(stats.LastDelivered).To(Equal(uint64(1)))
+				Expect(stats.AckFloor).To(Equal(uint64(0)))
+
+				Expect(client.storage.AckItem(ctx, item)).To(Succeed())
+				stats, err = client.QueueStats(ctx, "DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stats.InFlight).To(Equal(0))
+				Expect(stats.AckFloor).To(Equal(uint64(1)))
+			})
+		})
+	})
+
+	Describe("Queues", func() {
+		It("Should describe queues with their settings, depth and paused state", func() {
+			cases := map[string]func(func(*Client)){
+				"memory": func(cb func(*Client)) {
+					client, err := NewClient(StorageBackend(NewInMemoryStorage()), WorkQueue(&Queue{Name: "EMAIL", MaxTries: 5, MaxRunTime: time.Minute, MaxConcurrent: 2}))
+					Expect(err).ToNot(HaveOccurred())
+					cb(client)
+				},
+				"jetstream": func(cb func(*Client)) {
+					withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+						client, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: "EMAIL", MaxTries: 5, MaxRunTime: time.Minute, MaxConcurrent: 2}))
+						Expect(err).ToNot(HaveOccurred())
+						cb(client)
+					})
+				},
+			}
+
+			for name, setup := range cases {
+				By(name)
+				setup(func(client *Client) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					for i := 0; i < 2; i++ {
+						task, err := NewTask("ginkgo", nil)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					}
+					Expect(client.PauseQueue(ctx, "EMAIL")).To(Succeed())
+
+					queues, err := client.Queues(ctx)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(queues).To(HaveLen(1))
+					Expect(queues[0].Name).To(Equal("EMAIL"))
+					Expect(queues[0].MaxTries).To(Equal(5))
+					Expect(queues[0].MaxRunTime).To(Equal(time.Minute))
+					Expect(queues[0].MaxConcurrent).To(Equal(2))
+					Expect(queues[0].Depth).To(Equal(uint64(2)))
+					Expect(queues[0].Paused).To(BeTrue())
+				})
+			}
+		})
+	})
+
+	Describe("PauseQueue", func() {
+		It("Should stop and resume processing", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				Expect(client.PauseQueue(ctx, "UNKNOWN")).To(MatchError(ErrQueueNotFound))
+
+				var handled int32
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					atomic.AddInt32(&handled, 1)
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				enqueue := func() *Task {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					return task
+				}
+
+				enqueue()
+				Eventually(func() int32 { return atomic.LoadInt32(&handled) }).Should(Equal(int32(1)))
+
+				// pausing while a poll is active
+				Expect(client.PauseQueue(ctx, "DEFAULT")).To(Succeed())
+				nfo, err := client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Paused).To(BeTrue())
+				time.Sleep(250 * time.Millisecond)
+
+				task := enqueue()
+				Consistently(func() int32 { return atomic.LoadInt32(&handled) }, time.Second).Should(Equal(int32(1)))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateNew))
+
+				Expect(client.ResumeQueue(ctx, "DEFAULT")).To(Succeed())
+				Eventually(func() int32 { return atomic.LoadInt32(&handled) }).Should(Equal(int32(2)))
+
+				nfo, err = client.StorageAdmin().QueueInfo("DEFAULT")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Paused).To(BeFalse())
+			})
+		})
+
+		It("Should not process paused queues on start", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				Expect(client.PauseQueue(ctx, "DEFAULT")).To(Succeed())
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+				var handled int32
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					atomic.AddInt32(&handled, 1)
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				Consistently(func() int32 { return atomic.LoadInt32(&handled) }, time.Second).Should(Equal(int32(0)))
+				Expect(client.ResumeQueue(ctx, "DEFAULT")).To(Succeed())
+				Eventually(func() int32 { return atomic.LoadInt32(&handled) }).Should(Equal(int32(1)))
+			})
 		})
 	})
 
-	Describe("shouldDiscardTask", func() {
-		It("Should correctly detect task states", func() {
+	Describe("PurgeTasks", func() {
+		It("Should delete matching tasks and support the retention policy", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
-				_, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateActive))
-				Expect(err).To(MatchError("only states completed, expired or terminated can be discarded"))
+				client, err := NewClient(NatsConn(nc), RetentionPolicy(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.opts.retentionStates).To(ContainElement(TaskStateCompleted))
 
-				client, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateCompleted))
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				var tasks []*Task
+				for i := 0; i < 6; i++ {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					if i%2 == 0 {
+						task.CreatedAt = time.Now().Add(-2 * time.Hour)
+					}
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					tasks = append(tasks, task)
+				}
+
+				// old and new completed tasks, only the old ones should be reaped
+				for _, task := range tasks[0:4] {
+					Expect(client.setTaskSuccess(ctx, task, nil)).To(Succeed())
+				}
+
+				client.reapTasksOnce(ctx)
+
+				for i, task := range tasks {
+					_, err = client.LoadTaskByID(task.ID)
+					if i < 4 && i%2 == 0 {
+						Expect(err).To(MatchError(ErrTaskNotFound))
+					} else {
+						Expect(err).ToNot(HaveOccurred())
+					}
+				}
+
+				deleted, err := client.PurgeTasks(ctx, TaskFilter{States: []TaskState{TaskStateNew}})
 				Expect(err).ToNot(HaveOccurred())
+				Expect(deleted).To(Equal(2))
 
-				Expect(client.shouldDiscardTask(&Task{State: TaskStateActive})).To(BeFalse())
-				Expect(client.shouldDiscardTask(&Task{State: TaskStateExpired})).To(BeTrue())
-				Expect(client.shouldDiscardTask(&Task{State: TaskStateCompleted})).To(BeTrue())
+				_, err = client.LoadTaskByID(tasks[1].ID)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.LoadTaskByID(tasks[4].ID)
+				Expect(err).To(MatchError(ErrTaskNotFound))
+
+				_, err = NewClient(NatsConn(nc), RetentionPolicy(0))
+				Expect(err).To(MatchError("retention max age must be positive"))
 			})
 		})
 	})
 
-	Describe("saveOrDiscardTaskIfDesired", func() {
-		It("Should delete the correct tasks", func() {
+	Describe("DeadLetterQueue", func() {
+		It("Should store terminated tasks and support replaying them", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
-				client, err := NewClient(NatsConn(nc), DiscardTaskStates(TaskStateExpired, TaskStateCompleted))
+				client, err := NewClient(NatsConn(nc), DeadLetterQueue("DLQ"), DiscardTaskStates(TaskStateTerminated))
 				Expect(err).ToNot(HaveOccurred())
 
-				task, err := NewTask("x", nil)
+				Expect(client.ReplayDeadLetter(context.Background(), "missing")).To(MatchError(ErrTaskNotFound))
+
+				task, err := NewTask("ginkgo", "payload")
 				Expect(err).ToNot(HaveOccurred())
-				Expect(client.EnqueueTask(context.Background(), task)).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
 
-				Expect(client.saveOrDiscardTaskIfDesired(context.Background(), task)).ToNot(HaveOccurred())
+				var tries int32
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					if atomic.AddInt32(&tries, 1) == 1 {
+						return nil, fmt.Errorf("simulated: %w", ErrTerminateTask)
+					}
+					return "done", nil
+				})
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				go client.Run(ctx, router)
+
+				Eventually(func() uint64 {
+					nfo, err := client.StorageAdmin().QueueInfo("DLQ")
+					Expect(err).ToNot(HaveOccurred())
+					return nfo.Stream.State.Msgs
+				}).Should(Equal(uint64(1)))
+
+				// discarded from the task store
 				_, err = client.LoadTaskByID(task.ID)
+				Expect(err).To(MatchError(ErrTaskNotFound))
+
+				stream, err := mgr.LoadStream("CHORIA_AJ_Q_DLQ")
+				Expect(err).ToNot(HaveOccurred())
+				msg, err := stream.ReadLastMessageForSubject("CHORIA_AJ.Q.DLQ." + task.ID)
 				Expect(err).ToNot(HaveOccurred())
+				item := &ProcessItem{}
+				Expect(json.Unmarshal(msg.Data, item)).To(Succeed())
+				Expect(item.Kind).To(Equal(DeadLetterItem))
+				Expect(item.Task.Payload).To(MatchJSON(`"payload"`))
+				Expect(item.Task.Tries).To(Equal(1))
+				Expect(item.Task.State).To(Equal(TaskStateTerminated))
+				Expect(item.Task.LastErr).To(Equal("simulated: terminate task"))
 
-				task.State = TaskStateExpired
-				Expect(client.saveOrDiscardTaskIfDesired(context.Background(), task)).ToNot(HaveOccurred())
-				_, err = client.LoadTaskByID(task.ID)
-				Expect(err).To(Equal(ErrTaskNotFound))
+				Expect(client.ReplayDeadLetter(context.Background(), task.ID)).To(Succeed())
+
+				Eventually(func() TaskState {
+					task, err = client.LoadTaskByID(task.ID)
+					if err != nil {
+						return TaskStateUnknown
+					}
+					return task.State
+				}).Should(Equal(TaskStateCompleted))
+				Expect(task.Tries).To(Equal(1))
+
+				nfo, err := client.StorageAdmin().QueueInfo("DLQ")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Stream.State.Msgs).To(Equal(uint64(0)))
+			})
+		})
+	})
+
+	Describe("SetConcurrency", func() {
+		It("Should scale the number of concurrent handlers", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), ClientConcurrency(1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.SetConcurrency(0)).To(MatchError("concurrency must be at least 1"))
+
+			var active, peak int32
+			release := make(chan struct{})
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				n := atomic.AddInt32(&active, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				<-release
+				atomic.AddInt32(&active, -1)
+				return "done", nil
+			})
+
+			var tasks []*Task
+			for i := 0; i < 6; i++ {
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+				tasks = append(tasks, task)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go client.Run(ctx, router)
+
+			Eventually(client.InFlightTasks).Should(Equal(1))
+			Consistently(client.InFlightTasks, "200ms").Should(Equal(1))
+
+			Expect(client.SetConcurrency(3)).To(Succeed())
+			Expect(client.Concurrency()).To(Equal(3))
+			Eventually(client.InFlightTasks).Should(Equal(3))
+
+			// in-flight handlers finish before their slots are removed
+			Expect(client.SetConcurrency(1)).To(Succeed())
+			Consistently(client.InFlightTasks, "200ms").Should(Equal(3))
+			atomic.StoreInt32(&peak, 0)
+			close(release)
+
+			for _, task := range tasks {
+				Eventually(func() TaskState {
+					task, err = client.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					return task.State
+				}).Should(Equal(TaskStateCompleted))
+			}
+			Expect(atomic.LoadInt32(&peak)).To(Equal(int32(1)))
+		})
+	})
+
+	Describe("NoRetry", func() {
+		It("Should terminate tasks after a single failed try", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting), WorkQueue(&Queue{Name: "NOTIFY", MaxTries: 10}))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var handled int32
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				atomic.AddInt32(&handled, 1)
+				return nil, fmt.Errorf("simulated failure")
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("ginkgo", nil, NoRetry())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+			Eventually(func() TaskState {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return task.State
+			}).Should(Equal(TaskStateTerminated))
+			Expect(task.NoRetry).To(BeTrue())
+			Expect(task.Tries).To(Equal(1))
+			Expect(task.LastErr).To(Equal("simulated failure"))
+			Expect(task.NextTryAt).To(BeNil())
+			Consistently(func() int32 { return atomic.LoadInt32(&handled) }, 200*time.Millisecond).Should(Equal(int32(1)))
+		})
+
+		It("Should expire tasks that failed after their deadline", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				<-ctx.Done()
+				return nil, fmt.Errorf("too slow")
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("ginkgo", nil, NoRetry(), TaskDeadline(time.Now().Add(200*time.Millisecond)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+			Eventually(func() TaskState {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return task.State
+			}).Should(Equal(TaskStateExpired))
+			Expect(task.Tries).To(Equal(1))
+			Expect(task.LastErr).To(ContainSubstring("too slow"))
+		})
+	})
+
+	Describe("MaxPayloadSize", func() {
+		It("Should validate the size", func() {
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), MaxPayloadSize(0))
+			Expect(err).To(MatchError("maximum payload size must be at least 1 byte"))
+		})
+
+		It("Should default relative to the server max payload", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.opts.maxPayloadSize).To(Equal(DefaultMaxPayloadSize))
+
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.opts.maxPayloadSize).To(Equal(int(nc.MaxPayload() / 2)))
+			})
+		})
+
+		It("Should reject large payloads before enqueueing or updating tasks", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), MaxPayloadSize(10))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			task, err := NewTask("ginkgo", "a long payload")
+			Expect(err).ToNot(HaveOccurred())
+			err = client.EnqueueTask(ctx, task)
+			Expect(err).To(MatchError(ErrTaskPayloadTooLarge))
+			Expect(err).To(MatchError("task payload too large: 16 bytes exceeds the limit of 10 bytes"))
+			_, err = client.LoadTaskByID(task.ID)
+			Expect(err).To(MatchError(ErrTaskNotFound))
+
+			task, err = NewTask("ginkgo", "short")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+			Expect(client.UpdateTask(ctx, task.ID, "a long payload")).To(MatchError(ErrTaskPayloadTooLarge))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.Payload).To(MatchJSON(`"short"`))
+		})
+	})
+
+	Describe("OnTaskDead", func() {
+		It("Should require a callback", func() {
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), OnTaskDead(nil))
+			Expect(err).To(MatchError("dead task callback is required"))
+		})
+
+		It("Should pass dead tasks to the callback without blocking processing", func() {
+			// the unreachable task is delivered again quickly when polled before its dependency terminated
+			defaultBlockedNakTime = 10 * time.Millisecond
+			defer func() { defaultBlockedNakTime = 5 * time.Second }()
+
+			release := make(chan struct{})
+			dead := make(chan *Task, 10)
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting), QuarantinePoisonTasks(2), OnTaskDead(func(t *Task) {
+				<-release
+				dead <- t
+			}))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				if t.NoRetry {
+					return nil, fmt.Errorf("simulated failure")
+				}
+				return "done", nil
+			})
+			router.HandleFunc("poison", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return nil, fmt.Errorf("poisoned")
+			})
+			go client.Run(ctx, router)
+
+			terminated, err := NewTask("ginkgo", nil, NoRetry())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, terminated)).To(Succeed())
+
+			unreachable, err := NewTask("ginkgo", nil, TaskDependsOn(terminated))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, unreachable)).To(Succeed())
+
+			quarantined, err := NewTask("poison", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, quarantined)).To(Succeed())
+
+			expired, err := NewTask("ginkgo", nil, TaskDeadline(time.Now().Add(-time.Hour)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, expired)).To(Succeed())
+
+			completed, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.EnqueueAndWait(ctx, completed)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dead).To(BeEmpty())
+
+			close(release)
+
+			found := map[TaskState]*Task{}
+			for i := 0; i < 4; i++ {
+				var task *Task
+				Eventually(dead, 5*time.Second).Should(Receive(&task))
+				found[task.State] = task
+			}
+			Expect(found).To(HaveLen(4))
+			Expect(found[TaskStateTerminated].ID).To(Equal(terminated.ID))
+			Expect(found[TaskStateTerminated].LastErr).To(Equal("simulated failure"))
+			Expect(found[TaskStateExpired].ID).To(Equal(expired.ID))
+			Expect(found[TaskStateUnreachable].ID).To(Equal(unreachable.ID))
+			Expect(found[TaskStateQuarantined].ID).To(Equal(quarantined.ID))
+			Expect(found[TaskStateQuarantined].LastErr).To(Equal("poisoned"))
+			Consistently(dead, 200*time.Millisecond).ShouldNot(Receive())
+
+			// the goroutine calling the callback exits once idle
+			client.deadMu.Lock()
+			Expect(client.deadDone).To(BeNil())
+			client.deadMu.Unlock()
+		})
+
+		It("Should wait for the callback when draining", func() {
+			release := make(chan struct{})
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), OnTaskDead(func(t *Task) { <-release }))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			Expect(client.Drain(ctx)).To(Succeed())
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.storage.SaveTaskState(ctx, task, false)).To(Succeed())
+			task.State = TaskStateTerminated
+			Expect(client.storage.SaveTaskState(ctx, task, false)).To(Succeed())
+
+			dctx, dcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer dcancel()
+			Expect(client.Drain(dctx)).To(MatchError(context.DeadlineExceeded))
+
+			close(release)
+			Expect(client.Drain(ctx)).To(Succeed())
+		})
+	})
+
+	Describe("RunUntilEmpty", func() {
+		It("Should handle all tasks and return once idle", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			Expect(client.RunUntilEmpty(ctx, NewTaskRouter(), 0)).To(MatchError("idle timeout must be positive"))
+
+			var handled int32
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				atomic.AddInt32(&handled, 1)
+				if t.Tries == 1 && string(t.Payload) == "0" {
+					return nil, fmt.Errorf("simulated failure")
+				}
+				return "done", nil
+			})
+
+			var tasks []*Task
+			for i := 0; i < 5; i++ {
+				task, err := NewTask("ginkgo", i)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				tasks = append(tasks, task)
+			}
+
+			Expect(client.RunUntilEmpty(ctx, router, 500*time.Millisecond)).To(Succeed())
+			Expect(ctx.Err()).ToNot(HaveOccurred())
+			Expect(atomic.LoadInt32(&handled)).To(Equal(int32(6)))
+			Expect(client.InFlightTasks()).To(BeZero())
+
+			for _, task := range tasks {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateCompleted))
+			}
+		})
+	})
+
+	Describe("Drain", func() {
+		It("Should do nothing when not running", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.Drain(context.Background())).To(Succeed())
+				Expect(client.InFlightTasks()).To(Equal(0))
+			})
+		})
+
+		It("Should stop polling and wait for in-flight tasks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), ClientConcurrency(2))
+				Expect(err).ToNot(HaveOccurred())
+
+				started := make(chan struct{}, 2)
+				release := make(chan struct{})
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+					started <- struct{}{}
+					<-release
+					return "done", nil
+				})
+
+				var tasks []*Task
+				for i := 0; i < 3; i++ {
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(context.Background(), task)).To(Succeed())
+					tasks = append(tasks, task)
+				}
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+
+				ran := make(chan error, 1)
+				go func() { ran <- client.Run(ctx, router) }()
+
+				<-started
+				<-started
+				Expect(client.InFlightTasks()).To(Equal(2))
+
+				drained := make(chan error, 1)
+				go func() { drained <- client.Drain(context.Background()) }()
+
+				Eventually(ran).Should(Receive(BeNil()))
+				Consistently(drained, "200ms").ShouldNot(Receive())
+
+				short, scancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer scancel()
+				Expect(client.Drain(short)).To(MatchError(context.DeadlineExceeded))
+
+				close(release)
+				Eventually(drained).Should(Receive(BeNil()))
+				Expect(client.InFlightTasks()).To(Equal(0))
+
+				completed := 0
+				for _, task := range tasks {
+					task, err = client.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					if task.State == TaskStateCompleted {
+						completed++
+					}
+				}
+				Expect(completed).To(Equal(2))
+			})
+		})
+
+		It("Should signal handlers and return stopped tasks to the queue", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), ClientConcurrency(2), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ShutdownSignal(context.Background())).To(BeNil())
+
+			started := make(chan struct{}, 2)
+			router := NewTaskRouter()
+			router.HandleFunc("quick", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				started <- struct{}{}
+				<-ShutdownSignal(ctx)
+				return "checkpointed", nil
 			})
+			router.HandleFunc("slow", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				started <- struct{}{}
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+
+			quick, err := NewTask("quick", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(context.Background(), quick)).To(Succeed())
+			slow, err := NewTask("slow", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(context.Background(), slow)).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go client.Run(ctx, router)
+
+			<-started
+			<-started
+
+			short, scancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer scancel()
+			Expect(client.Drain(short)).To(MatchError(context.DeadlineExceeded))
+			Expect(client.InFlightTasks()).To(Equal(0))
+
+			quick, err = client.LoadTaskByID(quick.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(quick.State).To(Equal(TaskStateCompleted))
+
+			slow, err = client.LoadTaskByID(slow.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(slow.State).To(Equal(TaskStateRetry))
+			Expect(slow.LastErr).To(Equal(ErrProcessorDraining.Error()))
+			Expect(slow.Tries).To(Equal(0))
+			Expect(slow.Deferrals).To(Equal(1))
 		})
 	})
 
@@ -310,4 +1999,80 @@ var _ = Describe("Client", func() {
 			Expect(task.State).To(Equal(TaskStateCompleted))
 		})
 	})
+
+	Describe("ConnectionStatus", func() {
+		It("Should report clients without a NATS connection as connected", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.ConnectionStatus()).To(Equal(ConnectionStatus{State: ConnectionConnected}))
+		})
+
+		It("Should pause fetching while reconnecting and stop once closed", func() {
+			d, err := os.MkdirTemp("", "jstest")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(d)
+
+			opts := &server.Options{JetStream: true, StoreDir: d, Port: -1, Host: "localhost"}
+			startServer := func() *server.Server {
+				s, err := server.NewServer(opts)
+				Expect(err).ToNot(HaveOccurred())
+				go s.Start()
+				Expect(s.ReadyForConnections(10 * time.Second)).To(BeTrue())
+				return s
+			}
+
+			s := startServer()
+			defer func() { s.Shutdown() }()
+			opts.Port = s.Addr().(*net.TCPAddr).Port
+
+			nc, err := nats.Connect(s.ClientURL(), nats.UseOldRequestStyle(), nats.MaxReconnects(-1), nats.ReconnectWait(50*time.Millisecond))
+			Expect(err).ToNot(HaveOccurred())
+			defer nc.Close()
+
+			client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.ConnectionStatus()).To(Equal(ConnectionStatus{State: ConnectionConnected}))
+
+			disconnects := make(chan error, 10)
+			reconnects := make(chan struct{}, 10)
+			client.OnDisconnect(func(err error) { disconnects <- err })
+			client.OnReconnect(func() { reconnects <- struct{}{} })
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return "done", nil
+			})
+
+			runErr := make(chan error, 1)
+			go func() { runErr <- client.Run(ctx, router) }()
+
+			s.Shutdown()
+			s.WaitForShutdown()
+			Eventually(disconnects).Should(Receive())
+			Expect(client.ConnectionStatus().State).To(Equal(ConnectionReconnecting))
+			Consistently(runErr, 200*time.Millisecond).ShouldNot(Receive())
+
+			s = startServer()
+			Eventually(reconnects, 5*time.Second).Should(Receive())
+			Expect(client.ConnectionStatus().State).To(Equal(ConnectionConnected))
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() error { return client.EnqueueTask(ctx, task) }, 5*time.Second).Should(Succeed())
+			Eventually(func() TaskState {
+				task, err = client.LoadTaskByID(task.ID)
+				if err != nil {
+					return TaskStateUnknown
+				}
+				return task.State
+			}, 10*time.Second).Should(Equal(TaskStateCompleted))
+
+			nc.Close()
+			Eventually(runErr, 5*time.Second).Should(Receive(MatchError(ErrConnectionClosed)))
+			Expect(client.ConnectionStatus().State).To(Equal(ConnectionClosed))
+		})
+	})
 })
@@ -0,0 +1,127 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// clock is the source of time for the retry, deadline, TTL, lease and schedule catch-up decisions of the client, its
+// processor, storage and Task Scheduler, tests replace it using withClock() to control time rather than wait for it.
+// Cron ticks of the Task Scheduler and the exported Task helpers like IsPastDeadline() use the wall clock
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) clockTimer
+}
+
+// clockTimer is a timer created by a clock
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// realClock is the wall clock
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) clockTimer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// sleep waits for d to pass on c or until interrupted by ctx
+func sleep(ctx context.Context, c clock, d time.Duration) error {
+	timer := c.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deadlineContext is a context canceled with context.DeadlineExceeded once c passes deadline
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+	err      error
+	mu       sync.Mutex
+}
+
+// withClockDeadline is context.WithDeadline() measuring time using c
+func withClockDeadline(parent context.Context, c clock, deadline time.Time) (context.Context, context.CancelFunc) {
+	ctx := &deadlineContext{Context: parent, deadline: deadline, done: make(chan struct{})}
+
+	until := deadline.Sub(c.Now())
+	if until <= 0 {
+		ctx.cancel(context.DeadlineExceeded)
+		return ctx, func() {}
+	}
+
+	timer := c.NewTimer(until)
+
+	go func() {
+		defer timer.Stop()
+
+		select {
+		case <-timer.C():
+			ctx.cancel(context.DeadlineExceeded)
+		case <-parent.Done():
+			ctx.cancel(parent.Err())
+		case <-ctx.done:
+		}
+	}()
+
+	return ctx, func() { ctx.cancel(context.Canceled) }
+}
+
+func (d *deadlineContext) cancel(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return
+	}
+
+	d.err = err
+	close(d.done)
+}
+
+func (d *deadlineContext) Deadline() (time.Time, bool) {
+	pd, ok := d.Context.Deadline()
+	if ok && pd.Before(d.deadline) {
+		return pd, true
+	}
+
+	return d.deadline, true
+}
+
+func (d *deadlineContext) Done() <-chan struct{} {
+	return d.done
+}
+
+func (d *deadlineContext) Err() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.err
+}
+
+// withClock sets the clock used by the client and the storage it creates or is given
+func withClock(c clock) ClientOpt {
+	return func(opts *ClientOpts) error {
+		opts.clock = c
+		return nil
+	}
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeClock is a clock that only moves when advanced, timers fire once the clock passes them
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	mu     sync.Mutex
+}
+
+type fakeTimer struct {
+	c     chan time.Time
+	at    time.Time
+	clock *fakeClock
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{c: make(chan time.Time, 1), at: c.now.Add(d), clock: c}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+// Advance moves the clock forward by d firing all timers that are due
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	for i, ct := range t.clock.timers {
+		if ct == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+var _ = Describe("Clock", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		clock  *fakeClock
+		client *Client
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		clock = newFakeClock()
+
+		var err error
+		client, err = NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(RetryLinearOneHour), withClock(clock))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { cancel() })
+
+	loadState := func(id string) TaskState {
+		task, err := client.LoadTaskByID(id)
+		Expect(err).ToNot(HaveOccurred())
+		return task.State
+	}
+
+	It("Should sleep until the clock passes the duration", func() {
+		done := make(chan error, 1)
+		go func() { done <- sleep(ctx, clock, time.Hour) }()
+
+		Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+		Eventually(func() bool {
+			clock.Advance(time.Minute)
+			return len(done) > 0
+		}).Should(BeTrue())
+		Expect(clock.Now().Sub(newFakeClock().Now())).To(BeNumerically(">=", time.Hour))
+	})
+
+	It("Should retry tasks once the retry delay passed", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(func() TaskState { return loadState(task.ID) }).Should(Equal(TaskStateRetry))
+		Consistently(func() TaskState { return loadState(task.ID) }, 100*time.Millisecond).Should(Equal(TaskStateRetry))
+
+		Eventually(func() TaskState {
+			clock.Advance(10 * time.Minute)
+			return loadState(task.ID)
+		}).Should(Equal(TaskStateCompleted))
+	})
+
+	It("Should persist the retry time and hold early deliveries until then", func() {
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		// a client failed the task and stopped before its item was delayed, so it is delivered again right away
+		item, err := client.storage.PollQueue(ctx, client.opts.queue)
+		Expect(err).ToNot(HaveOccurred())
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		task.Tries = 1
+		task.setNextTry(clock.Now(), time.Hour)
+		Expect(client.handleTaskError(ctx, task, fmt.Errorf("simulated failure"))).To(Succeed())
+		Expect(client.storage.NakDelayedItem(ctx, item, 0)).To(Succeed())
+
+		var tries atomic.Int32
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			tries.Add(1)
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		Consistently(func() TaskState { return loadState(task.ID) }, 200*time.Millisecond).Should(Equal(TaskStateRetry))
+		Expect(tries.Load()).To(BeZero())
+
+		clock.Advance(59 * time.Minute)
+		Consistently(func() TaskState { return loadState(task.ID) }, 100*time.Millisecond).Should(Equal(TaskStateRetry))
+
+		clock.Advance(2 * time.Minute)
+		Eventually(func() TaskState { return loadState(task.ID) }).Should(Equal(TaskStateCompleted))
+		Expect(tries.Load()).To(Equal(int32(1)))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.NextTryAt).To(BeNil())
+		Expect(task.Tries).To(Equal(2))
+	})
+
+	It("Should record task times using the clock", func() {
+		started := clock.Now()
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			clock.Advance(5 * time.Minute)
+			Expect(Progress(ctx).SetProgress(50, "half way")).To(Succeed())
+			clock.Advance(5 * time.Minute)
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(func() TaskState { return loadState(task.ID) }).Should(Equal(TaskStateCompleted))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(*task.LastTriedAt).To(BeTemporally("==", started.Add(10*time.Minute)))
+		Expect(task.Progress.UpdatedAt).To(BeTemporally("==", started.Add(5*time.Minute)))
+		Expect(task.Result.CompletedAt).To(BeTemporally("==", started.Add(10*time.Minute)))
+		Expect(task.Attempts).To(HaveLen(1))
+		Expect(task.Attempts[0].Time).To(BeTemporally("==", started))
+		Expect(task.Attempts[0].Duration).To(Equal(10 * time.Minute))
+	})
+
+	It("Should record the next try of failed tasks", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return nil, fmt.Errorf("simulated failure")
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(func() TaskState { return loadState(task.ID) }).Should(Equal(TaskStateRetry))
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.NextTryAt).ToNot(BeNil())
+		Expect(task.NextTryAt.After(clock.Now())).To(BeTrue())
+		Expect(task.NextTryAt.Sub(clock.Now())).To(BeNumerically("<=", time.Hour))
+	})
+
+	It("Should cancel handlers once the clock passes the task deadline", func() {
+		started := make(chan struct{}, 1)
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			deadline, ok := ctx.Deadline()
+			Expect(ok).To(BeTrue())
+			Expect(deadline).To(BeTemporally("==", *t.Deadline))
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil, TaskDeadline(clock.Now().Add(30*time.Second)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(started).Should(Receive())
+		Consistently(func() TaskState { return loadState(task.ID) }, 100*time.Millisecond).Should(Equal(TaskStateActive))
+
+		clock.Advance(31 * time.Second)
+		Eventually(func() TaskState { return loadState(task.ID) }).Should(Equal(TaskStateExpired))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.LastErr).To(ContainSubstring(ErrTaskPastDeadline.Error()))
+	})
+
+	It("Should hold scheduled tasks and expire tasks past their TTL", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return "done", nil
+		})
+
+		scheduled, err := NewTask("ginkgo", nil, TaskScheduledFor(clock.Now().Add(time.Hour)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, scheduled)).To(Succeed())
+
+		ttl, err := NewTask("ginkgo", nil, TaskTTL(time.Minute), TaskScheduledFor(clock.Now().Add(30*time.Second)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, ttl)).To(Succeed())
+		Expect(ttl.ExpiresAt.Equal(clock.Now().Add(time.Minute))).To(BeTrue())
+
+		clock.Advance(2 * time.Minute)
+		go client.Run(ctx, router)
+
+		Eventually(func() TaskState { return loadState(ttl.ID) }).Should(Equal(TaskStateExpired))
+		Consistently(func() TaskState { return loadState(scheduled.ID) }, 100*time.Millisecond).Should(Equal(TaskStateNew))
+
+		Eventually(func() TaskState {
+			clock.Advance(10 * time.Minute)
+			return loadState(scheduled.ID)
+		}).Should(Equal(TaskStateCompleted))
+	})
+})
@@ -0,0 +1,233 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CloudEventsSpecVersion is the version of the CloudEvents specification supported
+	CloudEventsSpecVersion = "1.0"
+	// DefaultCloudEventsSource is the source of CloudEvents created for tasks that were not enqueued with a source
+	DefaultCloudEventsSource = "asyncjobs"
+)
+
+// CloudEvent is a CloudEvents 1.0 event in the structured JSON format, only events with JSON data are supported.
+// When stored with a task Data is empty as the task payload holds the data
+type CloudEvent struct {
+	// SpecVersion is the CloudEvents specification version, always CloudEventsSpecVersion
+	SpecVersion string
+	// ID identifies the event, unique per Source
+	ID string
+	// Source identifies the context in which the event happened
+	Source string
+	// Type is the type of event
+	Type string
+	// Subject is the subject of the event in the context of the source
+	Subject string
+	// Time is when the event happened
+	Time *time.Time
+	// DataContentType is the content type of Data
+	DataContentType string
+	// DataSchema identifies the schema Data adheres to
+	DataSchema string
+	// Extensions are additional attributes of the event
+	Extensions map[string]any
+	// Data is the JSON encoded event data
+	Data json.RawMessage
+}
+
+var cloudEventAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "subject": true, "time": true,
+	"datacontenttype": true, "dataschema": true, "data": true, "data_base64": true,
+}
+
+// ParseCloudEvent parses a CloudEvent in the structured JSON format
+func ParseCloudEvent(data []byte) (*CloudEvent, error) {
+	ce := &CloudEvent{}
+	err := json.Unmarshal(data, ce)
+	if err != nil {
+		return nil, err
+	}
+
+	return ce, ce.validate()
+}
+
+func (e *CloudEvent) validate() error {
+	switch {
+	case e.SpecVersion != CloudEventsSpecVersion:
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidCloudEvent, e.SpecVersion)
+	case e.ID == "":
+		return fmt.Errorf("%w: id is required", ErrInvalidCloudEvent)
+	case e.Source == "":
+		return fmt.Errorf("%w: source is required", ErrInvalidCloudEvent)
+	case e.Type == "":
+		return fmt.Errorf("%w: type is required", ErrInvalidCloudEvent)
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the event in the structured JSON format
+func (e CloudEvent) MarshalJSON() ([]byte, error) {
+	res := map[string]any{}
+	for k, v := range e.Extensions {
+		res[k] = v
+	}
+
+	res["specversion"] = e.SpecVersion
+	res["id"] = e.ID
+	res["source"] = e.Source
+	res["type"] = e.Type
+	if e.Subject != "" {
+		res["subject"] = e.Subject
+	}
+	if e.Time != nil {
+		res["time"] = e.Time.Format(time.RFC3339Nano)
+	}
+	if e.DataContentType != "" {
+		res["datacontenttype"] = e.DataContentType
+	}
+	if e.DataSchema != "" {
+		res["dataschema"] = e.DataSchema
+	}
+	if len(e.Data) > 0 {
+		res["data"] = e.Data
+	}
+
+	return json.Marshal(res)
+}
+
+// UnmarshalJSON decodes an event in the structured JSON format, unknown attributes are stored in Extensions
+func (e *CloudEvent) UnmarshalJSON(data []byte) error {
+	var attrs map[string]json.RawMessage
+	err := json.Unmarshal(data, &attrs)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := attrs["data_base64"]; ok {
+		return fmt.Errorf("%w: only JSON data is supported", ErrInvalidCloudEvent)
+	}
+
+	*e = CloudEvent{}
+	for k, dst := range map[string]*string{"specversion": &e.SpecVersion, "id": &e.ID, "source": &e.Source, "type": &e.Type, "subject": &e.Subject, "datacontenttype": &e.DataContentType, "dataschema": &e.DataSchema} {
+		v, ok := attrs[k]
+		if !ok {
+			continue
+		}
+		err = json.Unmarshal(v, dst)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s: %v", ErrInvalidCloudEvent, k, err)
+		}
+	}
+
+	if v, ok := attrs["time"]; ok {
+		var t time.Time
+		err = json.Unmarshal(v, &t)
+		if err != nil {
+			return fmt.Errorf("%w: invalid time: %v", ErrInvalidCloudEvent, err)
+		}
+		e.Time = &t
+	}
+
+	if v, ok := attrs["data"]; ok && string(v) != "null" {
+		e.Data = v
+	}
+
+	for k, v := range attrs {
+		if cloudEventAttributes[k] {
+			continue
+		}
+
+		var ext any
+		err = json.Unmarshal(v, &ext)
+		if err != nil {
+			return fmt.Errorf("%w: invalid extension %s: %v", ErrInvalidCloudEvent, k, err)
+		}
+		if e.Extensions == nil {
+			e.Extensions = map[string]any{}
+		}
+		e.Extensions[k] = ext
+	}
+
+	return nil
+}
+
+// NewTaskFromCloudEvent creates a task with the event data as payload, the event attributes are stored in the task
+// CloudEvent. Dots in the event type are replaced by colons to form the task type so com.example.order becomes
+// com:example:order, a valid task type that can be routed by prefix
+func NewTaskFromCloudEvent(ce *CloudEvent, opts ...TaskOpt) (*Task, error) {
+	if ce == nil {
+		return nil, fmt.Errorf("%w: event is required", ErrInvalidCloudEvent)
+	}
+
+	err := ce.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if ce.DataContentType != "" && !isJSONContentType(ce.DataContentType) {
+		return nil, fmt.Errorf("%w: only JSON data is supported", ErrInvalidCloudEvent)
+	}
+
+	attrs := *ce
+	attrs.Data = nil
+
+	task, err := NewTask(strings.ReplaceAll(ce.Type, ".", ":"), nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ce.Data) > 0 {
+		task.Payload = []byte(ce.Data)
+	}
+	task.CloudEvent = &attrs
+
+	return task, nil
+}
+
+// AsCloudEvent creates a CloudEvent for the task with the task payload as data, tasks created from events or enqueued
+// by clients using CloudEventsEnvelope() keep their original attributes
+func (t *Task) AsCloudEvent() (*CloudEvent, error) {
+	var ce CloudEvent
+	if t.CloudEvent != nil {
+		ce = *t.CloudEvent
+	} else {
+		ce = t.newCloudEvent(DefaultCloudEventsSource)
+	}
+
+	if len(t.Payload) > 0 {
+		if !json.Valid(t.Payload) {
+			return nil, fmt.Errorf("%w: task payload is not JSON", ErrInvalidCloudEvent)
+		}
+		ce.Data = json.RawMessage(t.Payload)
+	}
+
+	return &ce, ce.validate()
+}
+
+func (t *Task) newCloudEvent(source string) CloudEvent {
+	created := t.CreatedAt
+
+	return CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              t.ID,
+		Source:          source,
+		Type:            t.Type,
+		Time:            &created,
+		DataContentType: "application/json",
+	}
+}
+
+func isJSONContentType(ct string) bool {
+	ct = strings.ToLower(strings.TrimSpace(strings.Split(ct, ";")[0]))
+
+	return ct == "application/json" || ct == "text/json" || strings.HasSuffix(ct, "+json")
+}
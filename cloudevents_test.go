@@ -0,0 +1,120 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CloudEvents", func() {
+	event := []byte(`{
+		"specversion": "1.0",
+		"id": "A234-1234-1234",
+		"source": "https://github.com/cloudevents/spec/pull",
+		"type": "com.github.pull_request.opened",
+		"subject": "123",
+		"time": "2018-04-05T17:31:00Z",
+		"comexampleextension1": "value",
+		"datacontenttype": "application/json",
+		"data": {"number": 123}
+	}`)
+
+	Describe("ParseCloudEvent", func() {
+		It("Should parse and validate events", func() {
+			ce, err := ParseCloudEvent(event)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ce.ID).To(Equal("A234-1234-1234"))
+			Expect(ce.Type).To(Equal("com.github.pull_request.opened"))
+			Expect(ce.Subject).To(Equal("123"))
+			Expect(ce.Time.Equal(time.Date(2018, 4, 5, 17, 31, 0, 0, time.UTC))).To(BeTrue())
+			Expect(ce.Extensions).To(Equal(map[string]any{"comexampleextension1": "value"}))
+			Expect(ce.Data).To(MatchJSON(`{"number": 123}`))
+
+			j, err := json.Marshal(ce)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(j).To(MatchJSON(event))
+
+			_, err = ParseCloudEvent([]byte(`{"specversion":"0.3","id":"1","source":"x","type":"x"}`))
+			Expect(err).To(MatchError(`invalid cloud event: unsupported specversion "0.3"`))
+			_, err = ParseCloudEvent([]byte(`{"specversion":"1.0","source":"x","type":"x"}`))
+			Expect(err).To(MatchError("invalid cloud event: id is required"))
+			_, err = ParseCloudEvent([]byte(`{"specversion":"1.0","id":"1","source":"x","type":"x","data_base64":"eA=="}`))
+			Expect(err).To(MatchError("invalid cloud event: only JSON data is supported"))
+		})
+	})
+
+	Describe("NewTaskFromCloudEvent", func() {
+		It("Should create tasks with the event data as payload", func() {
+			ce, err := ParseCloudEvent(event)
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err := NewTaskFromCloudEvent(ce, TaskPriority(1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.Type).To(Equal("com:github:pull_request:opened"))
+			Expect(task.Priority).To(Equal(1))
+			Expect(task.Payload).To(MatchJSON(`{"number": 123}`))
+			Expect(task.CloudEvent.Data).To(BeNil())
+			Expect(task.CloudEvent.Source).To(Equal("https://github.com/cloudevents/spec/pull"))
+
+			res, err := task.AsCloudEvent()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Marshal(res)).To(MatchJSON(event))
+
+			ce.DataContentType = "application/xml"
+			_, err = NewTaskFromCloudEvent(ce)
+			Expect(err).To(MatchError("invalid cloud event: only JSON data is supported"))
+		})
+	})
+
+	Describe("AsCloudEvent", func() {
+		It("Should create events for any task", func() {
+			task, err := NewTask("email:new", map[string]string{"to": "ginkgo"})
+			Expect(err).ToNot(HaveOccurred())
+
+			ce, err := task.AsCloudEvent()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ce.ID).To(Equal(task.ID))
+			Expect(ce.Source).To(Equal(DefaultCloudEventsSource))
+			Expect(ce.Type).To(Equal("email:new"))
+			Expect(ce.Time.Equal(task.CreatedAt)).To(BeTrue())
+			Expect(ce.Data).To(MatchJSON(`{"to":"ginkgo"}`))
+		})
+	})
+
+	Describe("CloudEventsEnvelope", func() {
+		It("Should store event attributes with enqueued tasks", func() {
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), CloudEventsEnvelope(""))
+			Expect(err).To(MatchError("cloud events source is required"))
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), CloudEventsEnvelope("/orders"))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			router := NewTaskRouter()
+			router.HandleFunc("order:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return map[string]any{"payload": string(t.Payload), "source": t.CloudEvent.Source}, nil
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("order:new", map[string]int{"id": 1})
+			Expect(err).ToNot(HaveOccurred())
+			res, err := client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`{"payload":"{\"id\":1}","source":"/orders"}`))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.CloudEvent.ID).To(Equal(task.ID))
+			Expect(task.CloudEvent.Type).To(Equal("order:new"))
+		})
+	})
+})
@@ -0,0 +1,100 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes task payloads, see PayloadCodec()
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec encodes payloads as JSON, the default Codec
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON
+func (JSONCodec) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+// Unmarshal decodes JSON data into v
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type codecKey struct{}
+
+func newCodecContext(ctx context.Context, codec Codec) context.Context {
+	if codec == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, codecKey{}, codec)
+}
+
+// UnmarshalPayload decodes the payload of task into v using the Codec the client handling the task is configured with
+// using PayloadCodec(), JSON by default. Protobuf payloads are decoded using UnmarshalProtoPayload() when v is a
+// proto.Message
+func UnmarshalPayload(ctx context.Context, task *Task, v any) error {
+	if m, ok := v.(proto.Message); ok && task.IsProtoPayload() {
+		return UnmarshalProtoPayload(task, m)
+	}
+
+	codec, ok := ctx.Value(codecKey{}).(Codec)
+	if !ok {
+		codec = JSONCodec{}
+	}
+
+	err := codec.Unmarshal(task.Payload, v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskPayloadInvalid, err)
+	}
+
+	return nil
+}
+
+// marshalPayload encodes payload using the client Codec, []byte payloads are stored as is and protobuf messages are
+// always encoded in the protobuf wire format
+func (c *Client) marshalPayload(payload any) ([]byte, string, error) {
+	if c.opts.codec == nil {
+		return marshalTaskPayload(payload)
+	}
+
+	switch p := payload.(type) {
+	case nil, proto.Message:
+		return marshalTaskPayload(payload)
+	case []byte:
+		return p, "", nil
+	}
+
+	p, err := c.opts.codec.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p, "", nil
+}
+
+// encodeTaskPayload encodes the payload given to NewTask() using the client Codec, NewTask() encodes payloads as
+// JSON as it is not aware of the client codec
+func (c *Client) encodeTaskPayload(task *Task) error {
+	if c.opts.codec == nil || task.payloadValue == nil {
+		return nil
+	}
+
+	p, pt, err := c.marshalPayload(task.payloadValue)
+	if err != nil {
+		return err
+	}
+
+	task.Payload = p
+	task.PayloadType = pt
+	task.payloadValue = nil
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+var _ = Describe("Codec", func() {
+	type order struct {
+		ID    int64
+		Items []string
+	}
+
+	It("Should encode and decode payloads using the client codec", func() {
+		_, err := NewClient(StorageBackend(NewInMemoryStorage()), PayloadCodec(nil))
+		Expect(err).To(MatchError("payload codec is required"))
+
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), PayloadCodec(gobCodec{}))
+		Expect(err).ToNot(HaveOccurred())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		router := NewTaskRouter()
+		router.HandleFunc("order:new", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			var o order
+			err := UnmarshalPayload(ctx, t, &o)
+			if err != nil {
+				return nil, err
+			}
+			return o.Items, nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("order:new", order{ID: 1, Items: []string{"book"}})
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`["book"]`))
+		Expect(json.Valid(task.Payload)).To(BeFalse())
+
+		raw, err := gobCodec{}.Marshal(order{ID: 2})
+		Expect(err).ToNot(HaveOccurred())
+		task, err = NewTask("order:new", raw)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+		Expect(task.Payload).To(Equal(raw))
+
+		Expect(client.UpdateTask(ctx, task.ID, order{ID: 3})).To(Succeed())
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		var o order
+		Expect(gobCodec{}.Unmarshal(task.Payload, &o)).To(Succeed())
+		Expect(o.ID).To(Equal(int64(3)))
+	})
+
+	It("Should decode JSON payloads by default", func() {
+		task, err := NewTask("order:new", order{ID: 1})
+		Expect(err).ToNot(HaveOccurred())
+
+		var o order
+		Expect(UnmarshalPayload(context.Background(), task, &o)).To(Succeed())
+		Expect(o.ID).To(Equal(int64(1)))
+		Expect(UnmarshalPayload(context.Background(), task, &[]string{})).To(MatchError(ErrTaskPayloadInvalid))
+	})
+})
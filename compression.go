@@ -0,0 +1,95 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionAlgorithm is an algorithm used to compress task payloads in storage
+type CompressionAlgorithm string
+
+const (
+	// NoCompression stores task payloads as is
+	NoCompression CompressionAlgorithm = ""
+	// GzipCompression compresses task payloads using gzip
+	GzipCompression CompressionAlgorithm = "gzip"
+	// S2Compression compresses task payloads using S2, a fast Snappy derivative
+	S2Compression CompressionAlgorithm = "s2"
+	// ZstdCompression compresses task payloads using Zstandard
+	ZstdCompression CompressionAlgorithm = "zstd"
+
+	// PayloadCompressionHeader is the header on stored tasks that indicates the algorithm used to compress the payload
+	PayloadCompressionHeader = "AJ-Payload-Compression"
+)
+
+func compressPayload(algo CompressionAlgorithm, payload []byte) ([]byte, error) {
+	switch algo {
+	case NoCompression:
+		return payload, nil
+
+	case GzipCompression:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		_, err := w.Write(payload)
+		if err != nil {
+			return nil, err
+		}
+		err = w.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+
+	case S2Compression:
+		return s2.Encode(nil, payload), nil
+
+	case ZstdCompression:
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+		return enc.EncodeAll(payload, nil), nil
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrCompressionUnsupported, algo)
+	}
+}
+
+func decompressPayload(algo CompressionAlgorithm, payload []byte) ([]byte, error) {
+	switch algo {
+	case NoCompression:
+		return payload, nil
+
+	case GzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+
+	case S2Compression:
+		return s2.Decode(nil, payload)
+
+	case ZstdCompression:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		return dec.DecodeAll(payload, nil)
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrCompressionUnsupported, algo)
+	}
+}
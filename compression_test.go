@@ -0,0 +1,92 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression", func() {
+	payload := bytes.Repeat([]byte(`{"hello":"world"}`), 1000)
+
+	Describe("compressPayload", func() {
+		It("Should round trip all algorithms", func() {
+			for _, algo := range []CompressionAlgorithm{NoCompression, GzipCompression, S2Compression, ZstdCompression} {
+				compressed, err := compressPayload(algo, payload)
+				Expect(err).ToNot(HaveOccurred())
+				if algo != NoCompression {
+					Expect(len(compressed)).To(BeNumerically("<", len(payload)), string(algo))
+				}
+
+				decompressed, err := decompressPayload(algo, compressed)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decompressed).To(Equal(payload), string(algo))
+			}
+
+			_, err := compressPayload("lzma", payload)
+			Expect(err).To(MatchError(ErrCompressionUnsupported))
+			_, err = decompressPayload("lzma", payload)
+			Expect(err).To(MatchError(ErrCompressionUnsupported))
+		})
+	})
+
+	Describe("PayloadCompression", func() {
+		It("Should validate the algorithm", func() {
+			opts := &ClientOpts{}
+			Expect(PayloadCompression("lzma")(opts)).To(MatchError(ErrCompressionUnsupported))
+			Expect(PayloadCompression(ZstdCompression)(opts)).ToNot(HaveOccurred())
+			Expect(opts.compression).To(Equal(ZstdCompression))
+		})
+
+		It("Should store compressed payloads and load compressed and uncompressed tasks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				plain, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+				compressed, err := NewClient(NatsConn(nc), PayloadCompression(S2Compression))
+				Expect(err).ToNot(HaveOccurred())
+
+				pt, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				pt.Payload = payload
+				Expect(plain.EnqueueTask(ctx, pt)).ToNot(HaveOccurred())
+
+				ct, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				ct.Payload = payload
+				Expect(compressed.EnqueueTask(ctx, ct)).ToNot(HaveOccurred())
+				Expect(ct.Payload).To(Equal(payload))
+
+				_, stream, err := compressed.StorageAdmin().TasksStore()
+				Expect(err).ToNot(HaveOccurred())
+
+				msg, err := stream.ReadLastMessageForSubject(fmt.Sprintf(TasksStreamSubjectPattern, ct.ID))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(msg.Data)).To(BeNumerically("<", len(payload)))
+				hdrs, err := decodeHeadersMsg(msg.Header)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdrs.Get(PayloadCompressionHeader)).To(Equal("s2"))
+
+				for _, c := range []*Client{plain, compressed} {
+					for _, id := range []string{pt.ID, ct.ID} {
+						task, err := c.LoadTaskByID(id)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(task.Payload).To(Equal(payload))
+					}
+				}
+			})
+		})
+	})
+})
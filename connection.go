@@ -0,0 +1,206 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ConnectionState is the state of the connection to the NATS server
+type ConnectionState string
+
+const (
+	// ConnectionConnected indicates the client is connected
+	ConnectionConnected ConnectionState = "connected"
+	// ConnectionReconnecting indicates the connection was lost and the client is trying to reconnect
+	ConnectionReconnecting ConnectionState = "reconnecting"
+	// ConnectionClosed indicates the connection was closed and will not be reconnected
+	ConnectionClosed ConnectionState = "closed"
+)
+
+// ConnectionStatus describes the health of the connection to the NATS server
+type ConnectionStatus struct {
+	// State is the current state of the connection
+	State ConnectionState
+	// LastError is the error that caused the most recent disconnection, nil when the connection was not lost
+	LastError error
+}
+
+// connectionMonitor tracks the state of a NATS connection, calling registered callbacks on changes and allowing
+// polling to wait for a reconnection
+type connectionMonitor struct {
+	nc           *nats.Conn
+	log          Logger
+	lastErr      error
+	changed      chan struct{}
+	onReconnect  []func()
+	onDisconnect []func(error)
+	mu           sync.Mutex
+}
+
+// newConnectionMonitor installs connection handlers on nc, any handlers already set on nc are still called
+func newConnectionMonitor(nc *nats.Conn, log Logger) *connectionMonitor {
+	m := &connectionMonitor{nc: nc, log: log, changed: make(chan struct{})}
+
+	prevDisconnect := nc.Opts.DisconnectedErrCB
+	prevDisconnectNoErr := nc.Opts.DisconnectedCB
+	prevReconnect := nc.Opts.ReconnectedCB
+	prevClosed := nc.Opts.ClosedCB
+
+	nc.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+		switch {
+		case prevDisconnect != nil:
+			prevDisconnect(nc, err)
+		case prevDisconnectNoErr != nil:
+			prevDisconnectNoErr(nc)
+		}
+		m.disconnected(err)
+	})
+
+	nc.SetReconnectHandler(func(nc *nats.Conn) {
+		if prevReconnect != nil {
+			prevReconnect(nc)
+		}
+		m.reconnected()
+	})
+
+	nc.SetClosedHandler(func(nc *nats.Conn) {
+		if prevClosed != nil {
+			prevClosed(nc)
+		}
+		m.notify()
+	})
+
+	return m
+}
+
+func (m *connectionMonitor) status() ConnectionStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return ConnectionStatus{State: connectionState(m.nc.Status()), LastError: m.lastErr}
+}
+
+func connectionState(s nats.Status) ConnectionState {
+	switch s {
+	case nats.CONNECTED, nats.DRAINING_SUBS, nats.DRAINING_PUBS:
+		return ConnectionConnected
+	case nats.CLOSED:
+		return ConnectionClosed
+	default:
+		return ConnectionReconnecting
+	}
+}
+
+func (m *connectionMonitor) disconnected(err error) {
+	m.mu.Lock()
+	if err != nil {
+		m.lastErr = err
+	}
+	cbs := append([]func(error){}, m.onDisconnect...)
+	m.mu.Unlock()
+
+	if m.nc.IsReconnecting() {
+		m.log.Warnf("Disconnected from NATS, pausing task fetching until reconnected: %v", err)
+	}
+
+	m.notify()
+
+	for _, cb := range cbs {
+		cb(err)
+	}
+}
+
+func (m *connectionMonitor) reconnected() {
+	m.mu.Lock()
+	cbs := append([]func(){}, m.onReconnect...)
+	m.mu.Unlock()
+
+	m.log.Infof("Reconnected to NATS, resuming task fetching")
+
+	m.notify()
+
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+// notify wakes up everyone waiting for a state change
+func (m *connectionMonitor) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// waitConnected waits for the connection to be connected, returns ErrConnectionClosed when it will not reconnect
+func (m *connectionMonitor) waitConnected(ctx context.Context) error {
+	for {
+		m.mu.Lock()
+		changed := m.changed
+		state := connectionState(m.nc.Status())
+		m.mu.Unlock()
+
+		switch state {
+		case ConnectionConnected:
+			return nil
+		case ConnectionClosed:
+			return ErrConnectionClosed
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ConnectionStatus reports the state of the connection to the NATS server, clients using a StorageBackend() without a
+// NATS connection are always reported as connected
+func (c *Client) ConnectionStatus() ConnectionStatus {
+	if c.conn == nil {
+		return ConnectionStatus{State: ConnectionConnected}
+	}
+
+	return c.conn.status()
+}
+
+// OnDisconnect registers cb to be called with the cause whenever the connection to the NATS server is lost, including
+// when it is closed. Callbacks are called sequentially and should not block
+func (c *Client) OnDisconnect(cb func(err error)) {
+	if c.conn == nil || cb == nil {
+		return
+	}
+
+	c.conn.mu.Lock()
+	c.conn.onDisconnect = append(c.conn.onDisconnect, cb)
+	c.conn.mu.Unlock()
+}
+
+// OnReconnect registers cb to be called whenever the connection to the NATS server is restored. Callbacks are called
+// sequentially and should not block
+func (c *Client) OnReconnect(cb func()) {
+	if c.conn == nil || cb == nil {
+		return
+	}
+
+	c.conn.mu.Lock()
+	c.conn.onReconnect = append(c.conn.onReconnect, cb)
+	c.conn.mu.Unlock()
+}
+
+// waitConnected waits until the client is connected to the NATS server
+func (c *Client) waitConnected(ctx context.Context) error {
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.waitConnected(ctx)
+}
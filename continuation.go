@@ -0,0 +1,65 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+)
+
+// Continuation is returned by handlers to complete their task and enqueue follow-up tasks, see Continue()
+type Continuation struct {
+	// Result is stored as the result payload of the completed task
+	Result any
+	// Tasks are enqueued before the task is marked completed
+	Tasks []*Task
+}
+
+// Continue creates a Continuation for a handler to return, its task is completed with result and tasks are enqueued
+// using the client handling it, like EnqueueTask(). The follow-up tasks are first stored with the task so should
+// the client stop before all are enqueued the remaining ones are enqueued when the task is delivered again, without
+// calling the handler again. Follow-up tasks are enqueued only if absent so one that was already enqueued is skipped
+func Continue(result any, tasks ...*Task) *Continuation {
+	return &Continuation{Result: result, Tasks: tasks}
+}
+
+// recordContinuation stores the follow-up tasks with t so they are not lost should enqueueing them be interrupted
+func (c *Client) recordContinuation(ctx context.Context, t *Task, result any, tasks []*Task) error {
+	for _, next := range tasks {
+		if next == nil {
+			return fmt.Errorf("%w: follow-up task is nil", ErrInvalidContinuation)
+		}
+
+		if schema, ok := c.opts.payloadSchemas[next.Type]; ok {
+			err := validateTaskPayload(schema, next)
+			if err != nil {
+				return fmt.Errorf("%w: follow-up task %s: %v", ErrInvalidContinuation, next.ID, err)
+			}
+		}
+	}
+
+	t.Continuations = tasks
+	t.Result = &TaskResult{Payload: result, Object: t.resultObject()}
+
+	return c.storage.SaveTaskState(ctx, t, false)
+}
+
+// completeContinuation enqueues the recorded follow-up tasks of t and then completes it
+func (c *Client) completeContinuation(ctx context.Context, t *Task) error {
+	for _, next := range t.Continuations {
+		_, err := c.EnqueueTaskIfAbsent(ctx, next)
+		if err != nil {
+			return fmt.Errorf("could not enqueue follow-up task %s: %w", next.ID, err)
+		}
+	}
+
+	var result any
+	if t.Result != nil {
+		result = t.Result.Payload
+	}
+	t.Continuations = nil
+
+	return c.setTaskSuccess(ctx, t, result)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Continuation", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		client *Client
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+
+		var err error
+		client, err = NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { cancel() })
+
+	It("Should enqueue follow-up tasks and complete the task", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("order:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			next, err := NewTask("order:ship", nil, TaskID("ship:1"))
+			if err != nil {
+				return nil, err
+			}
+			return Continue("created", next), nil
+		})
+		router.HandleFunc("order:ship", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return "shipped", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("order:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`"created"`))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.Continuations).To(BeEmpty())
+
+		Eventually(func() TaskState {
+			next, err := client.LoadTaskByID("ship:1")
+			if err != nil {
+				return TaskStateUnknown
+			}
+			return next.State
+		}).Should(Equal(TaskStateCompleted))
+	})
+
+	It("Should enqueue recorded follow-up tasks without calling the handler again", func() {
+		var called atomic.Int32
+		router := NewTaskRouter()
+		router.HandleFunc("order:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			called.Add(1)
+			return nil, nil
+		})
+		router.HandleFunc("order:ship", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return "shipped", nil
+		})
+
+		task, err := NewTask("order:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		// a client stopped after recording the follow-up tasks, one of which it enqueued
+		shipped, err := NewTask("order:ship", nil, TaskID("ship:1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, shipped)).To(Succeed())
+		invoiced, err := NewTask("order:ship", nil, TaskID("ship:2"))
+		Expect(err).ToNot(HaveOccurred())
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		task.State = TaskStateActive
+		task.Tries = 1
+		task.LastTriedAt = &time.Time{}
+		Expect(client.recordContinuation(ctx, task, "created", []*Task{shipped, invoiced})).To(Succeed())
+
+		go client.Run(ctx, router)
+
+		Eventually(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateCompleted))
+		Expect(task.Result.Payload).To(Equal("created"))
+		Expect(task.Tries).To(Equal(1))
+		Expect(called.Load()).To(BeZero())
+
+		for _, id := range []string{"ship:1", "ship:2"} {
+			Eventually(func() TaskState {
+				next, err := client.LoadTaskByID(id)
+				if err != nil {
+					return TaskStateUnknown
+				}
+				return next.State
+			}).Should(Equal(TaskStateCompleted))
+		}
+	})
+
+	It("Should retry tasks with invalid continuations", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("order:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return Continue(nil, nil), nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("order:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(func() string {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.LastErr
+		}).Should(Equal("invalid continuation: follow-up task is nil"))
+		Expect(task.Continuations).To(BeEmpty())
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// PayloadEncryptedHeader is the header on stored tasks that indicates the payload is encrypted
+const PayloadEncryptedHeader = "AJ-Payload-Encrypted"
+
+// Crypter encrypts and decrypts task payloads stored in JetStream, configured using PayloadEncryption()
+type Crypter interface {
+	// Encrypt encrypts plaintext
+	Encrypt(plaintext []byte) ([]byte, error)
+	// Decrypt decrypts ciphertext produced by Encrypt
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+type aesGCMCrypter struct {
+	aead cipher.AEAD
+}
+
+// NewAESGCMCrypter creates a Crypter that uses AES-256 in GCM mode with a key derived from secret using SHA-256,
+// every payload is encrypted with a unique random nonce that is stored with the ciphertext
+func NewAESGCMCrypter(secret []byte) (Crypter, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret is required")
+	}
+
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesGCMCrypter{aead: aead}, nil
+}
+
+func (c *aesGCMCrypter) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *aesGCMCrypter) Decrypt(ciphertext []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	if len(ciphertext) < ns+c.aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	return c.aead.Open(nil, ciphertext[:ns], ciphertext[ns:], nil)
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+	Describe("NewAESGCMCrypter", func() {
+		It("Should encrypt and decrypt payloads", func() {
+			_, err := NewAESGCMCrypter(nil)
+			Expect(err).To(MatchError("secret is required"))
+
+			c, err := NewAESGCMCrypter([]byte("s3cret"))
+			Expect(err).ToNot(HaveOccurred())
+
+			ct1, err := c.Encrypt([]byte("hello world"))
+			Expect(err).ToNot(HaveOccurred())
+			ct2, err := c.Encrypt([]byte("hello world"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ct1).ToNot(Equal(ct2))
+			Expect(bytes.Contains(ct1, []byte("hello"))).To(BeFalse())
+
+			pt, err := c.Decrypt(ct1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pt).To(Equal([]byte("hello world")))
+
+			other, err := NewAESGCMCrypter([]byte("other"))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = other.Decrypt(ct1)
+			Expect(err).To(HaveOccurred())
+
+			_, err = c.Decrypt([]byte("short"))
+			Expect(err).To(MatchError("ciphertext too short"))
+		})
+	})
+
+	Describe("PayloadEncryption", func() {
+		It("Should store ciphertext and load decrypted payloads", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				crypter, err := NewAESGCMCrypter([]byte("s3cret"))
+				Expect(err).ToNot(HaveOccurred())
+
+				encrypted, err := NewClient(NatsConn(nc), PayloadEncryption(crypter), PayloadCompression(GzipCompression))
+				Expect(err).ToNot(HaveOccurred())
+				plain, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", map[string]string{"ssn": "123-45-6789"})
+				Expect(err).ToNot(HaveOccurred())
+				payload := task.Payload
+				Expect(encrypted.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+				Expect(task.Payload).To(Equal(payload))
+
+				_, stream, err := encrypted.StorageAdmin().TasksStore()
+				Expect(err).ToNot(HaveOccurred())
+				msg, err := stream.ReadLastMessageForSubject(fmt.Sprintf(TasksStreamSubjectPattern, task.ID))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Contains(msg.Data, []byte("123-45-6789"))).To(BeFalse())
+				hdrs, err := decodeHeadersMsg(msg.Header)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdrs.Get(PayloadEncryptedHeader)).To(Equal("true"))
+
+				loaded, err := encrypted.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Payload).To(Equal(payload))
+
+				_, err = plain.LoadTaskByID(task.ID)
+				Expect(err).To(MatchError(ErrTaskPayloadEncrypted))
+
+				tasks, err := plain.ListTasks(ctx, TaskFilter{})
+				Expect(err).ToNot(HaveOccurred())
+				defer tasks.Close()
+				Expect(tasks.Next()).To(BeTrue())
+				Expect(tasks.Task().ID).To(Equal(task.ID))
+				Expect(tasks.Task().Payload).To(BeEmpty())
+				Expect(tasks.Next()).To(BeFalse())
+				Expect(tasks.Err()).ToNot(HaveOccurred())
+
+				storage := encrypted.storage.(*jetStreamStorage)
+				dlq := &Queue{Name: "DLQ"}
+				Expect(storage.PrepareQueue(dlq, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.DeadLetterTask(ctx, dlq, loaded)).ToNot(HaveOccurred())
+
+				dmsg, err := storage.qStreams["DLQ"].ReadLastMessageForSubject(fmt.Sprintf(WorkStreamSubjectPattern, "DLQ", task.ID))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(bytes.Contains(dmsg.Data, []byte("123-45-6789"))).To(BeFalse())
+
+				Expect(storage.ReplayDeadLetter(ctx, dlq, task.ID)).ToNot(HaveOccurred())
+				loaded, err = encrypted.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Payload).To(Equal(payload))
+				Expect(loaded.State).To(Equal(TaskStateRetry))
+			})
+		})
+	})
+})
@@ -12,12 +12,48 @@ import (
 var (
 	// ErrTaskNotFound is the error indicating a task does not exist rather than a failure to load
 	ErrTaskNotFound = errors.New("task not found")
-	// ErrTerminateTask indicates that a task failed, and no further processing attempts should be made
+	// ErrTerminateTask indicates that a task failed, and no further processing attempts should be made, see Terminate()
 	ErrTerminateTask = fmt.Errorf("terminate task")
 	// ErrNoTasks indicates the task store is empty
 	ErrNoTasks = fmt.Errorf("no tasks found")
 	// ErrTaskPastDeadline indicates a task that was scheduled for handling is past its deadline
 	ErrTaskPastDeadline = fmt.Errorf("past deadline")
+	// ErrTaskDeadlineBeforeSchedule indicates a task has a deadline that is before the time it is scheduled for
+	ErrTaskDeadlineBeforeSchedule = fmt.Errorf("deadline is before the scheduled time")
+	// ErrTaskResultTooLarge indicates a handler returned a result larger than the client MaxResultSize(), tasks are not retried
+	ErrTaskResultTooLarge = fmt.Errorf("%w: task result too large", ErrTerminateTask)
+	// ErrTaskPayloadTooLarge indicates a task payload is larger than the client MaxPayloadSize() and was not enqueued
+	ErrTaskPayloadTooLarge = fmt.Errorf("task payload too large")
+	// ErrTaskPayloadInvalid indicates a task payload does not match the JSON Schema registered for its type, tasks are not retried
+	ErrTaskPayloadInvalid = fmt.Errorf("%w: task payload does not match schema", ErrTerminateTask)
+	// ErrInvalidCloudEvent indicates a CloudEvent is not valid or not supported
+	ErrInvalidCloudEvent = fmt.Errorf("invalid cloud event")
+	// ErrInvalidPayloadSchema indicates a JSON Schema for task payloads could not be compiled
+	ErrInvalidPayloadSchema = fmt.Errorf("invalid payload schema")
+	// ErrQueueItemDiscarded indicates the queue item of a task was discarded because the queue was full
+	ErrQueueItemDiscarded = fmt.Errorf("discarded from full queue")
+	// ErrTaskPayloadTypeMismatch indicates a protobuf payload was decoded into a message of a different type
+	ErrTaskPayloadTypeMismatch = fmt.Errorf("task payload type mismatch")
+	// ErrTaskTTLInvalid indicates an invalid TTL was supplied for a task
+	ErrTaskTTLInvalid = fmt.Errorf("invalid task ttl")
+	// ErrTaskPastAbsoluteMaxAge indicates a task was older than the AbsoluteMaxAge of its queue when it was fetched
+	ErrTaskPastAbsoluteMaxAge = fmt.Errorf("task exceeds the queue absolute max age")
+	// ErrTaskPastTTL indicates a task was not handled within its TTL of being enqueued
+	ErrTaskPastTTL = fmt.Errorf("task ttl expired")
+	// ErrTaskInFlight indicates a task could not be changed because it is being handled
+	ErrTaskInFlight = fmt.Errorf("task is in flight")
+	// ErrTaskNotWaiting indicates a task could not be changed because it is not waiting to be processed
+	ErrTaskNotWaiting = fmt.Errorf("task is not waiting to be processed")
+	// ErrTaskTagInvalid indicates an invalid tag was supplied for a task
+	ErrTaskTagInvalid = fmt.Errorf("invalid task tag")
+	// ErrRetryAfter indicates a handler requested its task be tried again later, see RetryAfter()
+	ErrRetryAfter = fmt.Errorf("retry requested")
+	// ErrTaskSkipped indicates a handler skipped its task as it is obsolete, see SkipTask()
+	ErrTaskSkipped = fmt.Errorf("task skipped")
+	// ErrTaskMetaInvalid indicates invalid metadata was supplied for a task
+	ErrTaskMetaInvalid = fmt.Errorf("invalid task metadata")
+	// ErrTaskCanceled indicates a task was canceled before it could be processed
+	ErrTaskCanceled = fmt.Errorf("task canceled")
 	// ErrTaskExceedsMaxTries indicates a task exceeded its maximum attempts
 	ErrTaskExceedsMaxTries = fmt.Errorf("exceeded maximum tries")
 	// ErrTaskAlreadyActive indicates that a task is already in the active state
@@ -28,12 +64,36 @@ var (
 	ErrTaskUpdateFailed = fmt.Errorf("failed updating task state")
 	// ErrTaskAlreadyInState indicates an update failed because a task was already in the desired state
 	ErrTaskAlreadyInState = fmt.Errorf("%w, already in desired state", ErrTaskUpdateFailed)
+	// ErrConflict indicates an update failed because the stored task changed since it was loaded, the task should be loaded again and the update retried
+	ErrConflict = fmt.Errorf("%w, task was modified concurrently", ErrTaskUpdateFailed)
 	// ErrTaskLoadFailed indicates a task failed for an unknown reason
 	ErrTaskLoadFailed = fmt.Errorf("loading task failed")
+	// ErrTaskIDInvalid indicates an invalid task ID was given
+	ErrTaskIDInvalid = fmt.Errorf("task id is invalid")
+	// ErrTaskAlreadyExists indicates a task with the same ID is already stored
+	ErrTaskAlreadyExists = fmt.Errorf("task already exists")
+	// ErrTaskCapabilityInvalid indicates an invalid capability was required of workers handling a task
+	ErrTaskCapabilityInvalid = fmt.Errorf("invalid task capability")
 	// ErrTaskTypeRequired indicates an empty task type was given
 	ErrTaskTypeRequired = fmt.Errorf("task type is required")
 	// ErrTaskTypeInvalid indicates an invalid task type was given
 	ErrTaskTypeInvalid = fmt.Errorf("task type is invalid")
+	// ErrTaskPriorityInvalid indicates an invalid task priority was given
+	ErrTaskPriorityInvalid = fmt.Errorf("task priority is invalid")
+	// ErrResultStreamingNotEnabled indicates results can not be streamed as the client does not use StreamedResults()
+	ErrResultStreamingNotEnabled = fmt.Errorf("result streaming is not enabled")
+	// ErrTaskResultNotStreamed indicates the handler of a task did not stream a result
+	ErrTaskResultNotStreamed = fmt.Errorf("task has no streamed result")
+	// ErrTaskDeduplicationNotEnabled indicates a task with a deduplication key was enqueued without deduplication being configured
+	ErrTaskDeduplicationNotEnabled = fmt.Errorf("task deduplication is not enabled")
+	// ErrTaskTypeLocked indicates a task type limited to one active task already has an active task
+	ErrTaskTypeLocked = fmt.Errorf("task type is locked by an active task")
+	// ErrTaskTypeLockLost indicates a task type lock expired or was taken over by another task
+	ErrTaskTypeLockLost = fmt.Errorf("task type lock lost")
+	// ErrTaskTypeLockStoreNotPrepared indicates task type locks were used before the lock store was prepared
+	ErrTaskTypeLockStoreNotPrepared = fmt.Errorf("task type lock store not prepared")
+	// ErrDuplicateTask indicates a task with the same deduplication key is already pending
+	ErrDuplicateTask = fmt.Errorf("duplicate task")
 	// ErrTaskDependenciesFailed indicates that the task cannot be run as its dependencies failed
 	ErrTaskDependenciesFailed = fmt.Errorf("task dependencies failed")
 	// ErrTaskAlreadySigned indicates a task is already signed
@@ -44,12 +104,45 @@ var (
 	ErrTaskNotSigned = fmt.Errorf("task is not signed")
 	// ErrTaskSignatureInvalid indicates a signature did not pass validation
 	ErrTaskSignatureInvalid = fmt.Errorf("invalid task signature")
+	// ErrTaskFailed indicates a task reached a final state other than completed
+	ErrTaskFailed = fmt.Errorf("task failed")
 
+	// ErrTaskPanicked indicates that a task handler panicked
+	ErrTaskPanicked = fmt.Errorf("task handler panicked")
+	// ErrHandlerTimeLimit indicates a task handler was stopped for exceeding the HandlerTimeLimit()
+	ErrHandlerTimeLimit = fmt.Errorf("task handler exceeded its time limit")
+	// ErrHandlerMemoryLimit indicates a task handler was stopped while memory use exceeded the HandlerMemoryLimit()
+	ErrHandlerMemoryLimit = fmt.Errorf("task handler exceeded the memory limit")
 	// ErrNoHandlerForTaskType indicates that a task could not be handled by any known handlers
 	ErrNoHandlerForTaskType = fmt.Errorf("no handler for task type")
 	// ErrDuplicateHandlerForTaskType indicates a task handler for a specific type is already registered
 	ErrDuplicateHandlerForTaskType = fmt.Errorf("duplicate handler for task type")
 
+	// ErrProcessorDraining indicates that a task was not processed as the client is draining
+	ErrProcessorDraining = fmt.Errorf("processor is draining")
+
+	// ErrCompressionUnsupported indicates an unknown payload compression algorithm was requested
+	ErrCompressionUnsupported = fmt.Errorf("unsupported compression algorithm")
+	// ErrTaskPayloadDecompress indicates a stored task payload could not be decompressed
+	ErrTaskPayloadDecompress = fmt.Errorf("could not decompress task payload")
+	// ErrTaskPayloadEncrypt indicates a task payload could not be encrypted
+	ErrTaskPayloadEncrypt = fmt.Errorf("could not encrypt task payload")
+	// ErrTaskPayloadDecrypt indicates a stored task payload could not be decrypted
+	ErrTaskPayloadDecrypt = fmt.Errorf("could not decrypt task payload")
+	// ErrTaskPayloadEncrypted indicates a stored task payload is encrypted but no Crypter is configured
+	ErrTaskPayloadEncrypted = fmt.Errorf("task payload is encrypted")
+	// ErrHandlerTimeout indicates a handler registered using HandleFuncTimeout did not complete in time
+	ErrHandlerTimeout = fmt.Errorf("handler timeout")
+	// ErrInvalidHandlerTimeout indicates an invalid timeout was given when registering a handler
+	ErrInvalidHandlerTimeout = fmt.Errorf("invalid handler timeout")
+	// ErrInvalidTaskTypePattern indicates an invalid pattern was used when registering a handler
+	ErrInvalidTaskTypePattern = fmt.Errorf("invalid task type pattern")
+	// ErrInvalidRateLimit indicates an invalid rate limit was configured for a task type
+	ErrInvalidRateLimit = fmt.Errorf("invalid rate limit")
+	// ErrEnqueueRateLimited indicates a task was not enqueued as waiting for the EnqueueRateLimit() would exceed the context deadline, the enqueue can be tried again later
+	ErrEnqueueRateLimited = fmt.Errorf("enqueue rate limit exceeded")
+	// ErrInvalidProgress indicates invalid progress was reported by a handler
+	ErrInvalidProgress = fmt.Errorf("invalid progress")
 	// ErrInvalidHeaders indicates that message headers from JetStream were not valid
 	ErrInvalidHeaders = fmt.Errorf("coult not decode headers")
 	// ErrContextWithoutDeadline indicates a context.Context was passed without deadline when it was expected
@@ -58,6 +151,12 @@ var (
 	ErrInvalidStorageItem = fmt.Errorf("invalid storage item")
 	// ErrNoNatsConn indicates that a nil connection was supplied
 	ErrNoNatsConn = fmt.Errorf("no NATS connection supplied")
+	// ErrConnectionClosed indicates the connection to the NATS server was closed and will not be reconnected
+	ErrConnectionClosed = fmt.Errorf("connection closed")
+	// ErrInvalidContinuation indicates a handler returned a Continuation that can not be enqueued
+	ErrInvalidContinuation = fmt.Errorf("invalid continuation")
+	// ErrInvalidClientOptions indicates the options given to NewClient are invalid, see ClientOptionsError
+	ErrInvalidClientOptions = fmt.Errorf("invalid client options")
 	// ErrNoMux indicates that a processor was started with no routing mux configured
 	ErrNoMux = fmt.Errorf("mux is required")
 	// ErrStorageNotReady indicates the underlying storage is not ready
@@ -67,10 +166,18 @@ var (
 	ErrQueueNotFound = errors.New("queue not found")
 	// ErrQueueConsumerNotFound indicates that the Work Queue store has no consumers defined
 	ErrQueueConsumerNotFound = errors.New("queue consumer not found")
+	// ErrQueueInvalidSettings indicates a queue was configured with settings that conflict with each other
+	ErrQueueInvalidSettings = fmt.Errorf("invalid queue settings")
+	// ErrQueueAlreadyExists indicates a queue that was being created already exists
+	ErrQueueAlreadyExists = fmt.Errorf("queue already exists")
+	// ErrQueueSettingImmutable indicates an update to a queue changes a setting that JetStream can not change on an existing queue
+	ErrQueueSettingImmutable = fmt.Errorf("queue setting can not be changed")
 	// ErrQueueNameRequired indicates a queue has no name
 	ErrQueueNameRequired = fmt.Errorf("queue name is required")
 	// ErrQueueItemCorrupt indicates that an item received from the work queue was invalid - perhaps invalid JSON
 	ErrQueueItemCorrupt = fmt.Errorf("corrupt queue item received")
+	// ErrQueueItemUnsupported indicates an item of a kind that cannot be processed was received, like a dead letter item
+	ErrQueueItemUnsupported = fmt.Errorf("unsupported queue item received")
 	// ErrQueueItemInvalid is an item read from the queue with no data or obviously bad data
 	ErrQueueItemInvalid = fmt.Errorf("invalid queue item received")
 	// ErrInvalidQueueState indicates a queue was attempted to be used but no internal state is known of that queue
@@ -114,4 +221,27 @@ var (
 	ErrScheduledTaskInvalid = errors.New("invalid scheduled task")
 	// ErrScheduledTaskShortDeadline indicates the time allowed for task execution is too short
 	ErrScheduledTaskShortDeadline = errors.New("deadline too short")
+	// ErrLeaderElectionInvalid indicates a leader election was created with invalid settings
+	ErrLeaderElectionInvalid = errors.New("invalid leader election")
+	// ErrNotLeader indicates a task was handled by a process that is not the elected leader
+	ErrNotLeader = errors.New("not the elected leader")
+	// ErrScheduleCatchUpInvalid indicates an unknown catch-up policy was supplied to the task scheduler
+	ErrScheduleCatchUpInvalid = errors.New("invalid catch-up policy")
+	// ErrScheduleJitterInvalid indicates a schedule jitter is negative or not shorter than the time between ticks of the schedule
+	ErrScheduleJitterInvalid = errors.New("invalid schedule jitter")
 )
+
+// DuplicateTaskError is ErrDuplicateTask for an enqueue that failed because the task TaskID holds the deduplication
+// key, storage returns it for tasks with Task.MatchPending() set
+type DuplicateTaskError struct {
+	// TaskID is the ID of the task holding the deduplication key
+	TaskID string
+}
+
+func (e *DuplicateTaskError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrDuplicateTask, e.TaskID)
+}
+
+func (e *DuplicateTaskError) Is(target error) bool {
+	return target == ErrDuplicateTask
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	// fairShareRetryDelay is the minimum time a task of a type using more than its share is deferred for
+	fairShareRetryDelay = 500 * time.Millisecond
+	// fairShareWindow is how long after a task of a type was received it is considered to be waiting for a slot
+	fairShareWindow = 5 * time.Second
+)
+
+func fairShareDelay() time.Duration {
+	return fairShareRetryDelay + time.Duration(rand.Int63n(int64(fairShareRetryDelay)))
+}
+
+// fairShareLimit is the most tasks of taskType that may be handled concurrently while tasks of other types are
+// waiting, 0 when the type is not limited
+func (p *processor) fairShareLimit(taskType string) int {
+	share, ok := p.c.opts.taskTypeShares[taskType]
+	if !ok {
+		share = p.c.opts.fairShare
+	}
+	if share <= 0 {
+		return 0
+	}
+
+	limit := int(math.Ceil(share * float64(p.concurrency)))
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit
+}
+
+// overFairShare determines if task should be deferred as its type already uses its share of the concurrency while
+// tasks of other types that are below their share were received recently and more items are waiting in the queue. The
+// type of every task received is recorded, must be called with p.mu held
+func (p *processor) overFairShare(task *Task, item *ProcessItem) bool {
+	if p.c.opts.fairShare <= 0 && len(p.c.opts.taskTypeShares) == 0 {
+		return false
+	}
+
+	now := p.c.opts.clock.Now()
+	p.typeSeen[task.Type] = now
+
+	limit := p.fairShareLimit(task.Type)
+	if limit == 0 || p.typeActive[task.Type] < limit || item.pending == 0 {
+		return false
+	}
+
+	for other, seen := range p.typeSeen {
+		if now.Sub(seen) > fairShareWindow {
+			delete(p.typeSeen, other)
+			continue
+		}
+
+		if other == task.Type {
+			continue
+		}
+
+		otherLimit := p.fairShareLimit(other)
+		if otherLimit == 0 || p.typeActive[other] < otherLimit {
+			return true
+		}
+	}
+
+	return false
+}
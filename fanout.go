@@ -0,0 +1,101 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// EnqueueFanout enqueues a copy of task to every named queue, each copy is a distinct task that is handled and retried
+// independently. Copies have the ID of task followed by : and the queue name and share the ID of task as their
+// FanoutID, use FanoutTasks() to find them. All queues are tried even when enqueueing to some fail, the first
+// failure is returned. Copies that already exist are loaded rather than enqueued again so a failed fan-out can be
+// retried with the same task.
+func (c *Client) EnqueueFanout(ctx context.Context, task *Task, queues ...string) ([]*Task, error) {
+	if len(queues) == 0 {
+		return nil, ErrQueueNameRequired
+	}
+
+	seen := map[string]struct{}{}
+	for _, q := range queues {
+		if _, ok := seen[q]; ok {
+			return nil, fmt.Errorf("queue %s is listed more than once", q)
+		}
+		seen[q] = struct{}{}
+	}
+
+	var failed error
+	copies := make([]*Task, 0, len(queues))
+
+	for _, q := range queues {
+		cp, err := task.fanoutCopy(q)
+		if err != nil {
+			return copies, err
+		}
+
+		err = c.EnqueueTaskToQueue(ctx, q, cp)
+		if errors.Is(err, ErrTaskAlreadyExists) {
+			cp, err = c.LoadTaskByID(cp.ID)
+		}
+		if err != nil {
+			if failed == nil {
+				failed = fmt.Errorf("enqueueing to queue %s failed: %w", q, err)
+			}
+			continue
+		}
+
+		copies = append(copies, cp)
+	}
+
+	return copies, failed
+}
+
+// FanoutTasks loads all copies of a task enqueued using EnqueueFanout(), every task is read from storage to find them
+func (c *Client) FanoutTasks(ctx context.Context, fanoutID string) ([]*Task, error) {
+	if fanoutID == "" {
+		return nil, fmt.Errorf("fanout id is required")
+	}
+
+	tasks, err := c.ListTasks(ctx, TaskFilter{FanoutID: fanoutID})
+	if err != nil {
+		return nil, err
+	}
+	defer tasks.Close()
+
+	var found []*Task
+	for tasks.Next() {
+		found = append(found, tasks.Task())
+	}
+
+	return found, tasks.Err()
+}
+
+// fanoutCopy creates the copy of t enqueued to queue by EnqueueFanout()
+func (t *Task) fanoutCopy(queue string) (*Task, error) {
+	id := fmt.Sprintf("%s:%s", t.ID, queue)
+	if !IsValidName(id) || len(id) > MaxTaskIDLength {
+		return nil, fmt.Errorf("%w: fanout copy %s", ErrTaskIDInvalid, id)
+	}
+
+	j, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &Task{}
+	err = json.Unmarshal(j, cp)
+	if err != nil {
+		return nil, err
+	}
+
+	cp.ID = id
+	cp.FanoutID = t.ID
+	cp.payloadValue = t.payloadValue
+
+	return cp, nil
+}
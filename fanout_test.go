@@ -0,0 +1,84 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Fanout", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		client *Client
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+
+		var err error
+		client, err = NewClient(StorageBackend(NewInMemoryStorage()), AutoCreateQueue(true))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { cancel() })
+
+	It("Should enqueue a copy of the task to every queue", func() {
+		task, err := NewTask("order:new", map[string]int{"id": 1}, TaskID("order:1"), TaskTags(map[string]string{"shop": "eu"}))
+		Expect(err).ToNot(HaveOccurred())
+
+		copies, err := client.EnqueueFanout(ctx, task, "BILLING", "SHIPPING")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(copies).To(HaveLen(2))
+
+		for i, q := range []string{"BILLING", "SHIPPING"} {
+			Expect(copies[i].ID).To(Equal("order:1:" + q))
+			Expect(copies[i].Queue).To(Equal(q))
+
+			loaded, err := client.LoadTaskByID(copies[i].ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(loaded.FanoutID).To(Equal("order:1"))
+			Expect(loaded.Payload).To(MatchJSON(`{"id":1}`))
+			Expect(loaded.Tags).To(Equal(map[string]string{"shop": "eu"}))
+			Expect(loaded.State).To(Equal(TaskStateNew))
+		}
+
+		// the template itself is not stored
+		_, err = client.LoadTaskByID("order:1")
+		Expect(err).To(MatchError(ErrTaskNotFound))
+
+		// retrying loads the existing copies
+		copies, err = client.EnqueueFanout(ctx, task, "BILLING", "SHIPPING")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(copies).To(HaveLen(2))
+
+		other, err := NewTask("order:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, other)).To(Succeed())
+
+		siblings, err := client.FanoutTasks(ctx, "order:1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(siblings).To(HaveLen(2))
+		for _, s := range siblings {
+			Expect(s.FanoutID).To(Equal("order:1"))
+		}
+	})
+
+	It("Should validate the queues", func() {
+		task, err := NewTask("order:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = client.EnqueueFanout(ctx, task)
+		Expect(err).To(MatchError(ErrQueueNameRequired))
+		_, err = client.EnqueueFanout(ctx, task, "BILLING", "BILLING")
+		Expect(err).To(MatchError("queue BILLING is listed more than once"))
+		_, err = client.FanoutTasks(ctx, "")
+		Expect(err).To(MatchError("fanout id is required"))
+	})
+})
@@ -0,0 +1,209 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/choria-io/asyncjobs/election"
+)
+
+// LeaderElection allows a single member of a group of processes to be elected leader
+// for a named component, useful for gating singleton handlers or schedulers.
+//
+// Leadership is held using a lease in the CHORIA_AJ_ELECTIONS bucket that is renewed
+// in the background, loss of the lease is surfaced by closing the Resigned() channel.
+type LeaderElection struct {
+	name      string
+	component string
+	s         ScheduledTaskStorage
+	log       Logger
+
+	election election.Election
+	backoff  election.Backoff
+	started  bool
+	leader   bool
+	won      chan struct{}
+	resigned chan struct{}
+	mu       sync.Mutex
+}
+
+// NewLeaderElection creates a new leader election for component, name is a unique name for this member of the election
+func (c *Client) NewLeaderElection(name string, component string) (*LeaderElection, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrLeaderElectionInvalid)
+	}
+	if !IsValidName(component) {
+		return nil, fmt.Errorf("%w: component must match %s", ErrLeaderElectionInvalid, validNameMatcher.String())
+	}
+
+	s := c.ScheduledTasksStorage()
+	if s == nil {
+		return nil, ErrStorageNotReady
+	}
+
+	resigned := make(chan struct{})
+	close(resigned)
+
+	return &LeaderElection{
+		name:      name,
+		component: component,
+		s:         s,
+		log:       c.log,
+		won:       make(chan struct{}),
+		resigned:  resigned,
+	}, nil
+}
+
+// Campaign starts campaigning for leadership and blocks until leadership is won or ctx is cancelled.
+//
+// Campaigning continues in the background until ctx is cancelled, after losing leadership
+// Campaign can be called again to wait until leadership is regained
+func (e *LeaderElection) Campaign(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.started {
+		err := e.start(ctx)
+		if err != nil {
+			e.mu.Unlock()
+			return err
+		}
+	}
+	if e.leader {
+		e.mu.Unlock()
+		return nil
+	}
+	won := e.won
+	e.mu.Unlock()
+
+	select {
+	case <-won:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsLeader determines if this member is currently the leader
+func (e *LeaderElection) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.leader
+}
+
+// Resigned is a channel that will be closed when the current leadership is lost, it is closed already when not leader
+func (e *LeaderElection) Resigned() <-chan struct{} {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.resigned
+}
+
+// notLeaderRetryDelay is the minimum time tasks received while not leader are returned to the queue for
+var notLeaderRetryDelay = time.Second
+
+// Middleware creates a middleware that defers tasks received while not the leader, they are tried again after a short
+// delay without counting a try, the error matches both ErrNotLeader and ErrRetryAfter. The context passed to the
+// handler is cancelled should leadership be lost while the handler is running
+func (e *LeaderElection) Middleware() MiddlewareFunc {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, log Logger, t *Task) (any, error) {
+			e.mu.Lock()
+			leader := e.leader
+			resigned := e.resigned
+			e.mu.Unlock()
+
+			if !leader {
+				delay := notLeaderRetryDelay + time.Duration(rand.Int63n(int64(notLeaderRetryDelay)))
+				return nil, retryAfterBecause(delay, ErrNotLeader)
+			}
+
+			lctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			go func() {
+				select {
+				case <-resigned:
+					log.Warnf("Leadership of %s lost while handling task %s, cancelling handler context", e.component, t.ID)
+					cancel()
+				case <-lctx.Done():
+				}
+			}()
+
+			return next(lctx, log, t)
+		}
+	}
+}
+
+func (e *LeaderElection) start(ctx context.Context) error {
+	bucket, err := e.s.ElectionStorage()
+	if err != nil {
+		return err
+	}
+
+	opts := []election.Option{election.OnWon(e.onWon), election.OnLost(e.onLost)}
+	if e.backoff != nil {
+		opts = append(opts, election.WithBackoff(e.backoff))
+	}
+
+	e.election, err = election.NewElection(e.name, e.component, bucket, opts...)
+	if err != nil {
+		return err
+	}
+
+	e.started = true
+
+	e.log.Infof("Starting leader election for %s as %s", e.component, e.name)
+	go func() {
+		err := e.election.Start(ctx)
+		if err != nil {
+			e.log.Errorf("Election for %s failed: %v", e.component, err)
+		}
+
+		e.mu.Lock()
+		e.started = false
+		e.mu.Unlock()
+
+		e.onLost()
+	}()
+
+	return nil
+}
+
+func (e *LeaderElection) onWon() {
+	e.mu.Lock()
+	if e.leader {
+		e.mu.Unlock()
+		return
+	}
+
+	e.leader = true
+	e.resigned = make(chan struct{})
+	close(e.won)
+	e.mu.Unlock()
+
+	e.s.PublishLeaderElectedEvent(context.Background(), e.name, e.component)
+
+	e.log.Infof("Became leader for %s", e.component)
+}
+
+func (e *LeaderElection) onLost() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.leader {
+		return
+	}
+
+	e.leader = false
+	e.won = make(chan struct{})
+	close(e.resigned)
+
+	e.log.Warnf("Leadership lost for %s", e.component)
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LeaderElection", func() {
+	Describe("NewLeaderElection", func() {
+		It("Should validate the settings", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = client.NewLeaderElection("", "ginkgo")
+				Expect(err).To(MatchError(ErrLeaderElectionInvalid))
+				_, err = client.NewLeaderElection("ginkgo", "in valid")
+				Expect(err).To(MatchError(ErrLeaderElectionInvalid))
+
+				e, err := client.NewLeaderElection("ginkgo", "ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(e.IsLeader()).To(BeFalse())
+				Expect(e.Resigned()).To(BeClosed())
+			})
+		})
+	})
+
+	Describe("Campaign", func() {
+		It("Should elect a single leader and resign when stopped", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				fast := &RetryPolicy{Intervals: []time.Duration{250 * time.Millisecond}}
+
+				e1, err := client.NewLeaderElection("one", "ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				e1.backoff = fast
+				e2, err := client.NewLeaderElection("two", "ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				e2.backoff = fast
+
+				ctx1, cancel1 := context.WithTimeout(context.Background(), 20*time.Second)
+				defer cancel1()
+				ctx2, cancel2 := context.WithTimeout(context.Background(), 20*time.Second)
+				defer cancel2()
+
+				won := make(chan *LeaderElection, 2)
+				go func() {
+					if e1.Campaign(ctx1) == nil {
+						won <- e1
+					}
+				}()
+				go func() {
+					if e2.Campaign(ctx2) == nil {
+						won <- e2
+					}
+				}()
+
+				var leader *LeaderElection
+				Eventually(won, 10*time.Second).Should(Receive(&leader))
+				Consistently(won, time.Second).ShouldNot(Receive())
+
+				Expect(leader.IsLeader()).To(BeTrue())
+				Expect(e1.IsLeader() && e2.IsLeader()).To(BeFalse())
+				Expect(leader.Resigned()).ToNot(BeClosed())
+
+				resigned := leader.Resigned()
+				if leader == e1 {
+					cancel1()
+				} else {
+					cancel2()
+				}
+
+				Eventually(resigned, 2*time.Second).Should(BeClosed())
+				Expect(leader.IsLeader()).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("Middleware", func() {
+		It("Should only call handlers while leader", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				e, err := client.NewLeaderElection("ginkgo", "ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+
+				called := false
+				h := e.Middleware()(func(ctx context.Context, log Logger, t *Task) (any, error) {
+					called = true
+					return nil, ctx.Err()
+				})
+
+				task, _ := NewTask("ginkgo", nil)
+				_, err = h(context.Background(), &defaultLogger{}, task)
+				Expect(err).To(MatchError(ErrNotLeader))
+				Expect(err).To(MatchError(ErrRetryAfter))
+				Expect(called).To(BeFalse())
+
+				e.onWon()
+				_, err = h(context.Background(), &defaultLogger{}, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(called).To(BeTrue())
+			})
+		})
+
+		It("Should defer tasks received while not leader without counting a try", func() {
+			delay := notLeaderRetryDelay
+			notLeaderRetryDelay = 10 * time.Millisecond
+			DeferCleanup(func() { notLeaderRetryDelay = delay })
+
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				worker := func(name string, leader bool) *Client {
+					client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+					Expect(err).ToNot(HaveOccurred())
+
+					e, err := client.NewLeaderElection(name, "ginkgo")
+					Expect(err).ToNot(HaveOccurred())
+					if leader {
+						e.onWon()
+					}
+
+					router := NewTaskRouter()
+					router.Use(e.Middleware())
+					router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+						return name, nil
+					})
+					go client.Run(ctx, router)
+
+					return client
+				}
+
+				follower := worker("follower", false)
+
+				task, err := NewTask("ginkgo", nil, TaskMaxTries(1))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(follower.EnqueueTask(ctx, task)).To(Succeed())
+
+				Eventually(func() int {
+					task, err = follower.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					return task.Deferrals
+				}).Should(BeNumerically(">", 2))
+				Expect(task.Tries).To(Equal(0))
+				Expect(task.State).To(Equal(TaskStateRetry))
+				Expect(task.LastErr).To(ContainSubstring(ErrNotLeader.Error()))
+
+				worker("leader", true)
+
+				Eventually(func() TaskState {
+					task, err = follower.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					return task.State
+				}).Should(Equal(TaskStateCompleted))
+				Expect(task.Tries).To(Equal(1))
+				Expect(task.Result.Payload).To(Equal("leader"))
+			})
+		})
+	})
+})
@@ -0,0 +1,185 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type taskLeaseKey struct{}
+
+// taskLease is the context handlers run in, it expires after the queue MaxRunTime unless extended. Extending the
+// lease tells JetStream the task is still in progress so it is not redelivered while the handler is running
+type taskLease struct {
+	parent   context.Context
+	clock    clock
+	duration time.Duration
+	deadline time.Time
+	timer    clockTimer
+	extended chan struct{}
+	extender func(context.Context) error
+	done     chan struct{}
+	err      error
+	mu       sync.Mutex
+}
+
+func newTaskLease(parent context.Context, c clock, duration time.Duration, extender func(context.Context) error) *taskLease {
+	l := &taskLease{
+		parent:   parent,
+		clock:    c,
+		duration: duration,
+		deadline: c.Now().Add(duration),
+		timer:    c.NewTimer(duration),
+		extended: make(chan struct{}, 1),
+		extender: extender,
+		done:     make(chan struct{}),
+	}
+
+	go l.expire()
+
+	return l
+}
+
+// expire ends the lease once its timer fires or the parent is done, extending the lease replaces the timer
+func (l *taskLease) expire() {
+	for {
+		l.mu.Lock()
+		timer := l.timer
+		l.mu.Unlock()
+
+		select {
+		case <-timer.C():
+			l.mu.Lock()
+			current := timer == l.timer
+			l.mu.Unlock()
+
+			if current {
+				l.cancel(context.DeadlineExceeded)
+				return
+			}
+		case <-l.extended:
+		case <-l.parent.Done():
+			l.cancel(l.parent.Err())
+			return
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *taskLease) Deadline() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pd, ok := l.parent.Deadline()
+	if ok && pd.Before(l.deadline) {
+		return pd, true
+	}
+
+	return l.deadline, true
+}
+
+func (l *taskLease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *taskLease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+func (l *taskLease) Value(key any) any {
+	if _, ok := key.(taskLeaseKey); ok {
+		return l
+	}
+
+	return l.parent.Value(key)
+}
+
+// extend marks the task as in progress and restarts the lease with its full duration
+func (l *taskLease) extend(ctx context.Context) error {
+	if err := l.Err(); err != nil {
+		return err
+	}
+
+	err := l.extender(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	l.deadline = l.clock.Now().Add(l.duration)
+	l.timer.Stop()
+	l.timer = l.clock.NewTimer(l.duration)
+
+	select {
+	case l.extended <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// release ends the lease, to be called once the handler returned
+func (l *taskLease) release() {
+	l.cancel(context.Canceled)
+}
+
+func (l *taskLease) cancel(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.err != nil {
+		return
+	}
+
+	l.err = err
+	l.timer.Stop()
+	close(l.done)
+}
+
+// keepAlive extends the lease every interval until it ends
+func (l *taskLease) keepAlive(interval time.Duration, log Logger) {
+	for {
+		timer := l.clock.NewTimer(interval)
+
+		select {
+		case <-timer.C():
+			err := l.extend(l)
+			if err != nil && l.Err() == nil {
+				log.Warnf("Could not extend task lease: %v", err)
+			}
+		case <-l.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// Heartbeat tells JetStream the task being handled is still in progress and restarts the time the handler may
+// run, the queue MaxRunTime, from now. Outside of handlers it does nothing
+func Heartbeat(ctx context.Context) error {
+	lease := leaseFromContext(ctx)
+	if lease == nil {
+		return nil
+	}
+
+	return lease.extend(ctx)
+}
+
+func leaseFromContext(ctx context.Context) *taskLease {
+	l, _ := ctx.Value(taskLeaseKey{}).(*taskLease)
+	return l
+}
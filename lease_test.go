@@ -0,0 +1,133 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Lease", func() {
+	Describe("taskLease", func() {
+		It("Should expire unless extended", func() {
+			extended := 0
+			lease := newTaskLease(context.Background(), realClock{}, 200*time.Millisecond, func(_ context.Context) error {
+				extended++
+				return nil
+			})
+			defer lease.release()
+
+			first, ok := lease.Deadline()
+			Expect(ok).To(BeTrue())
+
+			time.Sleep(100 * time.Millisecond)
+			Expect(lease.extend(context.Background())).To(Succeed())
+			Expect(extended).To(Equal(1))
+
+			second, _ := lease.Deadline()
+			Expect(second).To(BeTemporally(">", first))
+
+			time.Sleep(150 * time.Millisecond)
+			Expect(lease.Err()).ToNot(HaveOccurred())
+
+			Eventually(lease.Done()).Should(BeClosed())
+			Expect(lease.Err()).To(MatchError(context.DeadlineExceeded))
+			Expect(lease.extend(context.Background())).To(MatchError(context.DeadlineExceeded))
+		})
+
+		It("Should expire using the clock", func() {
+			clock := newFakeClock()
+			lease := newTaskLease(context.Background(), clock, time.Minute, func(_ context.Context) error { return nil })
+			defer lease.release()
+
+			deadline, _ := lease.Deadline()
+			Expect(deadline).To(Equal(clock.Now().Add(time.Minute)))
+
+			clock.Advance(30 * time.Second)
+			Expect(lease.extend(context.Background())).To(Succeed())
+			deadline, _ = lease.Deadline()
+			Expect(deadline).To(Equal(clock.Now().Add(time.Minute)))
+
+			// the replaced timer passing its time does not end the lease
+			clock.Advance(45 * time.Second)
+			Consistently(lease.Done(), 50*time.Millisecond).ShouldNot(BeClosed())
+
+			clock.Advance(15 * time.Second)
+			Eventually(lease.Done()).Should(BeClosed())
+			Expect(lease.Err()).To(MatchError(context.DeadlineExceeded))
+		})
+
+		It("Should end with its parent", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			lease := newTaskLease(ctx, realClock{}, time.Hour, func(_ context.Context) error { return nil })
+			cancel()
+
+			Eventually(lease.Done()).Should(BeClosed())
+			Expect(lease.Err()).To(MatchError(context.Canceled))
+		})
+	})
+
+	Describe("Heartbeat", func() {
+		It("Should do nothing outside of handlers", func() {
+			Expect(Heartbeat(context.Background())).To(Succeed())
+		})
+
+		It("Should support explicit and automatic heartbeats", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				for _, automatic := range []bool{false, true} {
+					opts := []ClientOpt{NatsConn(nc), WorkQueue(&Queue{Name: "HEARTBEAT", MaxRunTime: time.Second})}
+					if automatic {
+						opts = append(opts, HandlerHeartbeats(0))
+					}
+
+					client, err := NewClient(opts...)
+					Expect(err).ToNot(HaveOccurred())
+
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+					router := NewTaskRouter()
+					router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+						// runs for twice the max run time
+						for i := 0; i < 4; i++ {
+							select {
+							case <-time.After(500 * time.Millisecond):
+							case <-ctx.Done():
+								return nil, ctx.Err()
+							}
+
+							if !automatic {
+								err := Heartbeat(ctx)
+								if err != nil {
+									return nil, err
+								}
+							}
+						}
+
+						return "done", nil
+					})
+					go client.Run(ctx, router)
+
+					Eventually(func() TaskState {
+						task, err = client.LoadTaskByID(task.ID)
+						Expect(err).ToNot(HaveOccurred())
+						return task.State
+					}, 5*time.Second).Should(Equal(TaskStateCompleted))
+					Expect(task.Tries).To(Equal(1))
+
+					cancel()
+				}
+			})
+		})
+	})
+})
@@ -39,6 +39,24 @@ type TaskStateChangeEvent struct {
 	Age time.Duration `json:"task_age,omitempty"`
 }
 
+// TaskEvent is a local notification of a Task state change delivered using Client.Events()
+type TaskEvent struct {
+	// TaskID is the ID of the task, use with LoadTaskByID() to access the task
+	TaskID string
+	// TaskType is the task routing type
+	TaskType string
+	// Queue is the queue the task is in, can be empty
+	Queue string
+	// PreviousState is the state the Task had before, TaskStateUnknown for new tasks
+	PreviousState TaskState
+	// State is the new state of the Task
+	State TaskState
+	// Tries is how many times the Task has been processed
+	Tries int
+	// TimeStamp is when the state change was recorded
+	TimeStamp time.Time
+}
+
 // LeaderElectedEvent notifies that a leader election was won
 type LeaderElectedEvent struct {
 	BaseEvent
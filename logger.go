@@ -5,7 +5,10 @@
 package asyncjobs
 
 import (
+	"fmt"
 	"log"
+	"sort"
+	"strings"
 )
 
 // Logger is a pluggable logger interface
@@ -16,6 +19,64 @@ type Logger interface {
 	Errorf(format string, v ...any)
 }
 
+// FieldLogger is a Logger that can create loggers with additional structured context, when the logger set using
+// CustomLogger() implements it the logger passed to handlers includes the task ID, type and queue. This allows
+// adapters for structured loggers like zap or zerolog to add the fields to every log line
+type FieldLogger interface {
+	Logger
+	WithFields(fields map[string]any) Logger
+}
+
+// StdLogger adapts a standard library logger, log lines are prefixed with their level and followed by any fields,
+// when l is nil the standard logger is used
+func StdLogger(l *log.Logger) FieldLogger {
+	if l == nil {
+		l = log.Default()
+	}
+
+	return &stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l      *log.Logger
+	fields string
+}
+
+func (l *stdLogger) WithFields(fields map[string]any) Logger {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(l.fields)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+
+	return &stdLogger{l: l.l, fields: b.String()}
+}
+
+func (l *stdLogger) logf(level string, format string, v ...any) {
+	l.l.Printf("[%s] %s%s", level, fmt.Sprintf(format, v...), l.fields)
+}
+
+func (l *stdLogger) Debugf(format string, v ...any) { l.logf("DEBUG", format, v...) }
+func (l *stdLogger) Infof(format string, v ...any)  { l.logf("INFO", format, v...) }
+func (l *stdLogger) Warnf(format string, v ...any)  { l.logf("WARN", format, v...) }
+func (l *stdLogger) Errorf(format string, v ...any) { l.logf("ERROR", format, v...) }
+
+// taskLogger is log with the task ID, type and queue added when log supports fields
+func taskLogger(log Logger, t *Task) Logger {
+	fl, ok := log.(FieldLogger)
+	if !ok {
+		return log
+	}
+
+	return fl.WithFields(map[string]any{"task": t.ID, "type": t.Type, "queue": t.Queue})
+}
+
 // Default console logger
 type defaultLogger struct{}
 
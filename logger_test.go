@@ -0,0 +1,56 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger", func() {
+	Describe("StdLogger", func() {
+		It("Should log levels and fields", func() {
+			out := &bytes.Buffer{}
+			logger := StdLogger(log.New(out, "", 0))
+
+			logger.Infof("hello %s", "world")
+			logger.WithFields(map[string]any{"queue": "DEFAULT", "task": "1"}).Errorf("failed")
+
+			Expect(out.String()).To(Equal("[INFO] hello world\n[ERROR] failed queue=DEFAULT task=1\n"))
+		})
+	})
+
+	Describe("taskLogger", func() {
+		It("Should pass task details to handlers", func() {
+			out := &bytes.Buffer{}
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), CustomLogger(StdLogger(log.New(out, "", 0))))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			task, err := NewTask("ginkgo", nil, TaskID("order:1"))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, log Logger, t *Task) (any, error) {
+				log.Infof("handling")
+				return nil, nil
+			})
+			go client.Run(ctx, router)
+
+			_, err = client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out.String()).To(ContainSubstring("[INFO] handling queue=DEFAULT task=order:1 type=ginkgo\n"))
+
+			Expect(taskLogger(&noopLogger{}, task)).To(BeAssignableToTypeOf(&noopLogger{}))
+		})
+	})
+})
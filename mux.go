@@ -7,40 +7,118 @@ package asyncjobs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"golang.org/x/time/rate"
 )
 
 type entryHandler struct {
-	ttype string
-	hf    HandlerFunc
+	ttype    string
+	wildcard bool
+	re       *regexp.Regexp
+	hf       HandlerFunc
+}
+
+// literals is the number of non wildcard characters in the pattern, used to order patterns by specificity
+func (e *entryHandler) literals() int {
+	return len(e.ttype) - strings.Count(e.ttype, "*")
+}
+
+func (e *entryHandler) matches(taskType string) bool {
+	switch {
+	case e.re != nil:
+		return e.re.MatchString(taskType)
+	case e.wildcard:
+		return wildcardMatch(e.ttype, taskType)
+	default:
+		return strings.HasPrefix(taskType, e.ttype)
+	}
+}
+
+// wildcardMatch matches s against pattern where * matches any sequence of characters, including none
+func wildcardMatch(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		idx := strings.Index(s, part)
+		if idx == -1 {
+			return false
+		}
+		s = s[idx+len(part):]
+	}
+
+	return len(s) >= len(parts[last]) && strings.HasSuffix(s, parts[last])
 }
 
 // HandlerFunc handles a single task, the response bytes will be stored in the original task
 type HandlerFunc func(ctx context.Context, log Logger, t *Task) (any, error)
 
+// ProcessTask calls f, making every HandlerFunc a Handler
+func (f HandlerFunc) ProcessTask(ctx context.Context, log Logger, t *Task) (any, error) {
+	return f(ctx, log, t)
+}
+
+// Handler handles tasks like a HandlerFunc, implementations can hold dependencies like database connections
+// and be registered using Handle
+type Handler interface {
+	// ProcessTask handles a single task, the response will be stored in the original task
+	ProcessTask(ctx context.Context, log Logger, t *Task) (any, error)
+}
+
+// MiddlewareFunc wraps a HandlerFunc, it can act before and after next is called or return without calling next
+type MiddlewareFunc func(next HandlerFunc) HandlerFunc
+
 // Mux routes messages
 //
-// Note: this will change to be nearer to a server mux and include support for middleware
+// Handlers are selected for a task type in this order:
+//
+//  1. A handler registered for exactly the task type
+//  2. Prefix and wildcard patterns, those with the most non-wildcard characters first, ties resolved in registration order
+//  3. Regular expressions registered using HandleFuncRegexp, in registration order
+//  4. The default handler registered using HandleDefault, "" or "*"
+//
+// Note: this will change to be nearer to a server mux
 type Mux struct {
-	hf  map[string]*entryHandler
-	ehf []*entryHandler
-	mu  *sync.Mutex
+	hf       map[string]*entryHandler
+	ehf      []*entryHandler
+	rhf      []*entryHandler
+	def      *entryHandler
+	mw       []MiddlewareFunc
+	limiters map[string]*rate.Limiter
+	schemas  map[string]*jsonschema.Schema
+	unique   map[string]bool
+	retries  map[string]RetryPolicyProvider
+	limits   map[string]int
+	mu       *sync.Mutex
 }
 
 // NewTaskRouter creates a new Mux
 func NewTaskRouter() *Mux {
 	return &Mux{
-		hf:  map[string]*entryHandler{},
-		ehf: []*entryHandler{},
-		mu:  &sync.Mutex{},
+		hf:       map[string]*entryHandler{},
+		ehf:      []*entryHandler{},
+		rhf:      []*entryHandler{},
+		limiters: map[string]*rate.Limiter{},
+		schemas:  map[string]*jsonschema.Schema{},
+		unique:   map[string]bool{},
+		retries:  map[string]RetryPolicyProvider{},
+		limits:   map[string]int{},
+		mu:       &sync.Mutex{},
 	}
 }
 
@@ -48,45 +126,313 @@ func notFoundHandler(_ context.Context, _ Logger, t *Task) (any, error) {
 	return nil, fmt.Errorf("%w %q", ErrNoHandlerForTaskType, t.Type)
 }
 
-// Handler looks up the handler function for a task
+// Handler looks up the handler function for a task, wrapped in all middleware registered using Use()
 func (m *Mux) Handler(t *Task) HandlerFunc {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	h := m.handler(t)
+	if schema, ok := m.schemas[t.Type]; ok {
+		h = handlerWithPayloadSchema(schema, h)
+	}
+
+	return m.wrap(h)
+}
+
+func (m *Mux) handler(t *Task) HandlerFunc {
 	hf, ok := m.hf[t.Type]
 	if ok {
 		return hf.hf
 	}
 
 	for _, hf := range m.ehf {
-		if strings.HasPrefix(t.Type, hf.ttype) {
+		if hf.matches(t.Type) {
+			return hf.hf
+		}
+	}
+
+	for _, hf := range m.rhf {
+		if hf.matches(t.Type) {
 			return hf.hf
 		}
 	}
 
+	if m.def != nil {
+		return m.def.hf
+	}
+
 	return notFoundHandler
 }
 
-// HandleFunc registers a task for a taskType. The taskType must match exactly with the matching tasks
+func (m *Mux) wrap(h HandlerFunc) HandlerFunc {
+	for i := len(m.mw) - 1; i >= 0; i-- {
+		h = m.mw[i](h)
+	}
+
+	return h
+}
+
+// Use adds middleware that wraps every handler, including those registered before calling Use and the
+// handler for unknown task types. Middleware runs in the order it was added, the first added is the outermost
+func (m *Mux) Use(middleware ...MiddlewareFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mw = append(m.mw, middleware...)
+}
+
+// HandleFunc registers a task for a taskType. The taskType matches tasks with exactly that type, or when no exact
+// match exists, tasks with the taskType as prefix. A taskType containing * is a wildcard pattern where * matches
+// any sequence of characters, like "email.*". Registering "" or "*" sets the default handler used for all tasks
+// that do not match any other handler, see Mux for the order handlers are selected in
 func (m *Mux) HandleFunc(taskType string, h HandlerFunc) error {
+	return m.Handle(taskType, h)
+}
+
+// Handle registers a Handler for a taskType, task types are matched like HandleFunc
+func (m *Mux) Handle(taskType string, h Handler) error {
+	if h == nil {
+		return fmt.Errorf("handler for %q is required", taskType)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if taskType == "*" {
+		taskType = ""
+	}
+
 	_, ok := m.hf[taskType]
 	if ok {
 		return fmt.Errorf("%w %q", ErrDuplicateHandlerForTaskType, taskType)
 	}
 
-	m.hf[taskType] = &entryHandler{hf: h, ttype: taskType}
-	m.ehf = append(m.ehf, m.hf[taskType])
+	entry := &entryHandler{hf: h.ProcessTask, ttype: taskType, wildcard: strings.Contains(taskType, "*")}
+	m.hf[taskType] = entry
 
-	sort.Slice(m.ehf, func(i, j int) bool {
-		return len(m.ehf[i].ttype) > len(m.ehf[j].ttype)
+	if taskType == "" {
+		m.def = entry
+		return nil
+	}
+
+	m.ehf = append(m.ehf, entry)
+
+	sort.SliceStable(m.ehf, func(i, j int) bool {
+		return m.ehf[i].literals() > m.ehf[j].literals()
 	})
 
 	return nil
 }
 
+// HandleDefault registers the handler used for task types that do not match any other handler, it is the same
+// as registering a handler for "" or "*"
+func (m *Mux) HandleDefault(h HandlerFunc) error {
+	return m.HandleFunc("", h)
+}
+
+// HandleFuncRegexp registers a handler for all task types matching re that are not matched by an exact, prefix
+// or wildcard registration, regular expressions are tried in the order they were registered
+func (m *Mux) HandleFuncRegexp(re *regexp.Regexp, h HandlerFunc) error {
+	if re == nil {
+		return fmt.Errorf("%w: regular expression is required", ErrInvalidTaskTypePattern)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range m.rhf {
+		if e.re.String() == re.String() {
+			return fmt.Errorf("%w %q", ErrDuplicateHandlerForTaskType, re.String())
+		}
+	}
+
+	m.rhf = append(m.rhf, &entryHandler{hf: h, ttype: re.String(), re: re})
+
+	return nil
+}
+
+// HandleFuncTimeout registers a handler for a taskType like HandleFunc with the context passed to h limited to timeout,
+// should the handler exceed the timeout the task fails with ErrHandlerTimeout and is retried according to the retry policy.
+//
+// The queue MaxRunTime also applies to the same context, the effective limit is the shorter of the two so timeout
+// should be shorter than the queue MaxRunTime to have any effect
+func (m *Mux) HandleFuncTimeout(taskType string, timeout time.Duration, h HandlerFunc) error {
+	if timeout <= 0 {
+		return fmt.Errorf("%w: timeout must be positive", ErrInvalidHandlerTimeout)
+	}
+
+	return m.HandleFunc(taskType, handlerWithTimeout(timeout, h))
+}
+
+func handlerWithTimeout(timeout time.Duration, h HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, log Logger, t *Task) (any, error) {
+		tctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		payload, err := h(tctx, log, t)
+
+		// only when our deadline fired, not when the parent context was done
+		if ctx.Err() == nil && errors.Is(tctx.Err(), context.DeadlineExceeded) {
+			if err != nil {
+				return nil, fmt.Errorf("%w after %v: %v", ErrHandlerTimeout, timeout, err)
+			}
+			return nil, fmt.Errorf("%w after %v", ErrHandlerTimeout, timeout)
+		}
+
+		return payload, err
+	}
+}
+
+// RateLimit limits handling of tasks with exactly the type taskType to limit tasks every interval within this process,
+// allowing bursts of up to burst tasks. Tasks received while the limit is reached are returned to the queue to be
+// delivered again once the limit allows, without being handled or counting as a try
+func (m *Mux) RateLimit(taskType string, limit int, interval time.Duration, burst int) error {
+	if limit <= 0 || interval <= 0 {
+		return fmt.Errorf("%w: limit and interval must be positive", ErrInvalidRateLimit)
+	}
+	if burst <= 0 {
+		return fmt.Errorf("%w: burst must be positive", ErrInvalidRateLimit)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.limiters[taskType] = rate.NewLimiter(rate.Limit(float64(limit)/interval.Seconds()), burst)
+
+	return nil
+}
+
+// rateLimitDelay is how long to wait before a task of type taskType may be handled, a token is taken from
+// the limiter when the task can be handled immediately
+func (m *Mux) rateLimitDelay(taskType string) time.Duration {
+	m.mu.Lock()
+	limiter, ok := m.limiters[taskType]
+	m.mu.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	r := limiter.Reserve()
+	delay := r.Delay()
+	if delay > 0 {
+		r.Cancel()
+	}
+
+	return delay
+}
+
+// UniqueActive limits tasks with exactly the type taskType to one active task across all clients sharing the same
+// storage using a lock held while the handler runs. Tasks received while another task of the type is active are
+// returned to the queue to be delivered again later, without being handled or counting as a try
+func (m *Mux) UniqueActive(taskType string) error {
+	if taskType == "" {
+		return ErrTaskTypeRequired
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.unique[taskType] = true
+
+	return nil
+}
+
+func (m *Mux) isUniqueActive(taskType string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.unique[taskType]
+}
+
+func (m *Mux) hasUniqueActive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.unique) > 0
+}
+
+// MaxConcurrent limits tasks with exactly the type taskType to limit concurrently running handlers within this
+// process, other types use the remaining ClientConcurrency() slots. Tasks received while the limit is reached are
+// returned to the queue to be delivered again later, without being handled or counting as a try
+func (m *Mux) MaxConcurrent(taskType string, limit int) error {
+	if taskType == "" {
+		return ErrTaskTypeRequired
+	}
+	if limit <= 0 {
+		return fmt.Errorf("concurrency limit must be positive")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.limits[taskType] = limit
+
+	return nil
+}
+
+func (m *Mux) maxConcurrent(taskType string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.limits[taskType]
+}
+
+// RetryPolicy sets the policy used to delay retries of failed tasks with exactly the type taskType, overriding the
+// client RetryBackoffPolicy() for those tasks
+func (m *Mux) RetryPolicy(taskType string, policy RetryPolicyProvider) error {
+	if taskType == "" {
+		return ErrTaskTypeRequired
+	}
+	if policy == nil {
+		return fmt.Errorf("retry policy is required")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.retries[taskType] = policy
+
+	return nil
+}
+
+// RetryPolicyName sets the policy used to delay retries of failed tasks with exactly the type taskType to one of the
+// named policies, see RetryPolicy()
+func (m *Mux) RetryPolicyName(taskType string, name string) error {
+	policy, err := RetryPolicyLookup(name)
+	if err != nil {
+		return err
+	}
+
+	return m.RetryPolicy(taskType, policy)
+}
+
+func (m *Mux) retryPolicy(taskType string) (RetryPolicyProvider, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	policy, ok := m.retries[taskType]
+
+	return policy, ok
+}
+
+// PayloadSchema validates the payload of tasks with exactly the type taskType against the JSON Schema document schema
+// before calling their handler, tasks with invalid payloads are terminated with ErrTaskPayloadInvalid describing
+// the problems found. Middleware runs before validation
+func (m *Mux) PayloadSchema(taskType string, schema []byte) error {
+	s, err := compilePayloadSchema(taskType, schema)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.schemas[taskType] = s
+
+	return nil
+}
+
 // RequestReply sets up a delegated handler via NATS Request-Reply
 func (m *Mux) RequestReply(taskType string, client *Client) error {
 	h := newRequestReplyHandleFunc(client.opts.nc, taskType)
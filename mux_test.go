@@ -6,12 +6,75 @@ package asyncjobs
 
 import (
 	"context"
+	"fmt"
+	"regexp"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
 
+type testHandler struct {
+	greeting string
+}
+
+func (h *testHandler) ProcessTask(_ context.Context, _ Logger, t *Task) (any, error) {
+	return h.greeting + " " + t.Type, nil
+}
+
 var _ = Describe("Router", func() {
+	Describe("Use", func() {
+		It("Should wrap handlers in registration order", func() {
+			router := NewTaskRouter()
+			task, err := NewTask("email:new", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			var calls []string
+			mw := func(name string) MiddlewareFunc {
+				return func(next HandlerFunc) HandlerFunc {
+					return func(ctx context.Context, log Logger, t *Task) (any, error) {
+						calls = append(calls, name)
+						return next(ctx, log, t)
+					}
+				}
+			}
+
+			router.Use(mw("first"))
+			Expect(router.HandleFunc("email:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				calls = append(calls, "handler")
+				return "ok", nil
+			})).To(Succeed())
+			router.Use(mw("second"), mw("third"))
+
+			res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal("ok"))
+			Expect(calls).To(Equal([]string{"first", "second", "third", "handler"}))
+		})
+
+		It("Should support short-circuiting", func() {
+			router := NewTaskRouter()
+			task, err := NewTask("email:new", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			called := false
+			Expect(router.HandleFunc("email:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				called = true
+				return nil, nil
+			})).To(Succeed())
+
+			router.Use(func(next HandlerFunc) HandlerFunc {
+				return func(ctx context.Context, log Logger, t *Task) (any, error) {
+					return nil, ErrTerminateTask
+				}
+			})
+
+			_, err = router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).To(MatchError(ErrTerminateTask))
+			Expect(called).To(BeFalse())
+		})
+	})
+
 	Describe("ExternalProcess", func() {
 		var (
 			task   *Task
@@ -91,5 +154,264 @@ var _ = Describe("Router", func() {
 			check("things:specific:other", "things:specific")
 			check("x", "custom default")
 		})
+
+		It("Should support wildcards and regular expressions", func() {
+			router := NewTaskRouter()
+			handler := func(r string) HandlerFunc {
+				return func(_ context.Context, _ Logger, _ *Task) (any, error) {
+					return r, nil
+				}
+			}
+
+			Expect(router.HandleFunc("*", handler("catch all"))).To(Succeed())
+			Expect(router.HandleFunc("", handler("default"))).To(MatchError(ErrDuplicateHandlerForTaskType))
+			Expect(router.HandleFunc("email:*", handler("email:*"))).To(Succeed())
+			Expect(router.HandleFunc("email:reset", handler("email:reset"))).To(Succeed())
+			Expect(router.HandleFunc("email:*:daily", handler("email:*:daily"))).To(Succeed())
+			Expect(router.HandleFunc("*:daily", handler("*:daily"))).To(Succeed())
+			Expect(router.HandleFunc("email:digest", handler("email:digest prefix"))).To(Succeed())
+			Expect(router.HandleFuncRegexp(regexp.MustCompile(`^sms:\d+$`), handler("sms regex"))).To(Succeed())
+			Expect(router.HandleFuncRegexp(regexp.MustCompile(`^sms:\d+$`), handler("sms regex"))).To(MatchError(ErrDuplicateHandlerForTaskType))
+			Expect(router.HandleFuncRegexp(regexp.MustCompile(`^sms:`), handler("sms other"))).To(Succeed())
+			Expect(router.HandleFuncRegexp(nil, handler("nil"))).To(MatchError(ErrInvalidTaskTypePattern))
+
+			check := func(ttype string, expected string) {
+				task := &Task{Type: ttype}
+				res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(Equal(expected), ttype)
+			}
+
+			check("email:reset", "email:reset")
+			check("email:welcome", "email:*")
+			check("email:", "email:*")
+			check("email:digest:weekly", "email:digest prefix")
+			// equally specific, the first registered wins
+			check("email:digest:daily", "email:*:daily")
+			check("email:report:daily", "email:*:daily")
+			check("report:daily", "*:daily")
+			check("sms:10", "sms regex")
+			check("sms:x", "sms other")
+			check("other", "catch all")
+		})
+	})
+
+	Describe("RateLimit", func() {
+		It("Should validate the limit", func() {
+			router := NewTaskRouter()
+			Expect(router.RateLimit("x", 0, time.Second, 1)).To(MatchError(ErrInvalidRateLimit))
+			Expect(router.RateLimit("x", 1, 0, 1)).To(MatchError(ErrInvalidRateLimit))
+			Expect(router.RateLimit("x", 1, time.Second, 0)).To(MatchError(ErrInvalidRateLimit))
+		})
+
+		It("Should delay tasks once the burst is used", func() {
+			router := NewTaskRouter()
+			Expect(router.RateLimit("x", 10, time.Second, 2)).To(Succeed())
+
+			Expect(router.rateLimitDelay("y")).To(BeZero())
+			Expect(router.rateLimitDelay("x")).To(BeZero())
+			Expect(router.rateLimitDelay("x")).To(BeZero())
+
+			delay := router.rateLimitDelay("x")
+			Expect(delay).To(BeNumerically(">", 0))
+			Expect(delay).To(BeNumerically("<=", 100*time.Millisecond))
+
+			// delayed tasks do not use up tokens
+			Expect(router.rateLimitDelay("x")).To(BeNumerically("~", delay, 10*time.Millisecond))
+		})
+	})
+
+	Describe("UniqueActive", func() {
+		It("Should register exact task types", func() {
+			router := NewTaskRouter()
+			Expect(router.UniqueActive("")).To(MatchError(ErrTaskTypeRequired))
+			Expect(router.hasUniqueActive()).To(BeFalse())
+
+			Expect(router.UniqueActive("cache:rebuild")).To(Succeed())
+			Expect(router.hasUniqueActive()).To(BeTrue())
+			Expect(router.isUniqueActive("cache:rebuild")).To(BeTrue())
+			Expect(router.isUniqueActive("cache")).To(BeFalse())
+		})
+	})
+
+	Describe("RetryPolicy", func() {
+		It("Should register exact task types", func() {
+			router := NewTaskRouter()
+			Expect(router.RetryPolicy("", RetryLinearOneMinute)).To(MatchError(ErrTaskTypeRequired))
+			Expect(router.RetryPolicy("email", nil)).To(MatchError("retry policy is required"))
+			Expect(router.RetryPolicyName("email", "unknown")).To(MatchError(ErrUnknownRetryPolicy))
+
+			Expect(router.RetryPolicyName("email:new", "1m")).To(Succeed())
+			policy, ok := router.retryPolicy("email:new")
+			Expect(ok).To(BeTrue())
+			Expect(policy).To(Equal(RetryLinearOneMinute))
+			_, ok = router.retryPolicy("email")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("Should delay retries of the task type using the policy", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(RetryLinearOneHour))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			Expect(router.RetryPolicy("email:new", retryForTesting)).To(Succeed())
+			Expect(router.HandleFunc("email", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				if t.Tries == 1 {
+					return nil, fmt.Errorf("simulated failure")
+				}
+				return "sent", nil
+			})).To(Succeed())
+			go client.Run(ctx, router)
+
+			task, err := NewTask("email:new", nil)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`"sent"`))
+
+			// the client policy applies to other types
+			task, err = NewTask("email:old", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+			Eventually(func() int {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return task.Tries
+			}).Should(Equal(1))
+			Consistently(func() TaskState {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return task.State
+			}, 200*time.Millisecond).Should(Equal(TaskStateRetry))
+		})
+	})
+
+	Describe("PayloadSchema", func() {
+		schema := []byte(`{"type":"object","required":["to"],"properties":{"to":{"type":"string"},"retries":{"type":"integer"}}}`)
+
+		It("Should validate the schema", func() {
+			router := NewTaskRouter()
+			Expect(router.PayloadSchema("", schema)).To(MatchError(ErrInvalidPayloadSchema))
+			Expect(router.PayloadSchema("email", []byte(`{"type":1}`))).To(MatchError(ErrInvalidPayloadSchema))
+			Expect(router.PayloadSchema("email", []byte(`{`))).To(MatchError(ErrInvalidPayloadSchema))
+		})
+
+		It("Should terminate tasks with invalid payloads", func() {
+			router := NewTaskRouter()
+			Expect(router.PayloadSchema("email:new", schema)).To(Succeed())
+			Expect(router.HandleFunc("email", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return "sent", nil
+			})).To(Succeed())
+
+			task, err := NewTask("email:new", map[string]any{"to": "ginkgo@example.net", "retries": 1})
+			Expect(err).ToNot(HaveOccurred())
+			res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal("sent"))
+
+			task, err = NewTask("email:new", map[string]any{"retries": 1.5})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).To(MatchError(ErrTaskPayloadInvalid))
+			Expect(err).To(MatchError(ErrTerminateTask))
+			Expect(err.Error()).To(ContainSubstring("/: missing properties: 'to'"))
+			Expect(err.Error()).To(ContainSubstring("/retries: expected integer, but got number"))
+
+			task, err = NewTask("email:new", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).To(MatchError(ErrTaskPayloadInvalid))
+
+			// only exact matches are validated
+			task, err = NewTask("email:old", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("Handle", func() {
+		It("Should register Handler implementations", func() {
+			router := NewTaskRouter()
+			Expect(router.Handle("email:new", nil)).To(MatchError(`handler for "email:new" is required`))
+			Expect(router.Handle("email:new", &testHandler{greeting: "hello"})).To(Succeed())
+			Expect(router.HandleFunc("email:new", func(_ context.Context, _ Logger, _ *Task) (any, error) {
+				return nil, nil
+			})).To(MatchError(ErrDuplicateHandlerForTaskType))
+
+			task := &Task{Type: "email:new"}
+			res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal("hello email:new"))
+		})
+	})
+
+	Describe("HandleDefault", func() {
+		It("Should register the default handler", func() {
+			router := NewTaskRouter()
+			Expect(router.HandleDefault(func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return t.Type, nil
+			})).To(Succeed())
+			Expect(router.HandleFunc("*", func(_ context.Context, _ Logger, _ *Task) (any, error) {
+				return nil, nil
+			})).To(MatchError(ErrDuplicateHandlerForTaskType))
+
+			task := &Task{Type: "unrouted"}
+			res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal("unrouted"))
+		})
+	})
+
+	Describe("HandleFuncTimeout", func() {
+		It("Should validate the timeout", func() {
+			router := NewTaskRouter()
+			err := router.HandleFuncTimeout("x", 0, func(_ context.Context, _ Logger, _ *Task) (any, error) {
+				return nil, nil
+			})
+			Expect(err).To(MatchError(ErrInvalidHandlerTimeout))
+		})
+
+		It("Should fail handlers that exceed the timeout", func() {
+			router := NewTaskRouter()
+			err := router.HandleFuncTimeout("slow", 50*time.Millisecond, func(ctx context.Context, _ Logger, _ *Task) (any, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = router.HandleFuncTimeout("fast", time.Second, func(ctx context.Context, _ Logger, _ *Task) (any, error) {
+				return "fast", nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			task := &Task{Type: "slow"}
+			_, err = router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).To(MatchError(ErrHandlerTimeout))
+
+			task = &Task{Type: "fast"}
+			res, err := router.Handler(task)(context.Background(), &defaultLogger{}, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(Equal("fast"))
+		})
+
+		It("Should not report a timeout when the parent context ends", func() {
+			router := NewTaskRouter()
+			err := router.HandleFuncTimeout("x", time.Minute, func(ctx context.Context, _ Logger, _ *Task) (any, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+
+			task := &Task{Type: "x"}
+			_, err = router.Handler(task)(ctx, &defaultLogger{}, task)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(err).ToNot(MatchError(ErrHandlerTimeout))
+		})
 	})
 })
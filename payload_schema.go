@@ -0,0 +1,99 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// compilePayloadSchema compiles a JSON Schema document used to validate payloads of taskType
+func compilePayloadSchema(taskType string, schema []byte) (*jsonschema.Schema, error) {
+	if taskType == "" {
+		return nil, fmt.Errorf("%w: task type is required", ErrInvalidPayloadSchema)
+	}
+
+	url := fmt.Sprintf("asyncjobs://schemas/%s.json", taskType)
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource(url, bytes.NewReader(schema))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayloadSchema, err)
+	}
+
+	s, err := compiler.Compile(url)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayloadSchema, err)
+	}
+
+	return s, nil
+}
+
+// validateTaskPayload validates the payload of t against schema, a task without payload is validated as null
+func validateTaskPayload(schema *jsonschema.Schema, t *Task) error {
+	payload := []byte(t.Payload)
+	if len(payload) == 0 {
+		payload = []byte("null")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+
+	var doc any
+	err := dec.Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskPayloadInvalid, err)
+	}
+
+	err = schema.Validate(doc)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrTaskPayloadInvalid, schemaValidationMessage(err))
+	}
+
+	return nil
+}
+
+// schemaValidationMessage describes every failed keyword of a validation error by the location in the payload
+func schemaValidationMessage(err error) string {
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err.Error()
+	}
+
+	var msgs []string
+	var walk func(e *jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			loc := e.InstanceLocation
+			if loc == "" {
+				loc = "/"
+			}
+			msgs = append(msgs, fmt.Sprintf("%s: %s", loc, e.Message))
+			return
+		}
+
+		for _, cause := range e.Causes {
+			walk(cause)
+		}
+	}
+	walk(ve)
+
+	return strings.Join(msgs, ", ")
+}
+
+func handlerWithPayloadSchema(schema *jsonschema.Schema, h HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, log Logger, t *Task) (any, error) {
+		err := validateTaskPayload(schema, t)
+		if err != nil {
+			return nil, err
+		}
+
+		return h(ctx, log, t)
+	}
+}
@@ -9,38 +9,99 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type processor struct {
-	queue       *Queue
+	queues      []*queueProcessor
 	mux         *Mux
 	c           *Client
 	concurrency int
 	limiter     chan struct{}
+	retiring    int32
+	wanting     chan *queueProcessor
 	retryPolicy RetryPolicyProvider
 	log         Logger
 
+	inFlight   int32
+	lastActive int64
+	typeActive map[string]int
+	typeSeen   map[string]time.Time
+	cancels    map[string]*handlerCancel
+	handlers   sync.WaitGroup
+	draining   bool
+	drainStart chan struct{}
+
 	mu *sync.Mutex
 }
 
+// queueProcessor polls one of the queues bound to a processor, polling requires a slot from the shared limiter
+// which is granted to queues according to their weight
+type queueProcessor struct {
+	queue   *Queue
+	weight  int
+	current int
+	grant   chan struct{}
+	p       *processor
+	log     Logger
+
+	paused     bool
+	resumed    chan struct{}
+	pollCancel context.CancelFunc
+
+	mu sync.Mutex
+}
+
 // ItemKind indicates the kind of job a work queue entry represents
 type ItemKind int
 
 var (
 	// TaskItem is a task as defined by Task
 	TaskItem ItemKind = 0
+	// DeadLetterItem is a copy of a failed task stored in a dead letter queue
+	DeadLetterItem ItemKind = 1
 )
 
 // ProcessItem is an individual item stored in the work queue
 type ProcessItem struct {
 	Kind  ItemKind `json:"kind"`
 	JobID string   `json:"job"`
+	// Task is a copy of the task for DeadLetterItem items
+	Task *Task `json:"task,omitempty"`
 
 	storageMeta any
+	queue       *Queue
+	pending     uint64
+	deliveries  uint64
+}
+
+// StorageMeta is the value attached to the item by the Storage that fetched it
+func (i *ProcessItem) StorageMeta() any {
+	return i.storageMeta
+}
+
+// SetStorageMeta attaches meta to the item, Storage implementations use this to find the queue entry again when the
+// item is acknowledged
+func (i *ProcessItem) SetStorageMeta(meta any) {
+	i.storageMeta = meta
+}
+
+// SetPending records how many entries were waiting in the queue when the item was fetched, this lets task types use
+// more than their fair share of concurrency when nothing else is waiting
+func (i *ProcessItem) SetPending(pending uint64) {
+	i.pending = pending
+}
+
+// SetDeliveries records how many times the item was delivered including this delivery, tasks allowed more tries than
+// their queue are enqueued again once the item reached the delivery limit of the queue
+func (i *ProcessItem) SetDeliveries(deliveries uint64) {
+	i.deliveries = deliveries
 }
 
 func newProcessItem(kind ItemKind, id string) ([]byte, error) {
@@ -50,21 +111,50 @@ func newProcessItem(kind ItemKind, id string) ([]byte, error) {
 func newProcessor(c *Client) (*processor, error) {
 	p := &processor{
 		c:           c,
-		queue:       c.opts.queue,
 		concurrency: c.opts.concurrency,
-		limiter:     make(chan struct{}, c.opts.concurrency),
+		limiter:     make(chan struct{}, maxConcurrency(c.opts.concurrency)),
+		wanting:     make(chan *queueProcessor),
 		retryPolicy: c.opts.retryPolicy,
 		log:         c.log,
+		drainStart:  make(chan struct{}),
+		typeActive:  make(map[string]int),
+		typeSeen:    make(map[string]time.Time),
+		cancels:     make(map[string]*handlerCancel),
 		mu:          &sync.Mutex{},
+		lastActive:  c.opts.clock.Now().UnixNano(),
 	}
 
-	for i := 0; i < cap(p.limiter); i++ {
+	for i := 0; i < p.concurrency; i++ {
 		p.limiter <- struct{}{}
 	}
 
+	for _, q := range c.workQueues() {
+		weight, ok := c.opts.queueWeights[q.Name]
+		if !ok {
+			weight = 1
+		}
+
+		p.queues = append(p.queues, &queueProcessor{
+			queue:  q,
+			weight: weight,
+			grant:  make(chan struct{}, 1),
+			p:      p,
+			log:    c.log,
+		})
+	}
+
 	return p, nil
 }
 
+// itemQueue is the queue item was fetched from
+func (p *processor) itemQueue(item *ProcessItem) *Queue {
+	if item.queue != nil {
+		return item.queue
+	}
+
+	return p.queues[0].queue
+}
+
 func (p *processor) loadDependencies(task *Task) (bool, bool, error) {
 	ready := true
 
@@ -73,13 +163,13 @@ func (p *processor) loadDependencies(task *Task) (bool, bool, error) {
 		if errors.Is(err, ErrTaskNotFound) {
 			return false, true, fmt.Errorf("%w: %s", ErrTaskNotFound, parent)
 		} else if err != nil {
-			return false, false, fmt.Errorf("%s: %s: %v", ErrTaskLoadFailed, parent, err)
+			return false, false, fmt.Errorf("%w: %s: %v", ErrTaskLoadFailed, parent, err)
 		}
 
 		switch pt.State {
 		case TaskStateCompleted:
-		case TaskStateExpired, TaskStateTerminated, TaskStateQueueError, TaskStateUnknown:
-			return false, true, nil
+		case TaskStateExpired, TaskStateTerminated, TaskStateQueueError, TaskStateUnreachable, TaskStateQuarantined, TaskStateSkipped, TaskStateUnknown:
+			return false, true, fmt.Errorf("dependency %s is in state %q", pt.ID, pt.State)
 		default:
 			ready = false
 			continue
@@ -96,29 +186,53 @@ func (p *processor) loadDependencies(task *Task) (bool, bool, error) {
 	return ready, false, nil
 }
 
+// handleDependenciesFailed updates the task and work item based on the client DependencyFailurePolicy
+func (p *processor) handleDependenciesFailed(ctx context.Context, item *ProcessItem, task *Task, derr error) error {
+	switch p.c.opts.dependencyFailure {
+	case DependencyFailureBlock:
+		p.log.Warnf("Dependencies for task %s failed, keeping it blocked: %v", task.ID, derr)
+		err := p.c.storage.NakBlockedItem(ctx, item)
+		if err != nil {
+			p.log.Warnf("NaK of blocked item failed: %v", err)
+		}
+
+		return nil
+
+	case DependencyFailureTerminate:
+		p.log.Warnf("Dependencies for task %s failed, terminating task: %v", task.ID, derr)
+		p.c.storage.TerminateItem(ctx, item)
+		err := p.c.handleTaskTerminated(ctx, task, fmt.Errorf("%w: %v", ErrTaskDependenciesFailed, derr))
+		if err != nil {
+			p.log.Warnf("Updating task after dependency failure failed: %v", err)
+		}
+
+	default:
+		p.log.Warnf("Dependencies for task %s failed, task is unreachable: %v", task.ID, derr)
+		p.c.storage.TerminateItem(ctx, item)
+		err := p.c.handleTaskError(ctx, task, fmt.Errorf("%w: %v", ErrTaskDependenciesFailed, derr))
+		if err != nil {
+			p.log.Warnf("Updating task after dependency failure failed: %v", err)
+		}
+	}
+
+	return ErrTaskDependenciesFailed
+}
+
 func (p *processor) processDependencies(ctx context.Context, item *ProcessItem, task *Task) (bool, error) {
 	ready, failed, err := p.loadDependencies(task)
 	if err != nil {
 		if failed {
-			p.log.Warnf("Could not process dependencies for task %s, terminating task: %v", task.ID, err)
 			taskDependenciesFailedCounter.WithLabelValues().Inc()
-			p.c.storage.TerminateItem(ctx, item)
-			p.c.handleTaskError(ctx, task, fmt.Errorf("%w: %v", ErrTaskDependenciesFailed, err))
-		} else {
-			p.log.Warnf("Could not process dependencies for task %s, will retry: %v", task.ID, err)
-			err = p.c.storage.NakBlockedItem(ctx, item)
-			if err != nil {
-				p.log.Warnf("NaK blocked item failed: %v", err)
-			}
+			return false, p.handleDependenciesFailed(ctx, item, task, err)
 		}
 
-		return false, err
-	}
+		p.log.Warnf("Could not process dependencies for task %s, will retry: %v", task.ID, err)
+		err = p.c.storage.NakBlockedItem(ctx, item)
+		if err != nil {
+			p.log.Warnf("NaK blocked item failed: %v", err)
+		}
 
-	if failed {
-		p.c.storage.TerminateItem(ctx, item)
-		p.c.handleTaskError(ctx, task, fmt.Errorf("%w: %v", ErrTaskDependenciesFailed, err))
-		return false, ErrTaskDependenciesFailed
+		return false, err
 	}
 
 	if !ready {
@@ -132,23 +246,39 @@ func (p *processor) processDependencies(ctx context.Context, item *ProcessItem,
 	return true, nil
 }
 
+// processMessage starts the handler for item, the limiter slot taken for item is passed to the handler and released
+// once it finished, if no handler is started the slot is released when processMessage returns
 func (p *processor) processMessage(ctx context.Context, item *ProcessItem) error {
+	started := false
+	defer func() {
+		if !started {
+			p.releaseSlot()
+		}
+	}()
+
+	if item.Kind != TaskItem {
+		return fmt.Errorf("%w: kind %d", ErrQueueItemUnsupported, item.Kind)
+	}
+
+	queue := p.itemQueue(item)
+
 	task, err := p.c.LoadTaskByID(item.JobID)
 	if err != nil {
-		workQueueEntryForUnknownTaskErrorCounter.WithLabelValues(p.queue.Name).Inc()
+		workQueueEntryForUnknownTaskErrorCounter.WithLabelValues(queue.Name).Inc()
 		if errors.Is(err, ErrTaskNotFound) {
 			p.log.Warnf("Could not find task data for %s, discarding work item", item.JobID)
 			p.c.storage.TerminateItem(ctx, item)
-			p.limiter <- struct{}{} // todo handle this in a better place
 			return nil
 		}
 
-		return fmt.Errorf("%s: %s", ErrTaskLoadFailed, err)
+		return fmt.Errorf("%w: %v", ErrTaskLoadFailed, err)
 	}
 
+	now := p.c.opts.clock.Now()
+
 	switch task.State {
 	case TaskStateActive:
-		if task.LastTriedAt == nil || time.Since(*task.LastTriedAt) < p.queue.MaxRunTime {
+		if task.LastTriedAt == nil || now.Sub(*task.LastTriedAt) < queue.MaxRunTime {
 			return ErrTaskAlreadyActive
 		}
 
@@ -156,29 +286,114 @@ func (p *processor) processMessage(ctx context.Context, item *ProcessItem) error
 		p.c.storage.AckItem(ctx, item)
 		return ErrTaskDependenciesFailed
 
-	case TaskStateCompleted, TaskStateExpired:
+	case TaskStateCompleted, TaskStateExpired, TaskStateTerminated, TaskStateQuarantined, TaskStateSkipped:
 		p.c.storage.AckItem(ctx, item)
 		return fmt.Errorf("%w %q", ErrTaskAlreadyInState, task.State)
 	}
 
-	if task.IsPastDeadline() {
-		workQueueEntryPastDeadlineCounter.WithLabelValues(p.queue.Name).Inc()
+	// the handler completed already, only its follow-up tasks remain to be enqueued
+	if len(task.Continuations) > 0 {
+		p.log.Infof("Enqueueing the remaining follow-up tasks of task %s", task.ID)
+		err = p.c.completeContinuation(ctx, task)
+		if err != nil {
+			p.c.storage.NakItem(ctx, item)
+			return err
+		}
+		p.c.storage.AckItem(ctx, item)
+		return nil
+	}
+
+	if task.isPastDeadline(now) {
+		workQueueEntryPastDeadlineCounter.WithLabelValues(queue.Name).Inc()
 		err = p.c.handleTaskExpired(ctx, task)
 		if err != nil {
 			p.log.Warnf("Could not expire task %s: %v", task.ID, err)
 		}
+		p.c.storage.TerminateItem(ctx, item)
 		return ErrTaskPastDeadline
 	}
 
-	if task.MaxTries > 0 && task.Tries >= task.MaxTries {
-		workQueueEntryPastMaxTriesCounter.WithLabelValues(p.queue.Name).Inc()
+	if task.isPastTTL(now) {
+		workQueueEntryPastTTLCounter.WithLabelValues(queue.Name).Inc()
+		err = p.c.handleTaskPastTTL(ctx, task)
+		if err != nil {
+			p.log.Warnf("Could not expire task %s: %v", task.ID, err)
+		}
+		p.c.storage.TerminateItem(ctx, item)
+		return ErrTaskPastTTL
+	}
+
+	if queue.isPastAbsoluteMaxAge(task, now) {
+		workQueueEntryPastAbsoluteMaxAgeCounter.WithLabelValues(queue.Name).Inc()
+		task.LastErr = ErrTaskPastAbsoluteMaxAge.Error()
+		err = p.c.handleTaskExpired(ctx, task)
+		if err != nil {
+			p.log.Warnf("Could not expire task %s: %v", task.ID, err)
+		}
+		p.c.storage.TerminateItem(ctx, item)
+		return ErrTaskPastAbsoluteMaxAge
+	}
+
+	if task.isScheduledInFuture(now) {
+		// it would only become eligible after it can no longer run
+		if task.ExpiresAt != nil && task.ExpiresAt.Before(*task.ScheduledFor) {
+			workQueueEntryPastTTLCounter.WithLabelValues(queue.Name).Inc()
+			err = p.c.handleTaskPastTTL(ctx, task)
+			if err != nil {
+				p.log.Warnf("Could not expire task %s: %v", task.ID, err)
+			}
+			p.c.storage.TerminateItem(ctx, item)
+			return ErrTaskPastTTL
+		}
+		if task.Deadline != nil && task.Deadline.Before(*task.ScheduledFor) {
+			workQueueEntryPastDeadlineCounter.WithLabelValues(queue.Name).Inc()
+			err = p.c.handleTaskExpired(ctx, task)
+			if err != nil {
+				p.log.Warnf("Could not expire task %s: %v", task.ID, err)
+			}
+			p.c.storage.TerminateItem(ctx, item)
+			return ErrTaskPastDeadline
+		}
+
+		delay := task.ScheduledFor.Sub(now)
+		p.log.Debugf("Task %s is scheduled for %v, delaying delivery by %v", task.ID, task.ScheduledFor, delay)
+		err = p.c.storage.NakDelayedItem(ctx, item, delay)
+		if err != nil {
+			p.log.Warnf("NaK of scheduled item failed: %v", err)
+		}
+		return nil
+	}
+
+	if task.isRetryInFuture(now) {
+		delay := task.NextTryAt.Sub(now)
+		p.log.Debugf("Task %s was delivered before its retry at %v, delaying delivery by %v", task.ID, task.NextTryAt, delay)
+		err = p.c.storage.NakDelayedItem(ctx, item, delay)
+		if err != nil {
+			p.log.Warnf("NaK of early retry item failed: %v", err)
+		}
+		return nil
+	}
+
+	if max := p.c.taskMaxTries(task); max > 0 && task.Tries >= max {
+		workQueueEntryPastMaxTriesCounter.WithLabelValues(queue.Name).Inc()
 		err = p.c.handleTaskExpired(ctx, task)
 		if err != nil {
 			p.log.Warnf("Could not expire task %s: %v", task.ID, err)
 		}
+		p.c.storage.TerminateItem(ctx, item)
 		return ErrTaskExceedsMaxTries
 	}
 
+	if missing := p.missingCapabilities(task); len(missing) > 0 {
+		p.log.Debugf("Task %s requires capabilities %v, delaying delivery to other workers", task.ID, missing)
+		handlersCapabilityDeferredCounter.WithLabelValues(queue.Name, taskTypeLabels.label(task.Type)).Inc()
+		err = p.c.storage.NakDelayedItem(ctx, item, capabilityDelay())
+		if err != nil {
+			p.log.Warnf("NaK of item requiring other capabilities failed: %v", err)
+		}
+		return nil
+	}
+
 	if task.State == TaskStateBlocked && task.HasDependencies() {
 		should, err := p.processDependencies(ctx, item, task)
 		if err != nil {
@@ -187,61 +402,566 @@ func (p *processor) processMessage(ctx context.Context, item *ProcessItem) error
 			}
 		}
 		if !should {
-			p.limiter <- struct{}{} // todo handle this in a better place
 			return nil
 		}
 	}
 
+	if delay := p.rateLimitDelay(queue, task); delay > 0 {
+		p.log.Debugf("Task %s of type %s is rate limited, delaying delivery by %v", task.ID, task.Type, delay)
+		err = p.c.storage.NakDelayedItem(ctx, item, delay)
+		if err != nil {
+			p.log.Warnf("NaK of rate limited item failed: %v", err)
+		}
+		return nil
+	}
+
+	lock, err := p.acquireTaskTypeLock(task)
+	if err != nil {
+		if errors.Is(err, ErrTaskTypeLocked) {
+			p.log.Debugf("Task %s of type %s waits for the active task of its type", task.ID, task.Type)
+			handlersUniqueActiveDelayedCounter.WithLabelValues(queue.Name, taskTypeLabels.label(task.Type)).Inc()
+		} else {
+			p.log.Warnf("Could not lock task type %s for task %s: %v", task.Type, task.ID, err)
+		}
+
+		err = p.c.storage.NakDelayedItem(ctx, item, uniqueActiveDelay())
+		if err != nil {
+			p.log.Warnf("NaK of item waiting for its task type lock failed: %v", err)
+		}
+		return nil
+	}
+
+	// the handler is registered while holding the lock so that drain() never waits on a partially started handler
+	p.mu.Lock()
+	if p.draining {
+		p.mu.Unlock()
+		lock.release()
+		p.c.storage.NakBlockedItem(ctx, item)
+		return ErrProcessorDraining
+	}
+	// a task enqueued again by retryItem() can be delivered while its previous handler is still finishing up
+	if _, active := p.cancels[task.ID]; active {
+		p.mu.Unlock()
+		lock.release()
+		p.log.Debugf("Task %s is still being handled, delaying delivery", task.ID)
+		err = p.c.storage.NakDelayedItem(ctx, item, fairShareDelay())
+		if err != nil {
+			p.log.Warnf("NaK of item for a task still being handled failed: %v", err)
+		}
+		return nil
+	}
+	if p.overTypeConcurrency(task) {
+		p.mu.Unlock()
+		lock.release()
+		p.log.Debugf("Task %s of type %s is deferred as its type reached its maximum concurrency", task.ID, task.Type)
+		handlersConcurrencyDeferredCounter.WithLabelValues(queue.Name, taskTypeLabels.label(task.Type)).Inc()
+		err = p.c.storage.NakDelayedItem(ctx, item, fairShareDelay())
+		if err != nil {
+			p.log.Warnf("NaK of item deferred for its type concurrency failed: %v", err)
+		}
+		return nil
+	}
+	if p.overFairShare(task, item) {
+		p.mu.Unlock()
+		lock.release()
+		p.log.Debugf("Task %s of type %s is deferred as its type uses its share of the concurrency", task.ID, task.Type)
+		handlersFairShareDeferredCounter.WithLabelValues(queue.Name, taskTypeLabels.label(task.Type)).Inc()
+		err = p.c.storage.NakDelayedItem(ctx, item, fairShareDelay())
+		if err != nil {
+			p.log.Warnf("NaK of item deferred for fair share failed: %v", err)
+		}
+		return nil
+	}
+	p.handlers.Add(1)
+	atomic.AddInt32(&p.inFlight, 1)
+	p.markActive()
+	p.typeActive[task.Type]++
+	p.cancels[task.ID] = &handlerCancel{}
+	p.mu.Unlock()
+
 	err = p.c.setTaskActive(ctx, task)
 	if err != nil {
+		lock.release()
+		p.handlerDone(task)
+
+		// the task was changed since it was loaded, like by UpdateTask() or CancelTask(), the item is delivered again
+		// straight away so the current task is handled rather than waiting for the item to time out
+		if errors.Is(err, ErrConflict) {
+			p.log.Debugf("Task %s was modified while being started, delivering it again: %v", task.ID, err)
+			err = p.c.storage.NakDelayedItem(ctx, item, 0)
+			if err != nil {
+				p.log.Warnf("NaK of item for modified task failed: %v", err)
+			}
+			return nil
+		}
+
 		return fmt.Errorf("%w %s: %v", ErrTaskUpdateFailed, task.State, err)
 	}
 
-	go p.handle(ctx, task, item, p.queue.MaxRunTime)
+	started = true
+	go func() {
+		defer lock.release()
+		p.handle(ctx, task, item, queue.MaxRunTime)
+	}()
 
 	return nil
 }
 
-func (p *processor) pollItem(ctx context.Context) (*ProcessItem, error) {
+// continueTask records the follow-up tasks of a handler that returned a Continuation, enqueues them and completes
+// t. Until recorded the handler is tried again, after that only enqueueing the remaining tasks is retried
+func (p *processor) continueTask(ctx context.Context, log Logger, t *Task, item *ProcessItem, result any, tasks []*Task) {
+	err := p.c.recordContinuation(ctx, t, result, tasks)
+	if err != nil {
+		log.Errorf("Recording follow-up tasks of task %s failed: %v", t.ID, err)
+
+		delay := p.retryDelay(t)
+		t.setNextTry(p.c.opts.clock.Now(), delay)
+
+		err = p.c.handleTaskError(ctx, t, err)
+		if err != nil {
+			log.Warnf("Updating task after failed processing failed: %v", err)
+		}
+		if t.State == TaskStateRetry {
+			recordRetryDelay(t, delay)
+		}
+
+		err = p.c.storage.NakDelayedItem(ctx, item, delay)
+		if err != nil {
+			log.Warnf("NaK after failed processing failed: %v", err)
+		}
+
+		return
+	}
+
+	err = p.c.completeContinuation(ctx, t)
+	if err != nil {
+		log.Errorf("Enqueueing follow-up tasks of task %s failed: %v", t.ID, err)
+
+		err = p.c.storage.NakItem(ctx, item)
+		if err != nil {
+			log.Warnf("NaK after failed processing failed: %v", err)
+		}
+
+		return
+	}
+
+	err = p.c.storage.AckItem(ctx, item)
+	if err != nil {
+		log.Errorf("Acknowledging work item failed: %v", err)
+	}
+}
+
+// inFlightCount is the number of handlers currently executing
+func (p *processor) inFlightCount() int {
+	return int(atomic.LoadInt32(&p.inFlight))
+}
+
+// markActive records that a handler started or finished
+func (p *processor) markActive() {
+	atomic.StoreInt64(&p.lastActive, p.c.opts.clock.Now().UnixNano())
+}
+
+// idleFor indicates that no handlers are running and none started or finished for at least d
+func (p *processor) idleFor(d time.Duration) bool {
+	if p.inFlightCount() > 0 {
+		return false
+	}
+
+	last := time.Unix(0, atomic.LoadInt64(&p.lastActive))
+
+	return p.c.opts.clock.Now().Sub(last) >= d
+}
+
+// drain stops polling for new items and waits for running handlers to finish or ctx to be done, once ctx is done the
+// handlers still running are canceled and given drainStopWait to return their tasks to the queue
+func (p *processor) drain(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.draining {
+		p.draining = true
+		close(p.drainStart)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.handlers.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-time.After(time.Second):
+			p.log.Infof("Waiting for %d in-flight tasks to complete", p.inFlightCount())
+		case <-ctx.Done():
+			p.stopHandlers()
+
+			select {
+			case <-done:
+			case <-time.After(drainStopWait):
+			}
+
+			return ctx.Err()
+		}
+	}
+}
+
+// BatchPoller is implemented by storage that can fetch several items from a queue at once, items are fetched one at a
+// time using PollQueue() from storage that does not implement it
+type BatchPoller interface {
+	// PollQueueBatch waits for the next item in q until ctx is done and returns it with up to max-1 more that are
+	// immediately available
+	PollQueueBatch(ctx context.Context, q *Queue, max int) ([]*ProcessItem, error)
+}
+
+// pollQueue fetches at least one and up to max items from the queue
+func (q *queueProcessor) pollQueue(ctx context.Context, max int) ([]*ProcessItem, error) {
+	if bp, ok := q.p.c.storage.(BatchPoller); ok && max > 1 {
+		return bp.PollQueueBatch(ctx, q.queue, max)
+	}
+
+	item, err := q.p.c.storage.PollQueue(ctx, q.queue)
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	return []*ProcessItem{item}, nil
+}
+
+// pollItems fetches up to max items from the queue, waiting while the queue is paused
+func (q *queueProcessor) pollItems(ctx context.Context, max int) ([]*ProcessItem, error) {
 	ctr := 0
 	for {
 		if ctx.Err() != nil {
 			return nil, ctx.Err()
 		}
 
-		workQueuePollCounter.WithLabelValues(p.queue.Name).Inc()
+		err := q.waitWhilePaused(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// fetching pauses while reconnecting, in-flight handlers are not interrupted
+		err = q.p.c.waitConnected(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		workQueuePollCounter.WithLabelValues(q.queue.Name).Inc()
 		timeout, cancel := context.WithTimeout(ctx, time.Minute)
-		item, err := p.c.storage.PollQueue(timeout, p.queue)
+		q.setPollCancel(cancel)
+		items, err := q.pollQueue(timeout, max)
+		q.setPollCancel(nil)
 		cancel()
 
 		switch {
+		case err == context.Canceled && ctx.Err() == nil:
+			q.log.Debugf("Poll interrupted by pausing the queue")
+			continue
 		case err == context.Canceled:
-			p.log.Debugf("Context canceled, terminating polling")
+			q.log.Debugf("Context canceled, terminating polling")
 			return nil, err
 		case err == context.DeadlineExceeded:
-			p.log.Debugf("Context timeout, retrying poll")
+			q.log.Debugf("Context timeout, retrying poll")
 			ctr = 0
 			continue
 
 		case err != nil:
-			p.log.Debugf("Unexpected polling error: %v", err)
-			workQueuePollErrorCounter.WithLabelValues(p.queue.Name).Inc()
+			q.log.Debugf("Unexpected polling error: %v", err)
+			workQueuePollErrorCounter.WithLabelValues(q.queue.Name).Inc()
 			if RetrySleep(ctx, retryLinearTenSeconds, ctr) == context.Canceled {
 				return nil, ctx.Err()
 			}
 			ctr++
 			continue
 
-		case item == nil:
-			p.log.Debugf("Had a nil item, retrying")
+		case len(items) == 0:
+			q.log.Debugf("Had a nil item, retrying")
 			// 404 etc
 			continue
 		}
 
-		return item, nil
+		for _, item := range items {
+			item.queue = q.queue
+		}
+
+		return items, nil
+	}
+}
+
+// rateLimitDelay is how long to delay task when its type is rate limited, a random delay of up to the same duration
+// is added so that many deferred tasks do not all return at the same time
+func (p *processor) rateLimitDelay(queue *Queue, task *Task) time.Duration {
+	if p.mux == nil {
+		return 0
+	}
+
+	delay := p.mux.rateLimitDelay(task.Type)
+	if delay <= 0 {
+		return 0
+	}
+
+	handlersRateLimitedCounter.WithLabelValues(queue.Name, taskTypeLabels.label(task.Type)).Inc()
+
+	return delay + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// overTypeConcurrency determines if task should be deferred as its type already runs the maximum concurrent handlers
+// set using Mux.MaxConcurrent(), must be called with p.mu held
+func (p *processor) overTypeConcurrency(task *Task) bool {
+	if p.mux == nil {
+		return false
+	}
+
+	limit := p.mux.maxConcurrent(task.Type)
+
+	return limit > 0 && p.typeActive[task.Type] >= limit
+}
+
+// watchPauseState tracks the pause state of the queue, returning once the current state is known, queues of storage
+// that cannot pause queues are never paused
+func (q *queueProcessor) watchPauseState(ctx context.Context) error {
+	pauser, ok := q.p.c.storage.(QueuePauser)
+	if !ok {
+		return nil
+	}
+
+	states, err := pauser.QueuePausedWatch(ctx, q.queue.Name)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case paused, ok := <-states:
+		if ok {
+			q.setPaused(paused)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	go func() {
+		for paused := range states {
+			q.setPaused(paused)
+		}
+	}()
+
+	return nil
+}
+
+func (q *queueProcessor) setPaused(paused bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if paused == q.paused {
+		return
+	}
+
+	q.paused = paused
+	if paused {
+		q.log.Warnf("Queue %s is paused, not fetching new tasks", q.queue.Name)
+		q.resumed = make(chan struct{})
+		if q.pollCancel != nil {
+			q.pollCancel()
+		}
+	} else {
+		q.log.Infof("Queue %s was resumed", q.queue.Name)
+		close(q.resumed)
+	}
+}
+
+// setPollCancel records the cancel function of the active poll so pausing can interrupt it
+func (q *queueProcessor) setPollCancel(cancel context.CancelFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.pollCancel = cancel
+	if cancel != nil && q.paused {
+		cancel()
 	}
 }
 
+func (q *queueProcessor) waitWhilePaused(ctx context.Context) error {
+	q.mu.Lock()
+	paused := q.paused
+	resumed := q.resumed
+	q.mu.Unlock()
+
+	if !paused {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// maxLimiterSlots is the most slots the limiter can hold, SetConcurrency() can not scale beyond this
+const maxLimiterSlots = 1 << 16
+
+// maxConcurrency is the capacity of the limiter, it holds empty structs so the capacity does not use memory
+func maxConcurrency(concurrency int) int {
+	if concurrency > maxLimiterSlots {
+		return concurrency
+	}
+
+	return maxLimiterSlots
+}
+
+// releaseSlot returns a slot to the limiter unless the concurrency was lowered while it was in use, then the slot is
+// retired instead
+func (p *processor) releaseSlot() {
+	for {
+		retiring := atomic.LoadInt32(&p.retiring)
+		if retiring <= 0 {
+			p.limiter <- struct{}{}
+			return
+		}
+
+		if atomic.CompareAndSwapInt32(&p.retiring, retiring, retiring-1) {
+			return
+		}
+	}
+}
+
+// setConcurrency adds or removes slots, free slots are removed immediately while slots in use are retired once
+// their handlers finish
+func (p *processor) setConcurrency(n int) error {
+	if n > cap(p.limiter) {
+		return fmt.Errorf("concurrency can be at most %d", cap(p.limiter))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delta := n - p.concurrency
+	p.concurrency = n
+
+	// slots waiting to be retired are kept first
+	for delta > 0 {
+		retiring := atomic.LoadInt32(&p.retiring)
+		if retiring <= 0 {
+			break
+		}
+		if atomic.CompareAndSwapInt32(&p.retiring, retiring, retiring-1) {
+			delta--
+		}
+	}
+
+	for ; delta > 0; delta-- {
+		p.limiter <- struct{}{}
+	}
+
+	for ; delta < 0; delta++ {
+		select {
+		case <-p.limiter:
+		default:
+			atomic.AddInt32(&p.retiring, 1)
+		}
+	}
+
+	p.log.Infof("Set concurrency to %d", n)
+
+	return nil
+}
+
+func (p *processor) currentConcurrency() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.concurrency
+}
+
+// acquireSlot waits for a free slot in the limiter, when several queues are bound the slot is granted by grantSlots
+func (p *processor) acquireSlot(ctx context.Context, q *queueProcessor) error {
+	if len(p.queues) == 1 {
+		select {
+		case <-p.limiter:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case p.wanting <- q:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-q.grant:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// grantSlots hands free slots to the queues waiting for one using smooth weighted round-robin, a waiting queue is
+// therefore granted a slot at least once for every sum of all weights slots granted
+func (p *processor) grantSlots(ctx context.Context) {
+	var waiting []*queueProcessor
+
+	for {
+		if len(waiting) == 0 {
+			select {
+			case q := <-p.wanting:
+				waiting = append(waiting, q)
+			case <-ctx.Done():
+				return
+			}
+
+			continue
+		}
+
+		select {
+		case q := <-p.wanting:
+			waiting = append(waiting, q)
+
+		case <-p.limiter:
+			// queues that started waiting while the slot was freed compete for it too
+			for more := true; more; {
+				select {
+				case q := <-p.wanting:
+					waiting = append(waiting, q)
+				default:
+					more = false
+				}
+			}
+
+			next := nextWeightedQueue(waiting)
+			waiting[next].grant <- struct{}{}
+			waiting = append(waiting[:next], waiting[next+1:]...)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// nextWeightedQueue picks the queue to grant a slot to using smooth weighted round-robin
+func nextWeightedQueue(waiting []*queueProcessor) int {
+	total := 0
+	next := 0
+
+	for i, q := range waiting {
+		q.current += q.weight
+		total += q.weight
+
+		if q.current > waiting[next].current {
+			next = i
+		}
+	}
+
+	waiting[next].current -= total
+
+	return next
+}
+
 func (p *processor) processMessages(ctx context.Context, mux *Mux) error {
 	if mux == nil {
 		return ErrNoMux
@@ -249,103 +969,472 @@ func (p *processor) processMessages(ctx context.Context, mux *Mux) error {
 
 	p.mux = mux
 
+	if mux.hasUniqueActive() {
+		locker, ok := p.c.storage.(TaskTypeLocker)
+		if !ok {
+			return fmt.Errorf("%w: storage does not support task type locks", ErrStorageNotReady)
+		}
+
+		err := locker.PrepareTaskTypeLockStore(p.c.opts.memoryStore, p.c.opts.replicas, taskTypeLockTTL)
+		if err != nil {
+			return err
+		}
+	}
+
+	// polling stops when draining while handlers continue using ctx
+	pollCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.drainStart:
+			cancel()
+		case <-pollCtx.Done():
+		}
+	}()
+
+	for _, q := range p.queues {
+		err := q.watchPauseState(pollCtx)
+		if err != nil {
+			p.log.Warnf("Could not watch the pause state of queue %s, pausing will not be supported: %v", q.queue.Name, err)
+		}
+	}
+
+	if len(p.queues) > 1 {
+		go p.grantSlots(pollCtx)
+	}
+
+	p.watchCancelRequests(ctx)
+
+	wg := sync.WaitGroup{}
+	for _, q := range p.queues {
+		wg.Add(1)
+		go func(q *queueProcessor) {
+			defer wg.Done()
+			p.processQueue(ctx, pollCtx, q)
+		}(q)
+	}
+	wg.Wait()
+
+	if pollCtx.Err() == nil && p.c.ConnectionStatus().State == ConnectionClosed {
+		return ErrConnectionClosed
+	}
+
+	p.log.Infof("Processor exiting on context %s", pollCtx.Err())
+
+	return nil
+}
+
+// processQueue polls q for items and starts their handlers until pollCtx is done
+func (p *processor) processQueue(ctx context.Context, pollCtx context.Context, q *queueProcessor) {
 	for {
+		// paused queues do not hold a slot while waiting to be resumed
+		err := q.waitWhilePaused(pollCtx)
+		if err != nil {
+			return
+		}
+
+		err = p.acquireSlot(pollCtx, q)
+		if err != nil {
+			return
+		}
+		slots := 1 + p.acquireExtraSlots()
+
+		items, err := q.pollItems(pollCtx, slots)
+		if err != nil {
+			if err == context.DeadlineExceeded || err == context.Canceled {
+				return
+			}
+			if err == ErrConnectionClosed {
+				p.log.Errorf("Stopping processing of queue %s: %v", q.queue.Name, err)
+				return
+			}
+
+			p.log.Errorf("Unexpected polling error: %v", err)
+			// pollItems already logged and slept
+		}
+
+		for i := len(items); i < slots; i++ {
+			p.releaseSlot()
+		}
+
+		// items in a batch are started concurrently as starting a handler updates the task in storage
+		wg := sync.WaitGroup{}
+		for _, item := range items {
+			wg.Add(1)
+			go func(item *ProcessItem) {
+				defer wg.Done()
+				p.startItem(ctx, q, item)
+			}(item)
+		}
+		wg.Wait()
+	}
+}
+
+func (p *processor) startItem(ctx context.Context, q *queueProcessor, item *ProcessItem) {
+	p.log.Debugf("Received an Item with ID %s from queue %s", item.JobID, q.queue.Name)
+
+	err := p.processMessage(ctx, item)
+	if err != nil {
+		p.log.Warnf("Processing job %s failed: %v", item.JobID, err)
+	}
+}
+
+// acquireExtraSlots takes up to FetchBatchSize()-1 free slots without waiting so more items can be fetched at once,
+// when several queues are bound slots are only granted one at a time
+func (p *processor) acquireExtraSlots() int {
+	if len(p.queues) > 1 {
+		return 0
+	}
+
+	extra := 0
+	for extra < p.c.opts.fetchBatchSize-1 {
 		select {
 		case <-p.limiter:
-			item, err := p.pollItem(ctx)
-			if err != nil {
-				if err == context.DeadlineExceeded {
-					p.log.Infof("Processor exiting on context %s", err)
-					return nil
-				}
-				if err == context.Canceled {
-					return nil
-				}
+			extra++
+		default:
+			return extra
+		}
+	}
 
-				p.log.Errorf("Unexpected polling error: %v", err)
-				// pollItem already logged and slept
-				p.limiter <- struct{}{}
-			}
+	return extra
+}
 
-			if item == nil {
-				continue
-			}
+// checkResultSize enforces the client MaxResultSize() on payload, oversized results terminate the task and when
+// truncating the truncated result is stored in t
+func (p *processor) checkResultSize(t *Task, payload any) error {
+	limit := p.c.opts.maxResultSize
+	if limit == 0 || payload == nil {
+		return nil
+	}
 
-			p.log.Debugf("Received an Item with ID %s", item.JobID)
+	res, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("%w: could not encode result: %v", ErrTerminateTask, err)
+	}
 
-			err = p.processMessage(ctx, item)
-			if err != nil {
-				p.log.Warnf("Processing job %s failed: %v", item.JobID, err)
-				p.limiter <- struct{}{}
-				continue
-			}
-		case <-ctx.Done():
-			p.log.Infof("Processor exiting on context %s", ctx.Err())
-			return nil
+	if len(res) <= limit {
+		return nil
+	}
+
+	if p.c.opts.oversizedResults == OversizedResultTruncate {
+		t.Result = &TaskResult{
+			Payload:     string(res[:limit]),
+			CompletedAt: p.c.opts.clock.Now().UTC(),
+		}
+	}
+
+	return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrTaskResultTooLarge, len(res), limit)
+}
+
+// runHandler calls the handler for t surrounded by the PreProcess() and PostProcess() hooks, recovering any panics and
+// turning them into errors with the stack trace stored in the task result
+func (p *processor) runHandler(ctx context.Context, t *Task) (payload any, err error) {
+	// deferred first so the hook sees the error of a recovered panic
+	defer func() { p.postProcess(ctx, t, payload, err) }()
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		stack := debug.Stack()
+
+		handlersPanickedCounter.WithLabelValues(t.Queue, taskTypeLabels.label(t.Type)).Inc()
+		p.log.Errorf("Handling task %s panicked: %v: %s", t.ID, r, stack)
+
+		payload = nil
+		err = fmt.Errorf("%w: %v", ErrTaskPanicked, r)
+		t.Result = &TaskResult{
+			Payload:     string(stack),
+			CompletedAt: p.c.opts.clock.Now().UTC(),
+		}
+
+		if p.c.opts.panicHandler != nil {
+			p.c.opts.panicHandler(t, r)
+		}
+	}()
+
+	ctx, err = p.preProcess(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.mux.Handler(t)(ctx, taskLogger(p.log, t), t)
+}
+
+// retryDelay is how long to wait before trying t again after it failed, the policy set for its type using
+// Mux.RetryPolicy() or else the client retry policy
+func (p *processor) retryDelay(t *Task) time.Duration {
+	if p.mux != nil {
+		if policy, ok := p.mux.retryPolicy(t.Type); ok {
+			return policy.Duration(t.Tries)
 		}
 	}
+
+	return p.c.opts.retryPolicy.Duration(t.Tries)
+}
+
+// retryItem returns item to the queue so t is tried again after delay. Items that reached the delivery limit of their
+// queue are replaced by a new item as t is allowed more tries than its queue, it is held until its NextTryAt
+func (p *processor) retryItem(ctx context.Context, t *Task, item *ProcessItem, delay time.Duration) error {
+	q := p.itemQueue(item)
+	limit := q.maxDeliver()
+	if limit <= 0 || item.deliveries < uint64(limit) {
+		return p.c.storage.NakDelayedItem(ctx, item, delay)
+	}
+
+	p.log.Debugf("Enqueueing task %s again after its queue item reached %d deliveries", t.ID, limit)
+
+	err := p.c.storage.EnqueueTask(ctx, q, t)
+	if err != nil {
+		return err
+	}
+
+	return p.c.storage.AckItem(ctx, item)
+}
+
+// recordAttempt adds the handler run that started at started to the attempt history of t
+func (p *processor) recordAttempt(t *Task, started time.Time, err error) {
+	attempt := TaskAttempt{
+		Time:     started.UTC(),
+		Duration: p.c.opts.clock.Now().Sub(started),
+		Worker:   p.c.opts.workerName,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	t.recordAttempt(attempt, p.c.opts.attemptHistory)
+}
+
+// handlerDone records that the handler for t registered in processMessage finished
+func (p *processor) handlerDone(t *Task) {
+	p.mu.Lock()
+	p.typeActive[t.Type]--
+	if p.typeActive[t.Type] <= 0 {
+		delete(p.typeActive, t.Type)
+	}
+	if hc, ok := p.cancels[t.ID]; ok && hc.cancel != nil {
+		hc.cancel()
+	}
+	delete(p.cancels, t.ID)
+	p.mu.Unlock()
+
+	p.markActive()
+	atomic.AddInt32(&p.inFlight, -1)
+	p.handlers.Done()
+}
+
+// taskDeadlineContext limits ctx to the Deadline of t as measured by c, the earlier of the two deadlines applies
+func taskDeadlineContext(ctx context.Context, c clock, t *Task) (context.Context, context.CancelFunc) {
+	if t.Deadline == nil {
+		return ctx, func() {}
+	}
+
+	return withClockDeadline(ctx, c, *t.Deadline)
 }
 
 func (p *processor) handle(ctx context.Context, t *Task, item *ProcessItem, to time.Duration) {
 	defer func() {
 		handlersBusyGauge.WithLabelValues().Dec()
-		p.limiter <- struct{}{}
+		p.handlerDone(t)
+		p.releaseSlot()
 	}()
 
 	if p.mux == nil {
 		return
 	}
 
-	obs := prometheus.NewTimer(handlerRunTimeSummary.WithLabelValues(t.Queue, t.Type))
+	log := taskLogger(p.log, t)
+	ttype := taskTypeLabels.label(t.Type)
+	obs := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
+		handlerRunTimeSummary.WithLabelValues(t.Queue, ttype).Observe(v)
+		handlerRunTimeHistogram.WithLabelValues(t.Queue, ttype).Observe(v)
+	}))
 	defer obs.ObserveDuration()
 	handlersBusyGauge.WithLabelValues().Inc()
 
-	timeout, cancel := context.WithTimeout(ctx, to)
-	defer cancel()
+	lease := newTaskLease(ctx, p.c.opts.clock, to, func(ctx context.Context) error { return p.c.storage.InProgressItem(ctx, item) })
+	defer lease.release()
+
+	if p.c.opts.heartbeats {
+		interval := p.c.opts.heartbeatInterval
+		if interval <= 0 {
+			interval = to / 3
+		}
+		go lease.keepAlive(interval, log)
+	}
 
 	t.Tries++
+	t.NextTryAt = nil
+
+	dctx, cancel := taskDeadlineContext(lease, p.c.opts.clock, t)
+	defer cancel()
+
+	started := p.c.opts.clock.Now()
+	qctx, requeue := newRequeueContext(p.handlerContext(dctx, t))
+	rctx, results := newResultStreamContext(qctx, p.c, t)
+	hctx, span := p.c.startHandlerSpan(newTaskInfoContext(newCodecContext(newProgressContext(rctx, t, p.c.storage, p.c.opts.clock), p.c.opts.codec), t), t)
+	payload, err := p.guardHandler(hctx, t)
+	obj, serr := results.finish(err)
+	switch {
+	case serr != nil:
+		err = fmt.Errorf("storing the streamed result failed: %w", serr)
+	case obj != nil:
+		t.Result = &TaskResult{Object: obj}
+	}
+	cont, ok := payload.(*Continuation)
+	if ok && err == nil {
+		payload = cont.Result
+	}
+	if err == nil {
+		err = p.checkResultSize(t, payload)
+	}
+	if err != nil && p.cancelRequested(t) {
+		err = Terminate(ErrTaskCanceled)
+	}
+	// only when the task deadline fired, not the lease or the client context
+	if err != nil && lease.Err() == nil && errors.Is(dctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w: %v", ErrTaskPastDeadline, err)
+	}
+	// streamed results are only referenced by tasks that complete
+	if err != nil && obj != nil {
+		t.Result = nil
+	}
+	endSpan(span, err)
+	p.recordAttempt(t, started, err)
+	if requeue.requested.Load() && !p.cancelRequested(t) {
+		handlersRequeuedCounter.WithLabelValues(t.Queue, ttype).Inc()
+		log.Infof("Handling task %s requested it be requeued", t.ID)
+
+		err = p.c.requeueTask(ctx, p.itemQueue(item), t, item)
+		if err != nil {
+			log.Warnf("Requeueing task failed: %v", err)
+		}
+
+		return
+	}
+	if err != nil && p.handlerStopped(t) {
+		log.Infof("Handling task %s was stopped by draining, returning it to the queue", t.ID)
+
+		err = p.c.handleTaskRetryAfter(ctx, t, ErrProcessorDraining)
+		if err != nil {
+			log.Warnf("Updating task after stopped processing failed: %v", err)
+		}
+
+		err = p.c.storage.NakItem(ctx, item)
+		if err != nil {
+			log.Warnf("NaK after stopped processing failed: %v", err)
+		}
+
+		return
+	}
+	if reason, ok := skipReason(err); ok {
+		log.Infof("Handling task %s was skipped: %s", t.ID, err)
+
+		err = p.c.handleTaskSkipped(ctx, t, reason)
+		if err != nil {
+			log.Warnf("Updating task after skipped processing failed: %v", err)
+		}
+
+		err = p.c.storage.AckItem(ctx, item)
+		if err != nil {
+			log.Warnf("Ack after skipped processing failed: %v", err)
+		}
+
+		return
+	}
+	if delay, ok := retryAfterDelay(err); ok {
+		handlersRetryAfterCounter.WithLabelValues(t.Queue, ttype).Inc()
+		log.Infof("Handling task %s requested a retry after %v", t.ID, delay)
+
+		t.setNextTry(p.c.opts.clock.Now(), delay)
+		err = p.c.handleTaskRetryAfter(ctx, t, err)
+		if err != nil {
+			log.Warnf("Updating task after deferred processing failed: %v", err)
+		}
+
+		err = p.c.storage.NakDelayedItem(ctx, item, delay)
+		if err != nil {
+			log.Warnf("NaK after deferred processing failed: %v", err)
+		}
+
+		return
+	}
 
-	payload, err := p.mux.Handler(t)(timeout, p.log, t)
 	if err != nil {
+		if errors.Is(err, ErrNoHandlerForTaskType) && p.c.opts.unroutedTasks != UnroutedTaskRetry {
+			err = fmt.Errorf("%w: %v", ErrTerminateTask, err)
+		}
+
 		if errors.Is(err, ErrTerminateTask) {
-			handlersErroredCounter.WithLabelValues(t.Queue, t.Type).Inc()
-			p.log.Errorf("Handling task %s failed, terminating retries: %s", t.ID, err)
+			handlersErroredCounter.WithLabelValues(t.Queue, ttype).Inc()
+			log.Errorf("Handling task %s failed, terminating retries: %s", t.ID, err)
+
+			if t.Result == nil {
+				t.Result = &TaskResult{CompletedAt: p.c.opts.clock.Now().UTC()}
+			}
+			t.Result.Error = err.Error()
 
 			err = p.c.handleTaskTerminated(ctx, t, err)
 			if err != nil {
-				p.log.Warnf("Updating task after failed processing failed: %v", err)
+				log.Warnf("Updating task after failed processing failed: %v", err)
 			}
 
 			err = p.c.storage.TerminateItem(ctx, item)
 			if err != nil {
-				p.log.Warnf("Term after failed processing failed: %v", err)
+				log.Warnf("Term after failed processing failed: %v", err)
 			}
 		} else {
-			handlersErroredCounter.WithLabelValues(t.Queue, t.Type).Inc()
-			p.log.Errorf("Handling task %s failed: %s", t.ID, err)
+			handlersErroredCounter.WithLabelValues(t.Queue, ttype).Inc()
+			log.Errorf("Handling task %s failed: %s", t.ID, err)
+
+			// stored with the task so that deliveries before this time, like after a restart, are delayed again
+			delay := p.retryDelay(t)
+			t.setNextTry(p.c.opts.clock.Now(), delay)
 
 			err = p.c.handleTaskError(ctx, t, err)
 			if err != nil {
-				p.log.Warnf("Updating task after failed processing failed: %v", err)
+				log.Warnf("Updating task after failed processing failed: %v", err)
+			}
+			if t.State == TaskStateRetry {
+				recordRetryDelay(t, delay)
 			}
 
-			err = p.c.storage.NakItem(ctx, item)
+			// no further tries will be made so there is no point in keeping the item around
+			if t.State == TaskStateExpired || t.State == TaskStateQuarantined || t.State == TaskStateTerminated {
+				err = p.c.storage.TerminateItem(ctx, item)
+				if err != nil {
+					log.Warnf("Term after exhausting tries failed: %v", err)
+				}
+
+				return
+			}
+
+			err = p.retryItem(ctx, t, item, delay)
 			if err != nil {
-				p.log.Warnf("NaK after failed processing failed: %v", err)
+				log.Warnf("NaK after failed processing failed: %v", err)
 			}
 		}
 
 		return
 	}
 
+	if cont != nil {
+		p.continueTask(ctx, log, t, item, payload, cont.Tasks)
+		return
+	}
+
 	err = p.c.setTaskSuccess(ctx, t, payload)
 	if err != nil {
-		p.log.Warnf("Updating task after processing failed: %v", err)
+		log.Warnf("Updating task after processing failed: %v", err)
 	}
 
 	// we try ack the thing anyway, hail mary to avoid a retry even if setTaskSuccess failed
 	err = p.c.storage.AckItem(ctx, item)
 	if err != nil {
-		p.log.Errorf("Acknowledging work item failed: %v", err)
+		log.Errorf("Acknowledging work item failed: %v", err)
 	}
 }
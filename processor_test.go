@@ -2,9 +2,11 @@ package asyncjobs
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jsm.go"
@@ -13,6 +15,30 @@ import (
 	. "github.com/onsi/gomega"
 )
 
+// racingStorage updates the payload of tasks between a worker loading and starting them the first time they are started
+type racingStorage struct {
+	*InMemoryStorage
+	updated sync.Map
+}
+
+func (s *racingStorage) SaveTaskState(ctx context.Context, task *Task, notify bool) error {
+	if task.State == TaskStateActive {
+		if _, done := s.updated.LoadOrStore(task.ID, true); !done {
+			loaded, err := s.LoadTaskByID(task.ID)
+			if err != nil {
+				return err
+			}
+			loaded.Payload = []byte(`"updated"`)
+			err = s.InMemoryStorage.SaveTaskState(ctx, loaded, false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.InMemoryStorage.SaveTaskState(ctx, task, notify)
+}
+
 var _ = Describe("Processor", func() {
 	var (
 		ctx    context.Context
@@ -61,6 +87,7 @@ var _ = Describe("Processor", func() {
 				Expect(err).ToNot(HaveOccurred())
 				Expect(task.State).To(Equal(TaskStateTerminated))
 				Expect(task.Tries).To(Equal(1))
+				Expect(task.Result.Error).To(Equal("simulated failure: terminate task"))
 
 				msg, err := sub.NextMsg(time.Second)
 				Expect(err).ToNot(HaveOccurred())
@@ -72,6 +99,435 @@ var _ = Describe("Processor", func() {
 			})
 		})
 
+		It("Should deliver tasks modified while being started again without waiting for the item to time out", func() {
+			storage := &racingStorage{InMemoryStorage: NewInMemoryStorage()}
+			client, err := NewClient(StorageBackend(storage), WorkQueue(&Queue{Name: "RACING", MaxRunTime: time.Hour}))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return string(t.Payload), nil
+			})
+
+			wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+			defer wcancel()
+			go client.Run(wctx, router)
+
+			task, err := NewTask("ginkgo", "original")
+			Expect(err).ToNot(HaveOccurred())
+			res, err := client.EnqueueAndWait(wctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`"\"updated\""`))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.Tries).To(Equal(1))
+		})
+
+		It("Should terminate the items of tasks that will not be tried again", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting), QuarantinePoisonTasks(2))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.setupStreams()).ToNot(HaveOccurred())
+				Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					return nil, fmt.Errorf("simulated failure")
+				})
+
+				// intercept the acks
+				sub, err := nc.SubscribeSync("$JS.ACK.CHORIA_AJ_Q_DEFAULT.WORKERS.>")
+				Expect(err).ToNot(HaveOccurred())
+
+				expected := map[string]TaskState{}
+				for _, tc := range []struct {
+					opts  []TaskOpt
+					state TaskState
+				}{
+					{[]TaskOpt{NoRetry()}, TaskStateTerminated},
+					{[]TaskOpt{TaskMaxTries(1)}, TaskStateExpired},
+					{[]TaskOpt{TaskMaxTries(5)}, TaskStateQuarantined},
+				} {
+					task, err := NewTask("ginkgo", nil, tc.opts...)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					expected[task.ID] = tc.state
+				}
+
+				go client.Run(ctx, router)
+
+				terms := 0
+				for terms < len(expected) {
+					msg, err := sub.NextMsg(5 * time.Second)
+					Expect(err).ToNot(HaveOccurred())
+					if string(msg.Data) == "+TERM" {
+						terms++
+					}
+				}
+
+				for id, state := range expected {
+					task, err := client.LoadTaskByID(id)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(task.State).To(Equal(state))
+				}
+
+				Eventually(func() uint64 {
+					nfo, err := client.StorageAdmin().QueueInfo(client.opts.queue.Name)
+					Expect(err).ToNot(HaveOccurred())
+					return nfo.Stream.State.Msgs
+				}).Should(Equal(uint64(0)))
+			})
+		})
+
+		It("Should use the task max tries only when set instead of the queue max tries", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				for _, opt := range []ClientOpt{NatsConn(nc), StorageBackend(NewInMemoryStorage())} {
+					client, err := NewClient(opt, RetryBackoffPolicy(retryForTesting), WorkQueue(&Queue{Name: "LIMITED", MaxTries: 2}))
+					Expect(err).ToNot(HaveOccurred())
+
+					router := NewTaskRouter()
+					router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+						return nil, fmt.Errorf("simulated failure")
+					})
+
+					wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+					go client.Run(wctx, router)
+
+					// tasks default to more tries than the queue allows, only a limit set explicitly exceeds it
+					for _, tc := range []struct {
+						opts  []TaskOpt
+						tries int
+					}{
+						{[]TaskOpt{TaskMaxTries(4)}, 4},
+						{[]TaskOpt{TaskMaxTries(1)}, 1},
+						{[]TaskOpt{TaskMaxTries(0)}, 2},
+						{nil, 2},
+					} {
+						task, err := NewTask("ginkgo", nil, tc.opts...)
+						Expect(err).ToNot(HaveOccurred())
+						_, err = client.EnqueueAndWait(wctx, task)
+						Expect(err).To(MatchError(ErrTaskFailed))
+
+						task, err = client.LoadTaskByID(task.ID)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(task.State).To(Equal(TaskStateExpired))
+						Expect(task.Tries).To(Equal(tc.tries))
+					}
+
+					wcancel()
+				}
+			})
+		})
+
+		It("Should terminate tasks using Terminate regardless of remaining tries", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return nil, Terminate(fmt.Errorf("invalid input"))
+			})
+
+			wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+			defer wcancel()
+			go client.Run(wctx, router)
+
+			task, err := NewTask("ginkgo", nil, TaskMaxTries(5))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.EnqueueAndWait(wctx, task)
+			Expect(err).To(MatchError("task failed: terminated: terminate task: invalid input"))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.State).To(Equal(TaskStateTerminated))
+			Expect(task.Tries).To(Equal(1))
+			Expect(task.Result.Error).To(Equal("terminate task: invalid input"))
+		})
+
+		It("Should skip tasks using SkipTask without running their dependents", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return nil, SkipTask("order was cancelled")
+			})
+			router.HandleFunc("ship", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				return "shipped", nil
+			})
+
+			wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+			defer wcancel()
+			go client.Run(wctx, router)
+
+			task, err := NewTask("ginkgo", nil, TaskMaxTries(5))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.EnqueueAndWait(wctx, task)
+			Expect(err).To(MatchError(ErrTaskSkipped))
+			Expect(err).To(MatchError("task skipped: order was cancelled"))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.State).To(Equal(TaskStateSkipped))
+			Expect(task.IsFinal()).To(BeTrue())
+			Expect(task.Tries).To(Equal(1))
+			Expect(task.LastErr).To(BeEmpty())
+			Expect(task.Result.SkipReason).To(Equal("order was cancelled"))
+
+			ship, err := NewTask("ship", nil, TaskDependsOn(task))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(wctx, ship)).To(Succeed())
+
+			Eventually(func() TaskState {
+				ship, err = client.LoadTaskByID(ship.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return ship.State
+			}).Should(Equal(TaskStateUnreachable))
+		})
+
+		It("Should requeue tasks using Requeue with their tries reset", func() {
+			Expect(Requeue(context.Background())).To(BeFalse())
+
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				for _, opt := range []ClientOpt{NatsConn(nc), StorageBackend(NewInMemoryStorage())} {
+					client, err := NewClient(opt, RetryBackoffPolicy(retryForTesting))
+					Expect(err).ToNot(HaveOccurred())
+
+					router := NewTaskRouter()
+					router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+						switch {
+						case t.Tries == 1 && t.Requeues == 0:
+							return nil, fmt.Errorf("simulated failure")
+						case t.Requeues == 0:
+							Expect(Requeue(ctx)).To(BeTrue())
+							return "discarded", nil
+						default:
+							return t.Tries, nil
+						}
+					})
+
+					wctx, wcancel := context.WithTimeout(ctx, 5*time.Second)
+					go client.Run(wctx, router)
+
+					task, err := NewTask("ginkgo", nil)
+					Expect(err).ToNot(HaveOccurred())
+					res, err := client.EnqueueAndWait(wctx, task)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(res).To(MatchJSON(`1`))
+
+					task, err = client.LoadTaskByID(task.ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(task.State).To(Equal(TaskStateCompleted))
+					Expect(task.Tries).To(Equal(1))
+					Expect(task.Requeues).To(Equal(1))
+					Expect(task.Attempts).To(HaveLen(3))
+					wcancel()
+				}
+			})
+		})
+
+		It("Should terminate tasks with results larger than the maximum size", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				_, err := NewClient(NatsConn(nc), MaxResultSize(0, OversizedResultReject))
+				Expect(err).To(MatchError("maximum result size must be at least 1 byte"))
+				_, err = NewClient(NatsConn(nc), MaxResultSize(10, "x"))
+				Expect(err).To(MatchError(`invalid oversized result policy "x"`))
+
+				for _, policy := range []OversizedResultPolicy{OversizedResultReject, OversizedResultTruncate} {
+					client, err := NewClient(NatsConn(nc), MaxResultSize(10, policy))
+					Expect(err).ToNot(HaveOccurred())
+
+					router := NewTaskRouter()
+					router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+						if string(t.Payload) == `"small"` {
+							return "done", nil
+						}
+						return "a result that is too large", nil
+					})
+
+					wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+					go client.Run(wctx, router)
+
+					small, err := NewTask("ginkgo", "small")
+					Expect(err).ToNot(HaveOccurred())
+					res, err := client.EnqueueAndWait(wctx, small)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(res).To(MatchJSON(`"done"`))
+
+					large, err := NewTask("ginkgo", "large")
+					Expect(err).ToNot(HaveOccurred())
+					_, err = client.EnqueueAndWait(wctx, large)
+					Expect(err).To(MatchError(ErrTaskFailed))
+
+					large, err = client.LoadTaskByID(large.ID)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(large.State).To(Equal(TaskStateTerminated))
+					Expect(large.Tries).To(Equal(1))
+					Expect(large.LastErr).To(ContainSubstring("28 bytes exceeds the limit of 10 bytes"))
+
+					if policy == OversizedResultTruncate {
+						Expect(large.Result.Payload).To(Equal(`"a result `))
+					} else {
+						Expect(large.Result.Payload).To(BeNil())
+					}
+					Expect(large.Result.Error).To(Equal(large.LastErr))
+
+					wcancel()
+				}
+			})
+		})
+
+		It("Should defer tasks requesting a retry without counting a try", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					if t.Deferrals < 2 {
+						return nil, RetryAfter(50 * time.Millisecond)
+					}
+					return "done", nil
+				})
+
+				wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+				defer wcancel()
+				go client.Run(wctx, router)
+
+				task, err := NewTask("ginkgo", nil, TaskMaxTries(1))
+				Expect(err).ToNot(HaveOccurred())
+				res, err := client.EnqueueAndWait(wctx, task)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(res).To(MatchJSON(`"done"`))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateCompleted))
+				Expect(task.Tries).To(Equal(1))
+				Expect(task.Deferrals).To(Equal(2))
+			})
+		})
+
+		It("Should record the most recent attempts", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				_, err := NewClient(NatsConn(nc), TaskAttemptHistory(-1))
+				Expect(err).To(MatchError("task attempt history may not be negative"))
+
+				client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting), TaskAttemptHistory(2), WorkerName("ginkgo:1"))
+				Expect(err).ToNot(HaveOccurred())
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					if t.Tries < 3 {
+						return nil, fmt.Errorf("try %d failed", t.Tries)
+					}
+					return "done", nil
+				})
+
+				wctx, wcancel := context.WithTimeout(ctx, 10*time.Second)
+				defer wcancel()
+				go client.Run(wctx, router)
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = client.EnqueueAndWait(wctx, task)
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.Tries).To(Equal(3))
+				Expect(task.Attempts).To(HaveLen(2))
+				Expect(task.Attempts[0].Error).To(Equal("try 2 failed"))
+				Expect(task.Attempts[1].Error).To(BeEmpty())
+				Expect(task.Attempts[1].Time).To(BeTemporally(">", task.Attempts[0].Time))
+				for _, a := range task.Attempts {
+					Expect(a.Worker).To(Equal("ginkgo:1"))
+				}
+			})
+		})
+
+		It("Should terminate tasks without a handler unless configured to retry them", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				for _, policy := range []UnroutedTaskPolicy{UnroutedTaskTerminate, UnroutedTaskRetry} {
+					client, err := NewClient(NatsConn(nc), UnroutedTaskHandling(policy))
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(client.setupStreams()).ToNot(HaveOccurred())
+					Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+					task, err := NewTask("ginkgo", "test")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+					pctx, pcancel := context.WithCancel(ctx)
+					go client.Run(pctx, NewTaskRouter())
+
+					expected := TaskStateTerminated
+					if policy == UnroutedTaskRetry {
+						expected = TaskStateRetry
+					}
+
+					Eventually(func() TaskState {
+						task, err = client.LoadTaskByID(task.ID)
+						Expect(err).ToNot(HaveOccurred())
+						return task.State
+					}).Should(Equal(expected))
+					Expect(task.LastErr).To(ContainSubstring("no handler for task type"))
+					Expect(task.Tries).To(Equal(1))
+
+					pcancel()
+				}
+
+				_, err := NewClient(NatsConn(nc), UnroutedTaskHandling("other"))
+				Expect(err).To(MatchError(`invalid unrouted task policy "other"`))
+			})
+		})
+
+		It("Should return rate limited tasks to the queue", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				var handled int32
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					atomic.AddInt32(&handled, 1)
+					return nil, nil
+				})
+				Expect(router.RateLimit("ginkgo", 1, time.Hour, 1)).To(Succeed())
+
+				sub, err := nc.SubscribeSync("$JS.ACK.CHORIA_AJ_Q_DEFAULT.WORKERS.>")
+				Expect(err).ToNot(HaveOccurred())
+
+				go client.Run(ctx, router)
+
+				first, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, first)).To(Succeed())
+				Eventually(func() int32 { return atomic.LoadInt32(&handled) }).Should(Equal(int32(1)))
+
+				msg, err := sub.NextMsg(time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(msg.Data)).To(Equal("+ACK"))
+
+				second, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, second)).To(Succeed())
+
+				msg, err = sub.NextMsg(time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(msg.Data)).To(MatchRegexp("-NAK {\"delay\":"))
+
+				second, err = client.LoadTaskByID(second.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(second.State).To(Equal(TaskStateNew))
+				Expect(second.Tries).To(Equal(0))
+				Expect(atomic.LoadInt32(&handled)).To(Equal(int32(1)))
+			})
+		})
+
 		It("Should handle handler errors and update the task and NaK the item", func() {
 			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
 				client, err := NewClient(NatsConn(nc))
@@ -113,6 +569,159 @@ var _ = Describe("Processor", func() {
 			})
 		})
 
+		It("Should expire tasks that exhausted their own max tries and terminate the item", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.setupStreams()).ToNot(HaveOccurred())
+				Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test", TaskMaxTries(1))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				wg := sync.WaitGroup{}
+				wg.Add(1)
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					wg.Done()
+					return nil, fmt.Errorf("simulated failure")
+				})
+
+				// intercept the term
+				sub, err := nc.SubscribeSync("$JS.ACK.CHORIA_AJ_Q_DEFAULT.WORKERS.>")
+				Expect(err).ToNot(HaveOccurred())
+
+				go client.Run(ctx, router)
+
+				wg.Wait()
+				time.Sleep(50 * time.Millisecond)
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+				Expect(task.Tries).To(Equal(1))
+
+				msg, err := sub.NextMsg(time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(msg.Data)).To(Equal("+TERM"))
+			})
+		})
+
+		It("Should call the pre and post process hooks around handlers", func() {
+			type tenantKey struct{}
+
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), PreProcess(nil))
+			Expect(err).To(MatchError("pre process hook is required"))
+			_, err = NewClient(StorageBackend(NewInMemoryStorage()), PostProcess(nil))
+			Expect(err).To(MatchError("post process hook is required"))
+
+			var mu sync.Mutex
+			var post []string
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting),
+				PreProcess(func(ctx context.Context, t *Task) (context.Context, error) {
+					if t.Tries == 1 {
+						return nil, fmt.Errorf("tenant lookup failed")
+					}
+					return context.WithValue(ctx, tenantKey{}, "acme"), nil
+				}),
+				PostProcess(func(ctx context.Context, t *Task, result any, err error) {
+					mu.Lock()
+					defer mu.Unlock()
+					tenant, _ := ctx.Value(tenantKey{}).(string)
+					post = append(post, fmt.Sprintf("%d %s %v %v", t.Tries, tenant, result, err))
+				}))
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				return ctx.Value(tenantKey{}), nil
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			res, err := client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`"acme"`))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.Tries).To(Equal(2))
+
+			mu.Lock()
+			defer mu.Unlock()
+			Expect(post).To(Equal([]string{"1  <nil> tenant lookup failed", "2 acme acme <nil>"}))
+		})
+
+		It("Should recover panics and retry the task", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				var panicked any
+				var panickedTask *Task
+
+				client, err := NewClient(NatsConn(nc), PanicHandler(func(t *Task, r any) {
+					panickedTask = t
+					panicked = r
+				}))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.setupStreams()).ToNot(HaveOccurred())
+				Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+				second, err := NewTask("ginkgo", "second")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, second)).ToNot(HaveOccurred())
+
+				wg := sync.WaitGroup{}
+				wg.Add(2)
+
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					defer wg.Done()
+					if t.ID == task.ID {
+						panic("simulated panic")
+					}
+					return "done", nil
+				})
+
+				// intercept the NaK
+				sub, err := nc.SubscribeSync("$JS.ACK.CHORIA_AJ_Q_DEFAULT.WORKERS.>")
+				Expect(err).ToNot(HaveOccurred())
+
+				go client.Run(ctx, router)
+
+				wg.Wait()
+				time.Sleep(50 * time.Millisecond)
+
+				Expect(panicked).To(Equal("simulated panic"))
+				Expect(panickedTask.ID).To(Equal(task.ID))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateRetry))
+				Expect(task.Tries).To(Equal(1))
+				Expect(task.LastErr).To(ContainSubstring("task handler panicked: simulated panic"))
+				Expect(task.Result.Payload).To(ContainSubstring("runtime/debug.Stack"))
+
+				second, err = client.LoadTaskByID(second.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(second.State).To(Equal(TaskStateCompleted))
+
+				var acks []string
+				for i := 0; i < 2; i++ {
+					msg, err := sub.NextMsg(time.Second)
+					Expect(err).ToNot(HaveOccurred())
+					acks = append(acks, string(msg.Data))
+				}
+				Expect(acks).To(ContainElement(MatchRegexp("-NAK {\"delay\":")))
+			})
+		})
+
 		It("Should set task success and Ack the item", func() {
 			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
 				client, err := NewClient(NatsConn(nc))
@@ -310,6 +919,97 @@ var _ = Describe("Processor", func() {
 			})
 		})
 
+		It("Should fail with ErrTaskLoadFailed for tasks that can not be loaded", func() {
+			pubk, _, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), TaskVerificationKey(pubk))
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err := NewTask("ginkgo", "test")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+			proc, err := newProcessor(client)
+			Expect(err).ToNot(HaveOccurred())
+
+			<-proc.limiter
+			err = proc.processMessage(ctx, &ProcessItem{JobID: task.ID})
+			Expect(err).To(MatchError(ErrTaskLoadFailed))
+			Expect(err).To(MatchError("loading task failed: task is not signed"))
+		})
+
+		It("Should not process tasks past their TTL, and it should set them to expired", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.setupStreams()).ToNot(HaveOccurred())
+				Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test", TaskTTL(10*time.Millisecond))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+				Expect(task.ExpiresAt).ToNot(BeNil())
+
+				proc, err := newProcessor(client)
+				Expect(err).ToNot(HaveOccurred())
+
+				time.Sleep(20 * time.Millisecond)
+
+				<-proc.limiter
+				err = proc.processMessage(ctx, &ProcessItem{JobID: task.ID})
+				Expect(err).To(MatchError(ErrTaskPastTTL))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+				Expect(task.LastErr).To(Equal("task ttl expired"))
+			})
+		})
+
+		It("Should expire tasks older than the queue absolute max age regardless of tries", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: "AGED", AbsoluteMaxAge: 10 * time.Millisecond}))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(client.setupStreams()).ToNot(HaveOccurred())
+				Expect(client.setupQueues()).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				events, err := nc.SubscribeSync(TaskStateChangeEventSubjectWildcard)
+				Expect(err).ToNot(HaveOccurred())
+
+				proc, err := newProcessor(client)
+				Expect(err).ToNot(HaveOccurred())
+
+				time.Sleep(20 * time.Millisecond)
+
+				<-proc.limiter
+				err = proc.processMessage(ctx, &ProcessItem{JobID: task.ID})
+				Expect(err).To(MatchError(ErrTaskPastAbsoluteMaxAge))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+				Expect(task.Tries).To(Equal(0))
+				Expect(task.LastErr).To(Equal("task exceeds the queue absolute max age"))
+
+				msg, err := events.NextMsg(time.Second)
+				Expect(err).ToNot(HaveOccurred())
+				event, _, err := ParseEventJSON(msg.Data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(event.(TaskStateChangeEvent).State).To(Equal(TaskStateExpired))
+				Expect(event.(TaskStateChangeEvent).LastErr).To(Equal("task exceeds the queue absolute max age"))
+			})
+
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), WorkQueue(&Queue{Name: "AGED", AbsoluteMaxAge: -1}))
+			Expect(err).To(MatchError(ErrQueueInvalidSettings))
+		})
+
 		It("Should support executing messages with deadlines in the future", func() {
 			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
 				client, err := NewClient(NatsConn(nc))
@@ -330,6 +1030,59 @@ var _ = Describe("Processor", func() {
 			})
 		})
 
+		It("Should expire scheduled tasks whose deadline is before their scheduled time", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = NewTask("ginkgo", "test", TaskScheduledIn(time.Hour), TaskDeadline(time.Now().Add(time.Minute)))
+				Expect(err).To(MatchError(ErrTaskDeadlineBeforeSchedule))
+
+				// tasks stored by older clients could still have such deadlines
+				task, err := NewTask("ginkgo", "test", TaskScheduledIn(time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				deadline := time.Now().Add(time.Minute)
+				task.Deadline = &deadline
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				proc, err := newProcessor(client)
+				Expect(err).ToNot(HaveOccurred())
+
+				<-proc.limiter
+				err = proc.processMessage(ctx, &ProcessItem{JobID: task.ID})
+				Expect(err).To(MatchError(ErrTaskPastDeadline))
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateExpired))
+				Expect(task.Tries).To(Equal(0))
+			})
+		})
+
+		It("Should delay scheduled tasks until their scheduled time", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test", TaskScheduledIn(500*time.Millisecond))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				handled := make(chan time.Time, 1)
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					handled <- time.Now()
+					return "done", nil
+				})
+
+				go client.Run(ctx, router)
+
+				var at time.Time
+				Eventually(handled, "2s").Should(Receive(&at))
+				Expect(at).To(BeTemporally(">=", *task.ScheduledFor))
+			})
+		})
+
 		It("Should set tasks as active and process them using the handler", func() {
 			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
 				client, err := NewClient(NatsConn(nc))
@@ -442,6 +1195,67 @@ var _ = Describe("Processor", func() {
 			})
 		})
 
+		It("Should support the terminate and block failure policies", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc), DependencyFailureHandling(DependencyFailureTerminate))
+				Expect(err).ToNot(HaveOccurred())
+
+				p1, err := NewTask("ginkgo", "parent")
+				Expect(err).ToNot(HaveOccurred())
+				p1.State = TaskStateTerminated
+				Expect(client.storage.SaveTaskState(ctx, p1, false)).ToNot(HaveOccurred())
+
+				task, err := NewTask("ginkgo", "test", TaskDependsOn(p1))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				tctx, cancel := context.WithCancel(ctx)
+				go client.Run(tctx, NewTaskRouter())
+
+				time.Sleep(50 * time.Millisecond)
+				cancel()
+
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateTerminated))
+				Expect(task.LastErr).To(ContainSubstring("task dependencies failed"))
+
+				client, err = NewClient(NatsConn(nc), DependencyFailureHandling(DependencyFailureBlock))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, err = NewTask("ginkgo", "test", TaskDependsOn(p1))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+
+				wg := sync.WaitGroup{}
+				wg.Add(1)
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					defer wg.Done()
+					return "done", nil
+				})
+
+				go client.Run(ctx, router)
+
+				time.Sleep(50 * time.Millisecond)
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateBlocked))
+
+				// the parent recovering unblocks the task
+				p1, err = client.LoadTaskByID(p1.ID)
+				Expect(err).ToNot(HaveOccurred())
+				p1.State = TaskStateCompleted
+				Expect(client.storage.SaveTaskState(ctx, p1, false)).ToNot(HaveOccurred())
+
+				wg.Wait()
+				time.Sleep(50 * time.Millisecond)
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(task.State).To(Equal(TaskStateCompleted))
+			})
+		})
+
 		It("Should run tasks in order", func() {
 			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
 				client, err := NewClient(NatsConn(nc))
@@ -507,8 +1321,336 @@ var _ = Describe("Processor", func() {
 				proc, err := newProcessor(client)
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(proc.limiter).To(HaveCap(5))
+				Expect(proc.limiter).To(HaveCap(maxLimiterSlots))
 				Expect(proc.limiter).To(HaveLen(5))
+				Expect(proc.currentConcurrency()).To(Equal(5))
+			})
+		})
+
+		It("Should set up bound queues with their weights", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				for _, name := range []string{"high", "low"} {
+					_, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: name}))
+					Expect(err).ToNot(HaveOccurred())
+				}
+
+				_, err := NewClient(NatsConn(nc), BindWorkQueues("high", "low"), WorkQueueWeights(map[string]int{"other": 2}))
+				Expect(err).To(MatchError("weight set for queue other that is not bound using BindWorkQueues"))
+				_, err = NewClient(NatsConn(nc), BindWorkQueues("high", "low"), ClientConcurrency(1))
+				Expect(err).To(MatchError("client concurrency must be at least the number of bound queues"))
+				_, err = NewClient(NatsConn(nc), BindWorkQueues("high", "high"))
+				Expect(err).To(MatchError("queue high is bound more than once"))
+				_, err = NewClient(NatsConn(nc), BindWorkQueues("high", "missing"))
+				Expect(err).To(MatchError(ErrQueueNotFound))
+
+				client, err := NewClient(NatsConn(nc), BindWorkQueues("high", "low"), WorkQueueWeights(map[string]int{"high": 3}))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.opts.queue.Name).To(Equal("high"))
+
+				proc, err := newProcessor(client)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(proc.queues).To(HaveLen(2))
+				Expect(proc.queues[0].queue.Name).To(Equal("high"))
+				Expect(proc.queues[0].weight).To(Equal(3))
+				Expect(proc.queues[1].queue.Name).To(Equal("low"))
+				Expect(proc.queues[1].weight).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("nextWeightedQueue", func() {
+		It("Should share slots according to weights without starving any queue", func() {
+			queues := []*queueProcessor{
+				{queue: &Queue{Name: "high"}, weight: 5},
+				{queue: &Queue{Name: "default"}, weight: 3},
+				{queue: &Queue{Name: "low"}, weight: 1},
+			}
+
+			granted := map[string]int{}
+			lastLow := 0
+			for i := 1; i <= 90; i++ {
+				q := queues[nextWeightedQueue(queues)]
+				granted[q.queue.Name]++
+
+				if q.queue.Name == "low" {
+					Expect(i - lastLow).To(BeNumerically("<=", 9))
+					lastLow = i
+				}
+			}
+
+			Expect(granted).To(Equal(map[string]int{"high": 50, "default": 30, "low": 10}))
+		})
+	})
+
+	Describe("processMessages", func() {
+		It("Should process tasks from all bound queues", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				for _, name := range []string{"high", "low"} {
+					client, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: name, MaxRunTime: time.Minute}))
+					Expect(err).ToNot(HaveOccurred())
+
+					for i := 0; i < 5; i++ {
+						task, err := NewTask("ginkgo", name)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+					}
+				}
+
+				client, err := NewClient(NatsConn(nc), BindWorkQueues("high", "low"), ClientConcurrency(2))
+				Expect(err).ToNot(HaveOccurred())
+
+				mu := sync.Mutex{}
+				handled := map[string]int{}
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					mu.Lock()
+					handled[t.Queue]++
+					mu.Unlock()
+					return "done", nil
+				})
+
+				go client.Run(ctx, router)
+
+				Eventually(func() map[string]int {
+					mu.Lock()
+					defer mu.Unlock()
+					return map[string]int{"high": handled["high"], "low": handled["low"]}
+				}, 5*time.Second).Should(Equal(map[string]int{"high": 5, "low": 5}))
+			})
+		})
+
+		It("Should handle one task of unique active types at a time across clients", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				defer func(d time.Duration) { uniqueActiveRetryDelay = d }(uniqueActiveRetryDelay)
+				uniqueActiveRetryDelay = 20 * time.Millisecond
+
+				var active, maxActive, handled int32
+				router := NewTaskRouter()
+				Expect(router.UniqueActive("cache:rebuild")).To(Succeed())
+				router.HandleFunc("cache:rebuild", func(_ context.Context, _ Logger, t *Task) (any, error) {
+					n := atomic.AddInt32(&active, 1)
+					defer atomic.AddInt32(&active, -1)
+					for {
+						m := atomic.LoadInt32(&maxActive)
+						if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+							break
+						}
+					}
+					time.Sleep(50 * time.Millisecond)
+					atomic.AddInt32(&handled, 1)
+					return "done", nil
+				})
+
+				for i := 0; i < 2; i++ {
+					client, err := NewClient(NatsConn(nc), ClientConcurrency(4), RetryBackoffPolicy(retryForTesting))
+					Expect(err).ToNot(HaveOccurred())
+					go client.Run(ctx, router)
+				}
+
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+				for i := 0; i < 4; i++ {
+					task, err := NewTask("cache:rebuild", i)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+				}
+
+				Eventually(func() int32 { return atomic.LoadInt32(&handled) }, 10*time.Second).Should(Equal(int32(4)))
+				Expect(atomic.LoadInt32(&maxActive)).To(Equal(int32(1)))
+			})
+		})
+
+		It("Should defer task types using more than their share while other types wait", func() {
+			defer func(d time.Duration) { fairShareRetryDelay = d }(fairShareRetryDelay)
+			fairShareRetryDelay = 20 * time.Millisecond
+
+			_, err := NewClient(StorageBackend(NewInMemoryStorage()), TaskTypeFairShare(0))
+			Expect(err).To(MatchError("fair share must be more than 0 and at most 1"))
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), ClientConcurrency(4), TaskTypeFairShare(0.5), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			var active, maxActive, floods, others, maxActiveBeforeOthers int32
+			var othersDoneFirst atomic.Bool
+			router := NewTaskRouter()
+			router.HandleFunc("flood", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				n := atomic.AddInt32(&active, 1)
+				defer atomic.AddInt32(&active, -1)
+				for {
+					m := atomic.LoadInt32(&maxActive)
+					if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+						break
+					}
+				}
+				time.Sleep(100 * time.Millisecond)
+				atomic.AddInt32(&floods, 1)
+				return "done", nil
+			})
+			router.HandleFunc("other", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				if atomic.AddInt32(&others, 1) == 3 {
+					othersDoneFirst.Store(atomic.LoadInt32(&floods) < 6)
+					atomic.StoreInt32(&maxActiveBeforeOthers, atomic.LoadInt32(&maxActive))
+				}
+				return "done", nil
+			})
+
+			for _, tt := range []string{"other", "flood", "flood", "flood", "flood", "flood", "flood", "other", "other"} {
+				task, err := NewTask(tt, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+			}
+
+			go client.Run(ctx, router)
+
+			Eventually(func() int32 { return atomic.LoadInt32(&floods) }, 5*time.Second).Should(Equal(int32(6)))
+			Expect(atomic.LoadInt32(&others)).To(Equal(int32(3)))
+			Expect(atomic.LoadInt32(&maxActiveBeforeOthers)).To(Equal(int32(2)))
+			Expect(othersDoneFirst.Load()).To(BeTrue())
+		})
+
+		It("Should limit concurrent handlers per task type", func() {
+			defer func(d time.Duration) { fairShareRetryDelay = d }(fairShareRetryDelay)
+			fairShareRetryDelay = 20 * time.Millisecond
+
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), ClientConcurrency(6), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			var active, maxActive, heavy, light int32
+			router := NewTaskRouter()
+			Expect(router.MaxConcurrent("heavy", 0)).To(MatchError("concurrency limit must be positive"))
+			Expect(router.MaxConcurrent("", 2)).To(MatchError(ErrTaskTypeRequired))
+			Expect(router.MaxConcurrent("heavy", 2)).To(Succeed())
+			router.HandleFunc("heavy", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				n := atomic.AddInt32(&active, 1)
+				defer atomic.AddInt32(&active, -1)
+				for {
+					m := atomic.LoadInt32(&maxActive)
+					if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+						break
+					}
+				}
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&heavy, 1)
+				return "done", nil
+			})
+			router.HandleFunc("light", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				atomic.AddInt32(&light, 1)
+				return "done", nil
+			})
+
+			for _, tt := range []string{"heavy", "heavy", "heavy", "heavy", "heavy", "heavy", "light", "light"} {
+				task, err := NewTask(tt, nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+			}
+
+			go client.Run(ctx, router)
+
+			Eventually(func() int32 { return atomic.LoadInt32(&heavy) }, 5*time.Second).Should(Equal(int32(6)))
+			Expect(atomic.LoadInt32(&light)).To(Equal(int32(2)))
+			Expect(atomic.LoadInt32(&maxActive)).To(Equal(int32(2)))
+
+			tasks, err := client.ListTasks(ctx, TaskFilter{Types: []string{"heavy"}})
+			Expect(err).ToNot(HaveOccurred())
+			for tasks.Next() {
+				Expect(tasks.Task().Tries).To(Equal(1))
+			}
+		})
+
+		It("Should limit the handler context to the task deadline", func() {
+			client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			deadline := time.Now().Add(200 * time.Millisecond)
+			seen := make(chan time.Time, 2)
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				d, _ := ctx.Deadline()
+				seen <- d
+
+				if t.Deadline == nil {
+					return "done", nil
+				}
+
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("ginkgo", nil, TaskDeadline(deadline))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+			Eventually(func() TaskState {
+				task, err = client.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				return task.State
+			}).Should(Equal(TaskStateExpired))
+			Expect(task.Tries).To(Equal(1))
+			Expect(task.LastErr).To(Equal("past deadline: context deadline exceeded"))
+			Expect(<-seen).To(BeTemporally("==", deadline))
+
+			// without a deadline the queue MaxRunTime applies
+			task, err = NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(<-seen).To(BeTemporally("~", time.Now().Add(client.opts.queue.MaxRunTime), time.Second))
+		})
+
+		It("Should fetch batches of tasks using free slots and handle them independently", func() {
+			withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+				_, err := NewClient(NatsConn(nc), FetchBatchSize(0))
+				Expect(err).To(MatchError("fetch batch size must be at least 1"))
+
+				client, err := NewClient(NatsConn(nc), ClientConcurrency(4), FetchBatchSize(4), RetryBackoffPolicy(retryForTesting))
+				Expect(err).ToNot(HaveOccurred())
+
+				var tasks []*Task
+				for i := 0; i < 6; i++ {
+					task, err := NewTask("ginkgo", i)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+					tasks = append(tasks, task)
+				}
+
+				// a single fetch returns the available tasks up to the limit
+				pctx, pcancel := context.WithTimeout(ctx, time.Second)
+				items, err := client.storage.(BatchPoller).PollQueueBatch(pctx, client.opts.queue, 4)
+				pcancel()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(items).To(HaveLen(4))
+				for i, item := range items {
+					Expect(item.JobID).To(Equal(tasks[i].ID))
+					Expect(client.storage.NakItem(ctx, item)).To(Succeed())
+				}
+
+				release := make(chan struct{})
+				router := NewTaskRouter()
+				router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+					if t.ID == tasks[0].ID {
+						select {
+						case <-release:
+						case <-ctx.Done():
+						}
+					}
+					return "done", nil
+				})
+				go client.Run(ctx, router)
+
+				state := func(t *Task) TaskState {
+					t, err := client.LoadTaskByID(t.ID)
+					Expect(err).ToNot(HaveOccurred())
+					return t.State
+				}
+
+				for _, task := range tasks[1:] {
+					Eventually(func() TaskState { return state(task) }, 5*time.Second).Should(Equal(TaskStateCompleted))
+				}
+				Expect(state(tasks[0])).To(Equal(TaskStateActive))
+
+				close(release)
+				Eventually(func() TaskState { return state(tasks[0]) }, 5*time.Second).Should(Equal(TaskStateCompleted))
 			})
 		})
 	})
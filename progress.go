@@ -0,0 +1,84 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TaskProgress is the most recent progress reported by the handler of a task
+type TaskProgress struct {
+	// Percent is how much of the work is done, between 0 and 100
+	Percent float64 `json:"percent"`
+	// Message is an optional description of the current step
+	Message string `json:"message,omitempty"`
+	// UpdatedAt is when the progress was reported
+	UpdatedAt time.Time `json:"updated"`
+}
+
+// ProgressReporter reports progress of the task being handled, obtained from the handler context using Progress()
+type ProgressReporter interface {
+	// SetProgress stores the progress on the task and extends the time the handler may run by the queue MaxRunTime
+	SetProgress(percent float64, message string) error
+}
+
+type progressReporterKey struct{}
+
+type taskProgressReporter struct {
+	ctx   context.Context
+	task  *Task
+	s     Storage
+	clock clock
+	mu    sync.Mutex
+}
+
+type noopProgressReporter struct{}
+
+func (noopProgressReporter) SetProgress(_ float64, _ string) error { return nil }
+
+// Progress retrieves the ProgressReporter for the task being handled from the handler context, outside of
+// handlers a reporter that does nothing is returned
+func Progress(ctx context.Context) ProgressReporter {
+	r, ok := ctx.Value(progressReporterKey{}).(*taskProgressReporter)
+	if !ok {
+		return noopProgressReporter{}
+	}
+
+	return r
+}
+
+func newProgressContext(ctx context.Context, task *Task, s Storage, c clock) context.Context {
+	return context.WithValue(ctx, progressReporterKey{}, &taskProgressReporter{ctx: ctx, task: task, s: s, clock: c})
+}
+
+func (r *taskProgressReporter) SetProgress(percent float64, message string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidProgress)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.task.Progress = &TaskProgress{
+		Percent:   percent,
+		Message:   message,
+		UpdatedAt: r.clock.Now().UTC(),
+	}
+
+	err := r.s.SaveTaskState(r.ctx, r.task, false)
+	if err != nil {
+		return err
+	}
+
+	lease := leaseFromContext(r.ctx)
+	if lease == nil {
+		return nil
+	}
+
+	return lease.extend(r.ctx)
+}
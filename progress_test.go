@@ -0,0 +1,74 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Progress", func() {
+	It("Should do nothing outside of handlers", func() {
+		Expect(Progress(context.Background()).SetProgress(10, "x")).To(Succeed())
+	})
+
+	It("Should store progress and extend the handler run time", func() {
+		withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+			client, err := NewClient(NatsConn(nc), WorkQueue(&Queue{Name: "PROGRESS", MaxRunTime: time.Second}))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+			watch, err := client.WatchTask(ctx, task.ID)
+			Expect(err).ToNot(HaveOccurred())
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+				Expect(Progress(ctx).SetProgress(101, "")).To(MatchError(ErrInvalidProgress))
+
+				// runs for twice the max run time
+				for i := 1; i <= 4; i++ {
+					select {
+					case <-time.After(500 * time.Millisecond):
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+
+					err := Progress(ctx).SetProgress(float64(i*25), "working")
+					if err != nil {
+						return nil, err
+					}
+				}
+
+				return "done", nil
+			})
+			go client.Run(ctx, router)
+
+			var progress []float64
+			var last *Task
+			for t := range watch {
+				if t.Progress != nil && t.State == TaskStateActive {
+					progress = append(progress, t.Progress.Percent)
+					Expect(t.Progress.Message).To(Equal("working"))
+				}
+				last = t
+			}
+
+			Expect(last.State).To(Equal(TaskStateCompleted))
+			Expect(last.Tries).To(Equal(1))
+			Expect(progress).To(Equal([]float64{25, 50, 75, 100}))
+		})
+	})
+})
@@ -0,0 +1,71 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// PayloadTypeHeader is the header the message type of protobuf payloads is stored in
+const PayloadTypeHeader = "AJ-Payload-Type"
+
+// marshalTaskPayload encodes payload, protobuf messages are encoded in the protobuf wire format and their full message
+// name returned as type, any other payload is JSON encoded
+func marshalTaskPayload(payload any) ([]byte, string, error) {
+	if payload == nil {
+		return nil, "", nil
+	}
+
+	if m, ok := payload.(proto.Message); ok {
+		p, err := proto.Marshal(m)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return p, string(m.ProtoReflect().Descriptor().FullName()), nil
+	}
+
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p, "", nil
+}
+
+// IsProtoPayload determines if the task payload is a protobuf message, see UnmarshalProtoPayload()
+func (t *Task) IsProtoPayload() bool {
+	return t.PayloadType != ""
+}
+
+// UnmarshalProtoPayload decodes the payload of task into m. Payloads of tasks created using NewTask() with a protobuf
+// message are decoded from the wire format and must be of the same message type as m, other payloads are decoded
+// from JSON using the protobuf JSON mapping
+func UnmarshalProtoPayload(task *Task, m proto.Message) error {
+	if !task.IsProtoPayload() {
+		err := protojson.Unmarshal(task.Payload, m)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTaskPayloadInvalid, err)
+		}
+
+		return nil
+	}
+
+	name := string(m.ProtoReflect().Descriptor().FullName())
+	if name != task.PayloadType {
+		return fmt.Errorf("%w: payload is %s not %s", ErrTaskPayloadTypeMismatch, task.PayloadType, name)
+	}
+
+	err := proto.Unmarshal(task.Payload, m)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskPayloadInvalid, err)
+	}
+
+	return nil
+}
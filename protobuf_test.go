@@ -0,0 +1,67 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var _ = Describe("Protobuf payloads", func() {
+	It("Should store protobuf payloads alongside JSON payloads", func() {
+		withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+			client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+				v := &wrapperspb.Int64Value{}
+				err := UnmarshalProtoPayload(t, v)
+				if err != nil {
+					return nil, err
+				}
+				return fmt.Sprintf("%d", v.Value), nil
+			})
+			go client.Run(ctx, router)
+
+			task, err := NewTask("ginkgo", wrapperspb.Int64(1<<62+1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.PayloadType).To(Equal("google.protobuf.Int64Value"))
+			Expect(task.IsProtoPayload()).To(BeTrue())
+			res, err := client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`"4611686018427387905"`))
+
+			js, err := nc.JetStream()
+			Expect(err).ToNot(HaveOccurred())
+			msg, err := js.GetLastMsg(TasksStreamName, fmt.Sprintf(TasksStreamSubjectPattern, task.ID))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(msg.Header.Get(PayloadTypeHeader)).To(Equal("google.protobuf.Int64Value"))
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.PayloadType).To(Equal("google.protobuf.Int64Value"))
+			Expect(UnmarshalProtoPayload(task, &wrapperspb.StringValue{})).To(MatchError(ErrTaskPayloadTypeMismatch))
+
+			// JSON payloads use the protobuf JSON mapping
+			task, err = NewTask("ginkgo", "10")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.IsProtoPayload()).To(BeFalse())
+			res, err = client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res).To(MatchJSON(`"10"`))
+		})
+	})
+})
@@ -0,0 +1,68 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// errorSignaturePrefix is how much of an error message identifies the error, details like paths or values that
+// often follow the start of messages are ignored
+const errorSignaturePrefix = 64
+
+// errorSignature identifies errors that are likely caused by the same problem, it hashes the type of the innermost
+// error and the start of the message with runs of digits removed so that IDs, counts and durations do not make the
+// same failure look different
+func errorSignature(err error) string {
+	root := err
+	for {
+		next := errors.Unwrap(root)
+		if next == nil {
+			break
+		}
+		root = next
+	}
+
+	var msg strings.Builder
+	digits := false
+	for _, r := range err.Error() {
+		if unicode.IsDigit(r) {
+			if !digits {
+				msg.WriteRune('#')
+			}
+			digits = true
+			continue
+		}
+
+		digits = false
+		msg.WriteRune(r)
+	}
+
+	prefix := msg.String()
+	if len(prefix) > errorSignaturePrefix {
+		prefix = prefix[:errorSignaturePrefix]
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%T:%s", root, prefix)))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// recordFailure tracks how many times in a row the handler failed with the same error
+func (t *Task) recordFailure(err error) {
+	sig := errorSignature(err)
+	if sig == t.FailureSignature {
+		t.FailureRepeats++
+		return
+	}
+
+	t.FailureSignature = sig
+	t.FailureRepeats = 1
+}
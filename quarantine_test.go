@@ -0,0 +1,93 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Quarantine", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	})
+
+	AfterEach(func() { cancel() })
+
+	Describe("errorSignature", func() {
+		It("Should match errors that only differ in numbers", func() {
+			Expect(errorSignature(fmt.Errorf("order 10 failed after 1.5s"))).To(Equal(errorSignature(fmt.Errorf("order 200 failed after 30.25s"))))
+			Expect(errorSignature(fmt.Errorf("order 10 failed"))).ToNot(Equal(errorSignature(fmt.Errorf("order 10 rejected"))))
+			Expect(errorSignature(fmt.Errorf("reading: %w", context.DeadlineExceeded))).ToNot(Equal(errorSignature(errors.New("reading: context deadline exceeded"))))
+		})
+	})
+
+	It("Should quarantine tasks that repeatedly fail with the same error", func() {
+		_, err := NewClient(StorageBackend(NewInMemoryStorage()), QuarantinePoisonTasks(0))
+		Expect(err).To(MatchError("quarantine failures must be at least 1"))
+
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting), QuarantinePoisonTasks(3))
+		Expect(err).ToNot(HaveOccurred())
+
+		router := NewTaskRouter()
+		router.HandleFunc("poison", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return nil, fmt.Errorf("parsing record %d failed: invalid character", t.Tries)
+		})
+		router.HandleFunc("flaky", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			switch {
+			case t.Tries == 5:
+				return "done", nil
+			case t.Tries%2 == 0:
+				return nil, fmt.Errorf("connection refused")
+			default:
+				return nil, fmt.Errorf("timeout")
+			}
+		})
+		go client.Run(ctx, router)
+
+		poison, err := NewTask("poison", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, poison)).To(Succeed())
+
+		flaky, err := NewTask("flaky", nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.EnqueueAndWait(ctx, flaky)
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(func() TaskState {
+			poison, err = client.LoadTaskByID(poison.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return poison.State
+		}).Should(Equal(TaskStateQuarantined))
+		Expect(poison.Tries).To(Equal(3))
+		Expect(poison.FailureRepeats).To(Equal(3))
+		Expect(poison.LastErr).To(Equal("parsing record 3 failed: invalid character"))
+
+		Consistently(func() int {
+			poison, err = client.LoadTaskByID(poison.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return poison.Tries
+		}, 100*time.Millisecond).Should(Equal(3))
+
+		Expect(client.ReplayTaskByID(ctx, poison.ID)).To(Succeed())
+		Eventually(func() int {
+			poison, err = client.LoadTaskByID(poison.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return poison.Tries
+		}).Should(Equal(3))
+		Expect(poison.State).To(Equal(TaskStateQuarantined))
+		Expect(poison.Attempts).To(HaveLen(6))
+	})
+})
@@ -6,12 +6,26 @@ package asyncjobs
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
+	"github.com/nats-io/jsm.go"
 	"github.com/nats-io/jsm.go/api"
 )
 
+// QueueStorage is the kind of JetStream storage used for the stream of a work queue
+type QueueStorage string
+
+const (
+	// QueueStorageDefault uses the storage the client is configured for, see MemoryStorage()
+	QueueStorageDefault QueueStorage = ""
+	// QueueStorageFile stores the queue on disk
+	QueueStorageFile QueueStorage = "file"
+	// QueueStorageMemory stores the queue in memory, entries in the queue are lost when the server restarts
+	QueueStorageMemory QueueStorage = "memory"
+)
+
 // Queue represents a work queue
 type Queue struct {
 	// Name is a unique name for the work queue, should be in the character range a-zA-Z0-9
@@ -20,14 +34,56 @@ type Queue struct {
 	MaxAge time.Duration `json:"max_age"`
 	// MaxEntries represents the maximum amount of entries that can be in the queue. When it's full new entries will be rejected. When unset no limit is applied.
 	MaxEntries int `json:"max_entries"`
-	// DiscardOld indicates that when MaxEntries are reached old entries will be discarded rather than new ones rejected
+	// DiscardOld indicates that when MaxEntries are reached old entries will be discarded rather than new ones rejected,
+	// tasks of discarded entries that are not being handled are set to TaskStateExpired
 	DiscardOld bool `json:"discard_old"`
-	// MaxTries is the maximum amount of times a entry can be tried, entries will be tried every MaxRunTime with some jitter applied. Default to DefaultMaxTries
+	// MaxTries is the maximum amount of times a entry can be tried, entries will be tried every MaxRunTime with some jitter applied.
+	// Tasks with their own limit set using TaskMaxTries() use that limit instead, tasks allowed more tries than their
+	// queue are enqueued again once their entry used up its deliveries
 	MaxTries int `json:"max_tries"`
 	// MaxRunTime is the maximum time a task can be processed. Defaults to DefaultJobRunTime
 	MaxRunTime time.Duration `json:"max_runtime"`
-	// MaxConcurrent is the total number of in-flight tasks across all active task handlers combined. Defaults to DefaultQueueMaxConcurrent
+	// AckWait is how long an entry handed to a worker can go unacknowledged before it is delivered again, it must be
+	// at least MaxRunTime. Defaults to MaxRunTime
+	AckWait time.Duration `json:"ack_wait,omitempty"`
+	// MaxRedeliveries is the maximum amount of times an entry is delivered again after its first delivery, -1 for
+	// unlimited. It must allow at least MaxTries deliveries, when unset entries are delivered up to MaxTries times
+	MaxRedeliveries int `json:"max_redeliveries,omitempty"`
+	// MaxConcurrent is the total number of in-flight tasks across all active task handlers combined. Defaults to DefaultQueueMaxConcurrent.
+	// With PrioritySupport the limit is shared by the priority levels, clients hold a slot in the queue slot bucket for
+	// every task in flight
 	MaxConcurrent int `json:"max_concurrent"`
+	// PrioritySupport enables delivering tasks with a higher Priority before lower priority ones, see TaskPriority().
+	// Each priority level is stored in its own subject and consumed using its own consumer. This can only be set when
+	// creating a queue, joined queues will detect it from the existing consumers
+	PrioritySupport bool `json:"priority_support"`
+	// PriorityAging raises the priority of waiting tasks by one level for every PriorityAging since they were enqueued
+	// so that lower priority tasks are not starved by a steady stream of higher priority tasks. Only used with
+	// PrioritySupport, this is a setting of the client fetching tasks and is not stored with the queue
+	PriorityAging time.Duration `json:"priority_aging,omitempty"`
+	// DuplicateWindow is how long the queue remembers enqueued task IDs to suppress duplicate entries, an enqueue
+	// that is repeated within this window after failing with TaskStateQueueError does not add a second entry. Must not
+	// exceed MaxAge, when unset the JetStream default is used. This can only be set when creating a queue, joined
+	// queues will detect it from the existing stream
+	DuplicateWindow time.Duration `json:"duplicate_window,omitempty"`
+	// AbsoluteMaxAge expires tasks older than this age when they are next fetched from the queue, regardless of how
+	// many tries they had. This guards against tasks that are never acknowledged, for example when handlers keep
+	// crashing the worker, and so are not limited by MaxTries. This is a setting of the client fetching tasks and is
+	// not stored with the queue
+	AbsoluteMaxAge time.Duration `json:"absolute_max_age,omitempty"`
+	// ConsumerName is the name of the durable JetStream consumer used to consume the queue, queues with
+	// PrioritySupport add a _P suffix with the priority for the consumers of other priorities. Defaults to
+	// WorkStreamConsumerName, all clients using the queue must use the same name. This is a setting of the client
+	// and is not stored with the queue
+	ConsumerName string `json:"consumer_name,omitempty"`
+	// EphemeralConsumer consumes the queue using a consumer created by the client that the server removes once the
+	// client stopped fetching tasks, only one client can consume a queue this way and not while it has a durable
+	// consumer. Can not be combined with ConsumerName or PrioritySupport
+	EphemeralConsumer bool `json:"ephemeral_consumer,omitempty"`
+	// Storage is the kind of storage used for the queue, memory queues are faster but lose all entries when the
+	// server restarts. Defaults to the storage of the client. This can only be set when creating a queue, joined
+	// queues will detect it from the existing stream
+	Storage QueueStorage `json:"storage,omitempty"`
 	// NoCreate will not try to create a queue, will bind to an existing one or fail
 	NoCreate bool
 
@@ -45,6 +101,13 @@ type QueueInfo struct {
 	Stream *api.StreamInfo `json:"stream_info"`
 	// Consumer is the worker stream information
 	Consumer *api.ConsumerInfo `json:"consumer_info"`
+	// Paused indicates the queue was paused using PauseQueue and tasks are not being processed
+	Paused bool `json:"paused"`
+	// MaxTries is the maximum amount of deliveries of entries, tasks without their own limit are tried at most this
+	// many times, -1 for unlimited
+	MaxTries int `json:"max_tries"`
+	// MaxConcurrent is the total number of in-flight tasks shared by all priority levels, -1 for unlimited
+	MaxConcurrent int `json:"max_concurrent"`
 }
 
 func (q *Queue) retryTaskByID(ctx context.Context, id string) error {
@@ -56,6 +119,166 @@ func (q *Queue) enqueueTask(ctx context.Context, task *Task) error {
 	return q.storage.EnqueueTask(ctx, q, task)
 }
 
+// validate checks the redelivery settings do not conflict with MaxRunTime and MaxTries
+func (q *Queue) validate() error {
+	if q.PriorityAging < 0 {
+		return fmt.Errorf("%w: queue %s priority aging can not be negative", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.AbsoluteMaxAge < 0 {
+		return fmt.Errorf("%w: queue %s absolute max age can not be negative", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.DuplicateWindow < 0 {
+		return fmt.Errorf("%w: queue %s duplicate window can not be negative", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.DuplicateWindow > 0 && q.MaxAge > 0 && q.DuplicateWindow > q.MaxAge {
+		return fmt.Errorf("%w: queue %s duplicate window %v is longer than the max age %v", ErrQueueInvalidSettings, q.Name, q.DuplicateWindow, q.MaxAge)
+	}
+	if q.AckWait < 0 {
+		return fmt.Errorf("%w: queue %s ack wait can not be negative", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.AckWait > 0 && q.AckWait < q.MaxRunTime {
+		return fmt.Errorf("%w: queue %s ack wait %v is shorter than the max run time %v", ErrQueueInvalidSettings, q.Name, q.AckWait, q.MaxRunTime)
+	}
+	if q.MaxRedeliveries < -1 {
+		return fmt.Errorf("%w: queue %s max redeliveries must be -1 or more", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.MaxRedeliveries > 0 && q.MaxTries > 0 && q.MaxRedeliveries+1 < q.MaxTries {
+		return fmt.Errorf("%w: queue %s allows %d redeliveries which is fewer than required for %d max tries", ErrQueueInvalidSettings, q.Name, q.MaxRedeliveries, q.MaxTries)
+	}
+	if q.ConsumerName != "" && !jsm.IsValidName(q.ConsumerName) {
+		return fmt.Errorf("%w: queue %s consumer name %q is not a valid JetStream name", ErrQueueInvalidSettings, q.Name, q.ConsumerName)
+	}
+	if q.EphemeralConsumer && q.ConsumerName != "" {
+		return fmt.Errorf("%w: queue %s ephemeral consumers can not be named", ErrQueueInvalidSettings, q.Name)
+	}
+	if q.EphemeralConsumer && q.PrioritySupport {
+		return fmt.Errorf("%w: queue %s ephemeral consumers do not support priorities", ErrQueueInvalidSettings, q.Name)
+	}
+	switch q.Storage {
+	case QueueStorageDefault, QueueStorageFile, QueueStorageMemory:
+	default:
+		return fmt.Errorf("%w: queue %s storage %q is not one of %q or %q", ErrQueueInvalidSettings, q.Name, q.Storage, QueueStorageFile, QueueStorageMemory)
+	}
+
+	return nil
+}
+
+// agedPriority is the priority of an entry of the queue with priority that was enqueued at enqueued as seen at now,
+// it grows by one level for every PriorityAging waited and can exceed MaxPriority
+func (q *Queue) agedPriority(priority int, enqueued time.Time, now time.Time) int {
+	if q.PriorityAging <= 0 || !now.After(enqueued) {
+		return priority
+	}
+
+	return priority + int(now.Sub(enqueued)/q.PriorityAging)
+}
+
+// isPastAbsoluteMaxAge determines if task is older than the AbsoluteMaxAge of the queue at now
+func (q *Queue) isPastAbsoluteMaxAge(task *Task, now time.Time) bool {
+	return q.AbsoluteMaxAge > 0 && now.Sub(task.CreatedAt) > q.AbsoluteMaxAge
+}
+
+// ackWait is the time entries can be held by workers before being redelivered
+func (q *Queue) ackWait() time.Duration {
+	if q.AckWait > 0 {
+		return q.AckWait
+	}
+
+	return q.MaxRunTime
+}
+
+// consumerName is the name of the durable consumer of the queue
+func (q *Queue) consumerName() string {
+	if q.ConsumerName != "" {
+		return q.ConsumerName
+	}
+
+	return WorkStreamConsumerName
+}
+
+// priorityConsumerName is the name of the durable consumer of the queue that delivers tasks of the given priority
+func (q *Queue) priorityConsumerName(priority int) string {
+	return priorityConsumerName(q.consumerName(), priority)
+}
+
+func priorityConsumerName(consumer string, priority int) string {
+	if consumer == WorkStreamConsumerName {
+		return fmt.Sprintf(WorkStreamPriorityConsumerPattern, priority)
+	}
+
+	return fmt.Sprintf("%s_P%d", consumer, priority)
+}
+
+// maxDeliver is the maximum amount of deliveries of an entry, -1 for unlimited
+func (q *Queue) maxDeliver() int {
+	switch {
+	case q.MaxRedeliveries == -1:
+		return -1
+	case q.MaxRedeliveries > 0:
+		return q.MaxRedeliveries + 1
+	default:
+		return q.MaxTries
+	}
+}
+
+// applyConsumerSettings updates q from the ack wait and max deliveries of an existing consumer, MaxRunTime and
+// MaxTries are only kept when the queue was configured with its own redelivery settings
+func (q *Queue) applyConsumerSettings(ackWait time.Duration, maxDeliver int) {
+	if q.AckWait == 0 || q.MaxRunTime == 0 || q.MaxRunTime > ackWait {
+		q.MaxRunTime = ackWait
+	}
+	if q.MaxRedeliveries == 0 || q.MaxTries == 0 || (maxDeliver > 0 && (q.MaxTries < 0 || q.MaxTries > maxDeliver)) {
+		q.MaxTries = maxDeliver
+	}
+
+	q.AckWait = ackWait
+	if maxDeliver > 0 {
+		q.MaxRedeliveries = maxDeliver - 1
+	} else {
+		q.MaxRedeliveries = -1
+	}
+}
+
+// applyTemplate sets the settings of q to those of template, used for queues that are created on demand
+func (q *Queue) applyTemplate(template *Queue) {
+	q.MaxAge = template.MaxAge
+	q.MaxEntries = template.MaxEntries
+	q.DiscardOld = template.DiscardOld
+	q.MaxTries = template.MaxTries
+	q.MaxRunTime = template.MaxRunTime
+	q.AckWait = template.AckWait
+	q.MaxRedeliveries = template.MaxRedeliveries
+	q.MaxConcurrent = template.MaxConcurrent
+	q.PrioritySupport = template.PrioritySupport
+	q.PriorityAging = template.PriorityAging
+	q.DuplicateWindow = template.DuplicateWindow
+	q.AbsoluteMaxAge = template.AbsoluteMaxAge
+	q.ConsumerName = template.ConsumerName
+	q.EphemeralConsumer = template.EphemeralConsumer
+	q.Storage = template.Storage
+}
+
+// storageFor is the storage used for q by a client with memory storage enabled or not
+func (q *Queue) storageFor(memory bool) QueueStorage {
+	switch {
+	case q.Storage != QueueStorageDefault:
+		return q.Storage
+	case memory:
+		return QueueStorageMemory
+	default:
+		return QueueStorageFile
+	}
+}
+
+// streamStorage is the storage of the queue stream ss
+func streamStorage(ss *jsm.Stream) QueueStorage {
+	if ss.Storage() == api.MemoryStorage {
+		return QueueStorageMemory
+	}
+
+	return QueueStorageFile
+}
+
 func newDefaultQueue() *Queue {
 	return &Queue{
 		Name:          "DEFAULT",
@@ -0,0 +1,59 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+type requeueKey struct{}
+
+// requeueRequest records that the handler of a task called Requeue()
+type requeueRequest struct {
+	requested atomic.Bool
+}
+
+// Requeue requests the task being handled is enqueued again from scratch once its handler returns, for example when
+// the configuration it was started with changed. Whatever the handler returns is discarded and the task is enqueued
+// again with its tries, last error and result reset, unlike a retry this does not use up one of its tries. Returns
+// false when ctx is not the context of a handler
+func Requeue(ctx context.Context) bool {
+	r, ok := ctx.Value(requeueKey{}).(*requeueRequest)
+	if !ok {
+		return false
+	}
+
+	r.requested.Store(true)
+
+	return true
+}
+
+func newRequeueContext(ctx context.Context) (context.Context, *requeueRequest) {
+	r := &requeueRequest{}
+
+	return context.WithValue(ctx, requeueKey{}, r), r
+}
+
+// requeueTask removes the queue item of t and enqueues t again with its tries reset
+func (c *Client) requeueTask(ctx context.Context, q *Queue, t *Task, item *ProcessItem) error {
+	err := c.storage.AckItem(ctx, item)
+	if err != nil {
+		return err
+	}
+
+	t.State = TaskStateRetry
+	t.Tries = 0
+	t.Requeues++
+	t.LastErr = ""
+	t.LastTriedAt = c.nowPointer()
+	t.FailureSignature = ""
+	t.FailureRepeats = 0
+	t.Result = nil
+	t.Progress = nil
+	t.NextTryAt = nil
+
+	return c.storage.EnqueueTask(ctx, q, t)
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ResultObject references a result streamed by the handler using ResultStream(), read it using Client.OpenResult()
+type ResultObject struct {
+	// Name is the name of the object in the result store
+	Name string `json:"name"`
+	// Size is the size of the result in bytes
+	Size uint64 `json:"size"`
+	// Digest is the digest of the result as calculated by the result store
+	Digest string `json:"digest,omitempty"`
+	// StoredAt is when the result was stored
+	StoredAt time.Time `json:"stored"`
+}
+
+// ResultStore is implemented by storage that can store results streamed by handlers
+type ResultStore interface {
+	// PrepareResultStore creates or binds to the store holding results, these are removed after ttl when not 0
+	PrepareResultStore(memory bool, replicas int, ttl time.Duration) error
+	// PutTaskResult stores the result of task id read from r, replacing any earlier result for the task
+	PutTaskResult(ctx context.Context, id string, r io.Reader) (*ResultObject, error)
+	// OpenTaskResult opens the result of task id for reading
+	OpenTaskResult(ctx context.Context, id string) (io.ReadCloser, error)
+}
+
+type resultStreamKey struct{}
+
+// taskResultStream streams the result written by a handler into the result store as it is written
+type taskResultStream struct {
+	ctx   context.Context
+	task  *Task
+	store ResultStore
+
+	pw   *io.PipeWriter
+	done chan struct{}
+	obj  *ResultObject
+	err  error
+	mu   sync.Mutex
+}
+
+// ResultStream retrieves a writer from the handler context that streams a result too large for the task Result
+// payload into the result store, requires a client using StreamedResults(). The result is kept once the handler
+// returns without error and is referenced from the task Result Object, the result of a failed handler is discarded.
+// Every call for the same task returns the same writer
+func ResultStream(ctx context.Context) (io.Writer, error) {
+	s, ok := ctx.Value(resultStreamKey{}).(*taskResultStream)
+	if !ok {
+		return nil, ErrResultStreamingNotEnabled
+	}
+
+	return s.writer(), nil
+}
+
+func newResultStreamContext(ctx context.Context, c *Client, task *Task) (context.Context, *taskResultStream) {
+	store, ok := c.storage.(ResultStore)
+	if !ok || !c.opts.streamedResults {
+		return ctx, nil
+	}
+
+	s := &taskResultStream{ctx: ctx, task: task, store: store}
+
+	return context.WithValue(ctx, resultStreamKey{}, s), s
+}
+
+func (s *taskResultStream) writer() io.Writer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pw != nil {
+		return s.pw
+	}
+
+	pr, pw := io.Pipe()
+	s.pw = pw
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		obj, err := s.store.PutTaskResult(s.ctx, s.task.ID, pr)
+		// writes fail with the storage error rather than block forever
+		pr.CloseWithError(err)
+
+		s.mu.Lock()
+		s.obj, s.err = obj, err
+		s.mu.Unlock()
+	}()
+
+	return pw
+}
+
+// finish completes the stream once the handler returned, herr being the handler error. The stored object is returned
+// unless nothing was written or the handler failed
+func (s *taskResultStream) finish(herr error) (*ResultObject, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	s.mu.Lock()
+	pw, done := s.pw, s.done
+	s.mu.Unlock()
+
+	if pw == nil {
+		return nil, nil
+	}
+
+	if herr != nil {
+		pw.CloseWithError(herr)
+	} else {
+		pw.Close()
+	}
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if herr != nil {
+		return nil, nil
+	}
+
+	return s.obj, s.err
+}
+
+// resultObject is the streamed result stored for t, if any
+func (t *Task) resultObject() *ResultObject {
+	if t.Result == nil {
+		return nil
+	}
+
+	return t.Result.Object
+}
+
+// OpenResult opens the result streamed by the handler of task id using ResultStream() for reading, the reader must be
+// closed. Tasks without a streamed result fail with ErrTaskResultNotStreamed
+func (c *Client) OpenResult(ctx context.Context, id string) (io.ReadCloser, error) {
+	store, ok := c.storage.(ResultStore)
+	if !ok || !c.opts.streamedResults {
+		return nil, ErrResultStreamingNotEnabled
+	}
+
+	task, err := c.LoadTaskByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if task.Result == nil || task.Result.Object == nil {
+		return nil, ErrTaskResultNotStreamed
+	}
+
+	return store.OpenTaskResult(ctx, task.ID)
+}
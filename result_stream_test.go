@@ -0,0 +1,138 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ResultStream", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	})
+
+	AfterEach(func() { cancel() })
+
+	report := strings.Repeat("line of the report\n", 20000)
+
+	router := func() *Mux {
+		router := NewTaskRouter()
+		router.HandleFunc("report", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			w, err := ResultStream(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, line := range strings.SplitAfter(report, "\n") {
+				_, err = io.WriteString(w, line)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+
+			return "done", nil
+		})
+		router.HandleFunc("small", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			return "small", nil
+		})
+
+		return router
+	}
+
+	readResult := func(client *Client, id string) string {
+		r, err := client.OpenResult(ctx, id)
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+
+		res, err := io.ReadAll(r)
+		Expect(err).ToNot(HaveOccurred())
+
+		return string(res)
+	}
+
+	It("Should require streamed results", func() {
+		_, err := ResultStream(context.Background())
+		Expect(err).To(MatchError(ErrResultStreamingNotEnabled))
+
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.OpenResult(ctx, "x")
+		Expect(err).To(MatchError(ErrResultStreamingNotEnabled))
+	})
+
+	It("Should store results of completed handlers", func() {
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), StreamedResults(), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+		go client.Run(ctx, router())
+
+		task, err := NewTask("report", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`"done"`))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.Tries).To(Equal(2))
+		Expect(task.Result.Object.Name).To(Equal(task.ID))
+		Expect(task.Result.Object.Size).To(Equal(uint64(len(report))))
+		Expect(task.Result.Object.Digest).To(Equal(resultDigest([]byte(report))))
+		Expect(readResult(client, task.ID)).To(Equal(report))
+
+		small, err := NewTask("small", nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.EnqueueAndWait(ctx, small)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.OpenResult(ctx, small.ID)
+		Expect(err).To(MatchError(ErrTaskResultNotStreamed))
+
+		Expect(client.storage.DeleteTaskByID(task.ID)).To(Succeed())
+		_, err = client.storage.(ResultStore).OpenTaskResult(ctx, task.ID)
+		Expect(err).To(MatchError(ErrTaskResultNotStreamed))
+	})
+
+	It("Should store results in the object store", func() {
+		withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+			client, err := NewClient(NatsConn(nc), StreamedResults(), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+			go client.Run(ctx, router())
+
+			task, err := NewTask("report", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = client.EnqueueAndWait(ctx, task)
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(task.Result.Object.Size).To(Equal(uint64(len(report))))
+			Expect(task.Result.Object.Digest).To(Equal(resultDigest([]byte(report))))
+
+			// only the output of the successful try is kept
+			Expect(readResult(client, task.ID)).To(Equal(report))
+
+			Expect(client.storage.DeleteTaskByID(task.ID)).To(Succeed())
+			_, err = client.storage.(ResultStore).OpenTaskResult(ctx, task.ID)
+			Expect(err).To(MatchError(ErrTaskResultNotStreamed))
+		})
+	})
+})
@@ -6,7 +6,9 @@ package asyncjobs
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"sort"
 	"time"
@@ -20,6 +22,129 @@ type RetryPolicy struct {
 	Jitter float64
 }
 
+// ExponentialBackoffPolicy is a RetryPolicyProvider where the delay grows exponentially per try from Base
+// up to Max, with a random jitter applied
+type ExponentialBackoffPolicy struct {
+	// Base is the delay that will be multiplied by Factor for every try
+	Base time.Duration
+	// Max is the upper boundary for any delay
+	Max time.Duration
+	// Factor is the growth factor applied per try
+	Factor float64
+	// Jitter is a factor between 0 and 1 by which delays are randomly reduced
+	Jitter float64
+
+	seed   int64
+	seeded bool
+}
+
+// RetryAfter creates an error that handlers can return to have their task tried again after delay, the try is not
+// counted towards the task MaxTries and the RetryPolicy is not consulted. Deferred tries are counted in the task
+// Deferrals. The error matches ErrRetryAfter and may be wrapped
+func RetryAfter(delay time.Duration) error {
+	if delay < 0 {
+		delay = 0
+	}
+
+	return &retryAfterError{delay: delay}
+}
+
+// retryAfterBecause is like RetryAfter() with the reason for deferring the task, the error matches both ErrRetryAfter and reason
+func retryAfterBecause(delay time.Duration, reason error) error {
+	return &retryAfterError{delay: delay, reason: reason}
+}
+
+type retryAfterError struct {
+	delay  time.Duration
+	reason error
+}
+
+func (e *retryAfterError) Error() string {
+	if e.reason != nil {
+		return fmt.Sprintf("%s: %s after %v", e.reason, ErrRetryAfter, e.delay)
+	}
+
+	return fmt.Sprintf("%s after %v", ErrRetryAfter, e.delay)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return ErrRetryAfter
+}
+
+func (e *retryAfterError) Is(target error) bool {
+	return e.reason != nil && errors.Is(e.reason, target)
+}
+
+// retryAfterDelay is the delay requested by a RetryAfter error found in err
+func retryAfterDelay(err error) (time.Duration, bool) {
+	var rerr *retryAfterError
+	if !errors.As(err, &rerr) {
+		return 0, false
+	}
+
+	return rerr.delay, true
+}
+
+// Terminate creates an error that handlers can return to mark permanent failures, the task is terminated without
+// further tries regardless of the tries remaining and err is recorded in the task Result. The error matches both
+// ErrTerminateTask and err
+func Terminate(err error) error {
+	if err == nil {
+		return ErrTerminateTask
+	}
+
+	return &terminateError{err: err}
+}
+
+type terminateError struct {
+	err error
+}
+
+func (e *terminateError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrTerminateTask, e.err)
+}
+
+func (e *terminateError) Is(target error) bool {
+	return target == ErrTerminateTask
+}
+
+func (e *terminateError) Unwrap() error {
+	return e.err
+}
+
+// SkipTask creates an error that handlers can return when a task is obsolete, the task is set to TaskStateSkipped without
+// further tries and reason is recorded in the task Result. Skipped tasks are not failures, but they are also not
+// completed, so tasks depending on them do not run. The error matches ErrTaskSkipped
+func SkipTask(reason string) error {
+	return &skipError{reason: reason}
+}
+
+type skipError struct {
+	reason string
+}
+
+func (e *skipError) Error() string {
+	if e.reason == "" {
+		return ErrTaskSkipped.Error()
+	}
+
+	return fmt.Sprintf("%s: %s", ErrTaskSkipped, e.reason)
+}
+
+func (e *skipError) Unwrap() error {
+	return ErrTaskSkipped
+}
+
+// skipReason is the reason given to a SkipTask error found in err
+func skipReason(err error) (string, bool) {
+	var serr *skipError
+	if !errors.As(err, &serr) {
+		return "", false
+	}
+
+	return serr.reason, true
+}
+
 // RetryPolicyProvider is the interface that the ReplyPolicy implements,
 // use this to implement your own exponential backoff system or similar for
 // task retries.
@@ -98,19 +223,55 @@ func (p RetryPolicy) Duration(n int) time.Duration {
 	return delay
 }
 
-// RetrySleep sleeps for the duration for try n or until interrupted by ctx
-func RetrySleep(ctx context.Context, p RetryPolicyProvider, n int) error {
-	timer := time.NewTimer(p.Duration(n))
+// NewExponentialBackoffPolicy creates a policy where try n will be delayed by min(max, base*factor^n) reduced by a random
+// jitter of up to jitter times the delay. Factors below 1 are treated as 1 and jitter is limited to between 0 and 1
+func NewExponentialBackoffPolicy(base time.Duration, max time.Duration, factor float64, jitter float64) *ExponentialBackoffPolicy {
+	if max < base {
+		max, base = base, max
+	}
 
-	select {
-	case <-timer.C:
-		return nil
-	case <-ctx.Done():
-		timer.Stop()
-		return ctx.Err()
+	return &ExponentialBackoffPolicy{
+		Base:   base,
+		Max:    max,
+		Factor: math.Max(factor, 1),
+		Jitter: math.Min(math.Max(jitter, 0), 1),
 	}
 }
 
+// WithSeed returns a copy of the policy where the jitter for any try is derived from seed, making the calculated durations repeatable
+func (p ExponentialBackoffPolicy) WithSeed(seed int64) *ExponentialBackoffPolicy {
+	p.seed = seed
+	p.seeded = true
+
+	return &p
+}
+
+// Duration is the period to sleep for try n, it includes a jitter
+func (p *ExponentialBackoffPolicy) Duration(n int) time.Duration {
+	if n < 0 {
+		n = 0
+	}
+
+	delay := math.Min(float64(p.Base)*math.Pow(p.Factor, float64(n)), float64(p.Max))
+	if delay <= 0 || p.Jitter == 0 {
+		return time.Duration(delay)
+	}
+
+	var r float64
+	if p.seeded {
+		r = rand.New(rand.NewSource(p.seed + int64(n))).Float64()
+	} else {
+		r = rand.Float64()
+	}
+
+	return time.Duration(delay - (delay * p.Jitter * r)).Round(time.Millisecond)
+}
+
+// RetrySleep sleeps for the duration for try n or until interrupted by ctx
+func RetrySleep(ctx context.Context, p RetryPolicyProvider, n int) error {
+	return sleep(ctx, realClock{}, p.Duration(n))
+}
+
 func linearPolicy(steps uint64, jitter float64, min time.Duration, max time.Duration) RetryPolicy {
 	if max < min {
 		max, min = min, max
@@ -1,6 +1,9 @@
 package asyncjobs
 
 import (
+	"fmt"
+	"time"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -17,6 +20,91 @@ var _ = Describe("RetryPolicy", func() {
 		})
 	})
 
+	Describe("RetryAfter", func() {
+		It("Should create errors carrying the delay", func() {
+			err := fmt.Errorf("resource not ready: %w", RetryAfter(time.Minute))
+			Expect(err).To(MatchError(ErrRetryAfter))
+			Expect(err).To(MatchError("resource not ready: retry requested after 1m0s"))
+
+			delay, ok := retryAfterDelay(err)
+			Expect(ok).To(BeTrue())
+			Expect(delay).To(Equal(time.Minute))
+
+			delay, ok = retryAfterDelay(RetryAfter(-1 * time.Second))
+			Expect(ok).To(BeTrue())
+			Expect(delay).To(Equal(time.Duration(0)))
+
+			_, ok = retryAfterDelay(ErrRetryAfter)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("Terminate", func() {
+		It("Should match termination and the original error", func() {
+			cause := fmt.Errorf("invalid input")
+			err := Terminate(cause)
+			Expect(err).To(MatchError(ErrTerminateTask))
+			Expect(err).To(MatchError(cause))
+			Expect(err).To(MatchError("terminate task: invalid input"))
+
+			Expect(Terminate(nil)).To(Equal(ErrTerminateTask))
+		})
+	})
+
+	Describe("SkipTask", func() {
+		It("Should carry the reason", func() {
+			err := fmt.Errorf("order cancelled: %w", SkipTask("obsolete"))
+			Expect(err).To(MatchError(ErrTaskSkipped))
+			Expect(err).To(MatchError("order cancelled: task skipped: obsolete"))
+
+			reason, ok := skipReason(err)
+			Expect(ok).To(BeTrue())
+			Expect(reason).To(Equal("obsolete"))
+
+			Expect(SkipTask("")).To(MatchError("task skipped"))
+			_, ok = skipReason(ErrTaskSkipped)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Describe("ExponentialBackoffPolicy", func() {
+		It("Should grow exponentially up to the max", func() {
+			p := NewExponentialBackoffPolicy(time.Second, time.Minute, 2, 0)
+			Expect(p.Duration(0)).To(Equal(time.Second))
+			Expect(p.Duration(1)).To(Equal(2 * time.Second))
+			Expect(p.Duration(3)).To(Equal(8 * time.Second))
+			Expect(p.Duration(6)).To(Equal(time.Minute))
+			Expect(p.Duration(10000)).To(Equal(time.Minute))
+		})
+
+		It("Should correct invalid settings", func() {
+			p := NewExponentialBackoffPolicy(time.Minute, time.Second, 0.5, 2)
+			Expect(p.Base).To(Equal(time.Second))
+			Expect(p.Max).To(Equal(time.Minute))
+			Expect(p.Factor).To(Equal(1.0))
+			Expect(p.Jitter).To(Equal(1.0))
+		})
+
+		It("Should apply jitter within bounds", func() {
+			p := NewExponentialBackoffPolicy(time.Second, time.Hour, 2, 0.5)
+			for i := 0; i < 100; i++ {
+				d := p.Duration(4)
+				Expect(d).To(BeNumerically(">=", 8*time.Second))
+				Expect(d).To(BeNumerically("<=", 16*time.Second))
+			}
+		})
+
+		It("Should have repeatable jitter when seeded", func() {
+			p := NewExponentialBackoffPolicy(time.Second, time.Hour, 2, 0.5).WithSeed(10)
+			o := NewExponentialBackoffPolicy(time.Second, time.Hour, 2, 0.5).WithSeed(10)
+
+			for i := 0; i < 10; i++ {
+				Expect(p.Duration(i)).To(Equal(o.Duration(i)))
+				Expect(p.Duration(i)).To(Equal(p.Duration(i)))
+			}
+		})
+	})
+
 	Describe("RetryPolicyNames", func() {
 		It("Should have the right names", func() {
 			Expect(RetryPolicyNames()).To(Equal([]string{"10m", "1h", "1m", "default"}))
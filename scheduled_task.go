@@ -6,6 +6,7 @@ package asyncjobs
 
 import (
 	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -28,17 +29,69 @@ type ScheduledTask struct {
 	Deadline time.Duration `json:"deadline,omitempty"`
 	// MaxTries is how many times the created task could be tried
 	MaxTries int `json:"max_tries"`
+	// Jitter is the longest random delay between a tick of the schedule and enqueueing its task, spreading enqueues
+	// of schedules that tick at the same time. Must be shorter than the time between ticks, see ScheduleJitter()
+	Jitter time.Duration `json:"jitter,omitempty"`
 	// CreatedAt is when the schedule was created
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// ScheduledTaskOpt configures a scheduled task
+type ScheduledTaskOpt func(*ScheduledTask) error
+
+// ScheduleJitter delays enqueueing the task of every tick by a random duration of up to jitter, so that many schedules
+// ticking at the same time do not all enqueue their tasks at once. The jitter must be shorter than the time between
+// ticks of the schedule
+func ScheduleJitter(jitter time.Duration) ScheduledTaskOpt {
+	return func(st *ScheduledTask) error {
+		if jitter < 0 {
+			return fmt.Errorf("%w: %v can not be negative", ErrScheduleJitterInvalid, jitter)
+		}
+
+		st.Jitter = jitter
+
+		return nil
+	}
+}
+
+// scheduleJitterTicks is how many ticks of a schedule are checked to find the shortest time between ticks
+const scheduleJitterTicks = 10
+
+// shortestTickInterval is the shortest time between the next ticks of cs after now, 0 when it does not tick again
+func shortestTickInterval(cs cron.Schedule, now time.Time) time.Duration {
+	var shortest time.Duration
+
+	prev := cs.Next(now)
+	for i := 0; i < scheduleJitterTicks && !prev.IsZero(); i++ {
+		next := cs.Next(prev)
+		if next.IsZero() {
+			break
+		}
+		if interval := next.Sub(prev); shortest == 0 || interval < shortest {
+			shortest = interval
+		}
+		prev = next
+	}
+
+	return shortest
+}
+
+// jitterDelay is a random delay of less than jitter
+func jitterDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
 type ScheduleWatchEntry struct {
 	Name   string
 	Task   *ScheduledTask
 	Delete bool
 }
 
-func newScheduledTaskFromTask(name string, schedule string, queue string, task *Task) (*ScheduledTask, cron.Schedule, error) {
+func newScheduledTaskFromTask(name string, schedule string, queue string, task *Task, opts ...ScheduledTaskOpt) (*ScheduledTask, cron.Schedule, error) {
 	if name == "" {
 		return nil, nil, ErrScheduleNameIsRequired
 	}
@@ -74,6 +127,20 @@ func newScheduledTaskFromTask(name string, schedule string, queue string, task *
 		}
 	}
 
+	for _, opt := range opts {
+		err = opt(sched)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if sched.Jitter > 0 {
+		interval := shortestTickInterval(cs, time.Now())
+		if interval > 0 && sched.Jitter >= interval {
+			return nil, nil, fmt.Errorf("%w: %v is not shorter than the %v between ticks", ErrScheduleJitterInvalid, sched.Jitter, interval)
+		}
+	}
+
 	return sched, cs, nil
 }
 
@@ -0,0 +1,53 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+)
+
+// drainStopWait is how long Drain waits for handlers whose context was canceled to return their tasks to the queue
+var drainStopWait = time.Second
+
+type shutdownKey struct{}
+
+// ShutdownSignal is closed once the client handling the task started draining using Client.Drain(), handlers can use
+// it to checkpoint their work. When Drain gives up waiting the handler context is canceled and a handler that then
+// fails has its task returned to the queue without counting the try. The channel is nil, and so never closed, when ctx
+// is not the context of a handler
+func ShutdownSignal(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(shutdownKey{}).(chan struct{})
+
+	return ch
+}
+
+func newShutdownContext(ctx context.Context, ch chan struct{}) context.Context {
+	return context.WithValue(ctx, shutdownKey{}, ch)
+}
+
+// stopHandlers cancels the context of every running handler as the client is shutting down
+func (p *processor) stopHandlers() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, hc := range p.cancels {
+		p.log.Infof("Canceling the handler of task %s as draining timed out", id)
+		hc.stopped = true
+		if hc.cancel != nil {
+			hc.cancel()
+		}
+	}
+}
+
+// handlerStopped determines if the handler of t was canceled by stopHandlers
+func (p *processor) handlerStopped(t *Task) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hc, ok := p.cancels[t.ID]
+
+	return ok && hc.stopped && !hc.requested
+}
@@ -5,9 +5,20 @@
 package asyncjobs
 
 import (
+	"errors"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+const (
+	// DefaultPrometheusTaskTypeLimit is the number of distinct task types that will be used as metric labels
+	DefaultPrometheusTaskTypeLimit = 100
+	// PrometheusOtherTaskType is the task type label used for task types beyond the task type limit
+	PrometheusOtherTaskType = "other"
+)
+
 var (
 	prometheusNamespace = "choria_asyncjobs"
 
@@ -21,6 +32,21 @@ var (
 		Help: "The number of jobs that failed to enqueued",
 	}, []string{"queue"})
 
+	enqueueRateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "enqueue_rate_limited_count"),
+		Help: "The number of jobs that were not enqueued due to the enqueue rate limit",
+	}, []string{"queue"})
+
+	deadLetterCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "dead_letter_count"),
+		Help: "The number of tasks that were stored in a dead letter queue",
+	}, []string{"queue", "origin"})
+
+	workQueuePendingGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "pending_count"),
+		Help: "The number of items waiting in a queue consumer, updated as items are received",
+	}, []string{"queue", "consumer"})
+
 	workQueueEntryCorruptCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "item_corrupt_error_count"),
 		Help: "The number of work queue process items that were corrupt",
@@ -36,11 +62,26 @@ var (
 		Help: "The number of work queue process items that referenced tasks past their deadline",
 	}, []string{"queue"})
 
+	workQueueEntryPastTTLCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "task_past_ttl_count"),
+		Help: "The number of work queue process items that referenced tasks not handled within their TTL",
+	}, []string{"queue"})
+
+	workQueueEntryPastAbsoluteMaxAgeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "task_past_absolute_max_age_count"),
+		Help: "The number of work queue process items that referenced tasks older than the queue absolute max age",
+	}, []string{"queue"})
+
 	workQueueEntryPastMaxTriesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "task_past_max_tries_count"),
 		Help: "The number of work queue process items that referenced tasks past their maximum try limit",
 	}, []string{"queue"})
 
+	workQueueEntryDiscardedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "item_discarded_count"),
+		Help: "The number of work queue items discarded to make space for new items in full queues",
+	}, []string{"queue"})
+
 	workQueuePollCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "queue", "poll_total"),
 		Help: "The number of times a specific queue was polled",
@@ -61,6 +102,48 @@ var (
 		Help: "The number of task updates that failed",
 	}, []string{})
 
+	storageRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "storage", "request_retry_total"),
+		Help: "The number of storage requests that were retried after failing for transient reasons",
+	}, []string{})
+
+	taskCompletedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "completed_total"),
+		Help: "The number of tasks that completed successfully",
+	}, []string{"queue", "type"})
+
+	taskFailedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "failed_total"),
+		Help: "The number of tasks that were terminated, expired or became unreachable",
+	}, []string{"queue", "type", "state"})
+
+	taskSkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "skipped_total"),
+		Help: "The number of tasks that handlers skipped as obsolete",
+	}, []string{"queue", "type"})
+
+	taskRetriedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "retried_total"),
+		Help: "The number of times tasks were scheduled for retry after failing",
+	}, []string{"queue", "type"})
+
+	taskTriesHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName(prometheusNamespace, "task", "tries"),
+		Help:    "The number of times tasks were tried by the time they reached a final state",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"queue", "type", "state"})
+
+	taskRetryDelayHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName(prometheusNamespace, "task", "retry_delay_seconds"),
+		Help:    "The backoff delay applied by the retry policy to tasks scheduled for retry after failing",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 14),
+	}, []string{"queue", "type"})
+
+	tasksReapedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "reaped_total"),
+		Help: "The number of tasks deleted according to the retention policy",
+	}, []string{})
+
 	taskDependenciesFailedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "task", "dependencies_failed"),
 		Help: "The number of tasks that failed because their dependencies had errors",
@@ -76,11 +159,77 @@ var (
 		Help: "The number of times a task handler returned an error",
 	}, []string{"queue", "type"})
 
+	handlersRequeuedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "requeued_total"),
+		Help: "The number of times a task handler requested its task be enqueued again from scratch",
+	}, []string{"queue", "type"})
+
+	handlersRetryAfterCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "retry_after_total"),
+		Help: "The number of times a task handler requested its task be tried again later",
+	}, []string{"queue", "type"})
+
+	handlersGuardViolationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "guard_violation_total"),
+		Help: "The number of times a task handler exceeded a time or memory limit or leaked goroutines",
+	}, []string{"queue", "type", "guard"})
+
+	handlersAbandonedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "abandoned_total"),
+		Help: "The number of task handlers left running after not stopping once their limits were exceeded",
+	}, []string{"queue", "type"})
+
+	handlersRateLimitedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "rate_limited_total"),
+		Help: "The number of tasks returned to the queue because their type was rate limited",
+	}, []string{"queue", "type"})
+
+	handlersUniqueActiveDelayedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "unique_active_delayed_total"),
+		Help: "The number of tasks returned to the queue because another task of their type was active",
+	}, []string{"queue", "type"})
+
+	handlersCapabilityDeferredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "capability_deferred_total"),
+		Help: "The number of tasks returned to the queue because the client lacks capabilities they require",
+	}, []string{"queue", "type"})
+
+	handlersFairShareDeferredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "fair_share_deferred_total"),
+		Help: "The number of tasks returned to the queue because their type used its share of the concurrency",
+	}, []string{"queue", "type"})
+
+	handlersConcurrencyDeferredCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "concurrency_deferred_total"),
+		Help: "The number of tasks returned to the queue because their type reached its maximum concurrency",
+	}, []string{"queue", "type"})
+
+	handlersPanickedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "panic_total"),
+		Help: "The number of times a task handler panicked",
+	}, []string{"queue", "type"})
+
 	handlerRunTimeSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "handler", "runtime"),
 		Help: "Time taken to handle a task",
 	}, []string{"queue", "type"})
 
+	handlerRunTimeHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    prometheus.BuildFQName(prometheusNamespace, "handler", "runtime_seconds"),
+		Help:    "Time taken to handle a task",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	}, []string{"queue", "type"})
+
+	taskEventsDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "events_dropped_total"),
+		Help: "The number of local task events dropped because the Events() channel was full",
+	}, []string{})
+
+	taskDeadDroppedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: prometheus.BuildFQName(prometheusNamespace, "task", "dead_dropped_total"),
+		Help: "The number of expired or terminated tasks not passed to the OnTaskDead() callback because it was not keeping up",
+	}, []string{"queue", "type"})
+
 	taskSchedulerPausedGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: prometheus.BuildFQName(prometheusNamespace, "task_scheduler", "paused"),
 		Help: "Indicates if the scheduler is paused",
@@ -100,29 +249,146 @@ var (
 		Name: prometheus.BuildFQName(prometheusNamespace, "task_scheduler", "schedule_error_count"),
 		Help: "Indicates how many times a task failed to create",
 	}, []string{"type", "queue"})
+
+	collectors = []prometheus.Collector{
+		enqueueCounter,
+		enqueueErrorCounter,
+		enqueueRateLimitedCounter,
+		deadLetterCounter,
+
+		workQueuePendingGauge,
+		workQueueEntryCorruptCounter,
+		workQueueEntryForUnknownTaskErrorCounter,
+		workQueueEntryPastDeadlineCounter,
+		workQueueEntryPastTTLCounter,
+		workQueueEntryPastAbsoluteMaxAgeCounter,
+		workQueueEntryPastMaxTriesCounter,
+		workQueueEntryDiscardedCounter,
+		workQueuePollCounter,
+		workQueuePollErrorCounter,
+
+		taskUpdateCounter,
+		taskUpdateErrorCounter,
+		storageRetryCounter,
+		taskCompletedCounter,
+		taskFailedCounter,
+		taskSkippedCounter,
+		taskRetriedCounter,
+		taskTriesHistogram,
+		taskRetryDelayHistogram,
+		tasksReapedCounter,
+		taskDependenciesFailedCounter,
+		taskEventsDroppedCounter,
+		taskDeadDroppedCounter,
+
+		handlersBusyGauge,
+		handlersErroredCounter,
+		handlersRetryAfterCounter,
+		handlersRequeuedCounter,
+		handlersPanickedCounter,
+		handlersGuardViolationCounter,
+		handlersAbandonedCounter,
+		handlersRateLimitedCounter,
+		handlersUniqueActiveDelayedCounter,
+		handlersFairShareDeferredCounter,
+		handlersCapabilityDeferredCounter,
+		handlersConcurrencyDeferredCounter,
+		handlerRunTimeSummary,
+		handlerRunTimeHistogram,
+
+		taskSchedulerPausedGauge,
+		taskSchedulerSchedules,
+		taskSchedulerScheduledCount,
+		taskSchedulerScheduleErrorCount,
+	}
+
+	taskTypeLabels    = &labelLimiter{limit: DefaultPrometheusTaskTypeLimit, seen: map[string]struct{}{}}
+	unregisterDefault sync.Once
 )
 
 func init() {
-	prometheus.MustRegister(enqueueCounter)
-	prometheus.MustRegister(enqueueErrorCounter)
-
-	prometheus.MustRegister(workQueueEntryCorruptCounter)
-	prometheus.MustRegister(workQueueEntryForUnknownTaskErrorCounter)
-	prometheus.MustRegister(workQueueEntryPastDeadlineCounter)
-	prometheus.MustRegister(workQueueEntryPastMaxTriesCounter)
-	prometheus.MustRegister(workQueuePollCounter)
-	prometheus.MustRegister(workQueuePollErrorCounter)
-
-	prometheus.MustRegister(taskUpdateCounter)
-	prometheus.MustRegister(taskUpdateErrorCounter)
-	prometheus.MustRegister(taskDependenciesFailedCounter)
-
-	prometheus.MustRegister(handlersBusyGauge)
-	prometheus.MustRegister(handlersErroredCounter)
-	prometheus.MustRegister(handlerRunTimeSummary)
-
-	prometheus.MustRegister(taskSchedulerPausedGauge)
-	prometheus.MustRegister(taskSchedulerSchedules)
-	prometheus.MustRegister(taskSchedulerScheduledCount)
-	prometheus.MustRegister(taskSchedulerScheduleErrorCount)
+	for _, c := range collectors {
+		prometheus.MustRegister(c)
+	}
+}
+
+// registerMetrics registers all collectors with reg, removing them from the default registry. Metrics are
+// shared by all clients in a process so registering with the same registry more than once is not an error
+func registerMetrics(reg prometheus.Registerer) error {
+	if reg == prometheus.DefaultRegisterer {
+		return nil
+	}
+
+	unregisterDefault.Do(func() {
+		for _, c := range collectors {
+			prometheus.Unregister(c)
+		}
+	})
+
+	for _, c := range collectors {
+		err := reg.Register(c)
+		if err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// labelLimiter bounds the cardinality of a label by only allowing a limited number of distinct values
+type labelLimiter struct {
+	limit int
+	seen  map[string]struct{}
+	mu    sync.Mutex
+}
+
+func (l *labelLimiter) setLimit(limit int) {
+	l.mu.Lock()
+	l.limit = limit
+	l.mu.Unlock()
+}
+
+// label is v when it is one of the first limit distinct values seen, PrometheusOtherTaskType otherwise
+func (l *labelLimiter) label(v string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+
+	if len(l.seen) >= l.limit {
+		return PrometheusOtherTaskType
+	}
+
+	l.seen[v] = struct{}{}
+
+	return v
+}
+
+// recordTaskStateMetrics updates the task outcome counters for a task that moved from previous to its current state
+func recordTaskStateMetrics(task *Task, previous TaskState) {
+	ttype := taskTypeLabels.label(task.Type)
+
+	if task.IsFinal() && task.State != TaskStateQueueError && task.State != previous {
+		taskTriesHistogram.WithLabelValues(task.Queue, ttype, string(task.State)).Observe(float64(task.Tries))
+	}
+
+	switch task.State {
+	case TaskStateCompleted:
+		taskCompletedCounter.WithLabelValues(task.Queue, ttype).Inc()
+	case TaskStateTerminated, TaskStateExpired, TaskStateUnreachable, TaskStateQuarantined:
+		taskFailedCounter.WithLabelValues(task.Queue, ttype, string(task.State)).Inc()
+	case TaskStateSkipped:
+		taskSkippedCounter.WithLabelValues(task.Queue, ttype).Inc()
+	case TaskStateRetry:
+		if previous == TaskStateActive {
+			taskRetriedCounter.WithLabelValues(task.Queue, ttype).Inc()
+		}
+	}
+}
+
+// recordRetryDelay records the backoff delay applied to a task that was scheduled for retry after failing
+func recordRetryDelay(task *Task, delay time.Duration) {
+	taskRetryDelayHistogram.WithLabelValues(task.Queue, taskTypeLabels.label(task.Type)).Observe(delay.Seconds())
 }
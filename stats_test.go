@@ -0,0 +1,58 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var _ = Describe("Stats", func() {
+	Describe("labelLimiter", func() {
+		It("Should limit distinct values", func() {
+			l := &labelLimiter{limit: 2, seen: map[string]struct{}{}}
+			Expect(l.label("a")).To(Equal("a"))
+			Expect(l.label("b")).To(Equal("b"))
+			Expect(l.label("c")).To(Equal(PrometheusOtherTaskType))
+			Expect(l.label("a")).To(Equal("a"))
+
+			l = &labelLimiter{limit: 0, seen: map[string]struct{}{}}
+			Expect(l.label("a")).To(Equal(PrometheusOtherTaskType))
+		})
+	})
+
+	Describe("registerMetrics", func() {
+		It("Should register with the supplied registry", func() {
+			reg := prometheus.NewRegistry()
+			Expect(registerMetrics(reg)).To(Succeed())
+			Expect(registerMetrics(reg)).To(Succeed())
+
+			task, err := NewTask("ginkgo:stats", nil)
+			Expect(err).ToNot(HaveOccurred())
+			task.Queue = "GINKGO"
+			task.State = TaskStateCompleted
+			recordTaskStateMetrics(task, TaskStateActive)
+			task.State = TaskStateRetry
+			recordTaskStateMetrics(task, TaskStateActive)
+			recordRetryDelay(task, time.Minute)
+
+			families, err := reg.Gather()
+			Expect(err).ToNot(HaveOccurred())
+
+			names := map[string]bool{}
+			for _, f := range families {
+				names[f.GetName()] = true
+			}
+
+			Expect(names).To(HaveKey("choria_asyncjobs_task_completed_total"))
+			Expect(names).To(HaveKey("choria_asyncjobs_task_retried_total"))
+			Expect(names).To(HaveKey("choria_asyncjobs_task_tries"))
+			Expect(names).To(HaveKey("choria_asyncjobs_task_retry_delay_seconds"))
+		})
+	})
+})
@@ -8,10 +8,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/textproto"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,10 +46,21 @@ const (
 	// LeaderElectedEventSubjectWildcard is the NATS wildcard for receiving all LeaderElectedEvent messages
 	LeaderElectedEventSubjectWildcard = "CHORIA_AJ.E.leader_election.>"
 
+	// TaskCancelRequestSubjectPattern is the printf pattern requests to cancel the handler of a task are published to
+	TaskCancelRequestSubjectPattern = "CHORIA_AJ.C.%s"
+	// TaskCancelRequestSubjectWildcard is a NATS wildcard for receiving all requests to cancel handlers
+	TaskCancelRequestSubjectWildcard = "CHORIA_AJ.C.*"
+
 	// WorkStreamNamePattern is the printf pattern for determining JetStream Stream names per queue
 	WorkStreamNamePattern = "CHORIA_AJ_Q_%s"
-	// WorkStreamSubjectPattern is the printf pattern individual items are placed in, placeholders for JobID and JobType
+	// WorkStreamSubjectPattern is the printf pattern individual items are placed in, placeholders for Queue and JobID
 	WorkStreamSubjectPattern = "CHORIA_AJ.Q.%s.%s"
+	// WorkStreamPrioritySubjectPattern is the printf pattern items with a non default priority are placed in for queues with priority support, placeholders for Queue, Priority and JobID
+	WorkStreamPrioritySubjectPattern = "CHORIA_AJ.Q.%s.P%d.%s"
+	// WorkStreamConsumerName is the name of the consumer workers use to consume a queue
+	WorkStreamConsumerName = "WORKERS"
+	// WorkStreamPriorityConsumerPattern is the printf pattern for determining consumer names per priority in queues with priority support
+	WorkStreamPriorityConsumerPattern = "WORKERS_P%d"
 	// WorkStreamSubjectWildcard is a NATS filter matching all enqueued items for any task store
 	WorkStreamSubjectWildcard = "CHORIA_AJ.Q.>"
 	// WorkStreamNamePrefix is the prefix that, when removed, reveals the queue name
@@ -58,10 +74,27 @@ const (
 
 	// LeaderElectionBucketName is the KV bucket that will manage leader elections
 	LeaderElectionBucketName = "CHORIA_AJ_ELECTIONS"
+
+	// ResultsBucketName is the Object Store holding results streamed by handlers
+	ResultsBucketName = "CHORIA_AJ_RESULTS"
+	// DeduplicationBucketName is the KV bucket that tracks task deduplication keys
+	DeduplicationBucketName = "CHORIA_AJ_DEDUPLICATION"
+	// PendingClaimsBucketName is the KV bucket that holds EnqueueIfNotPending() claims until the task holding them is final
+	PendingClaimsBucketName = "CHORIA_AJ_PENDING_CLAIMS"
+
+	// TaskTypeLockBucketName is the KV bucket that holds locks for task types limited to one active task
+	TaskTypeLockBucketName = "CHORIA_AJ_TYPE_LOCKS"
+	// QueueSlotsBucketPattern is the printf pattern for the KV bucket holding the in-flight slots shared by the
+	// priority levels of a queue, placeholder for the Queue
+	QueueSlotsBucketPattern = "CHORIA_AJ_SLOTS_%s"
 )
 
 // for tests
-var defaultBlockedNakTime = 5 * time.Second
+var (
+	defaultBlockedNakTime = 5 * time.Second
+	priorityPollInterval  = 250 * time.Millisecond
+	taskTypeLockTTL       = time.Minute
+)
 
 type jetStreamStorage struct {
 	nc  *nats.Conn
@@ -70,10 +103,31 @@ type jetStreamStorage struct {
 	tasks           *taskStorage
 	configBucket    nats.KeyValue
 	leaderElections nats.KeyValue
+	dedupe          nats.KeyValue
+	pending         nats.KeyValue
+	typeLocks       nats.KeyValue
+	results         nats.ObjectStore
 	retry           RetryPolicyProvider
 
+	// how often and with what backoff requests that failed for transient reasons are retried
+	requestRetries     int
+	requestRetryPolicy RetryPolicyProvider
+
+	clock clock
+
 	qStreams   map[string]*jsm.Stream
 	qConsumers map[string]*jsm.Consumer
+	qPriority  map[string]map[int]*jsm.Consumer
+	qSlots     map[string]nats.KeyValue
+	// slots held for items of priority queues until they are acknowledged
+	heldSlots map[*nats.Msg]*queueSlot
+
+	// called after a save changed the state of a task
+	stateChanged func(task *Task, previous TaskState)
+	// algorithm used to compress task payloads when saving
+	compression CompressionAlgorithm
+	// encrypts task payloads when saving and decrypts them when loading
+	crypter Crypter
 
 	log Logger
 
@@ -86,7 +140,8 @@ type taskStorage struct {
 }
 
 type taskMeta struct {
-	seq uint64
+	seq   uint64
+	state TaskState
 }
 
 func newJetStreamStorage(nc *nats.Conn, rp RetryPolicyProvider, log Logger) (*jetStreamStorage, error) {
@@ -99,9 +154,13 @@ func newJetStreamStorage(nc *nats.Conn, rp RetryPolicyProvider, log Logger) (*je
 	s := &jetStreamStorage{
 		nc:         nc,
 		retry:      rp,
+		clock:      realClock{},
 		log:        log,
 		qStreams:   map[string]*jsm.Stream{},
 		qConsumers: map[string]*jsm.Consumer{},
+		qPriority:  map[string]map[int]*jsm.Consumer{},
+		qSlots:     map[string]nats.KeyValue{},
+		heldSlots:  map[*nats.Msg]*queueSlot{},
 	}
 
 	s.mgr, err = jsm.New(nc)
@@ -144,25 +203,30 @@ func (s *jetStreamStorage) PublishTaskStateChangeEvent(ctx context.Context, task
 }
 
 func (s *jetStreamStorage) SaveTaskState(ctx context.Context, task *Task, notify bool) error {
-	jt, err := json.Marshal(task)
+	jt, hdrs, err := s.marshalTask(task)
 	if err != nil {
 		return err
 	}
 
 	msg := nats.NewMsg(fmt.Sprintf(TasksStreamSubjectPattern, task.ID))
 	msg.Data = jt
+	for k, v := range hdrs {
+		msg.Header.Add(k, v)
+	}
 
 	task.mu.Lock()
 	so := task.storageOptions
 	task.mu.Unlock()
 
-	if so == nil {
+	switch {
+	case so == nil && task.replace:
+	case so == nil:
 		msg.Header.Add(api.JSExpectedLastSubjSeq, "0")
-	} else {
+	default:
 		msg.Header.Add(api.JSExpectedLastSubjSeq, fmt.Sprintf("%d", so.(*taskMeta).seq))
 	}
 
-	resp, err := s.nc.RequestMsgWithContext(ctx, msg)
+	resp, _, err := s.request(ctx, msg)
 	if err != nil {
 		taskUpdateErrorCounter.WithLabelValues().Inc()
 		return err
@@ -171,15 +235,31 @@ func (s *jetStreamStorage) SaveTaskState(ctx context.Context, task *Task, notify
 	ack, err := jsm.ParsePubAck(resp)
 	if err != nil {
 		taskUpdateErrorCounter.WithLabelValues().Inc()
+		switch {
+		case so == nil && jsm.IsNatsError(err, 10071):
+			return fmt.Errorf("%w: %s", ErrTaskAlreadyExists, task.ID)
+		case jsm.IsNatsError(err, 10071):
+			return fmt.Errorf("%w: task %s revision %d", ErrConflict, task.ID, so.(*taskMeta).seq)
+		}
 		return err
 	}
 
+	previous := task.StoredState()
+
 	task.mu.Lock()
-	task.storageOptions = &taskMeta{seq: ack.Sequence}
+	task.storageOptions = &taskMeta{seq: ack.Sequence, state: task.State}
 	task.mu.Unlock()
 
 	taskUpdateCounter.WithLabelValues(string(task.State)).Inc()
 
+	if previous != task.State && task.IsFinal() {
+		s.releasePendingClaim(task)
+	}
+
+	if s.stateChanged != nil && previous != task.State {
+		s.stateChanged(task, previous)
+	}
+
 	if notify {
 		return s.PublishTaskStateChangeEvent(ctx, task)
 	}
@@ -188,6 +268,134 @@ func (s *jetStreamStorage) SaveTaskState(ctx context.Context, task *Task, notify
 
 }
 
+// marshalTask encodes task for storage, compressing and encrypting the payload when configured without
+// modifying task. The returned headers describe the payload encoding and must be stored with the data
+func (s *jetStreamStorage) marshalTask(task *Task) ([]byte, map[string]string, error) {
+	jt, err := json.Marshal(task)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encode := len(task.Payload) > 0 && (s.compression != NoCompression || s.crypter != nil)
+	if !encode && len(task.Meta) == 0 && task.PayloadType == "" {
+		return jt, nil, nil
+	}
+
+	hdrs := map[string]string{}
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(jt, &fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// metadata is stored in headers, separated from internal headers by the prefix
+	for k, v := range task.Meta {
+		hdrs[TaskMetaHeaderPrefix+k] = v
+	}
+	delete(fields, "meta")
+
+	if task.PayloadType != "" {
+		hdrs[PayloadTypeHeader] = task.PayloadType
+	}
+	delete(fields, "payload_type")
+
+	if !encode {
+		jt, err = json.Marshal(fields)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return jt, hdrs, nil
+	}
+
+	payload := task.Payload
+
+	if s.compression != NoCompression {
+		payload, err = compressPayload(s.compression, payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		hdrs[PayloadCompressionHeader] = string(s.compression)
+	}
+
+	if s.crypter != nil {
+		payload, err = s.crypter.Encrypt(payload)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", ErrTaskPayloadEncrypt, err)
+		}
+		hdrs[PayloadEncryptedHeader] = "true"
+	}
+
+	fields["payload"], err = json.Marshal(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jt, err = json.Marshal(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return jt, hdrs, nil
+}
+
+// unmarshalTask parses a task from the task store and decodes its payload. When the payload is encrypted and
+// no Crypter is configured the task is returned without a payload along with ErrTaskPayloadEncrypted
+func (s *jetStreamStorage) unmarshalTask(data []byte, hdrs map[string][]string) (*Task, error) {
+	task := &Task{}
+	err := json.Unmarshal(data, task)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta := taskMetaFromHeaders(hdrs); meta != nil {
+		task.Meta = meta
+	}
+	if pt := headerValue(hdrs, PayloadTypeHeader); pt != "" {
+		task.PayloadType = pt
+	}
+
+	err = s.decodeTaskPayload(task, headerValue(hdrs, PayloadCompressionHeader), headerValue(hdrs, PayloadEncryptedHeader) != "")
+	if errors.Is(err, ErrTaskPayloadEncrypted) {
+		return task, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return task, nil
+}
+
+// decodeTaskPayload decrypts and decompresses the payload of a task read from storage
+func (s *jetStreamStorage) decodeTaskPayload(task *Task, compression string, encrypted bool) error {
+	if len(task.Payload) == 0 {
+		return nil
+	}
+
+	var err error
+
+	if encrypted {
+		if s.crypter == nil {
+			task.Payload = nil
+			return ErrTaskPayloadEncrypted
+		}
+
+		task.Payload, err = s.crypter.Decrypt(task.Payload)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTaskPayloadDecrypt, err)
+		}
+	}
+
+	if compression != "" {
+		task.Payload, err = decompressPayload(CompressionAlgorithm(compression), task.Payload)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrTaskPayloadDecompress, err)
+		}
+	}
+
+	return nil
+}
+
 func (s *jetStreamStorage) RetryTaskByID(ctx context.Context, queue *Queue, id string) error {
 	task, err := s.LoadTaskByID(id)
 	if err != nil {
@@ -195,16 +403,281 @@ func (s *jetStreamStorage) RetryTaskByID(ctx context.Context, queue *Queue, id s
 	}
 
 	task.State = TaskStateRetry
+	task.NextTryAt = nil
 	task.Result = nil
 
 	return s.EnqueueTask(ctx, queue, task)
 }
 
+// DeadLetterTask stores a copy of task in the dead letter queue dlq
+func (s *jetStreamStorage) DeadLetterTask(ctx context.Context, dlq *Queue, task *Task) error {
+	jt, hdrs, err := s.marshalTask(task)
+	if err != nil {
+		return err
+	}
+
+	item, err := json.Marshal(&struct {
+		ProcessItem
+		Task json.RawMessage `json:"task"`
+	}{ProcessItem: ProcessItem{Kind: DeadLetterItem, JobID: task.ID}, Task: jt})
+	if err != nil {
+		return err
+	}
+
+	msg := nats.NewMsg(fmt.Sprintf(WorkStreamSubjectPattern, dlq.Name, task.ID))
+	msg.Data = item
+	for k, v := range hdrs {
+		msg.Header.Add(k, v)
+	}
+
+	s.log.Debugf("Storing task %s in dead letter queue %s via %s", task.ID, dlq.Name, msg.Subject)
+	ret, _, err := s.request(ctx, msg)
+	if err != nil {
+		enqueueErrorCounter.WithLabelValues(dlq.Name).Inc()
+		if err == nats.ErrNoResponders {
+			return fmt.Errorf("%w: %v", ErrQueueNotFound, err)
+		}
+		return err
+	}
+
+	_, err = jsm.ParsePubAck(ret)
+	if err != nil {
+		enqueueErrorCounter.WithLabelValues(dlq.Name).Inc()
+		return err
+	}
+
+	deadLetterCounter.WithLabelValues(dlq.Name, task.Queue).Inc()
+
+	return nil
+}
+
+// ReplayDeadLetter enqueues a task found in the dead letter queue dlq into its original queue with its tries reset
+func (s *jetStreamStorage) ReplayDeadLetter(ctx context.Context, dlq *Queue, id string) error {
+	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, dlq.Name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return ErrQueueNotFound
+		}
+		return err
+	}
+
+	msg, err := stream.ReadLastMessageForSubject(fmt.Sprintf(WorkStreamSubjectPattern, dlq.Name, id))
+	if err != nil {
+		if jsm.IsNatsError(err, 10037) {
+			return ErrTaskNotFound
+		}
+		return err
+	}
+
+	item := &ProcessItem{}
+	err = json.Unmarshal(msg.Data, item)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrQueueItemCorrupt, err)
+	}
+	if item.Kind != DeadLetterItem || item.Task == nil {
+		return fmt.Errorf("%w: not a dead letter item", ErrQueueItemInvalid)
+	}
+
+	hdrs, err := decodeHeadersMsg(msg.Header)
+	if err != nil {
+		return err
+	}
+
+	task := item.Task
+	if meta := taskMetaFromHeaders(hdrs); meta != nil {
+		task.Meta = meta
+	}
+	if pt := hdrs.Get(PayloadTypeHeader); pt != "" {
+		task.PayloadType = pt
+	}
+	err = s.decodeTaskPayload(task, hdrs.Get(PayloadCompressionHeader), hdrs.Get(PayloadEncryptedHeader) != "")
+	if err != nil {
+		return err
+	}
+
+	// the task might still be in the task store, when it is we need its revision to update it
+	stored, err := s.LoadTaskByID(id)
+	switch {
+	case err == nil:
+		stored.mu.Lock()
+		task.storageOptions = stored.storageOptions
+		stored.mu.Unlock()
+	case !errors.Is(err, ErrTaskNotFound):
+		return err
+	}
+
+	task.Tries = 0
+	task.State = TaskStateRetry
+	task.NextTryAt = nil
+	task.Result = nil
+
+	s.mu.Lock()
+	queue := &Queue{Name: task.Queue, PrioritySupport: len(s.qPriority[task.Queue]) > 0}
+	s.mu.Unlock()
+
+	err = s.EnqueueTask(ctx, queue, task)
+	if err != nil {
+		return err
+	}
+
+	return stream.DeleteMessage(msg.Sequence)
+}
+
 func (s *jetStreamStorage) EnqueueTask(ctx context.Context, queue *Queue, task *Task) error {
-	if task.State != TaskStateNew && task.State != TaskStateRetry && task.State != TaskStateBlocked {
+	switch task.State {
+	case TaskStateNew, TaskStateRetry, TaskStateBlocked:
+	case TaskStateQueueError:
+		// the same task enqueued again after its queue entry could not be confirmed
+		task.State = TaskStateNew
+		task.LastErr = ""
+	default:
 		return fmt.Errorf("%w %q", ErrTaskTypeCannotEnqueue, task.State)
 	}
 
+	task.startTTL(s.clock.Now())
+
+	// retries are for tasks that already hold their deduplication key
+	if task.DeduplicationKey == "" || task.State == TaskStateRetry {
+		return s.enqueueTask(ctx, queue, task)
+	}
+
+	// stored before claiming the key so callers finding the claim find the pending task holding it
+	if task.matchPending {
+		err := s.SaveTaskState(ctx, task, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := s.reserveDeduplicationKey(task)
+	if err != nil {
+		if task.matchPending {
+			discardUnclaimedTask(s, s.log, task, err)
+		}
+		return err
+	}
+
+	err = s.enqueueTask(ctx, queue, task)
+	if err != nil {
+		s.log.Debugf("Releasing deduplication key for task %s after enqueue failure: %v", task.ID, err)
+		if derr := s.deduplicationStore(task).Delete(key); derr != nil {
+			s.log.Warnf("Could not release deduplication key for task %s: %v", task.ID, derr)
+		}
+	}
+
+	return err
+}
+
+// discardUnclaimedTask removes a task stored by EnqueueIfNotPending() that failed to claim its key with err, unless it
+// is the task holding the claim
+func discardUnclaimedTask(s Storage, log Logger, task *Task, err error) {
+	var dupe *DuplicateTaskError
+	if errors.As(err, &dupe) && dupe.TaskID == task.ID {
+		return
+	}
+
+	err = s.DeleteTaskByID(task.ID)
+	if err != nil && !errors.Is(err, ErrTaskNotFound) {
+		log.Warnf("Could not remove task %s that was not enqueued: %v", task.ID, err)
+	}
+
+	task.mu.Lock()
+	task.storageOptions = nil
+	task.mu.Unlock()
+}
+
+func deduplicationBucketKey(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))
+}
+
+// deduplicationStore is the bucket holding the deduplication key of task, claims made by EnqueueIfNotPending() do
+// not expire with the deduplication window
+func (s *jetStreamStorage) deduplicationStore(task *Task) nats.KeyValue {
+	if task.matchPending {
+		return s.pending
+	}
+
+	return s.dedupe
+}
+
+// reserveDeduplicationKey claims the deduplication key of task, an existing claim is only
+// replaced when the task that holds it is completed, expired or no longer exist
+func (s *jetStreamStorage) reserveDeduplicationKey(task *Task) (string, error) {
+	kv := s.deduplicationStore(task)
+	if kv == nil {
+		return "", ErrTaskDeduplicationNotEnabled
+	}
+
+	key := deduplicationBucketKey(task.DeduplicationKey)
+
+	_, err := kv.Create(key, []byte(task.ID))
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, nats.ErrKeyExists) {
+		return "", err
+	}
+
+	entry, err := kv.Get(key)
+	if err != nil {
+		return "", err
+	}
+
+	// the same task enqueued again, storing it would fail so keep the claim as is
+	if string(entry.Value()) == task.ID && !task.replace {
+		if task.matchPending {
+			return "", &DuplicateTaskError{TaskID: task.ID}
+		}
+		return "", fmt.Errorf("%w: %s", ErrTaskAlreadyExists, task.ID)
+	}
+
+	holder, err := s.LoadTaskByID(string(entry.Value()))
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+	case err != nil:
+		return "", err
+	case task.matchPending && !holder.IsFinal():
+		return "", &DuplicateTaskError{TaskID: holder.ID}
+	case !task.matchPending && holder.State != TaskStateCompleted && holder.State != TaskStateExpired:
+		return "", &DuplicateTaskError{TaskID: holder.ID}
+	}
+
+	_, err = kv.Update(key, []byte(task.ID), entry.Revision())
+	if err != nil {
+		// another producer claimed it between our get and update
+		if task.matchPending {
+			if entry, gerr := kv.Get(key); gerr == nil {
+				return "", &DuplicateTaskError{TaskID: string(entry.Value())}
+			}
+		}
+		return "", fmt.Errorf("%w: %v", ErrDuplicateTask, err)
+	}
+
+	return key, nil
+}
+
+// releasePendingClaim removes the EnqueueIfNotPending() claim held by task so a new task can claim the key without
+// loading the final task first
+func (s *jetStreamStorage) releasePendingClaim(task *Task) {
+	if s.pending == nil || !strings.HasPrefix(task.DeduplicationKey, pendingDeduplicationKeyPrefix) {
+		return
+	}
+
+	key := deduplicationBucketKey(task.DeduplicationKey)
+
+	entry, err := s.pending.Get(key)
+	if err != nil || string(entry.Value()) != task.ID {
+		return
+	}
+
+	// a failed release leaves the claim to be replaced by the next task finding the holder final
+	err = s.pending.Delete(key, nats.LastRevision(entry.Revision()))
+	if err != nil {
+		s.log.Debugf("Could not release pending claim held by task %s: %v", task.ID, err)
+	}
+}
+
+func (s *jetStreamStorage) enqueueTask(ctx context.Context, queue *Queue, task *Task) error {
 	ji, err := newProcessItem(TaskItem, task.ID)
 	if err != nil {
 		return err
@@ -212,22 +685,28 @@ func (s *jetStreamStorage) EnqueueTask(ctx context.Context, queue *Queue, task *
 
 	task.Queue = queue.Name
 
+	// a previous attempt to store the queue entry might have succeeded without us knowing, the duplicate window
+	// of the queue suppresses a second entry
+	republish := task.StoredState() == TaskStateQueueError
+
 	err = s.SaveTaskState(ctx, task, true)
 	if err != nil {
 		return err
 	}
 
-	msg := nats.NewMsg(fmt.Sprintf(WorkStreamSubjectPattern, queue.Name, task.ID))
+	msg := nats.NewMsg(workItemSubject(queue, task))
 	msg.Data = ji
 
 	// if someone is retrying a task we should allow that without dupe checking since they
-	// would have removed the work queue item already
-	if task.State != TaskStateRetry {
+	// would have removed the work queue item already, replaced tasks might still have one
+	if task.State != TaskStateRetry && !task.replace {
 		msg.Header.Add(api.JSMsgId, task.ID) // dedupe on the queue, though should not be needed
 	}
 
+	discardSeq, discardID := s.discardCandidate(queue)
+
 	s.log.Debugf("Enqueueing task into queue %s via %s", task.Queue, msg.Subject)
-	ret, err := s.nc.RequestMsgWithContext(ctx, msg)
+	ret, retried, err := s.request(ctx, msg)
 	if err != nil {
 		enqueueErrorCounter.WithLabelValues(queue.Name).Inc()
 		task.State = TaskStateQueueError
@@ -251,10 +730,11 @@ func (s *jetStreamStorage) EnqueueTask(ctx context.Context, queue *Queue, task *
 		}
 		return err
 	}
-	if ack.Duplicate {
+	// a retry of an item that was stored before its acknowledgement was lost
+	if ack.Duplicate && !retried && !republish {
 		enqueueErrorCounter.WithLabelValues(queue.Name).Inc()
 		task.State = TaskStateQueueError
-		task.LastErr = err.Error()
+		task.LastErr = ErrDuplicateItem.Error()
 		if err := s.SaveTaskState(ctx, task, true); err != nil {
 			return err
 		}
@@ -263,31 +743,115 @@ func (s *jetStreamStorage) EnqueueTask(ctx context.Context, queue *Queue, task *
 
 	enqueueCounter.WithLabelValues(queue.Name).Inc()
 
+	if discardSeq > 0 {
+		s.mu.Lock()
+		stream := s.qStreams[queue.Name]
+		s.mu.Unlock()
+
+		_, err = stream.ReadMessage(discardSeq)
+		if jsm.IsNatsError(err, 10037) {
+			expireDiscardedTask(ctx, s, s.log, queue, discardID)
+		}
+	}
+
 	return nil
 }
 
+// discardCandidate is the sequence and task ID of the oldest item in a full queue that discards old items, this
+// item is removed by JetStream when the next item is stored
+func (s *jetStreamStorage) discardCandidate(queue *Queue) (uint64, string) {
+	if !queue.DiscardOld || queue.MaxEntries <= 0 {
+		return 0, ""
+	}
+
+	s.mu.Lock()
+	stream := s.qStreams[queue.Name]
+	s.mu.Unlock()
+
+	if stream == nil {
+		return 0, ""
+	}
+
+	nfo, err := stream.State()
+	if err != nil || nfo.Msgs < uint64(queue.MaxEntries) {
+		return 0, ""
+	}
+
+	msg, err := stream.ReadMessage(nfo.FirstSeq)
+	if err != nil {
+		return 0, ""
+	}
+
+	var item ProcessItem
+	err = json.Unmarshal(msg.Data, &item)
+	if err != nil || item.Kind != TaskItem {
+		return 0, ""
+	}
+
+	return msg.Sequence, item.JobID
+}
+
+// expireDiscardedTask sets a task whose queue item was discarded from a full queue to TaskStateExpired, tasks that
+// are being handled or already reached a final state are not changed
+func expireDiscardedTask(ctx context.Context, storage Storage, log Logger, queue *Queue, id string) {
+	workQueueEntryDiscardedCounter.WithLabelValues(queue.Name).Inc()
+
+	task, err := storage.LoadTaskByID(id)
+	if err != nil {
+		log.Warnf("Could not load task %s discarded from full queue %s: %v", id, queue.Name, err)
+		return
+	}
+
+	switch task.State {
+	case TaskStateNew, TaskStateRetry, TaskStateBlocked:
+	default:
+		return
+	}
+
+	log.Infof("Expiring task %s discarded from full queue %s", id, queue.Name)
+
+	task.State = TaskStateExpired
+	task.LastErr = fmt.Sprintf("%s %s", ErrQueueItemDiscarded, queue.Name)
+	err = storage.SaveTaskState(ctx, task, true)
+	if err != nil {
+		log.Warnf("Could not expire task %s discarded from full queue %s: %v", id, queue.Name, err)
+	}
+}
+
 func (s *jetStreamStorage) AckItem(ctx context.Context, item *ProcessItem) error {
 	if item.storageMeta == nil {
 		return ErrInvalidStorageItem
 	}
+	defer s.releaseItemSlot(item)
 
 	return item.storageMeta.(*nats.Msg).Ack(nats.Context(ctx))
 }
 
-func (s *jetStreamStorage) TerminateItem(ctx context.Context, item *ProcessItem) error {
+func (s *jetStreamStorage) InProgressItem(ctx context.Context, item *ProcessItem) error {
 	if item.storageMeta == nil {
 		return ErrInvalidStorageItem
 	}
+	s.refreshItemSlot(item)
 
-	return item.storageMeta.(*nats.Msg).Term(nats.Context(ctx))
+	return item.storageMeta.(*nats.Msg).InProgress(nats.Context(ctx))
 }
 
-func (s *jetStreamStorage) NakBlockedItem(ctx context.Context, item *ProcessItem) error {
+func (s *jetStreamStorage) TerminateItem(ctx context.Context, item *ProcessItem) error {
 	if item.storageMeta == nil {
 		return ErrInvalidStorageItem
 	}
+	defer s.releaseItemSlot(item)
 
-	msg := item.storageMeta.(*nats.Msg)
+	return item.storageMeta.(*nats.Msg).Term(nats.Context(ctx))
+}
+
+func (s *jetStreamStorage) NakBlockedItem(ctx context.Context, item *ProcessItem) error {
+	if item.storageMeta == nil {
+		return ErrInvalidStorageItem
+	}
+	defer s.releaseItemSlot(item)
+
+	msg := item.storageMeta.(*nats.Msg)
 
 	timeout, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
@@ -300,10 +864,31 @@ func (s *jetStreamStorage) NakBlockedItem(ctx context.Context, item *ProcessItem
 	return err
 }
 
+// NakDelayedItem NaKs item so that it is redelivered after delay
+func (s *jetStreamStorage) NakDelayedItem(ctx context.Context, item *ProcessItem, delay time.Duration) error {
+	if item.storageMeta == nil {
+		return ErrInvalidStorageItem
+	}
+	defer s.releaseItemSlot(item)
+
+	msg := item.storageMeta.(*nats.Msg)
+
+	timeout, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	s.log.Debugf("NaKing item with %v delay", delay)
+
+	resp := fmt.Sprintf(`%s {"delay": %d}`, api.AckNak, delay)
+	_, err := s.nc.RequestWithContext(timeout, msg.Reply, []byte(resp))
+
+	return err
+}
+
 func (s *jetStreamStorage) NakItem(ctx context.Context, item *ProcessItem) error {
 	if item.storageMeta == nil {
 		return ErrInvalidStorageItem
 	}
+	defer s.releaseItemSlot(item)
 
 	msg := item.storageMeta.(*nats.Msg)
 
@@ -328,9 +913,18 @@ func (s *jetStreamStorage) NakItem(ctx context.Context, item *ProcessItem) error
 	return err
 }
 
+func workItemSubject(queue *Queue, task *Task) string {
+	if !queue.PrioritySupport || task.Priority == DefaultPriority {
+		return fmt.Sprintf(WorkStreamSubjectPattern, queue.Name, task.ID)
+	}
+
+	return fmt.Sprintf(WorkStreamPrioritySubjectPattern, queue.Name, task.Priority, task.ID)
+}
+
 func (s *jetStreamStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessItem, error) {
 	s.mu.Lock()
 	qc, ok := s.qConsumers[q.Name]
+	pcs := s.qPriority[q.Name]
 	s.mu.Unlock()
 	if !ok {
 		return nil, ErrInvalidQueueState
@@ -341,7 +935,132 @@ func (s *jetStreamStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessIte
 		return nil, ErrContextWithoutDeadline
 	}
 
-	rj, err := json.Marshal(&api.JSApiConsumerGetNextRequest{Batch: 1, Expires: time.Until(deadline)})
+	if len(pcs) > 0 {
+		return s.pollPriorityQueue(ctx, q, pcs)
+	}
+
+	return s.pollConsumer(ctx, q, qc, &api.JSApiConsumerGetNextRequest{Batch: 1, Expires: time.Until(deadline)})
+}
+
+// pollPriorityQueue checks every priority level from highest to lowest for an item, when none are found or all
+// slots of the queue are held it sleeps for priorityPollInterval and tries again till ctx is done
+func (s *jetStreamStorage) pollPriorityQueue(ctx context.Context, q *Queue, consumers map[int]*jsm.Consumer) (*ProcessItem, error) {
+	for {
+		// the levels share MaxConcurrent, a slot is taken before fetching and kept until the item is acknowledged
+		slot, ok, err := s.acquireQueueSlot(q)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			item, err := s.pollPriorityLevels(ctx, q, consumers)
+			if item != nil {
+				s.holdQueueSlot(item.storageMeta.(*nats.Msg), slot)
+				return item, nil
+			}
+
+			s.releaseQueueSlot(slot)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		timer := time.NewTimer(priorityPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pollPriorityLevels checks every priority level in the order of priorityLevels for an item, nil when none are found
+func (s *jetStreamStorage) pollPriorityLevels(ctx context.Context, q *Queue, consumers map[int]*jsm.Consumer) (*ProcessItem, error) {
+	for _, p := range s.priorityLevels(ctx, q, consumers) {
+		qc := consumers[p]
+
+		// JetStream does not answer requests for a consumer at its MaxAckPending limit, so we bound
+		// the wait per level and move on to the next priority
+		pctx, cancel := context.WithTimeout(ctx, priorityPollInterval)
+		item, err := s.pollConsumer(pctx, q, qc, &api.JSApiConsumerGetNextRequest{Batch: 1, NoWait: true})
+		cancel()
+		if err == context.DeadlineExceeded && ctx.Err() == nil {
+			continue
+		}
+		if err != nil || item != nil {
+			return item, err
+		}
+	}
+
+	return nil, nil
+}
+
+// priorityLevels is the order in which the priority levels of q are polled, highest first. With PriorityAging the
+// levels are ordered by the aged priority of the oldest item waiting in each level
+func (s *jetStreamStorage) priorityLevels(ctx context.Context, q *Queue, consumers map[int]*jsm.Consumer) []int {
+	levels := make([]int, 0, len(consumers))
+	for p := MaxPriority; p >= 0; p-- {
+		if _, ok := consumers[p]; ok {
+			levels = append(levels, p)
+		}
+	}
+
+	if q.PriorityAging <= 0 {
+		return levels
+	}
+
+	now := s.clock.Now()
+	aged := make(map[int]int, len(levels))
+	for _, p := range levels {
+		aged[p] = p
+		enqueued, ok := s.oldestWaitingItem(ctx, consumers[p])
+		if ok {
+			aged[p] = q.agedPriority(p, enqueued, now)
+		}
+	}
+
+	sort.SliceStable(levels, func(i, j int) bool {
+		return aged[levels[i]] > aged[levels[j]]
+	})
+
+	return levels
+}
+
+// oldestWaitingItem is the time the oldest item not yet delivered by qc was enqueued, items waiting to be retried are
+// not considered
+func (s *jetStreamStorage) oldestWaitingItem(ctx context.Context, qc *jsm.Consumer) (time.Time, bool) {
+	state, err := qc.State()
+	if err != nil || state.NumPending == 0 {
+		return time.Time{}, false
+	}
+
+	return s.oldestItemAfter(ctx, qc.StreamName(), qc.FilterSubject(), state.Delivered.Stream)
+}
+
+// oldestItemAfter is the time the first item in stream matching filter after sequence seq was enqueued
+func (s *jetStreamStorage) oldestItemAfter(ctx context.Context, stream string, filter string, seq uint64) (time.Time, bool) {
+	req, err := json.Marshal(api.JSApiMsgGetRequest{Seq: seq + 1, NextFor: filter})
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	msg, err := s.nc.RequestWithContext(ctx, fmt.Sprintf(api.JSApiMsgGetT, stream), req)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var resp api.JSApiMsgGetResponse
+	err = json.Unmarshal(msg.Data, &resp)
+	if err != nil || resp.IsError() || resp.Message == nil {
+		return time.Time{}, false
+	}
+
+	return resp.Message.Time, true
+}
+
+func (s *jetStreamStorage) pollConsumer(ctx context.Context, q *Queue, qc *jsm.Consumer, req *api.JSApiConsumerGetNextRequest) (*ProcessItem, error) {
+	rj, err := json.Marshal(req)
 	if err != nil {
 		workQueuePollErrorCounter.WithLabelValues(q.Name).Inc()
 		return nil, err
@@ -355,7 +1074,130 @@ func (s *jetStreamStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessIte
 		}
 		return nil, err
 	}
+
+	return s.queueItemFromMsg(ctx, q, qc, msg)
+}
+
+// PollQueueBatch fetches up to max items, waiting only for the first one and adding those immediately available
+func (s *jetStreamStorage) PollQueueBatch(ctx context.Context, q *Queue, max int) ([]*ProcessItem, error) {
+	item, err := s.PollQueue(ctx, q)
+	if err != nil || item == nil {
+		return nil, err
+	}
+
+	items := []*ProcessItem{item}
+	if max < 2 {
+		return items, nil
+	}
+
+	// more items are fetched from the consumer of the first, for priority queues that is its priority level
+	msg, ok := item.storageMeta.(*nats.Msg)
+	if !ok {
+		return items, nil
+	}
+	md, err := msg.Metadata()
+	if err != nil {
+		return items, nil
+	}
+
+	s.mu.Lock()
+	qc := s.qConsumers[q.Name]
+	for _, pc := range s.qPriority[q.Name] {
+		if pc.Name() == md.Consumer {
+			qc = pc
+		}
+	}
+	_, limited := s.qSlots[q.Name]
+	s.mu.Unlock()
+
+	// priority queues fetch only as many more items as they could take slots for
+	batch := max - 1
+	var slots []*queueSlot
+	if limited && q.MaxConcurrent > 0 {
+		for len(slots) < batch {
+			slot, ok, err := s.acquireQueueSlot(q)
+			if err != nil || !ok {
+				break
+			}
+			slots = append(slots, slot)
+		}
+
+		batch = len(slots)
+		if batch == 0 {
+			return items, nil
+		}
+	}
+
+	more, err := s.pollConsumerAvailable(ctx, q, qc, batch)
+	if err != nil {
+		s.log.Debugf("Fetching additional items from queue %s failed: %v", q.Name, err)
+	}
+
+	for i, slot := range slots {
+		if i < len(more) {
+			s.holdQueueSlot(more[i].storageMeta.(*nats.Msg), slot)
+		} else {
+			s.releaseQueueSlot(slot)
+		}
+	}
+
+	return append(items, more...), nil
+}
+
+// pollConsumerAvailable fetches up to batch items that are immediately available from qc without waiting for new ones
+func (s *jetStreamStorage) pollConsumerAvailable(ctx context.Context, q *Queue, qc *jsm.Consumer, batch int) ([]*ProcessItem, error) {
+	rj, err := json.Marshal(&api.JSApiConsumerGetNextRequest{Batch: batch, NoWait: true})
+	if err != nil {
+		return nil, err
+	}
+
+	inbox := s.nc.NewRespInbox()
+	sub, err := s.nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	err = s.nc.PublishRequest(qc.NextSubject(), inbox, rj)
+	if err != nil {
+		return nil, err
+	}
+
+	// JetStream ends a partially filled batch with a status message but does not answer at the MaxAckPending limit
+	tctx, cancel := context.WithTimeout(ctx, priorityPollInterval)
+	defer cancel()
+
+	var items []*ProcessItem
+	for len(items) < batch {
+		msg, err := sub.NextMsgWithContext(tctx)
+		if err == context.DeadlineExceeded {
+			return items, nil
+		}
+		if err != nil {
+			return items, err
+		}
+
+		item, err := s.queueItemFromMsg(ctx, q, qc, msg)
+		switch {
+		case err != nil:
+			// corrupt items are terminated and counted already
+			continue
+		case item == nil:
+			return items, nil
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// queueItemFromMsg parses a message received from a consumer, status messages result in a nil item
+func (s *jetStreamStorage) queueItemFromMsg(ctx context.Context, q *Queue, qc *jsm.Consumer, msg *nats.Msg) (*ProcessItem, error) {
 	status := msg.Header.Get("Status")
+	if status == "404" {
+		workQueuePendingGauge.WithLabelValues(q.Name, qc.Name()).Set(0)
+	}
 	if status == "404" || status == "409" || status == "408" {
 		return nil, nil
 	}
@@ -368,13 +1210,20 @@ func (s *jetStreamStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessIte
 	}
 
 	item := &ProcessItem{storageMeta: msg}
-	err = json.Unmarshal(msg.Data, item)
+	err := json.Unmarshal(msg.Data, item)
 	if err != nil || item.JobID == "" {
 		workQueueEntryCorruptCounter.WithLabelValues(q.Name).Inc()
 		msg.Term(nats.Context(ctx)) // data is corrupt so we terminate it, no associated job to update
 		return nil, ErrQueueItemCorrupt
 	}
 
+	md, err := msg.Metadata()
+	if err == nil {
+		item.pending = md.NumPending
+		item.deliveries = md.NumDelivered
+		workQueuePendingGauge.WithLabelValues(q.Name, qc.Name()).Set(float64(md.NumPending))
+	}
+
 	return item, nil
 }
 
@@ -391,6 +1240,11 @@ func (s *jetStreamStorage) createQueue(q *Queue, replicas int, memory bool) erro
 		q.MaxConcurrent = DefaultQueueMaxConcurrent
 	}
 
+	err := q.validate()
+	if err != nil {
+		return err
+	}
+
 	opts := []jsm.StreamOption{
 		jsm.Subjects(fmt.Sprintf(WorkStreamSubjectPattern, q.Name, ">")),
 		jsm.WorkQueueRetention(),
@@ -399,7 +1253,8 @@ func (s *jetStreamStorage) createQueue(q *Queue, replicas int, memory bool) erro
 		jsm.StreamDescription("Choria Async Jobs Work Queue"),
 	}
 
-	if memory {
+	storage := q.storageFor(memory)
+	if storage == QueueStorageMemory {
 		opts = append(opts, jsm.MemoryStorage())
 	} else {
 		opts = append(opts, jsm.FileStorage())
@@ -417,29 +1272,126 @@ func (s *jetStreamStorage) createQueue(q *Queue, replicas int, memory bool) erro
 	} else {
 		opts = append(opts, jsm.DiscardNew())
 	}
-
-	var err error
+	if q.DuplicateWindow > 0 {
+		opts = append(opts, jsm.DuplicateWindow(q.DuplicateWindow))
+	}
 
 	s.qStreams[q.Name], err = s.mgr.LoadOrNewStream(fmt.Sprintf(WorkStreamNamePattern, q.Name), opts...)
 	if err != nil {
 		return err
 	}
+	q.DuplicateWindow = s.qStreams[q.Name].DuplicateWindow()
+
+	if current := streamStorage(s.qStreams[q.Name]); q.Storage != QueueStorageDefault && current != q.Storage {
+		return fmt.Errorf("%w: queue %s storage can not be changed from %s to %s", ErrQueueSettingImmutable, q.Name, current, q.Storage)
+	}
+	q.Storage = streamStorage(s.qStreams[q.Name])
+	if q.Storage == QueueStorageMemory {
+		s.log.Warnf("Work queue %s is stored in memory, tasks waiting in the queue will be lost when the NATS server restarts", q.Name)
+	}
+
+	if q.EphemeralConsumer {
+		return s.newEphemeralConsumer(q)
+	}
+
+	if !q.PrioritySupport {
+		consumer, err := s.qStreams[q.Name].LoadOrNewConsumer(q.consumerName(), workConsumerOptions(q, q.consumerName(), "")...)
+		if err != nil {
+			return err
+		}
+		s.qConsumers[q.Name] = consumer
+
+		return s.updateQueueSettings(q)
+	}
+
+	// tasks with the default priority, or those enqueued without knowledge of priorities, are in the
+	// un-prefixed subjects and consumed by the usual consumer, other priorities get their own consumers
+	s.qConsumers[q.Name], err = s.qStreams[q.Name].LoadOrNewConsumer(q.consumerName(), workConsumerOptions(q, q.consumerName(), fmt.Sprintf(WorkStreamSubjectPattern, q.Name, "*"))...)
+	if err != nil {
+		return err
+	}
+
+	s.qPriority[q.Name] = map[int]*jsm.Consumer{DefaultPriority: s.qConsumers[q.Name]}
+
+	for p := 0; p <= MaxPriority; p++ {
+		if p == DefaultPriority {
+			continue
+		}
+
+		name := q.priorityConsumerName(p)
+		s.qPriority[q.Name][p], err = s.qStreams[q.Name].LoadOrNewConsumer(name, workConsumerOptions(q, name, fmt.Sprintf(WorkStreamPrioritySubjectPattern, q.Name, p, "*"))...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.updateQueueSettings(q)
+	if err != nil {
+		return err
+	}
+
+	return s.prepareQueueSlots(q)
+}
 
-	wopts := []jsm.ConsumerOption{
-		jsm.DurableName("WORKERS"),
-		jsm.AckWait(q.MaxRunTime),
+// workConsumerOptions are the options for the consumer name of q consuming filter, an empty name is an ephemeral consumer
+func workConsumerOptions(q *Queue, name string, filter string) []jsm.ConsumerOption {
+	opts := []jsm.ConsumerOption{
+		jsm.AckWait(q.ackWait()),
 		jsm.MaxAckPending(uint(q.MaxConcurrent)),
 		jsm.AcknowledgeExplicit(),
-		jsm.MaxDeliveryAttempts(q.MaxTries),
+		jsm.MaxDeliveryAttempts(q.maxDeliver()),
+	}
+
+	if name != "" {
+		opts = append(opts, jsm.DurableName(name))
+	} else {
+		// long enough to not be removed while handling a task without fetching
+		opts = append(opts, jsm.InactiveThreshold(2*q.ackWait()))
 	}
-	s.qConsumers[q.Name], err = s.qStreams[q.Name].LoadOrNewConsumer("WORKERS", wopts...)
+
+	if filter != "" {
+		opts = append(opts, jsm.FilterStreamBySubject(filter))
+	}
+
+	return opts
+}
+
+// newEphemeralConsumer creates the ephemeral consumer of q, the queue stream must be loaded
+func (s *jetStreamStorage) newEphemeralConsumer(q *Queue) error {
+	consumer, err := s.qStreams[q.Name].NewConsumer(workConsumerOptions(q, "", "")...)
 	if err != nil {
-		return err
+		return fmt.Errorf("creating ephemeral consumer for queue %s failed: %w", q.Name, err)
 	}
+	s.qConsumers[q.Name] = consumer
 
 	return s.updateQueueSettings(q)
 }
 
+// loadWorkConsumer loads the consumer workers use to consume the queue name from stream, consumers not called
+// consumer are found by their filter as work queue streams can not have overlapping consumers
+func loadWorkConsumer(stream *jsm.Stream, name string, consumer string) (*jsm.Consumer, error) {
+	c, err := stream.LoadConsumer(consumer)
+	if !jsm.IsNatsError(err, 10014) {
+		return c, err
+	}
+
+	var found *jsm.Consumer
+	eerr := stream.EachConsumer(func(c *jsm.Consumer) {
+		filter := c.FilterSubject()
+		if found == nil && (filter == "" || filter == fmt.Sprintf(WorkStreamSubjectPattern, name, "*")) {
+			found = c
+		}
+	})
+	if eerr != nil {
+		return nil, eerr
+	}
+	if found == nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
 func (s *jetStreamStorage) updateQueueSettings(q *Queue) error {
 	ss, sok := s.qStreams[q.Name]
 	sc, cok := s.qConsumers[q.Name]
@@ -447,17 +1399,42 @@ func (s *jetStreamStorage) updateQueueSettings(q *Queue) error {
 		return ErrQueueNotFound
 	}
 
+	applyQueueSettings(q, ss, sc)
+
+	return nil
+}
+
+// loadPriorityConsumers loads consumer and the consumers of the other priority levels of stream by priority
+func loadPriorityConsumers(stream *jsm.Stream, consumer *jsm.Consumer) (map[int]*jsm.Consumer, error) {
+	consumers := map[int]*jsm.Consumer{DefaultPriority: consumer}
+	for p := 0; p <= MaxPriority; p++ {
+		if p == DefaultPriority {
+			continue
+		}
+
+		pc, err := stream.LoadConsumer(priorityConsumerName(consumer.Name(), p))
+		if err != nil {
+			return nil, err
+		}
+		consumers[p] = pc
+	}
+
+	return consumers, nil
+}
+
+// applyQueueSettings updates q from the settings of the queue stream and its consumer
+func applyQueueSettings(q *Queue, ss *jsm.Stream, sc *jsm.Consumer) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	q.MaxRunTime = sc.AckWait()
+	q.applyConsumerSettings(sc.AckWait(), sc.MaxDeliver())
 	q.MaxConcurrent = sc.MaxAckPending()
-	q.MaxTries = sc.MaxDeliver()
 	q.DiscardOld = ss.Configuration().Discard == api.DiscardOld
 	q.MaxAge = ss.MaxAge()
 	q.MaxEntries = int(ss.MaxMsgs())
-
-	return nil
+	if q.MaxEntries < 0 {
+		q.MaxEntries = 0
+	}
 }
 
 func (s *jetStreamStorage) joinQueue(q *Queue) error {
@@ -470,8 +1447,14 @@ func (s *jetStreamStorage) joinQueue(q *Queue) error {
 		}
 		return err
 	}
+	q.DuplicateWindow = s.qStreams[q.Name].DuplicateWindow()
+	q.Storage = streamStorage(s.qStreams[q.Name])
 
-	s.qConsumers[q.Name], err = s.qStreams[q.Name].LoadConsumer("WORKERS")
+	if q.EphemeralConsumer {
+		return s.newEphemeralConsumer(q)
+	}
+
+	s.qConsumers[q.Name], err = s.qStreams[q.Name].LoadConsumer(q.consumerName())
 	if err != nil {
 		if jsm.IsNatsError(err, 10014) {
 			return ErrQueueConsumerNotFound
@@ -479,7 +1462,32 @@ func (s *jetStreamStorage) joinQueue(q *Queue) error {
 		return err
 	}
 
-	return s.updateQueueSettings(q)
+	// only queues with priority support have filtered consumers
+	if s.qConsumers[q.Name].FilterSubject() != "" {
+		q.PrioritySupport = true
+		s.qPriority[q.Name] = map[int]*jsm.Consumer{DefaultPriority: s.qConsumers[q.Name]}
+
+		for p := 0; p <= MaxPriority; p++ {
+			if p == DefaultPriority {
+				continue
+			}
+
+			s.qPriority[q.Name][p], err = s.qStreams[q.Name].LoadConsumer(q.priorityConsumerName(p))
+			if err != nil {
+				if jsm.IsNatsError(err, 10014) {
+					return ErrQueueConsumerNotFound
+				}
+				return err
+			}
+		}
+	}
+
+	err = s.updateQueueSettings(q)
+	if err != nil || !q.PrioritySupport {
+		return err
+	}
+
+	return s.prepareQueueSlots(q)
 }
 
 func (s *jetStreamStorage) PrepareQueue(q *Queue, replicas int, memory bool) error {
@@ -516,7 +1524,7 @@ func (s *jetStreamStorage) TasksInfo() (*TasksInfo, error) {
 	}
 
 	res := &TasksInfo{
-		Time: time.Now().UTC(),
+		Time: s.clock.Now().UTC(),
 	}
 
 	var err error
@@ -541,7 +1549,14 @@ func (s *jetStreamStorage) DeleteTaskByID(id string) error {
 		return err
 	}
 
-	return s.tasks.stream.DeleteMessage(msg.Sequence)
+	err = s.tasks.stream.DeleteMessage(msg.Sequence)
+	if err != nil {
+		return err
+	}
+
+	s.deleteTaskResult(id)
+
+	return nil
 }
 
 func (s *jetStreamStorage) LoadTaskByID(id string) (*Task, error) {
@@ -557,14 +1572,18 @@ func (s *jetStreamStorage) LoadTaskByID(id string) (*Task, error) {
 		return nil, err
 	}
 
-	task := &Task{}
-	err = json.Unmarshal(msg.Data, task)
+	hdrs, err := decodeHeadersMsg(msg.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	task, err := s.unmarshalTask(msg.Data, hdrs)
 	if err != nil {
 		return nil, err
 	}
 
 	task.mu.Lock()
-	task.storageOptions = &taskMeta{seq: msg.Sequence}
+	task.storageOptions = &taskMeta{seq: msg.Sequence, state: task.State}
 	task.mu.Unlock()
 
 	return task, nil
@@ -575,23 +1594,62 @@ func (s *jetStreamStorage) DeleteScheduledTaskByName(name string) error {
 		return fmt.Errorf("%w: scheduled storage not prepared", ErrStorageNotReady)
 	}
 
-	return s.configBucket.Delete(fmt.Sprintf("scheduled_tasks.%s", name))
-}
-
-func (s *jetStreamStorage) ScheduledTasks(ctx context.Context) ([]*ScheduledTask, error) {
-	if s.configBucket == nil {
-		return nil, fmt.Errorf("%w: scheduled storage not prepared", ErrStorageNotReady)
+	err := s.configBucket.Delete(fmt.Sprintf("scheduled_tasks.%s", name))
+	if err != nil {
+		return err
 	}
 
-	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	watch, err := s.configBucket.Watch("scheduled_tasks.*", nats.Context(wctx))
+	err = s.configBucket.Delete(fmt.Sprintf("scheduled_task_runs.%s", name))
 	if err != nil {
-		return nil, err
+		s.log.Warnf("Could not remove last run time for scheduled task %s: %v", name, err)
 	}
 
-	var tasks []*ScheduledTask
+	return nil
+}
+
+// ScheduledTaskLastRun loads the time a scheduled task last created a task, zero time when it has never run
+func (s *jetStreamStorage) ScheduledTaskLastRun(name string) (time.Time, error) {
+	if s.configBucket == nil {
+		return time.Time{}, fmt.Errorf("%w: scheduled storage not prepared", ErrStorageNotReady)
+	}
+
+	e, err := s.configBucket.Get(fmt.Sprintf("scheduled_task_runs.%s", name))
+	if err != nil {
+		if err == nats.ErrKeyNotFound {
+			return time.Time{}, nil
+		}
+
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, string(e.Value()))
+}
+
+// SaveScheduledTaskLastRun records the time a scheduled task last created a task
+func (s *jetStreamStorage) SaveScheduledTaskLastRun(name string, t time.Time) error {
+	if s.configBucket == nil {
+		return fmt.Errorf("%w: scheduled storage not prepared", ErrStorageNotReady)
+	}
+
+	_, err := s.configBucket.Put(fmt.Sprintf("scheduled_task_runs.%s", name), []byte(t.UTC().Format(time.RFC3339Nano)))
+
+	return err
+}
+
+func (s *jetStreamStorage) ScheduledTasks(ctx context.Context) ([]*ScheduledTask, error) {
+	if s.configBucket == nil {
+		return nil, fmt.Errorf("%w: scheduled storage not prepared", ErrStorageNotReady)
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	watch, err := s.configBucket.Watch("scheduled_tasks.*", nats.Context(wctx))
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []*ScheduledTask
 
 	for {
 		select {
@@ -715,7 +1773,7 @@ func (s *jetStreamStorage) SaveScheduledTask(st *ScheduledTask, update bool) err
 		rev, err = s.configBucket.Create(key, stj)
 	}
 	if err != nil {
-		if strings.Contains(err.Error(), "wrong last sequence") {
+		if errors.Is(err, nats.ErrKeyExists) {
 			return ErrScheduledTaskAlreadyExist
 		}
 		return err
@@ -778,220 +1836,1153 @@ func (s *jetStreamStorage) PrepareConfigurationStore(memory bool, replicas int)
 
 }
 
-func (s *jetStreamStorage) PrepareTasks(memory bool, replicas int, retention time.Duration) error {
-	var err error
-
+func (s *jetStreamStorage) PrepareDeduplicationStore(memory bool, replicas int, window time.Duration) error {
 	if replicas == 0 {
 		replicas = 1
 	}
 
-	opts := []jsm.StreamOption{
-		jsm.Subjects(TasksStreamSubjects),
-		jsm.MaxMessagesPerSubject(1),
-		jsm.Replicas(replicas),
-		jsm.StreamDescription("Choria Async Jobs Tasks"),
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return err
 	}
 
+	storage := nats.FileStorage
 	if memory {
-		opts = append(opts, jsm.MemoryStorage())
-	} else {
-		opts = append(opts, jsm.FileStorage())
+		storage = nats.MemoryStorage
 	}
 
-	opts = append(opts, jsm.MaxAge(retention))
+	kv, err := js.KeyValue(DeduplicationBucketName)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      DeduplicationBucketName,
+			Description: "Choria Async Jobs Task Deduplication",
+			Storage:     storage,
+			Replicas:    replicas,
+			TTL:         window,
+		})
+	}
+	if err != nil {
+		return err
+	}
 
-	s.tasks = &taskStorage{mgr: s.mgr}
-	s.tasks.stream, err = s.mgr.LoadOrNewStream(TasksStreamName, opts...)
+	pending, err := js.KeyValue(PendingClaimsBucketName)
+	if err == nats.ErrBucketNotFound {
+		pending, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      PendingClaimsBucketName,
+			Description: "Choria Async Jobs Pending Task Claims",
+			Storage:     storage,
+			Replicas:    replicas,
+		})
+	}
 	if err != nil {
 		return err
 	}
 
+	s.dedupe = kv
+	s.pending = pending
+
 	return nil
 }
 
-// DeleteQueue removes a queue and all its items
-func (s *jetStreamStorage) DeleteQueue(name string) error {
-	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+func (s *jetStreamStorage) PrepareResultStore(memory bool, replicas int, ttl time.Duration) error {
+	if replicas == 0 {
+		replicas = 1
+	}
+
+	js, err := s.nc.JetStream()
 	if err != nil {
-		if jsm.IsNatsError(err, 10059) {
-			return ErrQueueNotFound
-		}
 		return err
 	}
 
-	return stream.Delete()
-}
+	storage := nats.FileStorage
+	if memory {
+		storage = nats.MemoryStorage
+	}
 
-// PurgeQueue removes all work items from the named work queue
-func (s *jetStreamStorage) PurgeQueue(name string) error {
-	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	obs, err := js.ObjectStore(ResultsBucketName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		obs, err = js.CreateObjectStore(&nats.ObjectStoreConfig{
+			Bucket:      ResultsBucketName,
+			Description: "Choria Async Jobs Task Results",
+			Storage:     storage,
+			Replicas:    replicas,
+			TTL:         ttl,
+		})
+	}
 	if err != nil {
-		if jsm.IsNatsError(err, 10059) {
-			return ErrQueueNotFound
-		}
 		return err
 	}
 
-	return stream.Purge()
+	s.mu.Lock()
+	s.results = obs
+	s.mu.Unlock()
+
+	return nil
 }
 
-// QueueInfo loads information for a named queue
-func (s *jetStreamStorage) QueueInfo(name string) (*QueueInfo, error) {
-	nfo := &QueueInfo{
-		Name: name,
-		Time: time.Now().UTC(),
+func (s *jetStreamStorage) resultStore() (nats.ObjectStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.results == nil {
+		return nil, fmt.Errorf("%w: result store not initialized", ErrStorageNotReady)
 	}
 
-	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	return s.results, nil
+}
+
+func (s *jetStreamStorage) PutTaskResult(ctx context.Context, id string, r io.Reader) (*ResultObject, error) {
+	obs, err := s.resultStore()
 	if err != nil {
-		if jsm.IsNatsError(err, 10059) {
-			return nil, ErrQueueNotFound
-		}
 		return nil, err
 	}
-	consumer, err := stream.LoadConsumer("WORKERS")
+
+	nfo, err := obs.Put(&nats.ObjectMeta{Name: id, Description: "Result of task " + id}, r, nats.Context(ctx))
 	if err != nil {
 		return nil, err
 	}
 
-	nfo.Stream, err = stream.LatestInformation()
+	return &ResultObject{Name: nfo.Name, Size: nfo.Size, Digest: nfo.Digest, StoredAt: nfo.ModTime.UTC()}, nil
+}
+
+func (s *jetStreamStorage) OpenTaskResult(ctx context.Context, id string) (io.ReadCloser, error) {
+	obs, err := s.resultStore()
 	if err != nil {
 		return nil, err
 	}
-	cs, err := consumer.LatestState()
-	if err != nil {
-		return nil, err
+
+	res, err := obs.Get(id, nats.Context(ctx))
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return nil, ErrTaskResultNotStreamed
 	}
-	nfo.Consumer = &cs
 
-	return nfo, err
+	return res, err
 }
 
-// QueueNames finds all known queues in the storage
-func (s *jetStreamStorage) QueueNames() ([]string, error) {
-	var result []string
+// deleteTaskResult removes the streamed result of task id when results are stored
+func (s *jetStreamStorage) deleteTaskResult(id string) {
+	s.mu.Lock()
+	obs := s.results
+	s.mu.Unlock()
 
-	names, err := s.mgr.StreamNames(&jsm.StreamNamesFilter{Subject: WorkStreamSubjectWildcard})
-	if err != nil {
-		return nil, err
+	if obs == nil {
+		return
 	}
 
-	for _, name := range names {
-		result = append(result, strings.TrimPrefix(name, WorkStreamNamePrefix))
+	err := obs.Delete(id)
+	if err != nil && !errors.Is(err, nats.ErrObjectNotFound) {
+		s.log.Warnf("Could not delete the result of task %s: %v", id, err)
 	}
-
-	return result, nil
 }
 
-// Queues load full information for every found queue
-func (s *jetStreamStorage) Queues() ([]*QueueInfo, error) {
-	var result []*QueueInfo
+func (s *jetStreamStorage) PrepareTaskTypeLockStore(memory bool, replicas int, ttl time.Duration) error {
+	if replicas == 0 {
+		replicas = 1
+	}
 
-	names, err := s.QueueNames()
+	js, err := s.nc.JetStream()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	for _, name := range names {
-		nfo, err := s.QueueInfo(name)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, nfo)
+	storage := nats.FileStorage
+	if memory {
+		storage = nats.MemoryStorage
 	}
 
-	return result, nil
+	kv, err := js.KeyValue(TaskTypeLockBucketName)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      TaskTypeLockBucketName,
+			Description: "Choria Async Jobs Task Type Locks",
+			Storage:     storage,
+			Replicas:    replicas,
+			TTL:         ttl,
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.typeLocks = kv
+	s.mu.Unlock()
+
+	return nil
 }
 
-func (s *jetStreamStorage) TasksStore() (*jsm.Manager, *jsm.Stream, error) {
-	return s.tasks.mgr, s.tasks.stream, nil
+// task types can not hold dots so replacing the colons makes a valid and unique key
+func taskTypeLockKey(taskType string) string {
+	return strings.ReplaceAll(taskType, ":", ".")
 }
 
-// ElectionStorage gives access to the key-value store used for elections
-func (s *jetStreamStorage) ElectionStorage() (nats.KeyValue, error) {
-	if s.leaderElections == nil {
-		return nil, fmt.Errorf("%s: election bucket not configured", ErrStorageNotReady)
+func (s *jetStreamStorage) typeLockBucket() (nats.KeyValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.typeLocks == nil {
+		return nil, ErrTaskTypeLockStoreNotPrepared
 	}
 
-	return s.leaderElections, nil
+	return s.typeLocks, nil
 }
 
-func (s *jetStreamStorage) Tasks(ctx context.Context, limit int32) (chan *Task, error) {
-	if s.tasks == nil || s.tasks.stream == nil {
-		return nil, fmt.Errorf("%w: task store not initialized", ErrStorageNotReady)
+func (s *jetStreamStorage) AcquireTaskTypeLock(taskType string, holder string) (uint64, error) {
+	kv, err := s.typeLockBucket()
+	if err != nil {
+		return 0, err
 	}
 
-	if limit <= 0 {
-		s.log.Debugf("Defaulting to task list limit of 10000")
-		limit = 10000
+	rev, err := kv.Create(taskTypeLockKey(taskType), []byte(holder))
+	if errors.Is(err, nats.ErrKeyExists) {
+		return 0, fmt.Errorf("%w: %s", ErrTaskTypeLocked, taskType)
 	}
 
-	nfo, err := s.tasks.stream.State()
+	return rev, err
+}
+
+func (s *jetStreamStorage) RefreshTaskTypeLock(taskType string, holder string, revision uint64) (uint64, error) {
+	kv, err := s.typeLockBucket()
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	if nfo.Msgs == 0 {
-		return nil, ErrNoTasks
+
+	rev, err := kv.Update(taskTypeLockKey(taskType), []byte(holder), revision)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrTaskTypeLockLost, err)
 	}
 
-	out := make(chan *Task, limit)
-	cnt := int32(0)
+	return rev, nil
+}
 
-	timeout, cancel := context.WithTimeout(ctx, time.Minute)
+func (s *jetStreamStorage) ReleaseTaskTypeLock(taskType string, revision uint64) error {
+	kv, err := s.typeLockBucket()
+	if err != nil {
+		return err
+	}
 
-	sub, err := s.nc.Subscribe(s.nc.NewRespInbox(), func(msg *nats.Msg) {
-		if len(msg.Data) == 0 {
-			return
-		}
+	err = kv.Delete(taskTypeLockKey(taskType), nats.LastRevision(revision))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrTaskTypeLockLost, err)
+	}
 
-		task := &Task{}
-		err := json.Unmarshal(msg.Data, task)
-		if err != nil {
-			return
-		}
+	return nil
+}
 
-		select {
-		case out <- task:
-			md, err := msg.Metadata()
-			if err != nil {
-				return
-			}
-			done := atomic.AddInt32(&cnt, 1)
-			if md.NumPending == 0 || done == limit {
-				msg.Sub.Unsubscribe()
-				cancel()
-			}
-		default:
-			msg.Sub.Unsubscribe()
-			cancel()
-		}
+// queueSlot is one of the MaxConcurrent slots of a priority queue, held while an item of the queue is in flight
+type queueSlot struct {
+	kv       nats.KeyValue
+	key      string
+	revision uint64
+}
 
-		msg.Ack()
-	})
+func queueSlotsBucketName(queue string) string {
+	return fmt.Sprintf(QueueSlotsBucketPattern, strings.ReplaceAll(queue, ":", "_"))
+}
+
+// prepareQueueSlots loads or creates the slot bucket of the priority queue q, slots expire after the queue ack wait
+// so those held by clients that crashed are reclaimed once their items would be delivered again
+func (s *jetStreamStorage) prepareQueueSlots(q *Queue) error {
+	js, err := s.nc.JetStream()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	_, err = s.tasks.stream.NewConsumer(jsm.DeliverAllAvailable(), jsm.DeliverySubject(sub.Subject))
+	stream := s.qStreams[q.Name].Configuration()
+	storage := nats.FileStorage
+	if stream.Storage == api.MemoryStorage {
+		storage = nats.MemoryStorage
+	}
+
+	kv, err := js.KeyValue(queueSlotsBucketName(q.Name))
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:      queueSlotsBucketName(q.Name),
+			Description: fmt.Sprintf("Choria Async Jobs Queue %s Slots", q.Name),
+			Storage:     storage,
+			Replicas:    stream.Replicas,
+			TTL:         q.ackWait(),
+		})
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	go func() {
-		<-timeout.Done()
-		close(out)
-		sub.Unsubscribe()
-	}()
+	s.qSlots[q.Name] = kv
 
-	return out, nil
+	return nil
 }
 
-const (
-	hdrLine   = "NATS/1.0\r\n"
+// updateQueueSlotsTTL sets the slot expiry of the priority queue q to its ack wait, queues without a slot bucket get
+// one when they are joined
+func (s *jetStreamStorage) updateQueueSlotsTTL(q *Queue) error {
+	stream, err := s.mgr.LoadStream("KV_" + queueSlotsBucketName(q.Name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return nil
+		}
+		return err
+	}
+
+	cfg := stream.Configuration()
+	if cfg.MaxAge == q.ackWait() {
+		return nil
+	}
+	cfg.MaxAge = q.ackWait()
+
+	err = stream.UpdateConfiguration(cfg)
+	if err != nil {
+		return fmt.Errorf("updating queue %s slots failed: %w", q.Name, err)
+	}
+
+	return nil
+}
+
+// acquireQueueSlot takes a free slot of the priority queue q, false when all MaxConcurrent slots are held. Queues
+// without a concurrency limit have no slots
+func (s *jetStreamStorage) acquireQueueSlot(q *Queue) (*queueSlot, bool, error) {
+	s.mu.Lock()
+	kv := s.qSlots[q.Name]
+	s.mu.Unlock()
+
+	if kv == nil || q.MaxConcurrent <= 0 {
+		return nil, true, nil
+	}
+
+	keys, err := kv.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return nil, false, err
+	}
+
+	held := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		held[k] = true
+	}
+
+	for i := 0; i < q.MaxConcurrent; i++ {
+		key := strconv.Itoa(i)
+		if held[key] {
+			continue
+		}
+
+		rev, err := kv.Create(key, []byte(s.clock.Now().UTC().Format(time.RFC3339)))
+		if errors.Is(err, nats.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		return &queueSlot{kv: kv, key: key, revision: rev}, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// releaseQueueSlot releases slot, slots that expired or were taken by another client are left alone
+func (s *jetStreamStorage) releaseQueueSlot(slot *queueSlot) {
+	if slot == nil {
+		return
+	}
+
+	err := slot.kv.Delete(slot.key, nats.LastRevision(slot.revision))
+	if err != nil {
+		s.log.Debugf("Could not release queue slot %s: %v", slot.key, err)
+	}
+}
+
+// holdQueueSlot records slot as held by msg until it is acknowledged
+func (s *jetStreamStorage) holdQueueSlot(msg *nats.Msg, slot *queueSlot) {
+	if slot == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.heldSlots[msg] = slot
+	s.mu.Unlock()
+}
+
+// releaseItemSlot releases the slot held by the item, if any
+func (s *jetStreamStorage) releaseItemSlot(item *ProcessItem) {
+	msg, ok := item.storageMeta.(*nats.Msg)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	slot := s.heldSlots[msg]
+	delete(s.heldSlots, msg)
+	s.mu.Unlock()
+
+	s.releaseQueueSlot(slot)
+}
+
+// refreshItemSlot extends the slot held by the item while it is in progress
+func (s *jetStreamStorage) refreshItemSlot(item *ProcessItem) {
+	msg, ok := item.storageMeta.(*nats.Msg)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	slot, ok := s.heldSlots[msg]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	rev, err := slot.kv.Update(slot.key, []byte(s.clock.Now().UTC().Format(time.RFC3339)), slot.revision)
+	if err != nil {
+		s.log.Warnf("Could not refresh queue slot %s: %v", slot.key, err)
+		return
+	}
+
+	s.mu.Lock()
+	slot.revision = rev
+	s.mu.Unlock()
+}
+
+func (s *jetStreamStorage) PrepareTasks(memory bool, replicas int, retention time.Duration) error {
+	var err error
+
+	if replicas == 0 {
+		replicas = 1
+	}
+
+	opts := []jsm.StreamOption{
+		jsm.Subjects(TasksStreamSubjects),
+		jsm.MaxMessagesPerSubject(1),
+		jsm.Replicas(replicas),
+		jsm.StreamDescription("Choria Async Jobs Tasks"),
+	}
+
+	if memory {
+		opts = append(opts, jsm.MemoryStorage())
+	} else {
+		opts = append(opts, jsm.FileStorage())
+	}
+
+	opts = append(opts, jsm.MaxAge(retention))
+
+	s.tasks = &taskStorage{mgr: s.mgr}
+	s.tasks.stream, err = s.mgr.LoadOrNewStream(TasksStreamName, opts...)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteQueue removes a queue and all its items
+func (s *jetStreamStorage) DeleteQueue(name string) error {
+	return s.DeleteWorkQueue(name)
+}
+
+// CreateWorkQueue creates a new work queue, unlike PrepareQueue it fails with ErrQueueAlreadyExists when the queue exists
+func (s *jetStreamStorage) CreateWorkQueue(q *Queue, replicas int, memory bool) error {
+	if q.Name == "" {
+		return ErrQueueNameRequired
+	}
+
+	known, err := s.mgr.IsKnownStream(fmt.Sprintf(WorkStreamNamePattern, q.Name))
+	if err != nil {
+		return err
+	}
+	if known {
+		return fmt.Errorf("%w: %s", ErrQueueAlreadyExists, q.Name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.createQueue(q, replicas, memory)
+}
+
+// UpdateWorkQueue updates the settings of an existing work queue to those of q, unset values are set to their defaults
+// like when creating a queue. Changing PrioritySupport or Storage fails with ErrQueueSettingImmutable as the consumers
+// and storage of the queue can not be changed, the queue has to be deleted and created again. Once updated q holds the settings of the queue.
+// Clients already using the queue keep using the settings they loaded until they are restarted
+func (s *jetStreamStorage) UpdateWorkQueue(q *Queue) error {
+	if q.Name == "" {
+		return ErrQueueNameRequired
+	}
+
+	if q.MaxTries == 0 {
+		q.MaxTries = -1
+	}
+	if q.MaxRunTime == 0 {
+		q.MaxRunTime = DefaultJobRunTime
+	}
+	if q.MaxConcurrent == 0 {
+		q.MaxConcurrent = DefaultQueueMaxConcurrent
+	}
+
+	err := q.validate()
+	if err != nil {
+		return err
+	}
+
+	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, q.Name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return ErrQueueNotFound
+		}
+		return err
+	}
+
+	consumer, err := loadWorkConsumer(stream, q.Name, q.consumerName())
+	if err != nil {
+		if jsm.IsNatsError(err, 10014) {
+			return ErrQueueConsumerNotFound
+		}
+		return err
+	}
+	if q.ConsumerName == "" && consumer.IsDurable() && consumer.Name() != WorkStreamConsumerName {
+		q.ConsumerName = consumer.Name()
+	}
+
+	if hasPriority := consumer.FilterSubject() != ""; hasPriority != q.PrioritySupport {
+		return fmt.Errorf("%w: queue %s priority support can not be changed from %t to %t", ErrQueueSettingImmutable, q.Name, hasPriority, q.PrioritySupport)
+	}
+	if current := streamStorage(stream); q.Storage != QueueStorageDefault && current != q.Storage {
+		return fmt.Errorf("%w: queue %s storage can not be changed from %s to %s", ErrQueueSettingImmutable, q.Name, current, q.Storage)
+	}
+	q.Storage = streamStorage(stream)
+
+	cfg := stream.Configuration()
+	cfg.MaxAge = q.MaxAge
+	cfg.MaxMsgs = -1
+	if q.MaxEntries > 0 {
+		cfg.MaxMsgs = int64(q.MaxEntries)
+	}
+	cfg.Discard = api.DiscardNew
+	if q.DiscardOld {
+		cfg.Discard = api.DiscardOld
+	}
+	if q.DuplicateWindow > 0 {
+		cfg.Duplicates = q.DuplicateWindow
+	}
+	if cfg.MaxAge > 0 && cfg.Duplicates > cfg.MaxAge {
+		cfg.Duplicates = cfg.MaxAge
+	}
+
+	err = stream.UpdateConfiguration(cfg)
+	if err != nil {
+		return fmt.Errorf("updating queue %s failed: %w", q.Name, err)
+	}
+
+	// ephemeral consumers are configured by the client that created them
+	if consumer.IsEphemeral() {
+		return nil
+	}
+
+	consumers := map[int]*jsm.Consumer{DefaultPriority: consumer}
+	if q.PrioritySupport {
+		consumers, err = loadPriorityConsumers(stream, consumer)
+		if err != nil {
+			return err
+		}
+
+		err = s.updateQueueSlotsTTL(q)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, c := range consumers {
+		err = c.UpdateConfiguration(jsm.AckWait(q.ackWait()), jsm.MaxAckPending(uint(q.MaxConcurrent)), jsm.MaxDeliveryAttempts(q.maxDeliver()))
+		if err != nil {
+			return fmt.Errorf("updating queue %s consumer %s failed: %w", q.Name, c.Name(), err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.joinQueue(q)
+}
+
+// DeleteWorkQueue deletes the named work queue and all its items
+func (s *jetStreamStorage) DeleteWorkQueue(name string) error {
+	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return ErrQueueNotFound
+		}
+		return err
+	}
+
+	err = stream.Delete()
+	if err != nil {
+		return err
+	}
+
+	// only priority queues have slots
+	slots, err := s.mgr.LoadStream("KV_" + queueSlotsBucketName(name))
+	if err == nil {
+		err = slots.Delete()
+	}
+	if err != nil && !jsm.IsNatsError(err, 10059) {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.qStreams, name)
+	delete(s.qConsumers, name)
+	delete(s.qPriority, name)
+	delete(s.qSlots, name)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// ListWorkQueues loads the settings of every work queue, settings that are not stored with the queue like
+// PriorityAging are not set
+func (s *jetStreamStorage) ListWorkQueues() ([]*Queue, error) {
+	names, err := s.QueueNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Queue
+	for _, name := range names {
+		stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+		if err != nil {
+			// deleted since being listed
+			if jsm.IsNatsError(err, 10059) {
+				continue
+			}
+			return nil, err
+		}
+
+		consumer, err := loadWorkConsumer(stream, name, WorkStreamConsumerName)
+		if err != nil {
+			if jsm.IsNatsError(err, 10014) {
+				continue
+			}
+			return nil, err
+		}
+
+		q := &Queue{
+			Name:            name,
+			DuplicateWindow: stream.DuplicateWindow(),
+			PrioritySupport: consumer.FilterSubject() != "",
+			Storage:         streamStorage(stream),
+			NoCreate:        true,
+		}
+		switch {
+		case consumer.IsEphemeral():
+			q.EphemeralConsumer = true
+		case consumer.Name() != WorkStreamConsumerName:
+			q.ConsumerName = consumer.Name()
+		}
+		applyQueueSettings(q, stream, consumer)
+
+		result = append(result, q)
+	}
+
+	return result, nil
+}
+
+// PurgeQueue removes all work items from the named work queue
+func (s *jetStreamStorage) PurgeQueue(name string) error {
+	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return ErrQueueNotFound
+		}
+		return err
+	}
+
+	return stream.Purge()
+}
+
+// QueueInfo loads information for a named queue
+func (s *jetStreamStorage) QueueInfo(name string) (*QueueInfo, error) {
+	nfo := &QueueInfo{
+		Name: name,
+		Time: s.clock.Now().UTC(),
+	}
+
+	stream, err := s.mgr.LoadStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	if err != nil {
+		if jsm.IsNatsError(err, 10059) {
+			return nil, ErrQueueNotFound
+		}
+		return nil, err
+	}
+	consumer, err := loadWorkConsumer(stream, name, WorkStreamConsumerName)
+	if err != nil {
+		return nil, err
+	}
+
+	nfo.Stream, err = stream.LatestInformation()
+	if err != nil {
+		return nil, err
+	}
+	cs, err := consumer.LatestState()
+	if err != nil {
+		return nil, err
+	}
+	nfo.Consumer = &cs
+	nfo.MaxTries = cs.Config.MaxDeliver
+	nfo.MaxConcurrent = cs.Config.MaxAckPending
+
+	if s.configBucket != nil {
+		nfo.Paused, err = s.QueuePaused(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nfo, err
+}
+
+// QueueNames finds all known queues in the storage
+func queuePausedKey(name string) string {
+	return fmt.Sprintf("queue_paused.%s", name)
+}
+
+func (s *jetStreamStorage) PauseQueue(name string) error {
+	if s.configBucket == nil {
+		return fmt.Errorf("%w: configuration storage not prepared", ErrStorageNotReady)
+	}
+
+	known, err := s.mgr.IsKnownStream(fmt.Sprintf(WorkStreamNamePattern, name))
+	if err != nil {
+		return err
+	}
+	if !known {
+		return ErrQueueNotFound
+	}
+
+	_, err = s.configBucket.Put(queuePausedKey(name), []byte(s.clock.Now().UTC().Format(time.RFC3339Nano)))
+	return err
+}
+
+func (s *jetStreamStorage) ResumeQueue(name string) error {
+	if s.configBucket == nil {
+		return fmt.Errorf("%w: configuration storage not prepared", ErrStorageNotReady)
+	}
+
+	return s.configBucket.Delete(queuePausedKey(name))
+}
+
+func (s *jetStreamStorage) QueuePaused(name string) (bool, error) {
+	if s.configBucket == nil {
+		return false, fmt.Errorf("%w: configuration storage not prepared", ErrStorageNotReady)
+	}
+
+	_, err := s.configBucket.Get(queuePausedKey(name))
+	if err == nats.ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// QueuePausedWatch delivers the current pause state of the queue followed by every change to it
+func (s *jetStreamStorage) QueuePausedWatch(ctx context.Context, name string) (chan bool, error) {
+	if s.configBucket == nil {
+		return nil, fmt.Errorf("%w: configuration storage not prepared", ErrStorageNotReady)
+	}
+
+	watch, err := s.configBucket.Watch(queuePausedKey(name), nats.Context(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	states := make(chan bool, 10)
+
+	go func() {
+		defer close(states)
+		defer watch.Stop()
+
+		seen := false
+		for {
+			select {
+			case entry, ok := <-watch.Updates():
+				if !ok {
+					return
+				}
+
+				// nil marks the end of the initial values, when there were none the queue is not paused
+				if entry == nil {
+					if !seen {
+						seen = true
+						states <- false
+					}
+					continue
+				}
+
+				seen = true
+				states <- entry.Operation() == nats.KeyValuePut
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return states, nil
+}
+
+func (s *jetStreamStorage) RequestTaskCancel(ctx context.Context, id string) error {
+	err := s.nc.Publish(fmt.Sprintf(TaskCancelRequestSubjectPattern, id), nil)
+	if err != nil {
+		return err
+	}
+
+	return s.nc.FlushWithContext(ctx)
+}
+
+func (s *jetStreamStorage) TaskCancelRequestsWatch(ctx context.Context) (chan string, error) {
+	msgs := make(chan *nats.Msg, 100)
+	sub, err := s.nc.ChanSubscribe(TaskCancelRequestSubjectWildcard, msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(chan string, 100)
+
+	go func() {
+		defer close(ids)
+		defer sub.Unsubscribe()
+
+		for {
+			select {
+			case msg := <-msgs:
+				ids <- strings.TrimPrefix(msg.Subject, fmt.Sprintf(TaskCancelRequestSubjectPattern, ""))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ids, nil
+}
+
+func (s *jetStreamStorage) QueueNames() ([]string, error) {
+	var result []string
+
+	names, err := s.mgr.StreamNames(&jsm.StreamNamesFilter{Subject: WorkStreamSubjectWildcard})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		result = append(result, strings.TrimPrefix(name, WorkStreamNamePrefix))
+	}
+
+	return result, nil
+}
+
+// Queues load full information for every found queue
+func (s *jetStreamStorage) Queues() ([]*QueueInfo, error) {
+	var result []*QueueInfo
+
+	names, err := s.QueueNames()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		nfo, err := s.QueueInfo(name)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nfo)
+	}
+
+	return result, nil
+}
+
+func (s *jetStreamStorage) TasksStore() (*jsm.Manager, *jsm.Stream, error) {
+	return s.tasks.mgr, s.tasks.stream, nil
+}
+
+// ElectionStorage gives access to the key-value store used for elections
+func (s *jetStreamStorage) ElectionStorage() (nats.KeyValue, error) {
+	if s.leaderElections == nil {
+		return nil, fmt.Errorf("%w: election bucket not configured", ErrStorageNotReady)
+	}
+
+	return s.leaderElections, nil
+}
+
+func (s *jetStreamStorage) Tasks(ctx context.Context, limit int32) (chan *Task, error) {
+	if s.tasks == nil || s.tasks.stream == nil {
+		return nil, fmt.Errorf("%w: task store not initialized", ErrStorageNotReady)
+	}
+
+	if limit <= 0 {
+		s.log.Debugf("Defaulting to task list limit of 10000")
+		limit = 10000
+	}
+
+	nfo, err := s.tasks.stream.State()
+	if err != nil {
+		return nil, err
+	}
+	if nfo.Msgs == 0 {
+		return nil, ErrNoTasks
+	}
+
+	out := make(chan *Task, limit)
+	cnt := int32(0)
+
+	timeout, cancel := context.WithTimeout(ctx, time.Minute)
+
+	sub, err := s.nc.Subscribe(s.nc.NewRespInbox(), func(msg *nats.Msg) {
+		if len(msg.Data) == 0 {
+			return
+		}
+
+		task, err := s.unmarshalTask(msg.Data, msg.Header)
+		if err != nil && !errors.Is(err, ErrTaskPayloadEncrypted) {
+			return
+		}
+
+		select {
+		case out <- task:
+			md, err := msg.Metadata()
+			if err != nil {
+				return
+			}
+			done := atomic.AddInt32(&cnt, 1)
+			if md.NumPending == 0 || done == limit {
+				msg.Sub.Unsubscribe()
+				cancel()
+			}
+		default:
+			msg.Sub.Unsubscribe()
+			cancel()
+		}
+
+		msg.Ack()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.tasks.stream.NewConsumer(jsm.DeliverAllAvailable(), jsm.DeliverySubject(sub.Subject))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		<-timeout.Done()
+		close(out)
+		sub.Unsubscribe()
+	}()
+
+	return out, nil
+}
+
+func (s *jetStreamStorage) ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error) {
+	if s.tasks == nil || s.tasks.stream == nil {
+		return nil, fmt.Errorf("%w: task store not initialized", ErrStorageNotReady)
+	}
+
+	pageSize := filter.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultTaskListPageSize
+	}
+
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []nats.SubOpt{nats.BindStream(s.tasks.stream.Name()), nats.AckNone(), nats.InactiveThreshold(time.Minute)}
+	if filter.CreatedAfter.IsZero() {
+		opts = append(opts, nats.DeliverAll())
+	} else {
+		// tasks are only ever updated after creation so none created after this point are stored before it
+		opts = append(opts, nats.StartTime(filter.CreatedAfter))
+	}
+
+	sub, err := js.PullSubscribe(TasksStreamSubjects, "", opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	nfo, err := sub.ConsumerInfo()
+	if err != nil {
+		sub.Unsubscribe()
+		return nil, err
+	}
+
+	pending := nfo.NumPending
+
+	pager := func(ctx context.Context) ([]*Task, bool, error) {
+		if pending == 0 {
+			return nil, false, nil
+		}
+
+		fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		msgs, err := sub.Fetch(pageSize, nats.Context(fctx))
+		if err != nil {
+			return nil, false, err
+		}
+
+		tasks := make([]*Task, 0, len(msgs))
+		for _, msg := range msgs {
+			md, err := msg.Metadata()
+			if err != nil {
+				return nil, false, err
+			}
+			pending = md.NumPending
+
+			task, err := s.unmarshalTask(msg.Data, msg.Header)
+			if err != nil && !errors.Is(err, ErrTaskPayloadEncrypted) {
+				s.log.Warnf("Skipping invalid task in sequence %d: %v", md.Sequence.Stream, err)
+				continue
+			}
+			task.storageOptions = &taskMeta{seq: md.Sequence.Stream, state: task.State}
+
+			tasks = append(tasks, task)
+		}
+
+		return tasks, pending > 0, nil
+	}
+
+	return NewTaskIterator(ctx, filter, pending, pager, func() { sub.Unsubscribe() }), nil
+}
+
+// PurgeTasks deletes all tasks matching filter, pausing for pause after every filter.PageSize deletions. Tasks
+// updated after being listed are not deleted
+func (s *jetStreamStorage) PurgeTasks(ctx context.Context, filter TaskFilter, pause time.Duration) (int, error) {
+	if filter.PageSize <= 0 {
+		filter.PageSize = DefaultTaskListPageSize
+	}
+
+	tasks, err := s.ListTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer tasks.Close()
+
+	deleted := 0
+	for tasks.Next() {
+		task := tasks.Task()
+
+		// deleting the listed sequence ensures tasks updated since being listed are left alone
+		err = s.tasks.stream.DeleteMessage(task.storageOptions.(*taskMeta).seq)
+		if err != nil {
+			if jsm.IsNatsError(err, 10057) {
+				continue
+			}
+			return deleted, err
+		}
+
+		deleted++
+		s.deleteTaskResult(task.ID)
+
+		if pause > 0 && deleted%filter.PageSize == 0 {
+			select {
+			case <-time.After(pause):
+			case <-ctx.Done():
+				return deleted, ctx.Err()
+			}
+		}
+	}
+
+	return deleted, tasks.Err()
+}
+
+func (s *jetStreamStorage) WatchTask(ctx context.Context, id string) (chan *Task, error) {
+	task, err := s.LoadTaskByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *Task, 10)
+	out <- task
+
+	if task.IsFinal() {
+		close(out)
+		return out, nil
+	}
+
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	task.mu.Lock()
+	seq := task.storageOptions.(*taskMeta).seq
+	task.mu.Unlock()
+
+	// starting after the loaded state ensures no updates are missed between loading and subscribing
+	sub, err := js.SubscribeSync(fmt.Sprintf(TasksStreamSubjectPattern, id), nats.BindStream(s.tasks.stream.Name()), nats.OrderedConsumer(), nats.StartSequence(seq+1))
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		defer close(out)
+		defer sub.Unsubscribe()
+
+		for {
+			msg, err := sub.NextMsgWithContext(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					s.log.Warnf("Watching task %s failed: %v", id, err)
+				}
+				return
+			}
+
+			md, err := msg.Metadata()
+			if err != nil {
+				continue
+			}
+
+			task, err := s.unmarshalTask(msg.Data, msg.Header)
+			if err != nil && !errors.Is(err, ErrTaskPayloadEncrypted) {
+				s.log.Warnf("Skipping invalid update for task %s in sequence %d: %v", id, md.Sequence.Stream, err)
+				continue
+			}
+			task.storageOptions = &taskMeta{seq: md.Sequence.Stream, state: task.State}
+
+			select {
+			case out <- task:
+			case <-ctx.Done():
+				return
+			}
+
+			if task.IsFinal() {
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+const (
+	hdrLine   = "NATS/1.0\r\n"
 	crlf      = "\r\n"
 	hdrPreEnd = len(hdrLine) - len(crlf)
 )
 
+// headerValue is the first value of key in hdrs, headers parsed from raw messages have canonical keys while those
+// received from NATS are kept as published
+func headerValue(hdrs map[string][]string, key string) string {
+	for _, k := range []string{key, textproto.CanonicalMIMEHeaderKey(key)} {
+		if v := hdrs[k]; len(v) > 0 {
+			return v[0]
+		}
+	}
+
+	return ""
+}
+
 func decodeHeadersMsg(data []byte) (http.Header, error) {
 	if len(data) == 0 {
 		return map[string][]string{}, nil
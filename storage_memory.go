@@ -0,0 +1,1425 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemoryStorage is a Storage that keeps tasks, work queues and scheduled tasks in memory, it is intended for unit
+// testing handlers and routing without a NATS server.
+//
+// Queue limits like MaxTries, MaxRunTime, MaxConcurrent, MaxEntries and MaxAge are enforced like JetStream would,
+// task retention is not applied. Lifecycle events are not published and leader elections are not supported so the
+// Task Scheduler and RetentionPolicy cannot be used.
+//
+//	client, err := asyncjobs.NewClient(asyncjobs.StorageBackend(asyncjobs.NewInMemoryStorage()))
+type InMemoryStorage struct {
+	seq       uint64
+	tasks     map[string]*memoryTask
+	queues    map[string]*memoryQueue
+	paused    map[string]time.Time
+	scheduled map[string][]byte
+	lastRuns  map[string]time.Time
+	dedupe    map[string]memoryDedupeEntry
+	pending   map[string]string
+	window    time.Duration
+	typeLocks map[string]*memoryTypeLock
+	lockTTL   time.Duration
+	results   map[string][]byte
+
+	changed         chan struct{}
+	taskWatchers    map[string][]*memoryTaskWatch
+	pauseWatchers   map[string][]chan bool
+	scheduleWatches []chan *ScheduleWatchEntry
+	cancelWatchers  []chan string
+
+	retry RetryPolicyProvider
+	clock clock
+	log   Logger
+	// called after a save changed the state of a task
+	stateChanged func(task *Task, previous TaskState)
+
+	mu sync.Mutex
+}
+
+type memoryTask struct {
+	seq  uint64
+	data []byte
+}
+
+type memoryDedupeEntry struct {
+	id      string
+	created time.Time
+}
+
+type memoryTypeLock struct {
+	holder   string
+	revision uint64
+	expires  time.Time
+}
+
+type memoryQueue struct {
+	queue   *Queue
+	entries []*memoryQueueEntry
+}
+
+type memoryQueueEntry struct {
+	id          string
+	seq         uint64
+	priority    int
+	data        []byte
+	created     time.Time
+	availableAt time.Time
+	deadline    time.Time
+	deliveries  int
+	active      bool
+	removed     bool
+	queue       *memoryQueue
+}
+
+type memoryTaskWatch struct {
+	pending []*Task
+	signal  chan struct{}
+}
+
+// NewInMemoryStorage creates a new empty InMemoryStorage, pass it to NewClient using StorageBackend()
+func NewInMemoryStorage() *InMemoryStorage {
+	return &InMemoryStorage{
+		tasks:         map[string]*memoryTask{},
+		queues:        map[string]*memoryQueue{},
+		paused:        map[string]time.Time{},
+		scheduled:     map[string][]byte{},
+		lastRuns:      map[string]time.Time{},
+		changed:       make(chan struct{}),
+		taskWatchers:  map[string][]*memoryTaskWatch{},
+		retry:         RetryDefault,
+		clock:         realClock{},
+		log:           &noopLogger{},
+		pauseWatchers: map[string][]chan bool{},
+	}
+}
+
+// notifyChanged wakes up pollers waiting for queue changes, must be called with the lock held
+func (s *InMemoryStorage) notifyChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *InMemoryStorage) nextSeq() uint64 {
+	s.seq++
+	return s.seq
+}
+
+func (s *InMemoryStorage) loadTask(id string) (*Task, error) {
+	mt, ok := s.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	task := &Task{}
+	err := json.Unmarshal(mt.data, task)
+	if err != nil {
+		return nil, err
+	}
+	task.storageOptions = &taskMeta{seq: mt.seq, state: task.State}
+
+	return task, nil
+}
+
+func (s *InMemoryStorage) SaveTaskState(ctx context.Context, task *Task, notify bool) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	task.mu.Lock()
+	so := task.storageOptions
+	task.mu.Unlock()
+
+	s.mu.Lock()
+
+	existing, ok := s.tasks[task.ID]
+	switch {
+	case so == nil && task.replace:
+	case so == nil && ok:
+		s.mu.Unlock()
+		taskUpdateErrorCounter.WithLabelValues().Inc()
+		return fmt.Errorf("%w: %s", ErrTaskAlreadyExists, task.ID)
+	case so != nil && (!ok || existing.seq != so.(*taskMeta).seq):
+		s.mu.Unlock()
+		taskUpdateErrorCounter.WithLabelValues().Inc()
+		return fmt.Errorf("%w: task %s revision %d", ErrConflict, task.ID, so.(*taskMeta).seq)
+	}
+
+	seq := s.nextSeq()
+	s.tasks[task.ID] = &memoryTask{seq: seq, data: data}
+
+	if task.IsFinal() && s.pending[task.DeduplicationKey] == task.ID {
+		delete(s.pending, task.DeduplicationKey)
+	}
+
+	for _, w := range s.taskWatchers[task.ID] {
+		update := &Task{}
+		if json.Unmarshal(data, update) == nil {
+			update.storageOptions = &taskMeta{seq: seq, state: update.State}
+			w.pending = append(w.pending, update)
+			select {
+			case w.signal <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	s.mu.Unlock()
+
+	previous := task.StoredState()
+
+	task.mu.Lock()
+	task.storageOptions = &taskMeta{seq: seq, state: task.State}
+	task.mu.Unlock()
+
+	taskUpdateCounter.WithLabelValues(string(task.State)).Inc()
+
+	if s.stateChanged != nil && previous != task.State {
+		s.stateChanged(task, previous)
+	}
+
+	return nil
+}
+
+func (s *InMemoryStorage) EnqueueTask(ctx context.Context, queue *Queue, task *Task) error {
+	switch task.State {
+	case TaskStateNew, TaskStateRetry, TaskStateBlocked:
+	case TaskStateQueueError:
+		// the same task enqueued again after its queue entry could not be confirmed
+		task.State = TaskStateNew
+		task.LastErr = ""
+	default:
+		return fmt.Errorf("%w %q", ErrTaskTypeCannotEnqueue, task.State)
+	}
+
+	task.startTTL(s.clock.Now())
+
+	// retries are for tasks that already hold their deduplication key
+	if task.DeduplicationKey == "" || task.State == TaskStateRetry {
+		return s.enqueueTask(ctx, queue, task)
+	}
+
+	// stored before claiming the key so callers finding the claim find the pending task holding it
+	if task.matchPending {
+		err := s.SaveTaskState(ctx, task, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.reserveDeduplicationKey(task)
+	if err != nil {
+		if task.matchPending {
+			discardUnclaimedTask(s, s.log, task, err)
+		}
+		return err
+	}
+
+	err = s.enqueueTask(ctx, queue, task)
+	if err != nil {
+		s.mu.Lock()
+		if task.matchPending {
+			delete(s.pending, task.DeduplicationKey)
+		} else {
+			delete(s.dedupe, task.DeduplicationKey)
+		}
+		s.mu.Unlock()
+	}
+
+	return err
+}
+
+// reserveDeduplicationKey claims the deduplication key of task, an existing claim is only
+// replaced when the task that holds it is completed, expired or no longer exist
+func (s *InMemoryStorage) reserveDeduplicationKey(task *Task) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dedupe == nil {
+		return ErrTaskDeduplicationNotEnabled
+	}
+
+	// claims made by EnqueueIfNotPending() do not expire with the deduplication window
+	if task.matchPending {
+		id, ok := s.pending[task.DeduplicationKey]
+		if ok {
+			if id == task.ID {
+				return &DuplicateTaskError{TaskID: task.ID}
+			}
+
+			holder, err := s.loadTask(id)
+			if err == nil && !holder.IsFinal() {
+				return &DuplicateTaskError{TaskID: holder.ID}
+			}
+		}
+
+		s.pending[task.DeduplicationKey] = task.ID
+
+		return nil
+	}
+
+	entry, ok := s.dedupe[task.DeduplicationKey]
+	if ok && (s.window == 0 || s.clock.Now().Sub(entry.created) < s.window) {
+		if entry.id == task.ID && !task.replace {
+			if task.matchPending {
+				return &DuplicateTaskError{TaskID: task.ID}
+			}
+			return fmt.Errorf("%w: %s", ErrTaskAlreadyExists, task.ID)
+		}
+
+		holder, err := s.loadTask(entry.id)
+		switch {
+		case err != nil:
+		case task.matchPending && !holder.IsFinal():
+			return &DuplicateTaskError{TaskID: holder.ID}
+		case !task.matchPending && holder.State != TaskStateCompleted && holder.State != TaskStateExpired:
+			return &DuplicateTaskError{TaskID: holder.ID}
+		}
+	}
+
+	s.dedupe[task.DeduplicationKey] = memoryDedupeEntry{id: task.ID, created: s.clock.Now()}
+
+	return nil
+}
+
+func (s *InMemoryStorage) enqueueTask(ctx context.Context, queue *Queue, task *Task) error {
+	ji, err := newProcessItem(TaskItem, task.ID)
+	if err != nil {
+		return err
+	}
+
+	task.Queue = queue.Name
+
+	err = s.SaveTaskState(ctx, task, true)
+	if err != nil {
+		return err
+	}
+
+	s.log.Debugf("Enqueueing task into queue %s", task.Queue)
+	discarded, err := s.addQueueEntry(queue.Name, task.ID, task.Priority, ji)
+	if err != nil {
+		enqueueErrorCounter.WithLabelValues(queue.Name).Inc()
+		task.State = TaskStateQueueError
+		task.LastErr = err.Error()
+		if err := s.SaveTaskState(ctx, task, true); err != nil {
+			return err
+		}
+		return err
+	}
+
+	enqueueCounter.WithLabelValues(queue.Name).Inc()
+
+	if discarded != "" {
+		expireDiscardedTask(ctx, s, s.log, queue, discarded)
+	}
+
+	return nil
+}
+
+// addQueueEntry stores data in the named queue, replacing any existing entry for id. When an old entry for a task
+// was discarded to make space its task ID is returned
+func (s *InMemoryStorage) addQueueEntry(name string, id string, priority int, data []byte) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mq, ok := s.queues[name]
+	if !ok {
+		return "", ErrQueueNotFound
+	}
+
+	mq.expire(s.clock.Now())
+
+	for _, e := range mq.entries {
+		if e.id == id {
+			mq.remove(e)
+			break
+		}
+	}
+
+	var discarded string
+	if mq.queue.MaxEntries > 0 && len(mq.entries) >= mq.queue.MaxEntries {
+		if !mq.queue.DiscardOld {
+			return "", fmt.Errorf("queue %s is full", name)
+		}
+
+		var item ProcessItem
+		if json.Unmarshal(mq.entries[0].data, &item) == nil && item.Kind == TaskItem {
+			discarded = item.JobID
+		}
+		mq.remove(mq.entries[0])
+	}
+
+	now := s.clock.Now()
+	mq.entries = append(mq.entries, &memoryQueueEntry{
+		id:          id,
+		seq:         s.nextSeq(),
+		priority:    priority,
+		data:        data,
+		created:     now,
+		availableAt: now,
+		queue:       mq,
+	})
+
+	s.notifyChanged()
+
+	return discarded, nil
+}
+
+func (q *memoryQueue) remove(entry *memoryQueueEntry) {
+	for i, e := range q.entries {
+		if e == entry {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			break
+		}
+	}
+
+	entry.removed = true
+	entry.active = false
+}
+
+// expire removes entries older than the queue MaxAge at now
+func (q *memoryQueue) expire(now time.Time) {
+	if q.queue.MaxAge <= 0 {
+		return
+	}
+
+	for _, e := range append([]*memoryQueueEntry{}, q.entries...) {
+		if now.Sub(e.created) > q.queue.MaxAge {
+			q.remove(e)
+		}
+	}
+}
+
+// next finds the next entry to deliver at now, when none is available wait is the time till a delayed entry becomes
+// available
+func (q *memoryQueue) next(now time.Time) (entry *memoryQueueEntry, wait time.Duration) {
+	q.expire(now)
+
+	active := 0
+
+	for _, e := range append([]*memoryQueueEntry{}, q.entries...) {
+		if e.active && now.After(e.deadline) {
+			e.active = false
+			e.availableAt = now
+		}
+
+		if e.active {
+			active++
+			continue
+		}
+
+		// MaxTries of -1 allows unlimited deliveries
+		if max := q.queue.maxDeliver(); max > 0 && e.deliveries >= max {
+			q.remove(e)
+			continue
+		}
+
+		if e.availableAt.After(now) {
+			if d := e.availableAt.Sub(now); wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+
+		if entry == nil || (q.queue.PrioritySupport && q.queue.agedPriority(e.priority, e.created, now) > q.queue.agedPriority(entry.priority, entry.created, now)) {
+			entry = e
+		}
+	}
+
+	if q.queue.MaxConcurrent > 0 && active >= q.queue.MaxConcurrent {
+		return nil, 0
+	}
+
+	return entry, wait
+}
+
+func (s *InMemoryStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessItem, error) {
+	for {
+		s.mu.Lock()
+		mq, ok := s.queues[q.Name]
+		if !ok {
+			s.mu.Unlock()
+			return nil, ErrInvalidQueueState
+		}
+
+		now := s.clock.Now()
+		entry, wait := mq.next(now)
+		changed := s.changed
+
+		if entry != nil {
+			entry.active = true
+			entry.deliveries++
+			entry.deadline = now.Add(mq.queue.ackWait())
+			data := entry.data
+			deliveries := uint64(entry.deliveries)
+			var pending uint64
+			for _, e := range mq.entries {
+				if !e.active {
+					pending++
+				}
+			}
+			s.mu.Unlock()
+
+			item := &ProcessItem{storageMeta: entry, pending: pending, deliveries: deliveries}
+			err := json.Unmarshal(data, item)
+			if err != nil || item.JobID == "" {
+				workQueueEntryCorruptCounter.WithLabelValues(q.Name).Inc()
+				s.removeEntry(entry)
+				return nil, ErrQueueItemCorrupt
+			}
+
+			return item, nil
+		}
+		s.mu.Unlock()
+
+		// active entries are checked again periodically so those not completed within MaxRunTime are redelivered
+		if wait == 0 || wait > time.Second {
+			wait = time.Second
+		}
+
+		timer := s.clock.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		timer.Stop()
+	}
+}
+
+func (s *InMemoryStorage) removeEntry(entry *memoryQueueEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.queue.remove(entry)
+	s.notifyChanged()
+}
+
+// delayEntry makes entry available for delivery again after delay
+func (s *InMemoryStorage) delayEntry(entry *memoryQueueEntry, delay time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.removed {
+		return
+	}
+
+	entry.active = false
+	entry.availableAt = s.clock.Now().Add(delay)
+	s.notifyChanged()
+}
+
+func memoryItemEntry(item *ProcessItem) (*memoryQueueEntry, error) {
+	entry, ok := item.storageMeta.(*memoryQueueEntry)
+	if !ok {
+		return nil, ErrInvalidStorageItem
+	}
+
+	return entry, nil
+}
+
+func (s *InMemoryStorage) AckItem(_ context.Context, item *ProcessItem) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.removeEntry(entry)
+
+	return nil
+}
+
+func (s *InMemoryStorage) TerminateItem(_ context.Context, item *ProcessItem) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.removeEntry(entry)
+
+	return nil
+}
+
+func (s *InMemoryStorage) InProgressItem(_ context.Context, item *ProcessItem) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry.active {
+		entry.deadline = s.clock.Now().Add(entry.queue.queue.ackWait())
+	}
+
+	return nil
+}
+
+func (s *InMemoryStorage) NakBlockedItem(_ context.Context, item *ProcessItem) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.delayEntry(entry, defaultBlockedNakTime)
+
+	return nil
+}
+
+func (s *InMemoryStorage) NakDelayedItem(_ context.Context, item *ProcessItem, delay time.Duration) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.delayEntry(entry, delay)
+
+	return nil
+}
+
+func (s *InMemoryStorage) NakItem(_ context.Context, item *ProcessItem) error {
+	entry, err := memoryItemEntry(item)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	deliveries := entry.deliveries
+	s.mu.Unlock()
+
+	s.delayEntry(entry, s.retry.Duration(deliveries))
+
+	return nil
+}
+
+func (s *InMemoryStorage) RetryTaskByID(ctx context.Context, queue *Queue, id string) error {
+	s.mu.Lock()
+	task, err := s.loadTask(id)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	task.State = TaskStateRetry
+	task.NextTryAt = nil
+	task.Result = nil
+
+	return s.EnqueueTask(ctx, queue, task)
+}
+
+// DeadLetterTask stores a copy of task in the dead letter queue dlq
+func (s *InMemoryStorage) DeadLetterTask(_ context.Context, dlq *Queue, task *Task) error {
+	item, err := json.Marshal(&ProcessItem{Kind: DeadLetterItem, JobID: task.ID, Task: task})
+	if err != nil {
+		return err
+	}
+
+	s.log.Debugf("Storing task %s in dead letter queue %s", task.ID, dlq.Name)
+
+	_, err = s.addQueueEntry(dlq.Name, task.ID, DefaultPriority, item)
+
+	return err
+}
+
+// ReplayDeadLetter enqueues a task found in the dead letter queue dlq into its original queue with its tries reset
+func (s *InMemoryStorage) ReplayDeadLetter(ctx context.Context, dlq *Queue, id string) error {
+	s.mu.Lock()
+	mq, ok := s.queues[dlq.Name]
+	if !ok {
+		s.mu.Unlock()
+		return ErrQueueNotFound
+	}
+
+	var entry *memoryQueueEntry
+	for _, e := range mq.entries {
+		if e.id == id {
+			entry = e
+			break
+		}
+	}
+	if entry == nil {
+		s.mu.Unlock()
+		return ErrTaskNotFound
+	}
+
+	item := &ProcessItem{}
+	err := json.Unmarshal(entry.data, item)
+	if err != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %v", ErrQueueItemCorrupt, err)
+	}
+	if item.Kind != DeadLetterItem || item.Task == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: not a dead letter item", ErrQueueItemInvalid)
+	}
+
+	task := item.Task
+
+	// the task might still be in the task store, when it is we need its revision to update it
+	if stored, ok := s.tasks[id]; ok {
+		task.storageOptions = &taskMeta{seq: stored.seq, state: storedMemoryTaskState(stored)}
+	}
+
+	queue := &Queue{Name: task.Queue}
+	s.mu.Unlock()
+
+	task.Tries = 0
+	task.State = TaskStateRetry
+	task.NextTryAt = nil
+	task.Result = nil
+
+	err = s.EnqueueTask(ctx, queue, task)
+	if err != nil {
+		return err
+	}
+
+	s.removeEntry(entry)
+
+	return nil
+}
+
+func storedMemoryTaskState(mt *memoryTask) TaskState {
+	t := &Task{}
+	if json.Unmarshal(mt.data, t) != nil {
+		return TaskStateUnknown
+	}
+
+	return t.State
+}
+
+func (s *InMemoryStorage) LoadTaskByID(id string) (*Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loadTask(id)
+}
+
+func (s *InMemoryStorage) DeleteTaskByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return ErrTaskNotFound
+	}
+
+	delete(s.tasks, id)
+	delete(s.results, id)
+
+	return nil
+}
+
+// sortedTasks are all stored tasks ordered by their last update
+func (s *InMemoryStorage) sortedTasks() []*Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make([]*Task, 0, len(s.tasks))
+	for id := range s.tasks {
+		task, err := s.loadTask(id)
+		if err != nil {
+			s.log.Warnf("Skipping invalid task %s: %v", id, err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].storageOptions.(*taskMeta).seq < tasks[j].storageOptions.(*taskMeta).seq
+	})
+
+	return tasks
+}
+
+func (s *InMemoryStorage) ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error) {
+	pageSize := filter.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultTaskListPageSize
+	}
+
+	tasks := s.sortedTasks()
+	estimate := uint64(len(tasks))
+
+	pager := func(ctx context.Context) ([]*Task, bool, error) {
+		if len(tasks) <= pageSize {
+			page := tasks
+			tasks = nil
+			return page, false, nil
+		}
+
+		page := tasks[:pageSize]
+		tasks = tasks[pageSize:]
+
+		return page, true, nil
+	}
+
+	return NewTaskIterator(ctx, filter, estimate, pager, nil), nil
+}
+
+func (s *InMemoryStorage) WatchTask(ctx context.Context, id string) (chan *Task, error) {
+	s.mu.Lock()
+	task, err := s.loadTask(id)
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+
+	out := make(chan *Task, 10)
+	out <- task
+
+	if task.IsFinal() {
+		s.mu.Unlock()
+		close(out)
+		return out, nil
+	}
+
+	w := &memoryTaskWatch{signal: make(chan struct{}, 1)}
+	s.taskWatchers[id] = append(s.taskWatchers[id], w)
+	s.mu.Unlock()
+
+	go func() {
+		defer close(out)
+		defer s.removeTaskWatch(id, w)
+
+		for {
+			select {
+			case <-w.signal:
+			case <-ctx.Done():
+				return
+			}
+
+			s.mu.Lock()
+			pending := w.pending
+			w.pending = nil
+			s.mu.Unlock()
+
+			for _, task := range pending {
+				select {
+				case out <- task:
+				case <-ctx.Done():
+					return
+				}
+
+				if task.IsFinal() {
+					return
+				}
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *InMemoryStorage) removeTaskWatch(id string, w *memoryTaskWatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	watchers := s.taskWatchers[id]
+	for i, e := range watchers {
+		if e == w {
+			s.taskWatchers[id] = append(watchers[:i], watchers[i+1:]...)
+			break
+		}
+	}
+
+	if len(s.taskWatchers[id]) == 0 {
+		delete(s.taskWatchers, id)
+	}
+}
+
+// PurgeTasks deletes all tasks matching filter, tasks updated after being listed are not deleted
+func (s *InMemoryStorage) PurgeTasks(ctx context.Context, filter TaskFilter, _ time.Duration) (int, error) {
+	tasks, err := s.ListTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer tasks.Close()
+
+	deleted := 0
+	for tasks.Next() {
+		task := tasks.Task()
+
+		s.mu.Lock()
+		stored, ok := s.tasks[task.ID]
+		if ok && stored.seq == task.storageOptions.(*taskMeta).seq {
+			delete(s.tasks, task.ID)
+			delete(s.results, task.ID)
+			deleted++
+		}
+		s.mu.Unlock()
+	}
+
+	return deleted, tasks.Err()
+}
+
+// PublishTaskStateChangeEvent does nothing, lifecycle events are not supported by InMemoryStorage
+func (s *InMemoryStorage) PublishTaskStateChangeEvent(_ context.Context, _ *Task) error {
+	return nil
+}
+
+func (s *InMemoryStorage) PauseQueue(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.queues[name]; !ok {
+		return ErrQueueNotFound
+	}
+
+	s.paused[name] = s.clock.Now().UTC()
+	s.notifyPauseWatchers(name, true)
+
+	return nil
+}
+
+func (s *InMemoryStorage) ResumeQueue(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.queues[name]; !ok {
+		return ErrQueueNotFound
+	}
+
+	delete(s.paused, name)
+	s.notifyPauseWatchers(name, false)
+
+	return nil
+}
+
+func (s *InMemoryStorage) notifyPauseWatchers(name string, paused bool) {
+	for _, w := range s.pauseWatchers[name] {
+		select {
+		case w <- paused:
+		default:
+		}
+	}
+}
+
+func (s *InMemoryStorage) QueuePaused(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, paused := s.paused[name]
+
+	return paused, nil
+}
+
+func (s *InMemoryStorage) QueuePausedWatch(ctx context.Context, name string) (chan bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, paused := s.paused[name]
+
+	states := make(chan bool, 10)
+	states <- paused
+	s.pauseWatchers[name] = append(s.pauseWatchers[name], states)
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		watchers := s.pauseWatchers[name]
+		for i, w := range watchers {
+			if w == states {
+				s.pauseWatchers[name] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		close(states)
+	}()
+
+	return states, nil
+}
+
+func (s *InMemoryStorage) RequestTaskCancel(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.cancelWatchers {
+		select {
+		case w <- id:
+		default:
+			s.log.Warnf("Could not deliver the cancel request for task %s to a slow watcher", id)
+		}
+	}
+
+	return nil
+}
+
+func (s *InMemoryStorage) TaskCancelRequestsWatch(ctx context.Context) (chan string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(chan string, 100)
+	s.cancelWatchers = append(s.cancelWatchers, ids)
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, w := range s.cancelWatchers {
+			if w == ids {
+				s.cancelWatchers = append(s.cancelWatchers[:i], s.cancelWatchers[i+1:]...)
+				break
+			}
+		}
+		close(ids)
+	}()
+
+	return ids, nil
+}
+
+func (s *InMemoryStorage) PrepareQueue(q *Queue, _ int, _ bool) error {
+	if q.Name == "" {
+		return ErrQueueNameRequired
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if mq, ok := s.queues[q.Name]; ok {
+		q.mu.Lock()
+		q.applyConsumerSettings(mq.queue.ackWait(), mq.queue.maxDeliver())
+		q.MaxConcurrent = mq.queue.MaxConcurrent
+		q.DiscardOld = mq.queue.DiscardOld
+		q.MaxAge = mq.queue.MaxAge
+		q.MaxEntries = mq.queue.MaxEntries
+		q.PrioritySupport = mq.queue.PrioritySupport
+		q.mu.Unlock()
+
+		return nil
+	}
+
+	if q.NoCreate {
+		return ErrQueueNotFound
+	}
+
+	if q.MaxTries == 0 {
+		q.MaxTries = -1
+	}
+	if q.MaxRunTime == 0 {
+		q.MaxRunTime = DefaultJobRunTime
+	}
+	if q.MaxConcurrent == 0 {
+		q.MaxConcurrent = DefaultQueueMaxConcurrent
+	}
+
+	err := q.validate()
+	if err != nil {
+		return err
+	}
+
+	s.queues[q.Name] = &memoryQueue{
+		queue: &Queue{
+			Name:            q.Name,
+			MaxAge:          q.MaxAge,
+			MaxEntries:      q.MaxEntries,
+			DiscardOld:      q.DiscardOld,
+			MaxTries:        q.MaxTries,
+			MaxRunTime:      q.MaxRunTime,
+			AckWait:         q.AckWait,
+			MaxRedeliveries: q.MaxRedeliveries,
+			MaxConcurrent:   q.MaxConcurrent,
+			PrioritySupport: q.PrioritySupport,
+			PriorityAging:   q.PriorityAging,
+			AbsoluteMaxAge:  q.AbsoluteMaxAge,
+		},
+	}
+
+	return nil
+}
+
+// PrepareTasks does nothing, tasks are always stored and retention is not applied
+func (s *InMemoryStorage) PrepareTasks(_ bool, _ int, _ time.Duration) error {
+	return nil
+}
+
+// PrepareConfigurationStore does nothing, configuration is always stored
+func (s *InMemoryStorage) PrepareConfigurationStore(_ bool, _ int) error {
+	return nil
+}
+
+func (s *InMemoryStorage) PrepareDeduplicationStore(_ bool, _ int, window time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dedupe == nil {
+		s.dedupe = map[string]memoryDedupeEntry{}
+		s.pending = map[string]string{}
+	}
+	s.window = window
+
+	return nil
+}
+
+func (s *InMemoryStorage) PrepareResultStore(_ bool, _ int, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.results == nil {
+		s.results = map[string][]byte{}
+	}
+
+	return nil
+}
+
+func (s *InMemoryStorage) PutTaskResult(_ context.Context, id string, r io.Reader) (*ResultObject, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.results == nil {
+		return nil, fmt.Errorf("%w: result store not initialized", ErrStorageNotReady)
+	}
+
+	s.results[id] = data
+
+	return &ResultObject{Name: id, Size: uint64(len(data)), Digest: resultDigest(data), StoredAt: s.clock.Now().UTC()}, nil
+}
+
+// resultDigest is the digest of data in the format used by the JetStream Object Store
+func resultDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "SHA-256=" + base64.URLEncoding.EncodeToString(sum[:])
+}
+
+func (s *InMemoryStorage) OpenTaskResult(_ context.Context, id string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.results == nil {
+		return nil, fmt.Errorf("%w: result store not initialized", ErrStorageNotReady)
+	}
+
+	data, ok := s.results[id]
+	if !ok {
+		return nil, ErrTaskResultNotStreamed
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *InMemoryStorage) PrepareTaskTypeLockStore(_ bool, _ int, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.typeLocks == nil {
+		s.typeLocks = map[string]*memoryTypeLock{}
+	}
+	s.lockTTL = ttl
+
+	return nil
+}
+
+// typeLock is the unexpired lock for taskType, must be called with the lock held
+func (s *InMemoryStorage) typeLock(taskType string) (*memoryTypeLock, error) {
+	if s.typeLocks == nil {
+		return nil, ErrTaskTypeLockStoreNotPrepared
+	}
+
+	lock, ok := s.typeLocks[taskType]
+	if ok && s.clock.Now().After(lock.expires) {
+		delete(s.typeLocks, taskType)
+		return nil, nil
+	}
+
+	return lock, nil
+}
+
+func (s *InMemoryStorage) AcquireTaskTypeLock(taskType string, holder string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := s.typeLock(taskType)
+	if err != nil {
+		return 0, err
+	}
+	if lock != nil {
+		return 0, fmt.Errorf("%w: %s", ErrTaskTypeLocked, taskType)
+	}
+
+	s.seq++
+	s.typeLocks[taskType] = &memoryTypeLock{holder: holder, revision: s.seq, expires: s.clock.Now().Add(s.lockTTL)}
+
+	return s.seq, nil
+}
+
+func (s *InMemoryStorage) RefreshTaskTypeLock(taskType string, holder string, revision uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := s.typeLock(taskType)
+	if err != nil {
+		return 0, err
+	}
+	if lock == nil || lock.revision != revision {
+		return 0, ErrTaskTypeLockLost
+	}
+
+	s.seq++
+	lock.holder = holder
+	lock.revision = s.seq
+	lock.expires = s.clock.Now().Add(s.lockTTL)
+
+	return s.seq, nil
+}
+
+func (s *InMemoryStorage) ReleaseTaskTypeLock(taskType string, revision uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, err := s.typeLock(taskType)
+	if err != nil {
+		return err
+	}
+	if lock == nil || lock.revision != revision {
+		return ErrTaskTypeLockLost
+	}
+
+	delete(s.typeLocks, taskType)
+
+	return nil
+}
+
+func (s *InMemoryStorage) SaveScheduledTask(st *ScheduledTask, update bool) error {
+	stj, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.scheduled[st.Name]; ok && !update {
+		return ErrScheduledTaskAlreadyExist
+	}
+
+	s.scheduled[st.Name] = stj
+	s.notifyScheduleWatchers(&ScheduleWatchEntry{Name: st.Name, Task: st})
+
+	return nil
+}
+
+func (s *InMemoryStorage) LoadScheduledTaskByName(name string) (*ScheduledTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stj, ok := s.scheduled[name]
+	if !ok {
+		return nil, ErrScheduledTaskNotFound
+	}
+
+	st := &ScheduledTask{}
+	err := json.Unmarshal(stj, st)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrScheduledTaskInvalid, err)
+	}
+
+	return st, nil
+}
+
+func (s *InMemoryStorage) DeleteScheduledTaskByName(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.scheduled, name)
+	delete(s.lastRuns, name)
+	s.notifyScheduleWatchers(&ScheduleWatchEntry{Name: name, Delete: true})
+
+	return nil
+}
+
+func (s *InMemoryStorage) ScheduledTasks(_ context.Context) ([]*ScheduledTask, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.scheduled))
+	for name := range s.scheduled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tasks []*ScheduledTask
+	for _, name := range names {
+		st := &ScheduledTask{}
+		err := json.Unmarshal(s.scheduled[name], st)
+		if err != nil {
+			s.log.Errorf("could not process stored scheduled task: %v", err)
+			continue
+		}
+
+		tasks = append(tasks, st)
+	}
+
+	return tasks, nil
+}
+
+// ScheduledTasksWatch delivers all scheduled tasks followed by a nil entry and then every change
+func (s *InMemoryStorage) ScheduledTasksWatch(ctx context.Context) (chan *ScheduleWatchEntry, error) {
+	current, err := s.ScheduledTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tasks := make(chan *ScheduleWatchEntry, 100+len(current))
+	for _, st := range current {
+		tasks <- &ScheduleWatchEntry{Name: st.Name, Task: st}
+	}
+	tasks <- nil
+
+	s.scheduleWatches = append(s.scheduleWatches, tasks)
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, w := range s.scheduleWatches {
+			if w == tasks {
+				s.scheduleWatches = append(s.scheduleWatches[:i], s.scheduleWatches[i+1:]...)
+				break
+			}
+		}
+		close(tasks)
+	}()
+
+	return tasks, nil
+}
+
+func (s *InMemoryStorage) notifyScheduleWatchers(entry *ScheduleWatchEntry) {
+	for _, w := range s.scheduleWatches {
+		select {
+		case w <- entry:
+		default:
+			s.log.Warnf("Dropping scheduled task update for %s, watcher is full", entry.Name)
+		}
+	}
+}
+
+// ScheduledTaskLastRun loads the time a scheduled task last created a task, zero time when it has never run
+func (s *InMemoryStorage) ScheduledTaskLastRun(name string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastRuns[name], nil
+}
+
+// SaveScheduledTaskLastRun records the time a scheduled task last created a task
+func (s *InMemoryStorage) SaveScheduledTaskLastRun(name string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastRuns[name] = t.UTC()
+
+	return nil
+}
+
+// QueueStats is information about every queue in the storage
+func (s *InMemoryStorage) QueueStats(_ context.Context) ([]QueueStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	stats := make([]QueueStats, 0, len(names))
+	for _, name := range names {
+		stats = append(stats, s.newQueueStats(name))
+	}
+
+	return stats, nil
+}
+
+// DescribeQueues describes every queue in the storage
+func (s *InMemoryStorage) DescribeQueues(_ context.Context) ([]QueueDescription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.queues))
+	for name := range s.queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make([]QueueDescription, 0, len(names))
+	for _, name := range names {
+		res = append(res, newQueueDescription(s.queues[name].queue, s.newQueueStats(name)))
+	}
+
+	return res, nil
+}
+
+// QueueStatsByName is information about the queue name
+func (s *InMemoryStorage) QueueStatsByName(_ context.Context, name string) (QueueStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.queues[name]; !ok {
+		return QueueStats{}, ErrQueueNotFound
+	}
+
+	return s.newQueueStats(name), nil
+}
+
+func (s *InMemoryStorage) newQueueStats(name string) QueueStats {
+	mq := s.queues[name]
+	now := s.clock.Now()
+	mq.expire(now)
+
+	_, paused := s.paused[name]
+	qs := QueueStats{Name: name, Depth: uint64(len(mq.entries)), Paused: paused}
+	for i, e := range mq.entries {
+		if i == 0 {
+			qs.OldestItemAge = now.Sub(e.created)
+		}
+		if e.active {
+			qs.InFlight++
+			continue
+		}
+
+		qs.Pending++
+		if age := now.Sub(e.created); age > qs.OldestPendingAge {
+			qs.OldestPendingAge = age
+		}
+	}
+
+	return qs
+}
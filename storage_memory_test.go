@@ -0,0 +1,780 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// wrappedStorage is a Storage built using only the exported API, it hands out its own items wrapping those of the
+// in-memory storage
+type wrappedStorage struct {
+	*InMemoryStorage
+	polled atomic.Int32
+}
+
+func (s *wrappedStorage) PollQueue(ctx context.Context, q *Queue) (*ProcessItem, error) {
+	inner, err := s.InMemoryStorage.PollQueue(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	s.polled.Add(1)
+
+	item := &ProcessItem{Kind: inner.Kind, JobID: inner.JobID, Task: inner.Task}
+	item.SetStorageMeta(inner)
+	item.SetPending(1)
+
+	return item, nil
+}
+
+func (s *wrappedStorage) inner(item *ProcessItem) *ProcessItem {
+	inner, ok := item.StorageMeta().(*ProcessItem)
+	if !ok {
+		return item
+	}
+	return inner
+}
+
+func (s *wrappedStorage) AckItem(ctx context.Context, item *ProcessItem) error {
+	return s.InMemoryStorage.AckItem(ctx, s.inner(item))
+}
+
+func (s *wrappedStorage) InProgressItem(ctx context.Context, item *ProcessItem) error {
+	return s.InMemoryStorage.InProgressItem(ctx, s.inner(item))
+}
+
+func (s *wrappedStorage) NakBlockedItem(ctx context.Context, item *ProcessItem) error {
+	return s.InMemoryStorage.NakBlockedItem(ctx, s.inner(item))
+}
+
+func (s *wrappedStorage) NakItem(ctx context.Context, item *ProcessItem) error {
+	return s.InMemoryStorage.NakItem(ctx, s.inner(item))
+}
+
+func (s *wrappedStorage) NakDelayedItem(ctx context.Context, item *ProcessItem, delay time.Duration) error {
+	return s.InMemoryStorage.NakDelayedItem(ctx, s.inner(item), delay)
+}
+
+func (s *wrappedStorage) TerminateItem(ctx context.Context, item *ProcessItem) error {
+	return s.InMemoryStorage.TerminateItem(ctx, s.inner(item))
+}
+
+func (s *wrappedStorage) ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error) {
+	var tasks []*Task
+	all, err := s.InMemoryStorage.ListTasks(ctx, TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+	for all.Next() {
+		tasks = append(tasks, all.Task())
+	}
+	all.Close()
+
+	pager := func(_ context.Context) ([]*Task, bool, error) {
+		if len(tasks) == 0 {
+			return nil, false, nil
+		}
+		page := tasks[:1]
+		tasks = tasks[1:]
+		return page, len(tasks) > 0, nil
+	}
+
+	return NewTaskIterator(ctx, filter, uint64(len(tasks)), pager, nil), nil
+}
+
+// standaloneStorage is a Storage that keeps its own tasks and queue entries using only the exported API, it supports
+// deduplication of pending tasks but none of the other optional features
+type standaloneStorage struct {
+	tasks    map[string]standaloneTask
+	pending  map[string]string
+	revision uint64
+	entries  chan *ProcessItem
+	handler  func(task *Task, previous TaskState)
+	batches  atomic.Int32
+
+	mu sync.Mutex
+}
+
+type standaloneTask struct {
+	revision uint64
+	data     []byte
+}
+
+func newStandaloneStorage() *standaloneStorage {
+	return &standaloneStorage{tasks: map[string]standaloneTask{}, pending: map[string]string{}, entries: make(chan *ProcessItem, 100)}
+}
+
+func (s *standaloneStorage) SetTaskStateChangeHandler(handler func(task *Task, previous TaskState)) {
+	s.handler = handler
+}
+
+func (s *standaloneStorage) SaveTaskState(_ context.Context, task *Task, _ bool) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	stored, ok := s.tasks[task.ID]
+	switch {
+	case task.Revision() == 0 && ok && !task.ReplaceExisting():
+		s.mu.Unlock()
+		return ErrTaskAlreadyExists
+	case task.Revision() != 0 && task.Revision() != stored.revision:
+		s.mu.Unlock()
+		return ErrConflict
+	}
+	s.revision++
+	revision := s.revision
+	s.tasks[task.ID] = standaloneTask{revision: revision, data: data}
+	s.mu.Unlock()
+
+	previous := task.StoredState()
+	task.SetRevision(revision, task.State)
+	if s.handler != nil && previous != task.State {
+		s.handler(task, previous)
+	}
+
+	return nil
+}
+
+func (s *standaloneStorage) LoadTaskByID(id string) (*Task, error) {
+	s.mu.Lock()
+	stored, ok := s.tasks[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+
+	task := &Task{}
+	err := json.Unmarshal(stored.data, task)
+	if err != nil {
+		return nil, err
+	}
+	task.SetRevision(stored.revision, task.State)
+
+	return task, nil
+}
+
+func (s *standaloneStorage) ListTasks(ctx context.Context, filter TaskFilter) (*TaskIterator, error) {
+	s.mu.Lock()
+	ids := make([]string, 0, len(s.tasks))
+	for id := range s.tasks {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	pager := func(_ context.Context) ([]*Task, bool, error) {
+		var tasks []*Task
+		for _, id := range ids {
+			task, err := s.LoadTaskByID(id)
+			if err != nil {
+				return nil, false, err
+			}
+			tasks = append(tasks, task)
+		}
+		return tasks, false, nil
+	}
+
+	return NewTaskIterator(ctx, filter, uint64(len(ids)), pager, nil), nil
+}
+
+func (s *standaloneStorage) EnqueueTask(ctx context.Context, queue *Queue, task *Task) error {
+	if task.MatchPending() {
+		s.mu.Lock()
+		holder, ok := s.pending[task.DeduplicationKey]
+		s.mu.Unlock()
+		if ok {
+			pending, err := s.LoadTaskByID(holder)
+			if err == nil && !pending.IsFinal() {
+				return &DuplicateTaskError{TaskID: holder}
+			}
+		}
+	}
+
+	task.Queue = queue.Name
+	err := s.SaveTaskState(ctx, task, false)
+	if err != nil {
+		return err
+	}
+
+	if task.MatchPending() {
+		s.mu.Lock()
+		s.pending[task.DeduplicationKey] = task.ID
+		s.mu.Unlock()
+	}
+
+	s.entries <- &ProcessItem{Kind: TaskItem, JobID: task.ID}
+
+	return nil
+}
+
+func (s *standaloneStorage) RetryTaskByID(ctx context.Context, queue *Queue, id string) error {
+	task, err := s.LoadTaskByID(id)
+	if err != nil {
+		return err
+	}
+
+	task.State = TaskStateRetry
+	err = s.SaveTaskState(ctx, task, false)
+	if err != nil {
+		return err
+	}
+
+	s.entries <- &ProcessItem{Kind: TaskItem, JobID: task.ID}
+
+	return nil
+}
+
+func (s *standaloneStorage) DeleteTaskByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tasks[id]; !ok {
+		return ErrTaskNotFound
+	}
+	delete(s.tasks, id)
+
+	return nil
+}
+
+func (s *standaloneStorage) WatchTask(ctx context.Context, id string) (chan *Task, error) {
+	task, err := s.LoadTaskByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := make(chan *Task, 1)
+	tasks <- task
+	close(tasks)
+
+	return tasks, nil
+}
+
+func (s *standaloneStorage) PurgeTasks(ctx context.Context, filter TaskFilter, _ time.Duration) (int, error) {
+	tasks, err := s.ListTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for tasks.Next() {
+		err = s.DeleteTaskByID(tasks.Task().ID)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, tasks.Err()
+}
+
+func (s *standaloneStorage) PollQueue(ctx context.Context, _ *Queue) (*ProcessItem, error) {
+	select {
+	case item := <-s.entries:
+		return item, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *standaloneStorage) PollQueueBatch(ctx context.Context, q *Queue, max int) ([]*ProcessItem, error) {
+	item, err := s.PollQueue(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	s.batches.Add(1)
+
+	items := []*ProcessItem{item}
+	for len(items) < max {
+		select {
+		case item := <-s.entries:
+			items = append(items, item)
+		default:
+			return items, nil
+		}
+	}
+
+	return items, nil
+}
+
+func (s *standaloneStorage) QueueStats(ctx context.Context) ([]QueueStats, error) {
+	stats, err := s.QueueStatsByName(ctx, "DEFAULT")
+	return []QueueStats{stats}, err
+}
+
+func (s *standaloneStorage) QueueStatsByName(_ context.Context, name string) (QueueStats, error) {
+	if name != "DEFAULT" {
+		return QueueStats{}, ErrQueueNotFound
+	}
+
+	return QueueStats{Name: name, Pending: uint64(len(s.entries))}, nil
+}
+
+func (s *standaloneStorage) DescribeQueues(_ context.Context) ([]QueueDescription, error) {
+	return []QueueDescription{{Name: "DEFAULT", Depth: uint64(len(s.entries))}}, nil
+}
+
+func (s *standaloneStorage) requeue(item *ProcessItem, delay time.Duration) {
+	time.AfterFunc(delay, func() { s.entries <- item })
+}
+
+func (s *standaloneStorage) AckItem(_ context.Context, _ *ProcessItem) error        { return nil }
+func (s *standaloneStorage) InProgressItem(_ context.Context, _ *ProcessItem) error { return nil }
+func (s *standaloneStorage) TerminateItem(_ context.Context, _ *ProcessItem) error  { return nil }
+
+func (s *standaloneStorage) NakItem(_ context.Context, item *ProcessItem) error {
+	s.requeue(item, 10*time.Millisecond)
+	return nil
+}
+
+func (s *standaloneStorage) NakBlockedItem(_ context.Context, item *ProcessItem) error {
+	s.requeue(item, 10*time.Millisecond)
+	return nil
+}
+
+func (s *standaloneStorage) NakDelayedItem(_ context.Context, item *ProcessItem, delay time.Duration) error {
+	s.requeue(item, delay)
+	return nil
+}
+
+func (s *standaloneStorage) PublishTaskStateChangeEvent(_ context.Context, _ *Task) error { return nil }
+func (s *standaloneStorage) PrepareQueue(_ *Queue, _ int, _ bool) error                   { return nil }
+func (s *standaloneStorage) PrepareTasks(_ bool, _ int, _ time.Duration) error            { return nil }
+func (s *standaloneStorage) PrepareDeduplicationStore(_ bool, _ int, _ time.Duration) error {
+	return nil
+}
+
+var _ = Describe("InMemoryStorage", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+		log.SetOutput(GinkgoWriter)
+	})
+
+	AfterEach(func() { cancel() })
+
+	newClient := func(opts ...ClientOpt) (*Client, *InMemoryStorage) {
+		storage := NewInMemoryStorage()
+		client, err := NewClient(append([]ClientOpt{StorageBackend(storage), RetryBackoffPolicy(retryForTesting)}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+
+		return client, storage
+	}
+
+	It("Should store and load tasks", func() {
+		client, _ := newClient()
+
+		task, err := NewTask("ginkgo", "test", TaskID("order:1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		loaded, err := client.LoadTaskByID("order:1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Payload).To(MatchJSON(`"test"`))
+		Expect(loaded.State).To(Equal(TaskStateNew))
+		Expect(loaded.Queue).To(Equal("DEFAULT"))
+
+		task, err = NewTask("ginkgo", "test", TaskID("order:1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(MatchError(ErrTaskAlreadyExists))
+
+		// stale updates are rejected
+		loaded.State = TaskStateActive
+		Expect(client.storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+		stale, err := client.LoadTaskByID("order:1")
+		Expect(err).ToNot(HaveOccurred())
+		loaded.State = TaskStateCompleted
+		Expect(client.storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+		Expect(client.storage.SaveTaskState(ctx, stale, false)).To(MatchError(ErrConflict))
+
+		_, err = client.LoadTaskByID("unknown")
+		Expect(err).To(MatchError(ErrTaskNotFound))
+
+		stats, err := client.Stats(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Queues).To(HaveLen(1))
+		Expect(stats.Queues[0].Depth).To(Equal(uint64(1)))
+		Expect(stats.TaskStates).To(Equal(map[TaskState]uint64{TaskStateCompleted: 1}))
+	})
+
+	It("Should process tasks using the router", func() {
+		client, _ := newClient(DiscardTaskStates(TaskStateCompleted))
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+			if string(t.Payload) == `"terminate"` {
+				return nil, ErrTerminateTask
+			}
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", "terminate")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		discarded, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, discarded)).To(Succeed())
+
+		Eventually(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateTerminated))
+		Expect(task.Tries).To(Equal(2))
+
+		Eventually(func() error {
+			_, err := client.LoadTaskByID(discarded.ID)
+			return err
+		}).Should(MatchError(ErrTaskNotFound))
+
+		stats, err := client.Stats(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Processed).To(Equal(uint64(1)))
+		Expect(stats.Failed).To(Equal(uint64(1)))
+		Expect(stats.Queues[0].Depth).To(Equal(uint64(0)))
+	})
+
+	It("Should enforce queue limits", func() {
+		client, storage := newClient(WorkQueue(&Queue{Name: "LIMITED", MaxEntries: 1, MaxTries: 2}))
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		full, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, full)).To(MatchError("queue LIMITED is full"))
+		Expect(full.State).To(Equal(TaskStateQueueError))
+
+		q := client.opts.queue
+		for i := 0; i < 2; i++ {
+			pctx, pcancel := context.WithTimeout(ctx, time.Second)
+			item, err := storage.PollQueue(pctx, q)
+			pcancel()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(item.JobID).To(Equal(task.ID))
+			Expect(storage.NakDelayedItem(ctx, item, 0)).To(Succeed())
+		}
+
+		// MaxTries deliveries were made
+		pctx, pcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer pcancel()
+		_, err = storage.PollQueue(pctx, q)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+	})
+
+	It("Should deliver aged lower priority tasks first", func() {
+		client, storage := newClient(WorkQueue(&Queue{Name: "AGING", PrioritySupport: true, PriorityAging: 20 * time.Millisecond}))
+
+		low, err := NewTask("ginkgo", nil, TaskPriority(1))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, low)).To(Succeed())
+		time.Sleep(200 * time.Millisecond)
+		high, err := NewTask("ginkgo", nil, TaskPriority(9))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, high)).To(Succeed())
+
+		for _, id := range []string{low.ID, high.ID} {
+			item, err := storage.PollQueue(ctx, client.opts.queue)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(item.JobID).To(Equal(id))
+			Expect(storage.AckItem(ctx, item)).To(Succeed())
+		}
+	})
+
+	It("Should share MaxConcurrent between the priority levels", func() {
+		client, storage := newClient(WorkQueue(&Queue{Name: "SHARED", PrioritySupport: true, MaxConcurrent: 2}))
+
+		var ids []string
+		for _, p := range []int{9, 9, 1} {
+			task, err := NewTask("ginkgo", nil, TaskPriority(p))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+			ids = append(ids, task.ID)
+		}
+
+		// a single level can use all of the limit
+		var items []*ProcessItem
+		for _, id := range ids[:2] {
+			item, err := storage.PollQueue(ctx, client.opts.queue)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(item.JobID).To(Equal(id))
+			items = append(items, item)
+		}
+
+		pctx, pcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer pcancel()
+		_, err := storage.PollQueue(pctx, client.opts.queue)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		Expect(storage.AckItem(ctx, items[0])).To(Succeed())
+		item, err := storage.PollQueue(ctx, client.opts.queue)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(item.JobID).To(Equal(ids[2]))
+	})
+
+	It("Should reclaim expired task type locks", func() {
+		_, storage := newClient()
+
+		Expect(storage.PrepareTaskTypeLockStore(false, 1, 50*time.Millisecond)).To(Succeed())
+		rev, err := storage.AcquireTaskTypeLock("cache:rebuild", "1")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = storage.AcquireTaskTypeLock("cache:rebuild", "2")
+		Expect(err).To(MatchError(ErrTaskTypeLocked))
+
+		rev, err = storage.RefreshTaskTypeLock("cache:rebuild", "1", rev)
+		Expect(err).ToNot(HaveOccurred())
+
+		// the holder stopped refreshing
+		time.Sleep(100 * time.Millisecond)
+		_, err = storage.RefreshTaskTypeLock("cache:rebuild", "1", rev)
+		Expect(err).To(MatchError(ErrTaskTypeLockLost))
+		_, err = storage.AcquireTaskTypeLock("cache:rebuild", "2")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("Should expire tasks discarded from full queues", func() {
+		client, _ := newClient(WorkQueue(&Queue{Name: "LIMITED", MaxEntries: 1, DiscardOld: true}))
+
+		oldest, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, oldest)).To(Succeed())
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		oldest, err = client.LoadTaskByID(oldest.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(oldest.State).To(Equal(TaskStateExpired))
+		Expect(oldest.LastErr).To(Equal("discarded from full queue LIMITED"))
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.State).To(Equal(TaskStateNew))
+	})
+
+	It("Should support watching and waiting for tasks", func() {
+		client, _ := newClient()
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return map[string]string{"hello": "world"}, nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`{"hello":"world"}`))
+
+		watch, err := client.WatchTask(ctx, task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect((<-watch).State).To(Equal(TaskStateCompleted))
+		Eventually(watch).Should(BeClosed())
+	})
+
+	It("Should pause and resume queues", func() {
+		client, storage := newClient()
+
+		Expect(client.PauseQueue(ctx, "UNKNOWN")).To(MatchError(ErrQueueNotFound))
+		Expect(client.PauseQueue(ctx, "DEFAULT")).To(Succeed())
+		paused, err := storage.QueuePaused("DEFAULT")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(paused).To(BeTrue())
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Consistently(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}, 200*time.Millisecond).Should(Equal(TaskStateNew))
+
+		Expect(client.ResumeQueue(ctx, "DEFAULT")).To(Succeed())
+
+		Eventually(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateCompleted))
+	})
+
+	It("Should support storage implemented outside the package", func() {
+		storage := &wrappedStorage{InMemoryStorage: NewInMemoryStorage()}
+		client, err := NewClient(StorageBackend(storage), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+			return "done", nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`"done"`))
+		Expect(storage.polled.Load()).To(Equal(int32(2)))
+
+		other, err := NewTask("other", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, other)).To(Succeed())
+
+		tasks, err := client.ListTasks(ctx, TaskFilter{States: []TaskState{TaskStateCompleted}})
+		Expect(err).ToNot(HaveOccurred())
+		defer tasks.Close()
+
+		var found []string
+		for tasks.Next() {
+			found = append(found, tasks.Task().ID)
+		}
+		Expect(tasks.Err()).ToNot(HaveOccurred())
+		Expect(found).To(Equal([]string{task.ID}))
+	})
+
+	It("Should support storage that keeps its own tasks", func() {
+		storage := newStandaloneStorage()
+		client, err := NewClient(StorageBackend(storage), RetryBackoffPolicy(retryForTesting), ClientConcurrency(4), FetchBatchSize(4), DedupWindow(time.Hour))
+		Expect(err).ToNot(HaveOccurred())
+		events := client.Events()
+
+		// optional features the storage does not implement fail rather than panic
+		_, err = NewClient(StorageBackend(newStandaloneStorage()), DeadLetterQueue("DLQ"))
+		Expect(err).To(MatchError(ErrStorageNotReady))
+		Expect(client.PauseQueue(ctx, "DEFAULT")).To(MatchError(ErrStorageNotReady))
+		_, err = client.LoadScheduledTaskByName("daily")
+		Expect(err).To(MatchError(ErrStorageNotReady))
+		Expect(client.RequestCancel(ctx, "x")).To(MatchError(ErrStorageNotReady))
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+			return "done", nil
+		})
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		// stale saves are detected using the revision set by the storage
+		loaded, err := client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(loaded.Revision()).To(Equal(task.Revision()))
+		Expect(loaded.StoredState()).To(Equal(TaskStateNew))
+		Expect(client.storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+		Expect(client.storage.SaveTaskState(ctx, task, false)).To(MatchError(ErrConflict))
+
+		// tasks are replaced and matched against pending tasks using the exported accessors
+		replaced, err := NewTask("ginkgo", nil, TaskID("replaced"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.storage.SaveTaskState(ctx, replaced, false)).To(Succeed())
+		replacement, err := NewTask("ginkgo", nil, TaskID("replaced"), TaskReplaceExisting())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(replacement.ReplaceExisting()).To(BeTrue())
+		Expect(client.EnqueueTask(ctx, replacement)).To(Succeed())
+
+		pending, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		id, enqueued, err := client.EnqueueIfNotPending(ctx, pending, "key")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(enqueued).To(BeTrue())
+		Expect(pending.MatchPending()).To(BeTrue())
+		duplicate, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		dupeID, enqueued, err := client.EnqueueIfNotPending(ctx, duplicate, "key")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(enqueued).To(BeFalse())
+		Expect(dupeID).To(Equal(id))
+
+		stats, err := client.QueueStats(ctx, "DEFAULT")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.Pending).To(Equal(uint64(3)))
+		queues, err := client.Queues(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(queues).To(HaveLen(1))
+		cstats, err := client.Stats(ctx)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cstats.Queues).To(HaveLen(1))
+
+		go client.Run(ctx, router)
+
+		Eventually(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateCompleted))
+		Expect(task.Tries).To(Equal(2))
+		Expect(task.Result.Payload).To(Equal("done"))
+		Expect(storage.batches.Load()).To(BeNumerically(">=", 2))
+
+		var transitions []string
+		Eventually(func() []string {
+			for {
+				select {
+				case e := <-events:
+					transitions = append(transitions, fmt.Sprintf("%s:%s", e.PreviousState, e.State))
+				default:
+					return transitions
+				}
+			}
+		}).Should(ContainElement(fmt.Sprintf("%s:%s", TaskStateActive, TaskStateCompleted)))
+		Expect(transitions[0]).To(Equal(fmt.Sprintf("%s:%s", TaskStateUnknown, TaskStateNew)))
+	})
+
+	It("Should store scheduled tasks", func() {
+		client, _ := newClient()
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.NewScheduledTask("daily", "@daily", "DEFAULT", task)).To(Succeed())
+		Expect(client.NewScheduledTask("daily", "@daily", "DEFAULT", task)).To(MatchError(ErrScheduledTaskAlreadyExist))
+
+		st, err := client.LoadScheduledTaskByName("daily")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(st.Schedule).To(Equal("@daily"))
+
+		Expect(client.RemoveScheduledTask("daily")).To(Succeed())
+		_, err = client.LoadScheduledTaskByName("daily")
+		Expect(err).To(MatchError(ErrScheduledTaskNotFound))
+
+		Expect(client.StorageAdmin()).To(BeNil())
+		Expect(client.ScheduledTasksStorage()).To(BeNil())
+	})
+})
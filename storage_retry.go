@@ -0,0 +1,63 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/jsm.go/api"
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/ksuid"
+)
+
+// DefaultStorageRetryPolicy is the backoff between storage retries when StorageRetries() is used without a policy
+var DefaultStorageRetryPolicy = NewExponentialBackoffPolicy(100*time.Millisecond, 2*time.Second, 2, 0.5)
+
+// isRetryableStorageError determines if a request to JetStream failed for a reason that might go away by itself, like
+// a timeout or a temporarily unavailable stream, rather than a problem with the request
+func isRetryableStorageError(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, nats.ErrTimeout), errors.Is(err, nats.ErrNoResponders), errors.Is(err, nats.ErrConnectionReconnecting):
+		return true
+	case jsm.IsNatsError(err, 10008): // JetStream system temporarily unavailable
+		return true
+	}
+
+	return false
+}
+
+// request publishes msg to a stream, retrying transient failures as configured using StorageRetries(). When retries
+// are enabled msgs get a message ID so a retry of a message that was stored before its acknowledgement was lost is
+// recognised as a duplicate, retried is true for those
+func (s *jetStreamStorage) request(ctx context.Context, msg *nats.Msg) (resp *nats.Msg, retried bool, err error) {
+	if s.requestRetries > 0 && msg.Header.Get(api.JSMsgId) == "" {
+		msg.Header.Set(api.JSMsgId, ksuid.New().String())
+	}
+
+	for try := 0; ; try++ {
+		resp, err = s.nc.RequestMsgWithContext(ctx, msg)
+		cause := err
+		if err == nil {
+			_, cause = jsm.ParsePubAck(resp)
+		}
+
+		if try >= s.requestRetries || ctx.Err() != nil || !isRetryableStorageError(cause) {
+			return resp, try > 0, err
+		}
+
+		storageRetryCounter.WithLabelValues().Inc()
+		s.log.Warnf("Retrying storage request to %s after try %d failed: %v", msg.Subject, try+1, cause)
+
+		serr := sleep(ctx, s.clock, s.requestRetryPolicy.Duration(try+1))
+		if serr != nil {
+			return nil, try > 0, serr
+		}
+	}
+}
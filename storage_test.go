@@ -277,6 +277,68 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("PrepareDeduplicationStore", func() {
+		It("Should create the deduplication store correctly", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				err = storage.PrepareDeduplicationStore(true, 1, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+
+				kvs, err := storage.dedupe.Status()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(kvs.Bucket()).To(Equal(DeduplicationBucketName))
+				Expect(kvs.TTL()).To(Equal(time.Minute))
+				Expect(kvs.(*nats.KeyValueBucketStatus).StreamInfo().Config.Storage).To(Equal(nats.MemoryStorage))
+
+				kvs, err = storage.pending.Status()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(kvs.Bucket()).To(Equal(PendingClaimsBucketName))
+				Expect(kvs.TTL()).To(Equal(time.Duration(0)))
+			})
+		})
+	})
+
+	Describe("TaskTypeLocks", func() {
+		It("Should allow one holder per task type", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = storage.AcquireTaskTypeLock("cache:rebuild", "1")
+				Expect(err).To(MatchError(ErrTaskTypeLockStoreNotPrepared))
+
+				Expect(storage.PrepareTaskTypeLockStore(true, 1, time.Minute)).To(Succeed())
+				kvs, err := storage.typeLocks.Status()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(kvs.Bucket()).To(Equal(TaskTypeLockBucketName))
+				Expect(kvs.TTL()).To(Equal(time.Minute))
+
+				rev, err := storage.AcquireTaskTypeLock("cache:rebuild", "1")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = storage.AcquireTaskTypeLock("cache:rebuild", "2")
+				Expect(err).To(MatchError(ErrTaskTypeLocked))
+				_, err = storage.AcquireTaskTypeLock("cache:flush", "2")
+				Expect(err).ToNot(HaveOccurred())
+
+				entry, err := storage.typeLocks.Get("cache.rebuild")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(entry.Value()).To(Equal([]byte("1")))
+
+				newRev, err := storage.RefreshTaskTypeLock("cache:rebuild", "1", rev)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = storage.RefreshTaskTypeLock("cache:rebuild", "1", rev)
+				Expect(err).To(MatchError(ErrTaskTypeLockLost))
+				Expect(storage.ReleaseTaskTypeLock("cache:rebuild", rev)).To(MatchError(ErrTaskTypeLockLost))
+				Expect(storage.ReleaseTaskTypeLock("cache:rebuild", newRev)).To(Succeed())
+
+				_, err = storage.AcquireTaskTypeLock("cache:rebuild", "2")
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+
 	Describe("PrepareTasks", func() {
 		It("Should support memory", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -353,6 +415,43 @@ var _ = Describe("Storage", func() {
 				Expect(t.storageOptions).ToNot(BeNil())
 			})
 		})
+
+		It("Should store metadata in headers", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).To(Succeed())
+
+				task, err := NewTask("ginkgo", "test", TaskMeta(map[string]string{"correlation-id": "abc", "route_hint": "eu"}))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+				msg, err := storage.tasks.stream.ReadLastMessageForSubject(fmt.Sprintf(TasksStreamSubjectPattern, task.ID))
+				Expect(err).ToNot(HaveOccurred())
+				hdrs, err := decodeHeadersMsg(msg.Header)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(hdrs.Get("AJ-Meta-correlation-id")).To(Equal("abc"))
+				Expect(string(msg.Data)).ToNot(ContainSubstring("correlation"))
+
+				loaded, err := storage.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Meta).To(Equal(map[string]string{"correlation-id": "abc", "route_hint": "eu"}))
+
+				loaded.State = TaskStateRetry
+				loaded.Tries = 1
+				Expect(storage.SaveTaskState(ctx, loaded, false)).To(Succeed())
+
+				tasks, err := storage.ListTasks(ctx, TaskFilter{})
+				Expect(err).ToNot(HaveOccurred())
+				defer tasks.Close()
+				Expect(tasks.Next()).To(BeTrue())
+				Expect(tasks.Task().Tries).To(Equal(1))
+				Expect(tasks.Task().Meta).To(Equal(loaded.Meta))
+			})
+		})
 	})
 
 	Describe("PrepareQueue", func() {
@@ -458,6 +557,65 @@ var _ = Describe("Storage", func() {
 
 				consumer := storage.qConsumers[q.Name]
 				Expect(consumer.MaxDeliver()).To(Equal(111))
+
+				joined := &Queue{Name: q.Name, NoCreate: true}
+				Expect(storage.PrepareQueue(joined, 1, true)).To(Succeed())
+				Expect(joined.MaxTries).To(Equal(111))
+			})
+		})
+
+		It("Should support ack wait and max redeliveries", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.MaxRunTime = time.Minute
+				q.AckWait = time.Hour
+				q.MaxTries = 10
+				q.MaxRedeliveries = 20
+				err := storage.PrepareQueue(q, 1, true)
+				Expect(err).ToNot(HaveOccurred())
+
+				consumer := storage.qConsumers[q.Name]
+				Expect(consumer.AckWait()).To(Equal(time.Hour))
+				Expect(consumer.MaxDeliver()).To(Equal(21))
+				Expect(q.MaxRunTime).To(Equal(time.Minute))
+				Expect(q.MaxTries).To(Equal(10))
+
+				joined := &Queue{Name: q.Name, NoCreate: true}
+				Expect(storage.PrepareQueue(joined, 1, true)).To(Succeed())
+				Expect(joined.AckWait).To(Equal(time.Hour))
+				Expect(joined.MaxRedeliveries).To(Equal(20))
+			})
+		})
+
+		It("Should reject conflicting redelivery settings", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.MaxRunTime = time.Hour
+				q.AckWait = time.Minute
+				err := storage.PrepareQueue(q, 1, true)
+				Expect(err).To(MatchError("invalid queue settings: queue ginkgo ack wait 1m0s is shorter than the max run time 1h0m0s"))
+				Expect(err).To(MatchError(ErrQueueInvalidSettings))
+
+				q.AckWait = 0
+				q.MaxTries = 10
+				q.MaxRedeliveries = 5
+				err = storage.PrepareQueue(q, 1, true)
+				Expect(err).To(MatchError("invalid queue settings: queue ginkgo allows 5 redeliveries which is fewer than required for 10 max tries"))
+				Expect(storage.qConsumers).ToNot(HaveKey(q.Name))
+			})
+		})
+
+		It("Should support duplicate windows", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.MaxAge = time.Minute
+				q.DuplicateWindow = time.Hour
+				Expect(storage.PrepareQueue(q, 1, true)).To(MatchError("invalid queue settings: queue ginkgo duplicate window 1h0m0s is longer than the max age 1m0s"))
+
+				q.DuplicateWindow = 30 * time.Second
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+				Expect(storage.qStreams[q.Name].DuplicateWindow()).To(Equal(30 * time.Second))
+
+				joined := &Queue{Name: q.Name, NoCreate: true}
+				Expect(storage.PrepareQueue(joined, 1, true)).To(Succeed())
+				Expect(joined.DuplicateWindow).To(Equal(30 * time.Second))
 			})
 		})
 
@@ -480,6 +638,49 @@ var _ = Describe("Storage", func() {
 			})
 		})
 
+		It("Should support choosing the storage per queue", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.Storage = "disk"
+				Expect(storage.PrepareQueue(q, 1, false)).To(MatchError(`invalid queue settings: queue ginkgo storage "disk" is not one of "file" or "memory"`))
+
+				q.Storage = QueueStorageMemory
+				Expect(storage.PrepareQueue(q, 1, false)).To(Succeed())
+				Expect(storage.qStreams[q.Name].Storage()).To(Equal(api.MemoryStorage))
+
+				Expect(storage.PrepareQueue(&Queue{Name: q.Name}, 1, false)).To(Succeed())
+				Expect(storage.PrepareQueue(&Queue{Name: q.Name, Storage: QueueStorageFile}, 1, false)).To(MatchError(ErrQueueSettingImmutable))
+				Expect(storage.UpdateWorkQueue(&Queue{Name: q.Name, Storage: QueueStorageFile})).To(MatchError(ErrQueueSettingImmutable))
+
+				jq := &Queue{Name: q.Name, NoCreate: true}
+				Expect(storage.PrepareQueue(jq, 1, false)).To(Succeed())
+				Expect(jq.Storage).To(Equal(QueueStorageMemory))
+
+				fq := &Queue{Name: "FILE"}
+				Expect(storage.PrepareQueue(fq, 1, false)).To(Succeed())
+				Expect(fq.Storage).To(Equal(QueueStorageFile))
+				Expect(storage.qStreams[fq.Name].Storage()).To(Equal(api.FileStorage))
+			})
+		})
+
+		It("Should create priority consumers", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.PrioritySupport = true
+				err := storage.PrepareQueue(q, 1, true)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(storage.qConsumers[q.Name].FilterSubject()).To(Equal(fmt.Sprintf(WorkStreamSubjectPattern, q.Name, "*")))
+				Expect(storage.qPriority[q.Name]).To(HaveLen(MaxPriority + 1))
+				Expect(storage.qPriority[q.Name][DefaultPriority].Name()).To(Equal(WorkStreamConsumerName))
+				Expect(storage.qPriority[q.Name][9].Name()).To(Equal("WORKERS_P9"))
+				Expect(storage.qPriority[q.Name][9].FilterSubject()).To(Equal(fmt.Sprintf(WorkStreamPrioritySubjectPattern, q.Name, 9, "*")))
+
+				jq := &Queue{Name: q.Name, NoCreate: true}
+				Expect(storage.PrepareQueue(jq, 1, true)).ToNot(HaveOccurred())
+				Expect(jq.PrioritySupport).To(BeTrue())
+				Expect(storage.qPriority[q.Name]).To(HaveLen(MaxPriority + 1))
+			})
+		})
+
 		It("Should support joining an existing queue", func() {
 			prepare(func(storage *jetStreamStorage, q *Queue) {
 				q.NoCreate = true
@@ -496,6 +697,71 @@ var _ = Describe("Storage", func() {
 				Expect(err).To(Equal(ErrQueueConsumerNotFound))
 			})
 		})
+
+		It("Should support naming consumers", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.ConsumerName = "EMAIL.WORKERS"
+				Expect(storage.PrepareQueue(q, 1, true)).To(MatchError(ErrQueueInvalidSettings))
+
+				q.ConsumerName = "EMAIL_WORKERS"
+				q.PrioritySupport = true
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+				Expect(storage.qConsumers[q.Name].DurableName()).To(Equal("EMAIL_WORKERS"))
+				Expect(storage.qPriority[q.Name][9].DurableName()).To(Equal("EMAIL_WORKERS_P9"))
+
+				jq := &Queue{Name: q.Name, NoCreate: true, ConsumerName: "EMAIL_WORKERS"}
+				Expect(storage.PrepareQueue(jq, 1, true)).To(Succeed())
+				Expect(jq.PrioritySupport).To(BeTrue())
+				Expect(storage.PrepareQueue(&Queue{Name: q.Name, NoCreate: true}, 1, true)).To(MatchError(ErrQueueConsumerNotFound))
+
+				nfo, err := storage.QueueInfo(q.Name)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Consumer.Name).To(Equal("EMAIL_WORKERS"))
+
+				queues, err := storage.ListWorkQueues()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(queues).To(HaveLen(1))
+				Expect(queues[0].ConsumerName).To(Equal("EMAIL_WORKERS"))
+
+				uq := &Queue{Name: q.Name, PrioritySupport: true, MaxConcurrent: 20}
+				Expect(storage.UpdateWorkQueue(uq)).To(Succeed())
+				Expect(uq.ConsumerName).To(Equal("EMAIL_WORKERS"))
+				Expect(uq.MaxConcurrent).To(Equal(20))
+				Expect(storage.qPriority[q.Name][9].MaxAckPending()).To(Equal(20))
+			})
+		})
+
+		It("Should support ephemeral consumers", func() {
+			prepare(func(storage *jetStreamStorage, q *Queue) {
+				q.EphemeralConsumer = true
+				q.PrioritySupport = true
+				Expect(storage.PrepareQueue(q, 1, true)).To(MatchError(ErrQueueInvalidSettings))
+
+				q.PrioritySupport = false
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+				Expect(storage.qConsumers[q.Name].IsEphemeral()).To(BeTrue())
+
+				queues, err := storage.ListWorkQueues()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(queues).To(HaveLen(1))
+				Expect(queues[0].EphemeralConsumer).To(BeTrue())
+
+				// work queue streams do not support overlapping consumers
+				Expect(storage.PrepareQueue(&Queue{Name: q.Name}, 1, true)).To(HaveOccurred())
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.PrepareTasks(true, 1, 0)).To(Succeed())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+				item, err := storage.PollQueue(ctx, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item.JobID).To(Equal(task.ID))
+				Expect(storage.AckItem(ctx, item)).To(Succeed())
+			})
+		})
 	})
 
 	Describe("PollQueue", func() {
@@ -594,6 +860,212 @@ var _ = Describe("Storage", func() {
 				Expect(item.storageMeta).ToNot(BeNil())
 			})
 		})
+
+		It("Should not deliver more than MaxConcurrent items", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				q.MaxConcurrent = 1
+				Expect(storage.PrepareQueue(q, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).ToNot(HaveOccurred())
+
+				for i := 0; i < 2; i++ {
+					task, err := NewTask("ginkgo", "test")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).ToNot(HaveOccurred())
+				}
+
+				item, err := storage.PollQueue(ctx, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item).ToNot(BeNil())
+
+				// the poll is held by JetStream until it expires rather than failing
+				timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+				defer cancel()
+				busy, err := storage.PollQueue(timeout, q)
+				Expect(busy).To(BeNil())
+				Expect(err).To(Equal(context.DeadlineExceeded))
+
+				Expect(storage.AckItem(ctx, item)).ToNot(HaveOccurred())
+				item, err = storage.PollQueue(ctx, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item).ToNot(BeNil())
+			})
+		})
+
+		It("Should share MaxConcurrent between the priority levels", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				q.PrioritySupport = true
+				q.MaxConcurrent = 2
+				Expect(storage.PrepareQueue(q, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).ToNot(HaveOccurred())
+				Expect(q.MaxConcurrent).To(Equal(2))
+
+				for _, c := range storage.qPriority[q.Name] {
+					Expect(c.MaxAckPending()).To(Equal(2))
+				}
+
+				slots, err := mgr.LoadStream("KV_" + queueSlotsBucketName(q.Name))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(slots.MaxAge()).To(Equal(q.ackWait()))
+
+				nfo, err := storage.QueueInfo(q.Name)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.MaxConcurrent).To(Equal(2))
+
+				var ids []string
+				for _, p := range []int{9, 9, 1} {
+					task, err := NewTask("ginkgo", "test", TaskPriority(p))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).ToNot(HaveOccurred())
+					ids = append(ids, task.ID)
+				}
+
+				// a single level can use all of the limit
+				var items []*ProcessItem
+				for _, id := range ids[:2] {
+					item, err := storage.PollQueue(ctx, q)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(item.JobID).To(Equal(id))
+					items = append(items, item)
+				}
+
+				// other levels wait for a slot while the limit is reached
+				timeout, cancel := context.WithTimeout(ctx, time.Second)
+				defer cancel()
+				_, err = storage.PollQueue(timeout, q)
+				Expect(err).To(MatchError(context.DeadlineExceeded))
+
+				Expect(storage.AckItem(ctx, items[0])).To(Succeed())
+
+				timeout, cancel = context.WithTimeout(ctx, 2*time.Second)
+				defer cancel()
+				item, err := storage.PollQueue(timeout, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item.JobID).To(Equal(ids[2]))
+			})
+		})
+
+		It("Should reclaim the slots of items that were not acknowledged", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				q.PrioritySupport = true
+				q.MaxConcurrent = 1
+				q.MaxRunTime = time.Second
+				Expect(storage.PrepareQueue(q, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).ToNot(HaveOccurred())
+
+				for _, p := range []int{9, 1} {
+					task, err := NewTask("ginkgo", "test", TaskPriority(p))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).ToNot(HaveOccurred())
+				}
+
+				item, err := storage.PollQueue(ctx, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item).ToNot(BeNil())
+
+				// like a crashed client the first item is never acknowledged, its slot expires after the ack wait
+				timeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+				defer cancel()
+				item, err = storage.PollQueue(timeout, q)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(item).ToNot(BeNil())
+			})
+		})
+
+		It("Should poll higher priorities first and retain order within a priority", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				q.PrioritySupport = true
+				err = storage.PrepareQueue(q, 1, true)
+				Expect(err).ToNot(HaveOccurred())
+				err = storage.PrepareTasks(true, 1, time.Hour)
+				Expect(err).ToNot(HaveOccurred())
+
+				var expected []string
+				enqueue := func(p int) string {
+					task, err := NewTask("ginkgo", "test", TaskPriority(p))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).ToNot(HaveOccurred())
+					return task.ID
+				}
+
+				low := enqueue(1)
+				dflt := enqueue(DefaultPriority)
+				high1 := enqueue(9)
+				high2 := enqueue(9)
+				expected = append(expected, high1, high2, dflt, low)
+
+				for _, id := range expected {
+					item, err := storage.PollQueue(ctx, q)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(item.JobID).To(Equal(id))
+					Expect(storage.AckItem(ctx, item)).ToNot(HaveOccurred())
+				}
+
+				timeout, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+				defer cancel()
+				item, err := storage.PollQueue(timeout, q)
+				Expect(item).To(BeNil())
+				Expect(err).To(Equal(context.DeadlineExceeded))
+			})
+		})
+
+		It("Should compute aged priorities from the enqueue time", func() {
+			enqueued := time.Now()
+			q := &Queue{PriorityAging: time.Minute}
+			Expect(q.agedPriority(1, enqueued, enqueued.Add(90*time.Second))).To(Equal(2))
+			Expect(q.agedPriority(1, enqueued, enqueued.Add(20*time.Minute))).To(Equal(21))
+			Expect(q.agedPriority(1, enqueued, enqueued.Add(-time.Minute))).To(Equal(1))
+			Expect((&Queue{}).agedPriority(1, enqueued, enqueued.Add(time.Hour))).To(Equal(1))
+
+			q.PriorityAging = -1
+			Expect(q.validate()).To(MatchError(ErrQueueInvalidSettings))
+		})
+
+		It("Should poll aged lower priorities before newer higher priorities", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q := testQueue()
+				q.PrioritySupport = true
+				q.PriorityAging = 50 * time.Millisecond
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).To(Succeed())
+
+				enqueue := func(p int) string {
+					task, err := NewTask("ginkgo", "test", TaskPriority(p))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+					return task.ID
+				}
+
+				low := enqueue(1)
+				time.Sleep(500 * time.Millisecond)
+				high := enqueue(9)
+
+				for _, id := range []string{low, high} {
+					item, err := storage.PollQueue(ctx, q)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(item.JobID).To(Equal(id))
+					Expect(storage.AckItem(ctx, item)).To(Succeed())
+				}
+			})
+		})
 	})
 
 	Describe("NaKItem", func() {
@@ -658,6 +1130,94 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("ListTasks", func() {
+		It("Should stream matching tasks across pages", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				q1 := &Queue{Name: "Q1"}
+				q2 := &Queue{Name: "Q2"}
+				Expect(storage.PrepareQueue(q1, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.PrepareQueue(q2, 1, true)).ToNot(HaveOccurred())
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).ToNot(HaveOccurred())
+
+				list := func(filter TaskFilter) ([]*Task, uint64) {
+					tasks, err := storage.ListTasks(ctx, filter)
+					Expect(err).ToNot(HaveOccurred())
+					defer tasks.Close()
+
+					var found []*Task
+					for tasks.Next() {
+						found = append(found, tasks.Task())
+					}
+					Expect(tasks.Err()).ToNot(HaveOccurred())
+
+					return found, tasks.Estimate()
+				}
+
+				found, estimate := list(TaskFilter{})
+				Expect(found).To(BeEmpty())
+				Expect(estimate).To(Equal(uint64(0)))
+
+				var created []*Task
+				for i := 0; i < 10; i++ {
+					q := q1
+					ttype := "ginkgo:one"
+					if i%2 == 0 {
+						q = q2
+						ttype = "ginkgo:two"
+					}
+
+					task, err := NewTask(ttype, i, TaskTags(map[string]string{"tenant": fmt.Sprintf("t%d", i%3), "env": "test"}))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).ToNot(HaveOccurred())
+					created = append(created, task)
+				}
+
+				Expect(storage.SaveTaskState(ctx, created[0], false)).ToNot(HaveOccurred())
+				created[1].State = TaskStateActive
+				Expect(storage.SaveTaskState(ctx, created[1], false)).ToNot(HaveOccurred())
+
+				found, estimate = list(TaskFilter{PageSize: 3})
+				Expect(found).To(HaveLen(10))
+				Expect(estimate).To(Equal(uint64(10)))
+
+				found, _ = list(TaskFilter{Queues: []string{"Q1"}, PageSize: 3})
+				Expect(found).To(HaveLen(5))
+				for _, t := range found {
+					Expect(t.Queue).To(Equal("Q1"))
+					Expect(t.Type).To(Equal("ginkgo:one"))
+				}
+
+				found, _ = list(TaskFilter{Types: []string{"ginkgo:two"}})
+				Expect(found).To(HaveLen(5))
+
+				found, _ = list(TaskFilter{States: []TaskState{TaskStateActive, TaskStateRetry}})
+				Expect(found).To(HaveLen(1))
+				Expect(found[0].ID).To(Equal(created[1].ID))
+
+				found, _ = list(TaskFilter{CreatedAfter: created[5].CreatedAt})
+				Expect(len(found)).To(BeNumerically(">=", 5))
+				for _, t := range found {
+					Expect(t.CreatedAt).ToNot(BeTemporally("<", created[5].CreatedAt))
+				}
+
+				found, _ = list(TaskFilter{CreatedBefore: time.Now().Add(-time.Hour)})
+				Expect(found).To(BeEmpty())
+
+				found, _ = list(TaskFilter{Tags: map[string]string{"tenant": "t1", "env": "test"}})
+				Expect(found).To(HaveLen(3))
+				for _, t := range found {
+					Expect(t.Tags["tenant"]).To(Equal("t1"))
+				}
+
+				found, _ = list(TaskFilter{Tags: map[string]string{"tenant": "t1", "env": "prod"}})
+				Expect(found).To(BeEmpty())
+			})
+		})
+	})
+
 	Describe("DeleteTaskByID", func() {
 		It("Should delete the task", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -741,6 +1301,55 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("WorkQueues", func() {
+		It("Should create, update, list and delete work queues", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				var storage StorageAdmin
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(storage.CreateWorkQueue(&Queue{Name: "Q1", MaxTries: 5, MaxRunTime: time.Minute}, 1, true)).To(Succeed())
+				Expect(storage.CreateWorkQueue(&Queue{Name: "Q2", PrioritySupport: true}, 1, true)).To(Succeed())
+				Expect(storage.CreateWorkQueue(&Queue{Name: "Q1"}, 1, true)).To(MatchError(ErrQueueAlreadyExists))
+
+				update := &Queue{Name: "Q1", MaxTries: 10, MaxRunTime: time.Hour, MaxEntries: 100, DiscardOld: true, MaxConcurrent: 5}
+				Expect(storage.UpdateWorkQueue(update)).To(Succeed())
+				Expect(update.MaxTries).To(Equal(10))
+
+				err = storage.UpdateWorkQueue(&Queue{Name: "Q1", PrioritySupport: true})
+				Expect(err).To(MatchError(ErrQueueSettingImmutable))
+				Expect(err).To(MatchError("queue setting can not be changed: queue Q1 priority support can not be changed from false to true"))
+				Expect(storage.UpdateWorkQueue(&Queue{Name: "Q1", MaxRunTime: time.Hour, AckWait: time.Minute})).To(MatchError(ErrQueueInvalidSettings))
+				Expect(storage.UpdateWorkQueue(&Queue{Name: "Q3"})).To(MatchError(ErrQueueNotFound))
+				Expect(storage.UpdateWorkQueue(&Queue{Name: "Q2", PrioritySupport: true, MaxTries: 3})).To(Succeed())
+
+				queues, err := storage.ListWorkQueues()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(queues).To(HaveLen(2))
+				Expect(queues[0].Name).To(Equal("Q1"))
+				Expect(queues[0].MaxTries).To(Equal(10))
+				Expect(queues[0].MaxRunTime).To(Equal(time.Hour))
+				Expect(queues[0].MaxEntries).To(Equal(100))
+				Expect(queues[0].DiscardOld).To(BeTrue())
+				Expect(queues[0].MaxConcurrent).To(Equal(5))
+				Expect(queues[0].PrioritySupport).To(BeFalse())
+				Expect(queues[1].Name).To(Equal("Q2"))
+				Expect(queues[1].PrioritySupport).To(BeTrue())
+				Expect(queues[1].MaxTries).To(Equal(3))
+
+				pc, err := mgr.LoadConsumer(fmt.Sprintf(WorkStreamNamePattern, "Q2"), fmt.Sprintf(WorkStreamPriorityConsumerPattern, 9))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(pc.MaxDeliver()).To(Equal(3))
+
+				Expect(storage.DeleteWorkQueue("Q1")).To(Succeed())
+				Expect(storage.DeleteWorkQueue("Q1")).To(MatchError(ErrQueueNotFound))
+				queues, err = storage.ListWorkQueues()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(queues).To(HaveLen(1))
+			})
+		})
+	})
+
 	Describe("AckItem", func() {
 		It("Should fail when the item has no storage metadata", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -833,6 +1442,71 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("StorageRetries", func() {
+		It("Should only retry transient errors", func() {
+			Expect(isRetryableStorageError(nil)).To(BeFalse())
+			Expect(isRetryableStorageError(nats.ErrNoResponders)).To(BeTrue())
+			Expect(isRetryableStorageError(fmt.Errorf("saving: %w", nats.ErrTimeout))).To(BeTrue())
+			Expect(isRetryableStorageError(api.ApiError{Code: 503, ErrCode: 10008})).To(BeTrue())
+			Expect(isRetryableStorageError(nats.ErrBadSubject)).To(BeFalse())
+			Expect(isRetryableStorageError(api.ApiError{Code: 400, ErrCode: 10071})).To(BeFalse())
+		})
+
+		It("Should retry saves until the store is available", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+				storage.requestRetries = 10
+				storage.requestRetryPolicy = RetryPolicy{Intervals: []time.Duration{100 * time.Millisecond}}
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				go func() {
+					defer GinkgoRecover()
+					time.Sleep(150 * time.Millisecond)
+					Expect(storage.PrepareTasks(true, 1, time.Hour)).To(Succeed())
+				}()
+
+				Expect(storage.SaveTaskState(ctx, task, false)).To(Succeed())
+				loaded, err := storage.LoadTaskByID(task.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.ID).To(Equal(task.ID))
+
+				// a stored save that is retried is recognised as a duplicate and not stored again
+				msg := nats.NewMsg(fmt.Sprintf(TasksStreamSubjectPattern, task.ID))
+				msg.Header.Set(api.JSMsgId, "ginkgo")
+				for i := 0; i < 2; i++ {
+					resp, _, err := storage.request(ctx, msg)
+					Expect(err).ToNot(HaveOccurred())
+					ack, err := jsm.ParsePubAck(resp)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(ack.Sequence).To(Equal(uint64(2)))
+					Expect(ack.Duplicate).To(Equal(i == 1))
+				}
+			})
+		})
+
+		It("Should stop retrying when the context is done", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+				storage.requestRetries = 10
+				storage.requestRetryPolicy = RetryPolicy{Intervals: []time.Duration{time.Hour}}
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+
+				tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer tcancel()
+
+				start := time.Now()
+				Expect(storage.SaveTaskState(tctx, task, false)).To(MatchError(context.DeadlineExceeded))
+				Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			})
+		})
+	})
+
 	Describe("EnqueueTask", func() {
 		It("Save the task and handle save errors", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -877,6 +1551,38 @@ var _ = Describe("Storage", func() {
 			})
 		})
 
+		It("Should allow repeating enqueues that failed with a queue error", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(storage.PrepareTasks(true, 1, time.Hour)).To(Succeed())
+
+				q := testQueue()
+				Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+
+				task, err := NewTask("ginkgo", nil)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+				// the entry was stored but the client did not learn about it
+				task.State = TaskStateQueueError
+				task.LastErr = nats.ErrTimeout.Error()
+				Expect(storage.SaveTaskState(ctx, task, false)).To(Succeed())
+
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+				Expect(task.State).To(Equal(TaskStateNew))
+				Expect(task.LastErr).To(BeEmpty())
+
+				nfo, err := storage.qStreams[q.Name].State()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nfo.Msgs).To(Equal(uint64(1)))
+
+				Expect(storage.EnqueueTask(ctx, q, task)).To(MatchError(ErrDuplicateItem))
+				Expect(task.State).To(Equal(TaskStateQueueError))
+			})
+		})
+
 		It("Should not set dupe headers for retries", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
 				storage, err := newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
@@ -936,6 +1642,100 @@ var _ = Describe("Storage", func() {
 		})
 	})
 
+	Describe("EnqueueTask deduplication", func() {
+		var storage *jetStreamStorage
+		var q *Queue
+
+		prepare := func(nc *nats.Conn, window time.Duration) {
+			var err error
+			storage, err = newJetStreamStorage(nc, retryForTesting, &defaultLogger{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(storage.PrepareTasks(true, 1, time.Hour)).To(Succeed())
+			q = testQueue()
+			Expect(storage.PrepareQueue(q, 1, true)).To(Succeed())
+			if window > 0 {
+				Expect(storage.PrepareDeduplicationStore(true, 1, window)).To(Succeed())
+			}
+		}
+
+		It("Should require deduplication to be enabled", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				prepare(nc, 0)
+
+				task, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(MatchError(ErrTaskDeduplicationNotEnabled))
+
+				_, err = storage.LoadTaskByID(task.ID)
+				Expect(err).To(MatchError(ErrTaskNotFound))
+			})
+		})
+
+		It("Should reject live duplicates and allow retries", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				prepare(nc, time.Hour)
+
+				task, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+				dupe, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, dupe)).To(MatchError(ErrDuplicateTask))
+
+				_, err = storage.LoadTaskByID(dupe.ID)
+				Expect(err).To(MatchError(ErrTaskNotFound))
+
+				other, err := NewTask("ginkgo", nil, TaskDeduplicationKey("y"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, other)).To(Succeed())
+
+				Expect(storage.RetryTaskByID(ctx, q, task.ID)).To(Succeed())
+			})
+		})
+
+		It("Should allow new tasks once the holder is completed or expired", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				prepare(nc, time.Hour)
+
+				for _, state := range []TaskState{TaskStateCompleted, TaskStateExpired} {
+					task, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+					task.State = state
+					Expect(storage.SaveTaskState(ctx, task, false)).To(Succeed())
+				}
+
+				task, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+				entry, err := storage.dedupe.Get(deduplicationBucketKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(entry.Value())).To(Equal(task.ID))
+			})
+		})
+
+		It("Should expire keys after the window", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				prepare(nc, time.Second)
+
+				task, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(storage.EnqueueTask(ctx, q, task)).To(Succeed())
+
+				Eventually(func() error {
+					dupe, err := NewTask("ginkgo", nil, TaskDeduplicationKey("x"))
+					if err != nil {
+						return err
+					}
+					return storage.EnqueueTask(ctx, q, dupe)
+				}, "5s", "250ms").Should(Succeed())
+			})
+		})
+	})
+
 	Describe("SaveTaskState", func() {
 		It("Should handle missing streams", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -1036,9 +1836,7 @@ var _ = Describe("Storage", func() {
 				task.storageOptions.(*taskMeta).seq = 10
 
 				err = storage.SaveTaskState(ctx, task, false)
-				if !jsm.IsNatsError(err, 10071) {
-					Fail(fmt.Sprintf("Unexpected error %v", err))
-				}
+				Expect(err).To(MatchError(ErrConflict))
 			})
 		})
 
@@ -8,8 +8,9 @@ import (
 	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -41,6 +42,10 @@ const (
 	TaskStateBlocked TaskState = "blocked"
 	// TaskStateUnreachable tasks that could not be run due to dependency problems
 	TaskStateUnreachable TaskState = "unreachable"
+	// TaskStateQuarantined tasks that failed repeatedly with the same error and are held for review, see QuarantinePoisonTasks()
+	TaskStateQuarantined TaskState = "quarantined"
+	// TaskStateSkipped tasks that a handler found to be obsolete and skipped without handling them, see SkipTask()
+	TaskStateSkipped TaskState = "skipped"
 )
 
 var nameToTaskState = map[string]TaskState{
@@ -54,6 +59,8 @@ var nameToTaskState = map[string]TaskState{
 	string(TaskStateQueueError):  TaskStateQueueError,
 	string(TaskStateBlocked):     TaskStateBlocked,
 	string(TaskStateUnreachable): TaskStateUnreachable,
+	string(TaskStateQuarantined): TaskStateQuarantined,
+	string(TaskStateSkipped):     TaskStateSkipped,
 
 	"completed": TaskStateCompleted, // backward compat and just general UX
 }
@@ -72,14 +79,37 @@ type Task struct {
 	DependencyResults map[string]*TaskResult `json:"dependency_results,omitempty"`
 	// LoadDependencies indicates if this task should load dependency results before execting
 	LoadDependencies bool `json:"load_dependencies,omitempty"`
-	// Payload is a JSON representation of the associated work
+	// Payload is a JSON representation of the associated work, or the protobuf wire format when PayloadType is set
 	Payload []byte `json:"payload"`
+	// PayloadType is the full message name of protobuf payloads, empty for JSON payloads. It is stored in the
+	// PayloadTypeHeader header of the task
+	PayloadType string `json:"payload_type,omitempty"`
 	// Deadline is a cut-off time for the job to complete, should a job be scheduled after this time it will fail.
 	// In-Flight jobs are allowed to continue past this time. Only starting handlers are impacted by this deadline.
 	Deadline *time.Time `json:"deadline,omitempty"`
-	// MaxTries sets a per task maximum try limit. If this task is in a queue that allow fewer tries the queue max tries
-	// will override this setting.  A task may not exceed the work queue max tries
+	// TTL is how long after being enqueued the task expires when it was not yet handled, set using TaskTTL()
+	TTL time.Duration `json:"ttl,omitempty"`
+	// ExpiresAt is when a task with a TTL expires, set when the task is enqueued
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ScheduledFor is the earliest time the task will be handled, the task will be held in the queue until then
+	ScheduledFor *time.Time `json:"scheduled_for,omitempty"`
+	// NextTryAt is when a task waiting to be retried becomes eligible for its next try, the task is held in the queue
+	// until then even when delivered earlier, for example after a client restarted
+	NextTryAt *time.Time `json:"next_try,omitempty"`
+	// MaxTries sets a per task maximum try limit, the lower of this and the queue MaxTries applies unless
+	// MaxTriesOverride is set. When 0 the queue MaxTries applies
 	MaxTries int `json:"max_tries"`
+	// MaxTriesOverride indicates MaxTries is used instead of the queue MaxTries, even when the queue allows fewer
+	// tries. Set using TaskMaxTries()
+	MaxTriesOverride bool `json:"max_tries_override,omitempty"`
+	// NoRetry indicates the task is tried only once, a failed try terminates the task rather than retrying it unless
+	// the task is past its Deadline, which expires it. Set using NoRetry()
+	NoRetry bool `json:"no_retry,omitempty"`
+	// Priority is the processing priority between 0 and MaxPriority, higher priority tasks are processed first. Only used
+	// when the queue has PrioritySupport enabled
+	Priority int `json:"priority"`
+	// DeduplicationKey is a user supplied key used to prevent duplicate tasks from being enqueued
+	DeduplicationKey string `json:"deduplication_key,omitempty"`
 	// Result is the outcome of the job, only set for successful jobs
 	Result *TaskResult `json:"result,omitempty"`
 	// State is the most recent recorded state the job is in
@@ -90,12 +120,45 @@ type Task struct {
 	LastTriedAt *time.Time `json:"tried,omitempty"`
 	// Tries is how many times the job was handled
 	Tries int `json:"tries"`
+	// Attempts are the most recent times the job was handed to a handler, oldest first, limited using TaskAttemptHistory()
+	Attempts []TaskAttempt `json:"attempts,omitempty"`
+	// Continuations are follow-up tasks returned by the handler using Continue() that are not yet all enqueued
+	Continuations []*Task `json:"continuations,omitempty"`
+	// Deferrals is how many times a handler requested the task be tried later using RetryAfter(), these are not counted in Tries
+	Deferrals int `json:"deferrals,omitempty"`
+	// Requeues is how many times a handler requested the task be enqueued again from scratch using Requeue()
+	Requeues int `json:"requeues,omitempty"`
 	// LastErr is the most recent handling error if any
 	LastErr string `json:"last_err,omitempty"`
+	// FailureSignature identifies the error of the most recent handler failure, errors of the same type with the same
+	// message apart from numbers have the same signature
+	FailureSignature string `json:"failure_signature,omitempty"`
+	// FailureRepeats is how many consecutive handler failures had the FailureSignature
+	FailureRepeats int `json:"failure_repeats,omitempty"`
 	// Signature is an ed25519 signature of key properties
 	Signature string `json:"signature,omitempty"`
+	// TraceContext is the W3C Trace Context of the span that enqueued the task, set when tracing is enabled
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+	// Progress is the most recent progress reported by the handler using Progress()
+	Progress *TaskProgress `json:"progress,omitempty"`
+	// Tags are user supplied labels used to group related tasks, they can be matched using TaskFilter
+	Tags map[string]string `json:"tags,omitempty"`
+	// Capabilities are required of workers handling the task, only clients declaring all of them using
+	// WorkerCapabilities() handle the task. Set using RequireCapability()
+	Capabilities []string `json:"capabilities,omitempty"`
+	// FanoutID is the ID shared by the copies of a task enqueued to several queues using EnqueueFanout()
+	FanoutID string `json:"fanout_id,omitempty"`
+	// Meta is user supplied metadata like correlation IDs and routing hints set using TaskMeta(), it is stored in
+	// headers of the task rather than with the payload
+	Meta map[string]string `json:"meta,omitempty"`
+	// CloudEvent holds the CloudEvents attributes of tasks created from events or enqueued by clients using
+	// CloudEventsEnvelope(), the event data is the task Payload
+	CloudEvent *CloudEvent `json:"cloud_event,omitempty"`
 
 	storageOptions any
+	replace        bool
+	matchPending   bool
+	payloadValue   any
 	mu             sync.Mutex
 }
 
@@ -107,14 +170,34 @@ type TasksInfo struct {
 	Stream *api.StreamInfo `json:"stream_info"`
 }
 
-// TaskResult is the result of task execution, this will only be set for successfully processed jobs
+// TaskResult is the result of task execution, this will be set for successfully processed jobs and for jobs
+// terminated by their handler
 type TaskResult struct {
 	Payload     any       `json:"payload"`
 	CompletedAt time.Time `json:"completed"`
+	// Error is the error a handler terminated the task with, see Terminate()
+	Error string `json:"error,omitempty"`
+	// SkipReason is the reason a handler skipped the task, see SkipTask()
+	SkipReason string `json:"skip_reason,omitempty"`
+	// Object references the result streamed by the handler, see ResultStream()
+	Object *ResultObject `json:"object,omitempty"`
+}
+
+// TaskAttempt records one time a task was handed to a handler
+type TaskAttempt struct {
+	// Time is when the handler was called
+	Time time.Time `json:"time"`
+	// Duration is how long the handler ran
+	Duration time.Duration `json:"duration"`
+	// Worker is the WorkerName() of the client that called the handler
+	Worker string `json:"worker,omitempty"`
+	// Error is the error the handler returned, empty when it succeeded
+	Error string `json:"error,omitempty"`
 }
 
 // NewTask creates a new task of taskType that can later be used to route tasks to handlers.
-// The task will carry a JSON encoded representation of payload.
+// The task will carry a JSON encoded representation of payload, or the protobuf wire format when payload is a
+// proto.Message.
 func NewTask(taskType string, payload any, opts ...TaskOpt) (*Task, error) {
 	if !IsValidName(taskType) {
 		return nil, fmt.Errorf("%w: must match %s", ErrTaskTypeInvalid, validNameMatcher)
@@ -134,16 +217,15 @@ func NewTask(taskType string, payload any, opts ...TaskOpt) (*Task, error) {
 		Type:      taskType,
 		CreatedAt: time.Now().UTC(),
 		MaxTries:  DefaultMaxTries,
+		Priority:  DefaultPriority,
 		State:     TaskStateNew,
 	}
 
-	if payload != nil {
-		p, err := json.Marshal(payload)
-		if err != nil {
-			return nil, err
-		}
-		t.Payload = p
+	t.Payload, t.PayloadType, err = marshalTaskPayload(payload)
+	if err != nil {
+		return nil, err
 	}
+	t.payloadValue = payload
 
 	for _, opt := range opts {
 		err = opt(t)
@@ -152,6 +234,14 @@ func NewTask(taskType string, payload any, opts ...TaskOpt) (*Task, error) {
 		}
 	}
 
+	if t.Deadline != nil && t.ScheduledFor != nil && t.Deadline.Before(*t.ScheduledFor) {
+		return nil, ErrTaskDeadlineBeforeSchedule
+	}
+
+	if t.NoRetry {
+		t.MaxTries = 1
+	}
+
 	if len(t.Dependencies) > 0 {
 		t.State = TaskStateBlocked
 	}
@@ -159,9 +249,112 @@ func NewTask(taskType string, payload any, opts ...TaskOpt) (*Task, error) {
 	return t, nil
 }
 
-// IsPastDeadline determines if the task is past it's deadline
+// Revision is the revision of the stored task this task was loaded from or last saved as, 0 for tasks that were not
+// stored yet. Saving a task fails with ErrConflict when the stored task has a different revision
+func (t *Task) Revision() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta, ok := t.storageOptions.(*taskMeta)
+	if !ok {
+		return 0
+	}
+
+	return meta.seq
+}
+
+// SetRevision records that the task was loaded from or saved as revision of the stored task with state, Storage
+// implementations call this after every load and save so Revision() and StoredState() report the stored task
+func (t *Task) SetRevision(revision uint64, state TaskState) {
+	t.mu.Lock()
+	t.storageOptions = &taskMeta{seq: revision, state: state}
+	t.mu.Unlock()
+}
+
+// StoredState is the state the task had when it was last loaded from or saved to the store, TaskStateUnknown for
+// tasks that were not stored yet
+func (t *Task) StoredState() TaskState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta, ok := t.storageOptions.(*taskMeta)
+	if !ok {
+		return TaskStateUnknown
+	}
+
+	return meta.state
+}
+
+// ReplaceExisting indicates the task should replace a stored task with the same ID when enqueued, see TaskReplaceExisting()
+func (t *Task) ReplaceExisting() bool {
+	return t.replace
+}
+
+// MatchPending indicates the task is enqueued using Client.EnqueueIfNotPending(), storage fails enqueues with a
+// DuplicateTaskError while the task holding its DeduplicationKey is not in a final state rather than until the
+// deduplication window passed
+func (t *Task) MatchPending() bool {
+	return t.matchPending
+}
+
+// IsPastDeadline determines if the task is past it's deadline according to the wall clock
 func (t *Task) IsPastDeadline() bool {
-	return t.Deadline != nil && time.Since(*t.Deadline) > 0
+	return t.isPastDeadline(time.Now())
+}
+
+func (t *Task) isPastDeadline(now time.Time) bool {
+	return t.Deadline != nil && now.After(*t.Deadline)
+}
+
+// IsPastTTL determines if the task was not handled within its TTL of being enqueued according to the wall clock
+func (t *Task) IsPastTTL() bool {
+	return t.isPastTTL(time.Now())
+}
+
+func (t *Task) isPastTTL(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// startTTL sets when a task with a TTL expires, called every time the task is enqueued
+func (t *Task) startTTL(now time.Time) {
+	if t.TTL <= 0 {
+		return
+	}
+
+	expires := now.UTC().Add(t.TTL)
+	t.ExpiresAt = &expires
+}
+
+// recordAttempt adds a to the attempt history keeping only the most recent limit attempts
+func (t *Task) recordAttempt(a TaskAttempt, limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	t.Attempts = append(t.Attempts, a)
+	if len(t.Attempts) > limit {
+		t.Attempts = append([]TaskAttempt{}, t.Attempts[len(t.Attempts)-limit:]...)
+	}
+}
+
+// IsScheduledInFuture determines if the task should only be handled at a later time according to the wall clock
+func (t *Task) IsScheduledInFuture() bool {
+	return t.isScheduledInFuture(time.Now())
+}
+
+func (t *Task) isScheduledInFuture(now time.Time) bool {
+	return t.ScheduledFor != nil && t.ScheduledFor.After(now)
+}
+
+// isRetryInFuture determines if the task is waiting to be retried at a time after now
+func (t *Task) isRetryInFuture(now time.Time) bool {
+	return t.State == TaskStateRetry && t.NextTryAt != nil && t.NextTryAt.After(now)
+}
+
+// setNextTry records that the task should not be tried again before delay passed since now
+func (t *Task) setNextTry(now time.Time, delay time.Duration) {
+	next := now.Add(delay).UTC()
+	t.NextTryAt = &next
 }
 
 // HasDependencies determines if the task has any dependencies
@@ -169,6 +362,16 @@ func (t *Task) HasDependencies() bool {
 	return len(t.Dependencies) > 0
 }
 
+// IsFinal determines if the task is in a final state and will not be processed further
+func (t *Task) IsFinal() bool {
+	switch t.State {
+	case TaskStateCompleted, TaskStateExpired, TaskStateTerminated, TaskStateQueueError, TaskStateUnreachable, TaskStateQuarantined, TaskStateSkipped:
+		return true
+	default:
+		return false
+	}
+}
+
 func (t *Task) sign(pk ed25519.PrivateKey) error {
 	if t.Signature != "" {
 		return ErrTaskAlreadySigned
@@ -202,7 +405,37 @@ func (t *Task) signatureMessage() ([]byte, error) {
 // TaskOpt configures Tasks made using NewTask()
 type TaskOpt func(*Task) error
 
-// TaskDeadline sets an absolute time after which the task should not be handled
+// MaxTaskIDLength is the longest task ID that can be set using TaskID()
+const MaxTaskIDLength = 128
+
+// TaskID sets a caller supplied ID for the task rather than a generated one, the ID must match the same character
+// set as task types, letters, digits, _, : and -, and be at most MaxTaskIDLength long. Enqueueing a task with the ID
+// of an existing task fails with ErrTaskAlreadyExists unless TaskReplaceExisting() is also set
+func TaskID(id string) TaskOpt {
+	return func(t *Task) error {
+		if len(id) > MaxTaskIDLength {
+			return fmt.Errorf("%w: may not be longer than %d characters", ErrTaskIDInvalid, MaxTaskIDLength)
+		}
+		if !IsValidName(id) {
+			return fmt.Errorf("%w: must match %s", ErrTaskIDInvalid, validNameMatcher)
+		}
+
+		t.ID = id
+		return nil
+	}
+}
+
+// TaskReplaceExisting allows the task to replace an existing task with the same ID when enqueued, see TaskID()
+func TaskReplaceExisting() TaskOpt {
+	return func(t *Task) error {
+		t.replace = true
+		return nil
+	}
+}
+
+// TaskDeadline sets an absolute time after which the task should not be handled, tasks found past their deadline
+// are expired without calling the handler and failed tries past the deadline are not retried. The deadline may not
+// be before the time set using TaskScheduledFor()
 func TaskDeadline(deadline time.Time) TaskOpt {
 	return func(t *Task) error {
 		t.Deadline = &deadline
@@ -210,11 +443,172 @@ func TaskDeadline(deadline time.Time) TaskOpt {
 	}
 }
 
-// TaskMaxTries sets a maximum to the amount of processing attempts a task will have, the queue
-// max tries will override this
+// RequireCapability only lets workers declaring all of caps using WorkerCapabilities() handle the task, other workers
+// return the task to the queue. Combine with TaskDeadline() or TaskTTL() to expire tasks no worker can handle
+func RequireCapability(caps ...string) TaskOpt {
+	return func(t *Task) error {
+		for _, c := range caps {
+			if c == "" {
+				return fmt.Errorf("%w: capabilities may not be empty", ErrTaskCapabilityInvalid)
+			}
+			if !containsString(t.Capabilities, c) {
+				t.Capabilities = append(t.Capabilities, c)
+			}
+		}
+
+		return nil
+	}
+}
+
+// TaskTTL expires the task without handling it when it was not handled within ttl of being enqueued, unlike
+// TaskDeadline() the time is relative to when the task is enqueued, or enqueued again when retried by hand
+func TaskTTL(ttl time.Duration) TaskOpt {
+	return func(t *Task) error {
+		if ttl <= 0 {
+			return fmt.Errorf("%w: must be positive", ErrTaskTTLInvalid)
+		}
+
+		t.TTL = ttl
+		return nil
+	}
+}
+
+// TaskScheduledFor sets a time before which the task will not be handled
+func TaskScheduledFor(s time.Time) TaskOpt {
+	return func(t *Task) error {
+		s = s.UTC()
+		t.ScheduledFor = &s
+		return nil
+	}
+}
+
+// TaskScheduledIn sets a duration from now before which the task will not be handled
+func TaskScheduledIn(d time.Duration) TaskOpt {
+	return func(t *Task) error {
+		return TaskScheduledFor(time.Now().Add(d))(t)
+	}
+}
+
+// TaskMaxTries sets a maximum to the amount of processing attempts a task will have, this limit is used instead of
+// the queue MaxTries. Passing 0 uses the queue limit
 func TaskMaxTries(tries int) TaskOpt {
 	return func(t *Task) error {
 		t.MaxTries = tries
+		t.MaxTriesOverride = tries > 0
+		return nil
+	}
+}
+
+// NoRetry tries the task only once, like TaskMaxTries(1) regardless of the limits of the queue, but a failed try sets
+// the task to TaskStateTerminated straight away, or TaskStateExpired when it failed past its deadline. Suits best-effort tasks where a retry could cause duplicate work,
+// like sending notifications. Deferrals using RetryAfter() are still allowed as they are not tries
+func NoRetry() TaskOpt {
+	return func(t *Task) error {
+		t.NoRetry = true
+		return nil
+	}
+}
+
+// TaskPriority sets the processing priority of a task between 0 and MaxPriority, only used when the queue has PrioritySupport enabled
+func TaskPriority(priority int) TaskOpt {
+	return func(t *Task) error {
+		if priority < 0 || priority > MaxPriority {
+			return fmt.Errorf("%w: must be between 0 and %d", ErrTaskPriorityInvalid, MaxPriority)
+		}
+
+		t.Priority = priority
+		return nil
+	}
+}
+
+// TaskTags adds tags to a task that group related tasks, like all tasks for a tenant, so they can be found using a
+// TaskFilter. Tag names may not be empty
+func TaskTags(tags map[string]string) TaskOpt {
+	return func(t *Task) error {
+		for k, v := range tags {
+			if k == "" {
+				return fmt.Errorf("%w: tag names may not be empty", ErrTaskTagInvalid)
+			}
+
+			if t.Tags == nil {
+				t.Tags = map[string]string{}
+			}
+			t.Tags[k] = v
+		}
+
+		return nil
+	}
+}
+
+const (
+	// TaskMetaHeaderPrefix is the prefix of the headers metadata set using TaskMeta() is stored in
+	TaskMetaHeaderPrefix = "AJ-Meta-"
+	// MaxTaskMetaSize is the most bytes of metadata names and values a task can have
+	MaxTaskMetaSize = 4096
+)
+
+var validMetaNameMatcher = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// TaskMeta adds metadata to a task that handlers can access in Task.Meta without it being part of the payload.
+// Metadata is stored in task headers so names are limited to lower case letters, digits, _ and - and values may not
+// contain line breaks or start or end with white space. All names and values combined are limited to MaxTaskMetaSize bytes
+func TaskMeta(meta map[string]string) TaskOpt {
+	return func(t *Task) error {
+		size := 0
+		for k, v := range t.Meta {
+			size += len(k) + len(v)
+		}
+
+		for k, v := range meta {
+			if !validMetaNameMatcher.MatchString(k) {
+				return fmt.Errorf("%w: invalid name %q", ErrTaskMetaInvalid, k)
+			}
+			if strings.ContainsAny(v, "\r\n") || strings.TrimSpace(v) != v {
+				return fmt.Errorf("%w: invalid value for %s", ErrTaskMetaInvalid, k)
+			}
+
+			if old, ok := t.Meta[k]; ok {
+				size -= len(k) + len(old)
+			}
+			size += len(k) + len(v)
+			if size > MaxTaskMetaSize {
+				return fmt.Errorf("%w: exceeds %d bytes", ErrTaskMetaInvalid, MaxTaskMetaSize)
+			}
+
+			if t.Meta == nil {
+				t.Meta = map[string]string{}
+			}
+			t.Meta[k] = v
+		}
+
+		return nil
+	}
+}
+
+// taskMetaFromHeaders extracts metadata stored by TaskMeta() from headers of a stored task
+func taskMetaFromHeaders(hdrs map[string][]string) map[string]string {
+	var meta map[string]string
+	prefix := strings.ToLower(TaskMetaHeaderPrefix)
+
+	for k, v := range hdrs {
+		if len(v) == 0 || !strings.HasPrefix(strings.ToLower(k), prefix) {
+			continue
+		}
+
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[strings.ToLower(k[len(prefix):])] = v[0]
+	}
+
+	return meta
+}
+
+// TaskDeduplicationKey sets a key that prevents other tasks with the same key from being enqueued while this task
+// is not completed or expired, requires the client to be configured using DedupWindow()
+func TaskDeduplicationKey(key string) TaskOpt {
+	return func(t *Task) error {
+		t.DeduplicationKey = key
 		return nil
 	}
 }
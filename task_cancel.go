@@ -0,0 +1,128 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+)
+
+// TaskCancelRequester is implemented by storage that can ask the clients handling a task to stop
+type TaskCancelRequester interface {
+	// RequestTaskCancel asks every client handling task id to cancel its handler
+	RequestTaskCancel(ctx context.Context, id string) error
+	// TaskCancelRequestsWatch receives the IDs of tasks that should be canceled until ctx is done
+	TaskCancelRequestsWatch(ctx context.Context) (chan string, error)
+}
+
+// RequestCancel cancels the task with id. Waiting tasks are terminated as with CancelTasks(), when a handler is
+// running the context passed to it is canceled and the task is terminated with ErrTaskCanceled once the handler
+// returns an error. Canceling handlers is cooperative, handlers that do not stop when their context is done run to
+// completion and their result is stored as usual. Tasks in a final state fail with ErrTaskAlreadyInState
+func (c *Client) RequestCancel(ctx context.Context, id string) error {
+	requester, ok := c.storage.(TaskCancelRequester)
+	if !ok {
+		return fmt.Errorf("%w: storage does not support canceling tasks", ErrStorageNotReady)
+	}
+
+	for try := 0; try < 5; try++ {
+		canceled, err := c.cancelTask(ctx, id)
+		if err != nil {
+			return err
+		}
+		if canceled {
+			return nil
+		}
+
+		task, err := c.LoadTaskByID(id)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case task.State == TaskStateActive:
+			return requester.RequestTaskCancel(ctx, id)
+		case containsState(cancelableTaskStates, task.State):
+			// a worker changed the task since it was loaded for canceling
+			continue
+		default:
+			return fmt.Errorf("%w %q", ErrTaskAlreadyInState, task.State)
+		}
+	}
+
+	return fmt.Errorf("%w: could not cancel task %s", ErrConflict, id)
+}
+
+// handlerCancel allows the handler of a task to be canceled, cancel is set once the handler starts while requested
+// records cancel requests received before or after that
+type handlerCancel struct {
+	cancel    context.CancelFunc
+	requested bool
+	stopped   bool
+}
+
+// watchCancelRequests cancels the handlers of tasks whose cancellation is requested until ctx is done
+func (p *processor) watchCancelRequests(ctx context.Context) {
+	requester, ok := p.c.storage.(TaskCancelRequester)
+	if !ok {
+		return
+	}
+
+	ids, err := requester.TaskCancelRequestsWatch(ctx)
+	if err != nil {
+		p.log.Warnf("Could not watch task cancel requests, running handlers can not be canceled: %v", err)
+		return
+	}
+
+	go func() {
+		for id := range ids {
+			p.requestCancel(id)
+		}
+	}()
+}
+
+// requestCancel cancels the handler for task id when it is handled by this processor
+func (p *processor) requestCancel(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hc, ok := p.cancels[id]
+	if !ok {
+		return
+	}
+
+	p.log.Infof("Canceling the handler of task %s on request", id)
+	hc.requested = true
+	if hc.cancel != nil {
+		hc.cancel()
+	}
+}
+
+// handlerContext creates the context for the handler of t that is canceled on request, must only be called for
+// tasks registered in processMessage
+func (p *processor) handlerContext(ctx context.Context, t *Task) context.Context {
+	hctx, cancel := context.WithCancel(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hc := p.cancels[t.ID]
+	hc.cancel = cancel
+	if hc.requested || hc.stopped {
+		cancel()
+	}
+
+	return newShutdownContext(hctx, p.drainStart)
+}
+
+// cancelRequested determines if canceling the handler of t was requested
+func (p *processor) cancelRequested(t *Task) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hc, ok := p.cancels[t.ID]
+
+	return ok && hc.requested
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RequestCancel", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	})
+
+	AfterEach(func() { cancel() })
+
+	// blockingRouter handles tasks by waiting for their context to be done, started receives their IDs
+	blockingRouter := func(started chan string) *Mux {
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			started <- t.ID
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+
+		return router
+	}
+
+	testCancelActive := func(client *Client) {
+		started := make(chan string, 1)
+		go client.Run(ctx, blockingRouter(started))
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+		Eventually(started).Should(Receive(Equal(task.ID)))
+
+		Expect(client.RequestCancel(ctx, task.ID)).To(Succeed())
+
+		Eventually(func() TaskState {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.State
+		}).Should(Equal(TaskStateTerminated))
+		Expect(task.Tries).To(Equal(1))
+		Expect(task.LastErr).To(Equal("terminate task: task canceled"))
+		Expect(task.Result.Error).To(Equal(task.LastErr))
+
+		Expect(client.RequestCancel(ctx, task.ID)).To(MatchError(ErrTaskAlreadyInState))
+	}
+
+	It("Should terminate waiting tasks", func() {
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(client.RequestCancel(ctx, "unknown")).To(MatchError(ErrTaskNotFound))
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+		Expect(client.RequestCancel(ctx, task.ID)).To(Succeed())
+
+		task, err = client.LoadTaskByID(task.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.State).To(Equal(TaskStateTerminated))
+		Expect(task.LastErr).To(Equal(ErrTaskCanceled.Error()))
+	})
+
+	It("Should cancel running handlers", func() {
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+
+		testCancelActive(client)
+	})
+
+	It("Should cancel running handlers using JetStream", func() {
+		withJetStream(func(nc *nats.Conn, _ *jsm.Manager) {
+			client, err := NewClient(NatsConn(nc), RetryBackoffPolicy(retryForTesting))
+			Expect(err).ToNot(HaveOccurred())
+
+			testCancelActive(client)
+		})
+	})
+})
@@ -0,0 +1,69 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import "context"
+
+type taskInfoKey struct{}
+
+// taskInfo is a copy of the task properties made available to handlers through their context, taken when the
+// handler is called
+type taskInfo struct {
+	id       string
+	taskType string
+	queue    string
+	tries    int
+}
+
+func newTaskInfoContext(ctx context.Context, t *Task) context.Context {
+	return context.WithValue(ctx, taskInfoKey{}, &taskInfo{id: t.ID, taskType: t.Type, queue: t.Queue, tries: t.Tries})
+}
+
+func taskInfoFromContext(ctx context.Context) (*taskInfo, bool) {
+	nfo, ok := ctx.Value(taskInfoKey{}).(*taskInfo)
+	return nfo, ok
+}
+
+// TaskIDFromContext is the ID of the task being handled, false when ctx is not the context of a handler
+func TaskIDFromContext(ctx context.Context) (string, bool) {
+	nfo, ok := taskInfoFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return nfo.id, true
+}
+
+// TaskTypeFromContext is the type of the task being handled, false when ctx is not the context of a handler
+func TaskTypeFromContext(ctx context.Context) (string, bool) {
+	nfo, ok := taskInfoFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return nfo.taskType, true
+}
+
+// TaskQueueFromContext is the name of the queue the task being handled was received from, false when ctx is not the
+// context of a handler
+func TaskQueueFromContext(ctx context.Context) (string, bool) {
+	nfo, ok := taskInfoFromContext(ctx)
+	if !ok {
+		return "", false
+	}
+
+	return nfo.queue, true
+}
+
+// TaskTriesFromContext is the try of the task being handled, 1 on the first try, false when ctx is not the context
+// of a handler
+func TaskTriesFromContext(ctx context.Context) (int, bool) {
+	nfo, ok := taskInfoFromContext(ctx)
+	if !ok {
+		return 0, false
+	}
+
+	return nfo.tries, true
+}
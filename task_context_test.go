@@ -0,0 +1,55 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Task Context", func() {
+	It("Should not find task information outside of handlers", func() {
+		_, ok := TaskIDFromContext(context.Background())
+		Expect(ok).To(BeFalse())
+		_, ok = TaskTriesFromContext(context.Background())
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Should pass task information to handlers", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+
+		describe := func(ctx context.Context) string {
+			id, _ := TaskIDFromContext(ctx)
+			ttype, _ := TaskTypeFromContext(ctx)
+			queue, _ := TaskQueueFromContext(ctx)
+			tries, _ := TaskTriesFromContext(ctx)
+
+			return fmt.Sprintf("%s %s %s %d", id, ttype, queue, tries)
+		}
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			if t.Tries == 1 {
+				return nil, fmt.Errorf("simulated failure")
+			}
+			return describe(ctx), nil
+		})
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil, TaskID("ctx:1"))
+		Expect(err).ToNot(HaveOccurred())
+		res, err := client.EnqueueAndWait(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(MatchJSON(`"ctx:1 ginkgo DEFAULT 2"`))
+	})
+})
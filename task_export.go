@@ -0,0 +1,88 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ExportTasks writes all tasks matching filter to w as newline delimited JSON, one task per line including its
+// payload, result and attempts, returning the number of tasks written. Tasks are read from storage a page at a time
+// as with ListTasks() so large exports do not need to fit in memory, the export stops when ctx is done. Encrypted
+// payloads are exported decrypted and so require a client with the Crypter used to encrypt them
+func (c *Client) ExportTasks(ctx context.Context, filter TaskFilter, w io.Writer) (int, error) {
+	tasks, err := c.ListTasks(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer tasks.Close()
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	exported := 0
+	for tasks.Next() {
+		err = enc.Encode(tasks.Task())
+		if err != nil {
+			return exported, fmt.Errorf("exporting task %s failed: %w", tasks.Task().ID, err)
+		}
+		exported++
+	}
+	if tasks.Err() != nil {
+		return exported, tasks.Err()
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return exported, err
+	}
+
+	return exported, nil
+}
+
+// ImportTasks stores tasks read from r, as written by ExportTasks(), in the task store and returns the number of tasks
+// imported. Tasks that are already stored are skipped and left unchanged. Imported tasks are not added to any work
+// queue, waiting tasks can be processed again using RetryTaskByID()
+func (c *Client) ImportTasks(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+
+	imported := 0
+	for line := 1; ; line++ {
+		if ctx.Err() != nil {
+			return imported, ctx.Err()
+		}
+
+		task := &Task{}
+		err := dec.Decode(task)
+		if err == io.EOF {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("invalid task on line %d: %w", line, err)
+		}
+		if task.ID == "" {
+			return imported, fmt.Errorf("invalid task on line %d: %w", line, ErrTaskIDInvalid)
+		}
+		if task.Type == "" {
+			return imported, fmt.Errorf("invalid task on line %d: %w", line, ErrTaskTypeRequired)
+		}
+
+		err = c.storage.SaveTaskState(ctx, task, false)
+		switch {
+		case errors.Is(err, ErrTaskAlreadyExists):
+			c.log.Debugf("Skipping import of task %s that is already stored", task.ID)
+		case err != nil:
+			return imported, fmt.Errorf("importing task %s failed: %w", task.ID, err)
+		default:
+			imported++
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Task Export", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		client *Client
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+
+		var err error
+		client, err = NewClient(StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(retryForTesting))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() { cancel() })
+
+	It("Should export matching tasks as NDJSON and import them again", func() {
+		router := NewTaskRouter()
+		router.HandleFunc("email:new", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			return "sent", nil
+		})
+		go client.Run(ctx, router)
+
+		completed, err := NewTask("email:new", map[string]string{"to": "ginkgo"})
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.EnqueueAndWait(ctx, completed)
+		Expect(err).ToNot(HaveOccurred())
+
+		waiting, err := NewTask("email:new", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.storage.SaveTaskState(ctx, waiting, false)).To(Succeed())
+
+		out := bytes.NewBuffer(nil)
+		exported, err := client.ExportTasks(ctx, TaskFilter{States: []TaskState{TaskStateCompleted}}, out)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(exported).To(Equal(1))
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(1))
+		task := &Task{}
+		Expect(json.Unmarshal([]byte(lines[0]), task)).To(Succeed())
+		Expect(task.ID).To(Equal(completed.ID))
+		Expect(task.Payload).To(MatchJSON(`{"to":"ginkgo"}`))
+		Expect(task.Result.Payload).To(Equal("sent"))
+		Expect(task.Attempts).To(HaveLen(1))
+
+		restored, err := NewClient(StorageBackend(NewInMemoryStorage()))
+		Expect(err).ToNot(HaveOccurred())
+		imported, err := restored.ImportTasks(ctx, bytes.NewReader(out.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(imported).To(Equal(1))
+
+		task, err = restored.LoadTaskByID(completed.ID)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(task.State).To(Equal(TaskStateCompleted))
+		Expect(task.Result.Payload).To(Equal("sent"))
+
+		imported, err = restored.ImportTasks(ctx, bytes.NewReader(out.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(imported).To(BeZero())
+
+		_, err = restored.ImportTasks(ctx, strings.NewReader(lines[0]+"\n{\"type\":\"email:new\"}\n"))
+		Expect(err).To(MatchError(`invalid task on line 2: task id is invalid`))
+
+		cctx, ccancel := context.WithCancel(ctx)
+		ccancel()
+		_, err = client.ExportTasks(cctx, TaskFilter{}, out)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
@@ -0,0 +1,44 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import "context"
+
+// PreProcessFunc is called before a task is routed to its handler, the returned context is passed to the handler.
+// Returning an error fails the task like a handler error would
+type PreProcessFunc func(ctx context.Context, t *Task) (context.Context, error)
+
+// PostProcessFunc is called after the handler of a task returned with the result and error it returned, or with the
+// error returned by the PreProcessFunc
+type PostProcessFunc func(ctx context.Context, t *Task, result any, err error)
+
+// preProcess calls the PreProcess() hook, ctx is returned unchanged when no hook is set or the hook returned no context
+func (p *processor) preProcess(ctx context.Context, t *Task) (context.Context, error) {
+	if p.c.opts.preProcess == nil {
+		return ctx, nil
+	}
+
+	hctx, err := p.c.opts.preProcess(ctx, t)
+	if hctx == nil {
+		hctx = ctx
+	}
+
+	return hctx, err
+}
+
+// postProcess calls the PostProcess() hook, a panic in the hook is logged and does not affect the task
+func (p *processor) postProcess(ctx context.Context, t *Task, result any, err error) {
+	if p.c.opts.postProcess == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			p.log.Errorf("Post processing task %s panicked: %v", t.ID, r)
+		}
+	}()
+
+	p.c.opts.postProcess(ctx, t, result, err)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultTaskListPageSize is the number of tasks fetched from storage at a time by ListTasks
+const DefaultTaskListPageSize = 500
+
+// TaskFilter restricts the tasks returned by ListTasks, empty fields match all tasks
+type TaskFilter struct {
+	// States matches tasks in any of these states
+	States []TaskState
+	// Queues matches tasks enqueued in any of these queues
+	Queues []string
+	// Types matches tasks of any of these types
+	Types []string
+	// CreatedAfter matches tasks created at or after this time
+	CreatedAfter time.Time
+	// CreatedBefore matches tasks created before this time
+	CreatedBefore time.Time
+	// Tags matches tasks having all of these tags with the same values, tags are not part of the JetStream subjects
+	// so all tasks are read from storage and matched by the client
+	Tags map[string]string
+	// FanoutID matches copies of a task enqueued using EnqueueFanout(), like Tags it is matched by the client
+	FanoutID string
+	// PageSize is how many tasks are fetched from storage at a time, defaults to DefaultTaskListPageSize
+	PageSize int
+}
+
+func (f *TaskFilter) matches(t *Task) bool {
+	if len(f.States) > 0 && !containsState(f.States, t.State) {
+		return false
+	}
+	if len(f.Queues) > 0 && !containsString(f.Queues, t.Queue) {
+		return false
+	}
+	if len(f.Types) > 0 && !containsString(f.Types, t.Type) {
+		return false
+	}
+	if !f.CreatedAfter.IsZero() && t.CreatedAt.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !t.CreatedAt.Before(f.CreatedBefore) {
+		return false
+	}
+	if f.FanoutID != "" && t.FanoutID != f.FanoutID {
+		return false
+	}
+	for k, v := range f.Tags {
+		tv, ok := t.Tags[k]
+		if !ok || tv != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsState(states []TaskState, state TaskState) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TaskPager fetches the next page of tasks, more is false when no further pages are available
+type TaskPager func(ctx context.Context) (tasks []*Task, more bool, err error)
+
+// TaskIterator streams tasks matching a TaskFilter from storage a page at a time
+//
+//	tasks, _ := client.ListTasks(ctx, filter)
+//	defer tasks.Close()
+//
+//	for tasks.Next() {
+//		task := tasks.Task()
+//	}
+//
+//	if tasks.Err() != nil {
+//		// handle error
+//	}
+type TaskIterator struct {
+	ctx      context.Context
+	filter   TaskFilter
+	pager    TaskPager
+	closer   func()
+	estimate uint64
+
+	page []*Task
+	cur  *Task
+	err  error
+	done bool
+}
+
+// NewTaskIterator creates an iterator that reads pages from pager and returns tasks matching filter, estimate is the
+// number of tasks that might be read and closer, when not nil, is called once iteration stops. Storage implementations
+// use this to implement ListTasks()
+func NewTaskIterator(ctx context.Context, filter TaskFilter, estimate uint64, pager TaskPager, closer func()) *TaskIterator {
+	return &TaskIterator{
+		ctx:      ctx,
+		filter:   filter,
+		pager:    pager,
+		closer:   closer,
+		estimate: estimate,
+	}
+}
+
+// Next advances to the next matching task, false when all tasks were read or an error occurred
+func (i *TaskIterator) Next() bool {
+	for {
+		for len(i.page) > 0 {
+			t := i.page[0]
+			i.page = i.page[1:]
+
+			if i.filter.matches(t) {
+				i.cur = t
+				return true
+			}
+		}
+
+		if i.done {
+			i.cur = nil
+			return false
+		}
+
+		if i.ctx.Err() != nil {
+			i.err = i.ctx.Err()
+			i.Close()
+			return false
+		}
+
+		page, more, err := i.pager(i.ctx)
+		if err != nil {
+			i.err = err
+			i.Close()
+			return false
+		}
+
+		i.page = page
+		if !more {
+			i.Close()
+		}
+	}
+}
+
+// Task is the current task, valid after Next returned true
+func (i *TaskIterator) Task() *Task {
+	return i.cur
+}
+
+// Err is the error that stopped iteration, if any
+func (i *TaskIterator) Err() error {
+	return i.err
+}
+
+// Estimate is the number of tasks that will be examined before applying the filter, an upper bound on the results
+func (i *TaskIterator) Estimate() uint64 {
+	return i.estimate
+}
+
+// Close releases resources held by the iterator, it is safe to call multiple times
+func (i *TaskIterator) Close() {
+	if i.done {
+		return
+	}
+
+	i.done = true
+	if i.closer != nil {
+		i.closer()
+	}
+}
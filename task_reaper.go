@@ -0,0 +1,88 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+const (
+	// taskReaperComponent is the leader election component used to elect the client that deletes old tasks
+	taskReaperComponent = "task_reaper"
+	// taskReaperBatchSize is how many tasks are deleted before pausing for taskReaperBatchPause
+	taskReaperBatchSize = 100
+	// taskReaperBatchPause is the pause between batches of deletions
+	taskReaperBatchPause = 100 * time.Millisecond
+)
+
+// taskReaperInterval is how often tasks are checked against the retention policy
+var taskReaperInterval = time.Minute
+
+// reapTasks campaigns for leadership of the task reaper and, while leader, periodically deletes tasks matching the retention policy
+func (c *Client) reapTasks(ctx context.Context) {
+	name, err := ksuid.NewRandom()
+	if err != nil {
+		c.log.Errorf("Could not start the task reaper: %v", err)
+		return
+	}
+
+	election, err := c.NewLeaderElection(name.String(), taskReaperComponent)
+	if err != nil {
+		c.log.Errorf("Could not start the task reaper: %v", err)
+		return
+	}
+
+	for {
+		err = election.Campaign(ctx)
+		if err != nil {
+			return
+		}
+
+		c.log.Infof("Deleting %v tasks older than %v", c.opts.retentionStates, c.opts.retentionMaxAge)
+		c.reapTasksWhileLeader(ctx, election.Resigned())
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (c *Client) reapTasksWhileLeader(ctx context.Context, resigned <-chan struct{}) {
+	ticker := time.NewTicker(taskReaperInterval)
+	defer ticker.Stop()
+
+	for {
+		c.reapTasksOnce(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-resigned:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Client) reapTasksOnce(ctx context.Context) {
+	filter := TaskFilter{
+		States:        c.opts.retentionStates,
+		CreatedBefore: c.opts.clock.Now().Add(-c.opts.retentionMaxAge),
+		PageSize:      taskReaperBatchSize,
+	}
+
+	deleted, err := c.storage.PurgeTasks(ctx, filter, taskReaperBatchPause)
+	if err != nil && ctx.Err() == nil {
+		c.log.Errorf("Deleting tasks according to the retention policy failed: %v", err)
+	}
+
+	if deleted > 0 {
+		c.log.Infof("Deleted %d tasks according to the retention policy", deleted)
+		tasksReapedCounter.WithLabelValues().Add(float64(deleted))
+	}
+}
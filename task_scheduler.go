@@ -6,6 +6,7 @@ package asyncjobs
 
 import (
 	"context"
+	"fmt"
 	"sync"
 	"time"
 
@@ -16,6 +17,7 @@ import (
 
 type TaskScheduler struct {
 	s                  ScheduledTaskStorage
+	clock              clock
 	log                Logger
 	tasks              map[string]*scheduledTask
 	mu                 sync.Mutex
@@ -23,6 +25,9 @@ type TaskScheduler struct {
 	leader             bool
 	name               string
 	skipLeaderElection bool
+	catchUp            CatchUpPolicy
+	queue              string
+	catchUpMu          sync.Mutex
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -33,20 +38,62 @@ type scheduledTask struct {
 	cronID cron.EntryID
 }
 
+// CatchUpPolicy determines how a Task Scheduler handles schedule ticks that were missed while no scheduler was leader
+type CatchUpPolicy string
+
+const (
+	// CatchUpSkip ignores missed ticks, the schedule resumes at its next tick
+	CatchUpSkip CatchUpPolicy = "skip"
+	// CatchUpOnce creates a single task when one or more ticks were missed
+	CatchUpOnce CatchUpPolicy = "once"
+	// CatchUpAll creates a task for every missed tick, up to MaxCatchUpTasks
+	CatchUpAll CatchUpPolicy = "all"
+
+	// MaxCatchUpTasks is the most tasks CatchUpAll will create for a single schedule
+	MaxCatchUpTasks = 100
+)
+
+// TaskSchedulerOpt configures the Task Scheduler
+type TaskSchedulerOpt func(*TaskScheduler) error
+
+// ScheduleCatchUp sets the policy used for ticks missed while the scheduler was down or not leader
+func ScheduleCatchUp(policy CatchUpPolicy) TaskSchedulerOpt {
+	return func(s *TaskScheduler) error {
+		switch policy {
+		case CatchUpSkip, CatchUpOnce, CatchUpAll:
+			s.catchUp = policy
+		default:
+			return fmt.Errorf("%w: %q", ErrScheduleCatchUpInvalid, policy)
+		}
+
+		return nil
+	}
+}
+
 // NewTaskScheduler creates a new Task Scheduler service
-func NewTaskScheduler(name string, c *Client) (*TaskScheduler, error) {
+func NewTaskScheduler(name string, c *Client, opts ...TaskSchedulerOpt) (*TaskScheduler, error) {
 	sched := &TaskScheduler{
-		s:     c.ScheduledTasksStorage(),
-		log:   c.log,
-		tasks: make(map[string]*scheduledTask),
-		cron:  cron.New(),
-		name:  name,
+		s:       c.ScheduledTasksStorage(),
+		clock:   c.opts.clock,
+		log:     c.log,
+		tasks:   make(map[string]*scheduledTask),
+		cron:    cron.New(),
+		name:    name,
+		catchUp: CatchUpSkip,
+		queue:   c.opts.queue.Name,
 	}
 
 	if sched.s == nil {
 		return nil, ErrStorageNotReady
 	}
 
+	for _, opt := range opts {
+		err := opt(sched)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	c.startPrometheus()
 
 	return sched, nil
@@ -65,6 +112,8 @@ func (s *TaskScheduler) onWon() {
 	s.s.PublishLeaderElectedEvent(s.ctx, s.name, "task_scheduler")
 
 	s.log.Infof("Became leader, tasks will be scheduled")
+
+	go s.catchUpAll()
 }
 
 func (s *TaskScheduler) onLost() {
@@ -145,6 +194,16 @@ func (s *TaskScheduler) Stop() {
 	}
 }
 
+// AddSchedule creates a new scheduled task that will enqueue a fresh task of taskType into the client queue on every tick of cronExpr
+func (s *TaskScheduler) AddSchedule(name string, cronExpr string, taskType string, payload any, opts ...TaskOpt) error {
+	st, _, err := newScheduledTask(name, cronExpr, s.queue, taskType, payload, opts...)
+	if err != nil {
+		return err
+	}
+
+	return s.s.SaveScheduledTask(st, false)
+}
+
 // Count reports how many schedules are managed by this Scheduler
 func (s *TaskScheduler) Count() int {
 	s.mu.Lock()
@@ -163,6 +222,7 @@ func (s *TaskScheduler) deleteItem(name string) error {
 	}
 
 	s.cron.Remove(item.cronID)
+	delete(s.tasks, name)
 
 	return nil
 }
@@ -184,30 +244,152 @@ func (s *TaskScheduler) handlerFactory(name string) func() {
 			return
 		}
 
-		var opts []TaskOpt
-		if task.item.Deadline > 0 {
-			opts = append(opts, TaskDeadline(time.Now().UTC().Add(task.item.Deadline)))
-		}
-		if task.item.MaxTries > 0 {
-			opts = append(opts, TaskMaxTries(task.item.MaxTries))
+		if task.item.Jitter > 0 {
+			if !s.waitJitter(name, task.item.Jitter) {
+				return
+			}
 		}
 
-		nt, err := NewTask(task.item.TaskType, task.item.Payload, opts...)
-		if err != nil {
-			s.log.Warnf("Could not create new task to schedule for scheduled task %s in queue %s: %s", name, err)
-			taskSchedulerScheduleErrorCount.WithLabelValues(task.item.TaskType, task.item.Queue)
-			return
-		}
+		s.createTask(name, task.item)
+	}
+}
 
-		s.log.Infof("Creating new task %s for scheduled task %s on schedule %s", name, nt.ID, task.item.Schedule)
-		err = s.s.EnqueueTask(s.ctx, &Queue{Name: task.item.Queue}, nt)
-		if err != nil {
-			s.log.Warnf("Enqueueing new task for scheduled task %s failed: %s", name, err)
-			taskSchedulerScheduleErrorCount.WithLabelValues(task.item.TaskType, task.item.Queue)
+// waitJitter delays the tick of a schedule with jitter by a random duration, false when the scheduler stopped, lost
+// leadership or the schedule was removed while waiting
+func (s *TaskScheduler) waitJitter(name string, jitter time.Duration) bool {
+	delay := jitterDelay(jitter)
+	s.log.Debugf("Delaying task schedule %s by %v", name, delay)
+
+	timer := s.clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+	case <-s.ctx.Done():
+		return false
+	}
+
+	s.mu.Lock()
+	_, ok := s.tasks[name]
+	leader := s.leader
+	s.mu.Unlock()
+
+	if !ok || !leader {
+		s.log.Debugf("Skipping task schedule %s that changed while delayed", name)
+		return false
+	}
+
+	return true
+}
+
+func (s *TaskScheduler) createTask(name string, item *ScheduledTask) bool {
+	var opts []TaskOpt
+	if item.Deadline > 0 {
+		opts = append(opts, TaskDeadline(s.clock.Now().UTC().Add(item.Deadline)))
+	}
+	if item.MaxTries > 0 {
+		opts = append(opts, TaskMaxTries(item.MaxTries))
+	}
+
+	nt, err := NewTask(item.TaskType, item.Payload, opts...)
+	if err != nil {
+		s.log.Warnf("Could not create new task to schedule for scheduled task %s in queue %s: %s", name, item.Queue, err)
+		taskSchedulerScheduleErrorCount.WithLabelValues(taskTypeLabels.label(item.TaskType), item.Queue).Inc()
+		return false
+	}
+
+	s.log.Infof("Creating new task %s for scheduled task %s on schedule %s", nt.ID, name, item.Schedule)
+	err = s.s.EnqueueTask(s.ctx, &Queue{Name: item.Queue}, nt)
+	if err != nil {
+		s.log.Warnf("Enqueueing new task for scheduled task %s failed: %s", name, err)
+		taskSchedulerScheduleErrorCount.WithLabelValues(taskTypeLabels.label(item.TaskType), item.Queue).Inc()
+		return false
+	}
+
+	taskSchedulerScheduledCount.WithLabelValues(taskTypeLabels.label(item.TaskType), item.Queue).Inc()
+
+	err = s.s.SaveScheduledTaskLastRun(name, s.clock.Now())
+	if err != nil {
+		s.log.Warnf("Could not record last run time for scheduled task %s: %v", name, err)
+	}
+
+	return true
+}
+
+// missedTicks calculates how many ticks of schedule fell between last and now
+func missedTicks(schedule string, last time.Time, now time.Time, limit int) (int, error) {
+	if last.IsZero() {
+		return 0, nil
+	}
+
+	cs, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return 0, err
+	}
+
+	missed := 0
+	for next := cs.Next(last); !next.IsZero() && next.Before(now) && missed < limit; next = cs.Next(next) {
+		missed++
+	}
+
+	return missed, nil
+}
+
+func (s *TaskScheduler) catchUpAll() {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.tasks))
+	for name := range s.tasks {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	for _, name := range names {
+		s.catchUpSchedule(name)
+	}
+}
+
+// catchUpSchedule creates tasks for ticks of a schedule missed while no leader was scheduling, according to the catch-up policy
+func (s *TaskScheduler) catchUpSchedule(name string) {
+	s.mu.Lock()
+	task, ok := s.tasks[name]
+	leader := s.leader
+	policy := s.catchUp
+	s.mu.Unlock()
+
+	if !ok || !leader || policy == CatchUpSkip || policy == "" {
+		return
+	}
+
+	// serializes catch-up so that calls from registration and from winning an election do not both create tasks
+	s.catchUpMu.Lock()
+	defer s.catchUpMu.Unlock()
+
+	last, err := s.s.ScheduledTaskLastRun(name)
+	if err != nil {
+		s.log.Warnf("Could not load last run time for scheduled task %s: %v", name, err)
+		return
+	}
+
+	limit := MaxCatchUpTasks
+	if policy == CatchUpOnce {
+		limit = 1
+	}
+
+	missed, err := missedTicks(task.item.Schedule, last, s.clock.Now(), limit)
+	if err != nil {
+		s.log.Warnf("Could not determine missed ticks for scheduled task %s: %v", name, err)
+		return
+	}
+	if missed == 0 {
+		return
+	}
+
+	s.log.Infof("Catching up %d missed tick(s) for scheduled task %s using policy %s", missed, name, policy)
+
+	for i := 0; i < missed; i++ {
+		if s.ctx.Err() != nil || !s.createTask(name, task.item) {
 			return
 		}
-
-		taskSchedulerScheduledCount.WithLabelValues(task.item.TaskType, task.item.Queue)
 	}
 }
 
@@ -272,6 +454,8 @@ func (s *TaskScheduler) prepareAndWatch(ctx context.Context, wg *sync.WaitGroup,
 				s.log.Infof("Registered a new item %v on queue %v: %v", item.Name, item.Task.Queue, item.Task.Schedule)
 				taskSchedulerSchedules.WithLabelValues().Inc()
 
+				s.catchUpSchedule(item.Name)
+
 			case <-ctx.Done():
 				ready <- struct{}{}
 				return
@@ -29,6 +29,145 @@ var _ = Describe("TaskScheduler", func() {
 
 	AfterEach(func() { cancel() })
 
+	Describe("missedTicks", func() {
+		It("Should count ticks between the last run and now", func() {
+			now := time.Now()
+
+			missed, err := missedTicks("@every 1h", time.Time{}, now, MaxCatchUpTasks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(missed).To(Equal(0))
+
+			missed, err = missedTicks("@every 1h", now.Add(-3*time.Hour-time.Minute), now, MaxCatchUpTasks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(missed).To(Equal(3))
+
+			missed, err = missedTicks("@every 1m", now.Add(-24*time.Hour), now, MaxCatchUpTasks)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(missed).To(Equal(MaxCatchUpTasks))
+
+			_, err = missedTicks("invalid", now.Add(-time.Hour), now, 1)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("AddSchedule", func() {
+		It("Should create a schedule in the client queue", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = NewTaskScheduler("ginkgo", client, ScheduleCatchUp("bogus"))
+				Expect(err).To(MatchError(ErrScheduleCatchUpInvalid))
+
+				scheduler, err := NewTaskScheduler("ginkgo", client)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(scheduler.AddSchedule("ginkgo", "@daily", "ginkgo:test", map[string]string{"hello": "world"})).ToNot(HaveOccurred())
+				Expect(scheduler.AddSchedule("ginkgo", "@daily", "ginkgo:test", nil)).To(MatchError(ErrScheduledTaskAlreadyExist))
+
+				st, err := client.LoadScheduledTaskByName("ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(st.Queue).To(Equal("DEFAULT"))
+				Expect(st.TaskType).To(Equal("ginkgo:test"))
+				Expect(st.Payload).To(MatchJSON(`{"hello":"world"}`))
+			})
+		})
+	})
+
+	Describe("Jitter", func() {
+		It("Should only allow jitter shorter than the time between ticks", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, _ := NewTask("ginkgo:test", nil)
+				Expect(client.NewScheduledTask("ginkgo", "@every 1h", "DEFAULT", task, ScheduleJitter(-time.Second))).To(MatchError("invalid schedule jitter: -1s can not be negative"))
+				Expect(client.NewScheduledTask("ginkgo", "@every 1h", "DEFAULT", task, ScheduleJitter(time.Hour))).To(MatchError("invalid schedule jitter: 1h0m0s is not shorter than the 1h0m0s between ticks"))
+				Expect(client.NewScheduledTask("ginkgo", "0 9,10 * * *", "DEFAULT", task, ScheduleJitter(2*time.Hour))).To(MatchError(ErrScheduleJitterInvalid))
+				Expect(client.NewScheduledTask("ginkgo", "@every 1h", "DEFAULT", task, ScheduleJitter(10*time.Minute))).To(Succeed())
+
+				st, err := client.LoadScheduledTaskByName("ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(st.Jitter).To(Equal(10 * time.Minute))
+			})
+		})
+
+		It("Should delay enqueues by less than the jitter", func() {
+			for i := 0; i < 100; i++ {
+				Expect(jitterDelay(time.Second)).To(And(BeNumerically(">=", 0), BeNumerically("<", time.Second)))
+			}
+			Expect(jitterDelay(0)).To(BeZero())
+		})
+
+		It("Should enqueue tasks after a delay", func() {
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, _ := NewTask("ginkgo:test", nil)
+				Expect(client.NewScheduledTask("ginkgo", "@every 1s", "DEFAULT", task, ScheduleJitter(500*time.Millisecond))).To(Succeed())
+
+				scheduler, err := NewTaskScheduler("ginkgo", client)
+				Expect(err).ToNot(HaveOccurred())
+				scheduler.skipLeaderElection = true
+
+				rctx, rcancel := context.WithTimeout(ctx, 3500*time.Millisecond)
+				defer rcancel()
+				Expect(scheduler.Run(rctx, &wg)).To(Succeed())
+
+				tasks, err := client.StorageAdmin().TasksInfo()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tasks.Stream.State.Msgs).To(And(BeNumerically(">=", uint64(2)), BeNumerically("<=", uint64(4))))
+			})
+		})
+	})
+
+	Describe("Catch up", func() {
+		runCatchUp := func(policy CatchUpPolicy) uint64 {
+			var msgs uint64
+
+			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+				client, err := NewClient(NatsConn(nc))
+				Expect(err).ToNot(HaveOccurred())
+
+				task, _ := NewTask("ginko:test", nil)
+				Expect(client.NewScheduledTask("ginkgo", "@every 1h", "DEFAULT", task)).ToNot(HaveOccurred())
+				Expect(client.ScheduledTasksStorage().SaveScheduledTaskLastRun("ginkgo", time.Now().Add(-3*time.Hour-time.Minute))).ToNot(HaveOccurred())
+
+				scheduler, err := NewTaskScheduler("ginkgo", client, ScheduleCatchUp(policy))
+				Expect(err).ToNot(HaveOccurred())
+				scheduler.skipLeaderElection = true
+
+				rctx, rcancel := context.WithTimeout(ctx, time.Second)
+				defer rcancel()
+				Expect(scheduler.Run(rctx, &wg)).ToNot(HaveOccurred())
+
+				tasks, err := client.StorageAdmin().TasksInfo()
+				Expect(err).ToNot(HaveOccurred())
+				msgs = tasks.Stream.State.Msgs
+
+				last, err := client.ScheduledTasksStorage().ScheduledTaskLastRun("ginkgo")
+				Expect(err).ToNot(HaveOccurred())
+				if policy != CatchUpSkip {
+					Expect(last).To(BeTemporally("~", time.Now(), 2*time.Second))
+				}
+			})
+
+			return msgs
+		}
+
+		It("Should skip missed ticks by default", func() {
+			Expect(runCatchUp(CatchUpSkip)).To(Equal(uint64(0)))
+		})
+
+		It("Should create one task for missed ticks", func() {
+			Expect(runCatchUp(CatchUpOnce)).To(Equal(uint64(1)))
+		})
+
+		It("Should create a task for every missed tick", func() {
+			Expect(runCatchUp(CatchUpAll)).To(Equal(uint64(3)))
+		})
+	})
+
 	Describe("Run", func() {
 		It("Should function", func() {
 			withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
@@ -1,6 +1,7 @@
 package asyncjobs
 
 import (
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -32,6 +33,7 @@ var _ = Describe("Tasks", func() {
 			Expect(task.State).To(Equal(TaskStateBlocked)) // because we have dependencies
 			Expect(task.LoadDependencies).To(BeTrue())
 			Expect(task.MaxTries).To(Equal(DefaultMaxTries))
+			Expect(task.Priority).To(Equal(DefaultPriority))
 
 			// without dependencies, should be new
 			task, err = NewTask("test", payload, TaskDeadline(deadline), TaskMaxTries(10))
@@ -40,6 +42,56 @@ var _ = Describe("Tasks", func() {
 			Expect(task.LoadDependencies).To(BeFalse())
 			Expect(task.MaxTries).To(Equal(10))
 
+			pt, err := NewTask("test", payload, TaskPriority(9), TaskDeduplicationKey("webhook-1"), TaskScheduledIn(time.Hour))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(*pt.ScheduledFor).To(BeTemporally("~", time.Now().Add(time.Hour), time.Second))
+			Expect(pt.IsScheduledInFuture()).To(BeTrue())
+			Expect(task.IsScheduledInFuture()).To(BeFalse())
+			Expect(pt.Priority).To(Equal(9))
+			Expect(pt.DeduplicationKey).To(Equal("webhook-1"))
+
+			tt, err := NewTask("test", payload, TaskTags(map[string]string{"tenant": "acme"}), TaskTags(map[string]string{"region": "eu"}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tt.Tags).To(Equal(map[string]string{"tenant": "acme", "region": "eu"}))
+			_, err = NewTask("test", payload, TaskTags(map[string]string{"": "acme"}))
+			Expect(err).To(MatchError(ErrTaskTagInvalid))
+
+			ttl, err := NewTask("test", payload, TaskTTL(time.Minute))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ttl.TTL).To(Equal(time.Minute))
+			Expect(ttl.ExpiresAt).To(BeNil())
+			Expect(ttl.IsPastTTL()).To(BeFalse())
+			_, err = NewTask("test", payload, TaskTTL(-1*time.Second))
+			Expect(err).To(MatchError(ErrTaskTTLInvalid))
+
+			nr, err := NewTask("test", payload, NoRetry(), TaskMaxTries(10))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nr.NoRetry).To(BeTrue())
+			Expect(nr.MaxTries).To(Equal(1))
+
+			mt, err := NewTask("test", payload, TaskMeta(map[string]string{"trace-id": "1"}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mt.Meta).To(Equal(map[string]string{"trace-id": "1"}))
+			for _, meta := range []map[string]string{{"Trace": "1"}, {"trace id": "1"}, {"trace": "1\n2"}, {"trace": " 1"}, {"trace": strings.Repeat("x", MaxTaskMetaSize)}} {
+				_, err = NewTask("test", payload, TaskMeta(meta))
+				Expect(err).To(MatchError(ErrTaskMetaInvalid))
+			}
+
+			ct, err := NewTask("test", payload, TaskID("order:1234"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ct.ID).To(Equal("order:1234"))
+			_, err = NewTask("test", payload, TaskID("order.1234"))
+			Expect(err).To(MatchError(ErrTaskIDInvalid))
+			_, err = NewTask("test", payload, TaskID(""))
+			Expect(err).To(MatchError(ErrTaskIDInvalid))
+			_, err = NewTask("test", payload, TaskID(strings.Repeat("x", MaxTaskIDLength+1)))
+			Expect(err).To(MatchError(ErrTaskIDInvalid))
+
+			_, err = NewTask("test", payload, TaskPriority(10))
+			Expect(err).To(MatchError(ErrTaskPriorityInvalid))
+			_, err = NewTask("test", payload, TaskPriority(-1))
+			Expect(err).To(MatchError(ErrTaskPriorityInvalid))
+
 			_, err = task.signatureMessage()
 			Expect(err).To(MatchError(ErrTaskSignatureRequiresQueue))
 			task.Queue = "x"
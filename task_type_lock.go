@@ -0,0 +1,116 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// uniqueActiveRetryDelay is the minimum time a task waits for the active task of its type before being delivered again
+var uniqueActiveRetryDelay = time.Second
+
+// taskTypeLock is held while handling a task with a type registered using Mux.UniqueActive(), it is refreshed while
+// held so that it only expires when the client holding it stops
+type taskTypeLock struct {
+	storage  TaskTypeLocker
+	taskType string
+	holder   string
+	revision uint64
+	log      Logger
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// acquireTaskTypeLock locks the type of task when the mux limits it to one active task, returns a nil lock otherwise
+func (p *processor) acquireTaskTypeLock(task *Task) (*taskTypeLock, error) {
+	if p.mux == nil || !p.mux.isUniqueActive(task.Type) {
+		return nil, nil
+	}
+
+	locker, ok := p.c.storage.(TaskTypeLocker)
+	if !ok {
+		return nil, fmt.Errorf("%w: storage does not support task type locks", ErrStorageNotReady)
+	}
+
+	rev, err := locker.AcquireTaskTypeLock(task.Type, task.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &taskTypeLock{
+		storage:  locker,
+		taskType: task.Type,
+		holder:   task.ID,
+		revision: rev,
+		log:      p.log,
+		done:     make(chan struct{}),
+	}
+
+	go l.keepAlive(taskTypeLockTTL / 3)
+
+	return l, nil
+}
+
+// uniqueActiveDelay is how long to delay a task waiting for the lock of its type, a random delay of up to the same
+// duration is added so that waiting tasks do not all return at the same time
+func uniqueActiveDelay() time.Duration {
+	return uniqueActiveRetryDelay + time.Duration(rand.Int63n(int64(uniqueActiveRetryDelay)))
+}
+
+func (l *taskTypeLock) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !l.refresh() {
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *taskTypeLock) refresh() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	rev, err := l.storage.RefreshTaskTypeLock(l.taskType, l.holder, l.revision)
+	if err != nil {
+		l.log.Warnf("Could not refresh the lock for task type %s held by task %s: %v", l.taskType, l.holder, err)
+		return false
+	}
+	l.revision = rev
+
+	return true
+}
+
+// release gives up the lock, it does nothing for nil locks
+func (l *taskTypeLock) release() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	close(l.done)
+
+	err := l.storage.ReleaseTaskTypeLock(l.taskType, l.revision)
+	if err != nil {
+		l.log.Warnf("Could not release the lock for task type %s held by task %s: %v", l.taskType, l.holder, err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name used for spans created by this package
+const tracerName = "github.com/choria-io/asyncjobs"
+
+// tracePropagator carries trace context in tasks using the W3C Trace Context format
+var tracePropagator = propagation.TraceContext{}
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = trace.NewNoopTracerProvider()
+	}
+
+	return tp.Tracer(tracerName)
+}
+
+func taskSpanAttributes(t *Task) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("asyncjobs.task.id", t.ID),
+		attribute.String("asyncjobs.task.type", t.Type),
+		attribute.String("asyncjobs.task.queue", t.Queue),
+		attribute.Int("asyncjobs.task.tries", t.Tries),
+	)
+}
+
+// startEnqueueSpan starts a producer span for enqueueing t and stores its trace context in the task
+func (c *Client) startEnqueueSpan(ctx context.Context, t *Task) (context.Context, trace.Span) {
+	ctx, span := c.tracer.Start(ctx, "asyncjobs.enqueue "+t.Type, trace.WithSpanKind(trace.SpanKindProducer), taskSpanAttributes(t))
+	if span.SpanContext().IsValid() {
+		t.TraceContext = map[string]string{}
+		tracePropagator.Inject(ctx, propagation.MapCarrier(t.TraceContext))
+	}
+
+	return ctx, span
+}
+
+// startHandlerSpan starts a consumer span for handling t as a child of the trace context stored in the task
+func (c *Client) startHandlerSpan(ctx context.Context, t *Task) (context.Context, trace.Span) {
+	if len(t.TraceContext) > 0 {
+		ctx = tracePropagator.Extract(ctx, propagation.MapCarrier(t.TraceContext))
+	}
+
+	return c.tracer.Start(ctx, "asyncjobs.handle "+t.Type, trace.WithSpanKind(trace.SpanKindConsumer), taskSpanAttributes(t))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/nats-io/jsm.go"
+	"github.com/nats-io/nats.go"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Tracing", func() {
+	It("Should not trace without a provider", func() {
+		withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+			client, err := NewClient(NatsConn(nc))
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(context.Background(), task)).ToNot(HaveOccurred())
+			Expect(task.TraceContext).To(BeNil())
+		})
+	})
+
+	It("Should propagate the trace from enqueue to the handler", func() {
+		withJetStream(func(nc *nats.Conn, mgr *jsm.Manager) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			recorder := tracetest.NewSpanRecorder()
+			tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+			client, err := NewClient(NatsConn(nc), TracerProvider(tp))
+			Expect(err).ToNot(HaveOccurred())
+
+			task, err := NewTask("ginkgo", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.EnqueueTask(ctx, task)).ToNot(HaveOccurred())
+			Expect(task.TraceContext).To(HaveKey("traceparent"))
+
+			handled := make(chan trace.SpanContext, 1)
+			router := NewTaskRouter()
+			router.HandleFunc("ginkgo", func(ctx context.Context, log Logger, t *Task) (any, error) {
+				handled <- trace.SpanContextFromContext(ctx)
+				cancel()
+				return "done", nil
+			})
+
+			go client.Run(ctx, router)
+
+			var hsc trace.SpanContext
+			Eventually(handled, 5*time.Second).Should(Receive(&hsc))
+
+			Eventually(func() int { return len(recorder.Ended()) }, 2*time.Second).Should(Equal(2))
+			spans := recorder.Ended()
+			enqueue, handle := spans[0], spans[1]
+
+			Expect(enqueue.Name()).To(Equal("asyncjobs.enqueue ginkgo"))
+			Expect(enqueue.SpanKind()).To(Equal(trace.SpanKindProducer))
+			Expect(handle.Name()).To(Equal("asyncjobs.handle ginkgo"))
+			Expect(handle.SpanKind()).To(Equal(trace.SpanKindConsumer))
+			Expect(handle.Parent().SpanID()).To(Equal(enqueue.SpanContext().SpanID()))
+			Expect(handle.SpanContext().TraceID()).To(Equal(enqueue.SpanContext().TraceID()))
+			Expect(hsc.SpanID()).To(Equal(handle.SpanContext().SpanID()))
+		})
+	})
+})
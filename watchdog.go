@@ -0,0 +1,172 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultHandlerStopGrace is how long handlers stopped by a watchdog have to return before being abandoned
+	DefaultHandlerStopGrace = 10 * time.Second
+
+	handlerMemoryCheckInterval = time.Second
+	handlerLeakCheckWait       = 100 * time.Millisecond
+	handlerTaskLabel           = "asyncjobs_task"
+	heapObjectsMetric          = "/memory/classes/heap/objects:bytes"
+)
+
+type guardedResult struct {
+	payload any
+	err     error
+}
+
+// guardHandler runs the handler for t while enforcing the HandlerTimeLimit(), HandlerMemoryLimit() and
+// HandlerGoroutineLeakCheck() guards, handlers are run directly when none are configured
+func (p *processor) guardHandler(ctx context.Context, t *Task) (any, error) {
+	opts := p.c.opts
+	if opts.handlerTimeLimit == 0 && opts.handlerMemoryLimit == 0 && !opts.handlerLeakCheck {
+		return p.runHandler(ctx, t)
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan guardedResult, 1)
+	go func() {
+		var res guardedResult
+		run := func(ctx context.Context) { res.payload, res.err = p.runHandler(ctx, t) }
+
+		// goroutines started by the handler inherit the label, allowing leaks to be found
+		if opts.handlerLeakCheck {
+			pprof.Do(wctx, pprof.Labels(handlerTaskLabel, t.ID), run)
+		} else {
+			run(wctx)
+		}
+
+		done <- res
+	}()
+
+	var timeLimit, memoryCheck, abandon <-chan time.Time
+	if opts.handlerTimeLimit > 0 {
+		timer := time.NewTimer(opts.handlerTimeLimit)
+		defer timer.Stop()
+		timeLimit = timer.C
+	}
+	if opts.handlerMemoryLimit > 0 {
+		ticker := time.NewTicker(handlerMemoryCheckInterval)
+		defer ticker.Stop()
+		memoryCheck = ticker.C
+	}
+
+	var violation error
+	stop := func(guard string, err error) {
+		handlersGuardViolationCounter.WithLabelValues(t.Queue, taskTypeLabels.label(t.Type), guard).Inc()
+		p.log.Errorf("Stopping handler for task %s: %v", t.ID, err)
+
+		violation = err
+		timeLimit = nil
+		memoryCheck = nil
+		abandon = time.After(opts.handlerStopGrace)
+		cancel()
+	}
+
+	for {
+		select {
+		case res := <-done:
+			if opts.handlerLeakCheck {
+				p.checkGoroutineLeaks(t)
+			}
+
+			if violation == nil {
+				return res.payload, res.err
+			}
+			if res.err != nil {
+				return nil, fmt.Errorf("%w: %v", violation, res.err)
+			}
+			return nil, violation
+
+		case <-timeLimit:
+			stop("time", fmt.Errorf("%w of %v", ErrHandlerTimeLimit, opts.handlerTimeLimit))
+
+		case <-memoryCheck:
+			used := heapObjectBytes()
+			if used > opts.handlerMemoryLimit {
+				stop("memory", fmt.Errorf("%w: %d bytes in use exceeds %d bytes", ErrHandlerMemoryLimit, used, opts.handlerMemoryLimit))
+			}
+
+		case <-abandon:
+			handlersAbandonedCounter.WithLabelValues(t.Queue, taskTypeLabels.label(t.Type)).Inc()
+			p.log.Errorf("Handler for task %s did not stop within %v, abandoning it", t.ID, opts.handlerStopGrace)
+
+			return nil, violation
+		}
+	}
+}
+
+// checkGoroutineLeaks reports goroutines started by the handler for t that are still running shortly after it returned
+func (p *processor) checkGoroutineLeaks(t *Task) {
+	deadline := time.Now().Add(handlerLeakCheckWait)
+
+	for {
+		leaked := labeledGoroutines(handlerTaskLabel, t.ID)
+		if leaked == 0 {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			handlersGuardViolationCounter.WithLabelValues(t.Queue, taskTypeLabels.label(t.Type), "goroutines").Inc()
+			p.log.Warnf("Handler for task %s leaked %d goroutines", t.ID, leaked)
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// labeledGoroutines counts running goroutines with the profiler label key set to value
+func labeledGoroutines(key string, value string) int {
+	buf := bytes.Buffer{}
+	err := pprof.Lookup("goroutine").WriteTo(&buf, 1)
+	if err != nil {
+		return 0
+	}
+
+	label := fmt.Sprintf("%q:%q", key, value)
+	count, total := 0, 0
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case strings.Contains(line, " @ "):
+			count, _ = strconv.Atoi(strings.Fields(line)[0])
+		case strings.HasPrefix(line, "# labels:") && strings.Contains(line, label):
+			total += count
+		}
+	}
+
+	return total
+}
+
+// heapObjectBytes is the memory occupied by live and not yet collected heap objects
+func heapObjectBytes() uint64 {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	metrics.Read(sample)
+
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+
+	return sample[0].Value.Uint64()
+}
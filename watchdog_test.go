@@ -0,0 +1,111 @@
+// Copyright (c) 2022, R.I. Pienaar and the Project contributors
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package asyncjobs
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/types"
+)
+
+var _ = Describe("Handler Watchdog", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	})
+
+	AfterEach(func() { cancel() })
+
+	// runTask handles a task using h until it failed with an error matching lastErr, it is then not retried for a while
+	runTask := func(h HandlerFunc, lastErr types.GomegaMatcher, opts ...ClientOpt) {
+		client, err := NewClient(append([]ClientOpt{StorageBackend(NewInMemoryStorage()), RetryBackoffPolicy(RetryLinearOneHour)}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+
+		router := NewTaskRouter()
+		router.HandleFunc("ginkgo", h)
+		go client.Run(ctx, router)
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.EnqueueTask(ctx, task)).To(Succeed())
+
+		Eventually(func() string {
+			task, err = client.LoadTaskByID(task.ID)
+			Expect(err).ToNot(HaveOccurred())
+			return task.LastErr
+		}, 5*time.Second).Should(lastErr)
+	}
+
+	It("Should validate options", func() {
+		_, err := NewClient(StorageBackend(NewInMemoryStorage()), HandlerTimeLimit(0))
+		Expect(err).To(MatchError(ContainSubstring("handler time limit must be positive")))
+		_, err = NewClient(StorageBackend(NewInMemoryStorage()), HandlerMemoryLimit(0))
+		Expect(err).To(MatchError(ContainSubstring("handler memory limit must be positive")))
+		_, err = NewClient(StorageBackend(NewInMemoryStorage()), HandlerStopGrace(-1))
+		Expect(err).To(MatchError(ContainSubstring("handler stop grace may not be negative")))
+	})
+
+	It("Should stop handlers exceeding the time limit", func() {
+		runTask(func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, Equal("task handler exceeded its time limit of 50ms: context canceled"), HandlerTimeLimit(50*time.Millisecond))
+	})
+
+	It("Should abandon handlers that do not stop", func() {
+		release := make(chan struct{})
+		defer close(release)
+
+		runTask(func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			<-release
+			return "done", nil
+		}, Equal("task handler exceeded its time limit of 50ms"), HandlerTimeLimit(50*time.Millisecond), HandlerStopGrace(50*time.Millisecond))
+	})
+
+	It("Should stop handlers while memory use exceeds the limit", func() {
+		runTask(func(ctx context.Context, _ Logger, t *Task) (any, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}, HavePrefix("task handler exceeded the memory limit: "), HandlerMemoryLimit(1))
+	})
+
+	It("Should find goroutines leaked by handlers", func() {
+		release := make(chan struct{})
+		started := make(chan struct{})
+
+		client, err := NewClient(StorageBackend(NewInMemoryStorage()), HandlerGoroutineLeakCheck())
+		Expect(err).ToNot(HaveOccurred())
+
+		p, err := newProcessor(client)
+		Expect(err).ToNot(HaveOccurred())
+		p.mux = NewTaskRouter()
+		Expect(p.mux.HandleFunc("ginkgo", func(_ context.Context, _ Logger, t *Task) (any, error) {
+			go func() {
+				close(started)
+				<-release
+			}()
+			return "done", nil
+		})).To(Succeed())
+
+		task, err := NewTask("ginkgo", nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		res, err := p.guardHandler(ctx, task)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal("done"))
+
+		<-started
+		Expect(labeledGoroutines(handlerTaskLabel, task.ID)).To(Equal(1))
+		close(release)
+		Eventually(func() int { return labeledGoroutines(handlerTaskLabel, task.ID) }).Should(BeZero())
+	})
+})